@@ -0,0 +1,126 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/metrics"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/quota"
+	"vpnaas-backend/internal/store"
+)
+
+// VPNUpdater applies a user's state to their VPN workload
+type VPNUpdater interface {
+	UpdateUserVPN(ctx context.Context, user *models.User, plan *models.Plan) error
+}
+
+// EventRecorder records events about a user's VPN
+type EventRecorder interface {
+	RecordUserEvent(user *models.User, eventType, reason, message string)
+}
+
+// Enforcer applies changes to users and suspends or resumes their VPNs as
+// their expiry, quota and access schedule require
+type Enforcer struct {
+	store  store.Store
+	vpn    VPNUpdater
+	events EventRecorder
+	period quota.Period
+	now    func() time.Time
+}
+
+// NewEnforcer creates an enforcer resetting quotas at the period of cfg
+func NewEnforcer(userStore store.Store, vpn VPNUpdater, events EventRecorder, cfg config.QuotaConfig) (*Enforcer, error) {
+	period, err := quota.ParsePeriod(cfg.ResetPeriod)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Enforcer{
+		store:  userStore,
+		vpn:    vpn,
+		events: events,
+		period: period,
+		now:    time.Now,
+	}, nil
+}
+
+// Apply atomically moves a user into the current quota period, modifies it
+// with fn and evaluates its access, then suspends or resumes the user's VPN to
+// match the user's status. fn may be nil to only enforce access. If the VPN
+// could not be updated, the stored user is returned together with the error.
+func (e *Enforcer) Apply(ctx context.Context, userID string, fn func(user *models.User)) (*models.User, error) {
+	current, err := e.store.GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := e.userPlan(current)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	now := e.now()
+	updated, err := e.store.UpdateUser(userID, func(u *models.User) error {
+		e.period.Roll(u, now)
+		if fn != nil {
+			fn(u)
+		}
+		events = Evaluate(u, plan, now)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, event := range events {
+		e.events.RecordUserEvent(updated, event.Type, event.Reason, event.Message)
+	}
+
+	// Also retries suspensions and resumptions that failed earlier
+	if updated.WorkloadName != "" && updated.PeerRemoved != (updated.Status == "suspended") {
+		applied := updated.Clone()
+		if err := e.vpn.UpdateUserVPN(ctx, applied, plan); err != nil {
+			metrics.RecordError("access_enforcement", "access")
+			return updated, fmt.Errorf("failed to apply access state to VPN: %v", err)
+		}
+		// The update rebuilt the whole workload, not only the peer
+		updated, err = store.UpdateApplied(e.store, applied)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return updated, nil
+}
+
+// Status returns a user's usage against their quota
+func (e *Enforcer) Status(user *models.User) (models.QuotaStatus, error) {
+	plan, err := e.userPlan(user)
+	if err != nil {
+		return models.QuotaStatus{}, err
+	}
+
+	// Usage recorded in an earlier period no longer counts
+	current := user.Clone()
+	now := e.now()
+	e.period.Roll(current, now)
+
+	return quota.Status(current, plan, e.period, now), nil
+}
+
+// userPlan returns the user's plan, or nil if it has none
+func (e *Enforcer) userPlan(user *models.User) (*models.Plan, error) {
+	if user.Plan == "" {
+		return nil, nil
+	}
+	plan, err := e.store.GetPlan(user.Plan)
+	if errors.Is(err, store.ErrPlanNotFound) {
+		return nil, nil
+	}
+	return plan, err
+}
@@ -0,0 +1,91 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+)
+
+// fakeVPN counts the updates and deletions of VPNs and records events
+type fakeVPN struct {
+	err     error
+	updates int
+	deleted []string
+	events  []string
+}
+
+func (f *fakeVPN) UpdateUserVPN(ctx context.Context, user *models.User, plan *models.Plan) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.updates++
+	user.PeerRemoved = user.Status == "suspended"
+	user.ConfigData = fmt.Sprintf("[Interface]\n# update %d\n", f.updates)
+	return nil
+}
+
+func (f *fakeVPN) DeleteUserVPN(ctx context.Context, user *models.User) ([]models.ResourceRef, error) {
+	f.deleted = append(f.deleted, user.ID)
+	return nil, nil
+}
+
+func (f *fakeVPN) RecordUserEvent(user *models.User, eventType, reason, message string) {
+	f.events = append(f.events, reason)
+}
+
+func TestEnforcerApply(t *testing.T) {
+	ctx := context.Background()
+	userStore := store.NewMemoryStore()
+	userStore.CreatePlan(&models.Plan{Name: "basic", MonthlyDataQuota: 1000})
+
+	user := models.NewUser("alice", "alice@example.com")
+	user.Plan = "basic"
+	user.WorkloadName = "vpn-alice"
+	userStore.CreateUser(user)
+
+	vpn := &fakeVPN{err: errors.New("apiserver unavailable")}
+	enforcer, err := NewEnforcer(userStore, vpn, vpn, config.QuotaConfig{})
+	if err != nil {
+		t.Fatalf("create enforcer: %v", err)
+	}
+	now := time.Date(2026, time.October, 14, 0, 0, 0, 0, time.UTC)
+	enforcer.now = func() time.Time { return now }
+
+	// Exhausting the quota suspends the user even if the VPN update fails
+	updated, err := enforcer.Apply(ctx, user.ID, func(u *models.User) { u.AddDataUsage(1200) })
+	if err == nil || updated == nil || updated.Status != "suspended" || updated.PeerRemoved {
+		t.Fatalf("got %+v, %v; want suspended user and VPN error", updated, err)
+	}
+
+	// The next pass retries removing the peer
+	vpn.err = nil
+	updated, err = enforcer.Apply(ctx, user.ID, nil)
+	if err != nil || !updated.PeerRemoved || vpn.updates != 1 {
+		t.Fatalf("suspension not retried: %+v, %v", updated, err)
+	}
+	if stored, _ := userStore.GetUser(user.ID); stored.ConfigData != "[Interface]\n# update 1\n" {
+		t.Errorf("configuration applied with the suspension not stored: %q", stored.ConfigData)
+	}
+
+	// A new period resumes the user
+	now = now.AddDate(0, 1, 0)
+	updated, err = enforcer.Apply(ctx, user.ID, nil)
+	if err != nil || updated.Status != "active" || updated.PeerRemoved || updated.PeriodUsage != 0 || updated.DataUsage != 1200 {
+		t.Fatalf("not resumed in new period: %+v, %v", updated, err)
+	}
+
+	want := []string{"QuotaExhausted", "Suspended", "Resumed"}
+	if len(vpn.events) != len(want) {
+		t.Fatalf("got events %v, want %v", vpn.events, want)
+	}
+
+	if _, err := enforcer.Apply(ctx, "missing", nil); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,135 @@
+package access
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/quota"
+)
+
+// Event is something worth telling the operator about a user's access
+type Event struct {
+	Type    string // corev1.EventTypeNormal or corev1.EventTypeWarning
+	Reason  string
+	Message string
+}
+
+// Evaluate decides whether a user may use their VPN at now and suspends or
+// resumes them accordingly. Quota thresholds are reported once per period.
+// An expired user stays suspended before one over quota, who stays suspended
+// before one outside their access schedule. Inactive users and users an
+// administrator suspended are left alone.
+func Evaluate(user *models.User, plan *models.Plan, now time.Time) []Event {
+	var events []Event
+
+	level := quota.Level(user, plan)
+	if level > user.QuotaWarning {
+		limit := quota.Limit(user, plan)
+		event := Event{
+			Type:    corev1.EventTypeWarning,
+			Reason:  "QuotaWarning",
+			Message: fmt.Sprintf("User %s used %d%% of their data quota (%d of %d bytes)", user.Username, level, user.PeriodUsage, limit),
+		}
+		if level >= 100 {
+			event.Reason = "QuotaExhausted"
+			event.Message = fmt.Sprintf("User %s exhausted their data quota (%d of %d bytes)", user.Username, user.PeriodUsage, limit)
+		}
+		events = append(events, event)
+	}
+	user.QuotaWarning = level
+
+	var current string
+	switch {
+	case user.Status == "active":
+	case user.Status == "suspended" && user.SuspendedReason != "" && user.SuspendedReason != models.SuspendedByAdmin:
+		current = user.SuspendedReason
+	default:
+		return events
+	}
+
+	reason := suspendedReason(user, level >= 100, now)
+	if reason == current {
+		return events
+	}
+
+	user.UpdatedAt = now
+	if reason == "" {
+		user.Status = "active"
+		user.SuspendedReason = ""
+		return append(events, resumedEvent(user, current))
+	}
+	user.Status = "suspended"
+	user.SuspendedReason = reason
+	return append(events, suspendedEvent(user, reason))
+}
+
+// suspendedReason returns why the user must be suspended at now, if at all
+func suspendedReason(user *models.User, exhausted bool, now time.Time) string {
+	if user.ExpiresAt != nil && !now.Before(*user.ExpiresAt) {
+		return models.SuspendedByExpiry
+	}
+	if exhausted {
+		return models.SuspendedByQuota
+	}
+	if user.AccessSchedule != nil {
+		open, err := user.AccessSchedule.Open(now)
+		if err != nil {
+			// Schedules are validated when set, don't lock users out over one
+			// that no longer loads
+			logrus.Warnf("Ignoring access schedule of user %s: %v", user.ID, err)
+		} else if !open {
+			return models.SuspendedBySchedule
+		}
+	}
+	return ""
+}
+
+func suspendedEvent(user *models.User, reason string) Event {
+	switch reason {
+	case models.SuspendedByExpiry:
+		return Event{
+			Type:    corev1.EventTypeWarning,
+			Reason:  "Expired",
+			Message: fmt.Sprintf("User %s expired at %s", user.Username, user.ExpiresAt.UTC().Format(time.RFC3339)),
+		}
+	case models.SuspendedByQuota:
+		return Event{
+			Type:    corev1.EventTypeWarning,
+			Reason:  "Suspended",
+			Message: fmt.Sprintf("User %s suspended until their data quota resets", user.Username),
+		}
+	default:
+		return Event{
+			Type:    corev1.EventTypeNormal,
+			Reason:  "AccessWindowClosed",
+			Message: fmt.Sprintf("User %s suspended outside their access schedule", user.Username),
+		}
+	}
+}
+
+func resumedEvent(user *models.User, reason string) Event {
+	switch reason {
+	case models.SuspendedByExpiry:
+		return Event{
+			Type:    corev1.EventTypeNormal,
+			Reason:  "Resumed",
+			Message: fmt.Sprintf("User %s resumed, no longer expired", user.Username),
+		}
+	case models.SuspendedByQuota:
+		return Event{
+			Type:    corev1.EventTypeNormal,
+			Reason:  "Resumed",
+			Message: fmt.Sprintf("User %s resumed, data quota available again", user.Username),
+		}
+	default:
+		return Event{
+			Type:    corev1.EventTypeNormal,
+			Reason:  "AccessWindowOpened",
+			Message: fmt.Sprintf("User %s resumed within their access schedule", user.Username),
+		}
+	}
+}
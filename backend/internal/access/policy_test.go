@@ -0,0 +1,164 @@
+package access
+
+import (
+	"testing"
+	"time"
+
+	"vpnaas-backend/internal/models"
+)
+
+// officeHours is open 9:00 to 17:00 Berlin time on weekdays
+var officeHours = &models.AccessSchedule{
+	Timezone: "Europe/Berlin",
+	Windows:  []models.AccessWindow{{Start: "0 9 * * 1-5", Duration: "8h"}},
+}
+
+func TestEvaluate(t *testing.T) {
+	plan := &models.Plan{Name: "basic", MonthlyDataQuota: 1000}
+	// A Wednesday, 14:00 in Berlin
+	now := time.Date(2026, time.October, 14, 12, 0, 0, 0, time.UTC)
+	evening := now.Add(4 * time.Hour)
+	past := now.Add(-time.Hour)
+
+	tests := []struct {
+		name        string
+		user        models.User
+		plan        *models.Plan
+		now         time.Time
+		wantStatus  string
+		wantReason  string
+		wantWarning int
+		wantEvents  []string
+	}{
+		{
+			name:       "below thresholds",
+			user:       models.User{Status: "active", PeriodUsage: 500},
+			plan:       plan,
+			wantStatus: "active",
+		},
+		{
+			name:        "warning at 80%",
+			user:        models.User{Status: "active", PeriodUsage: 800},
+			plan:        plan,
+			wantStatus:  "active",
+			wantWarning: 80,
+			wantEvents:  []string{"QuotaWarning"},
+		},
+		{
+			name:        "warning reported once",
+			user:        models.User{Status: "active", PeriodUsage: 900, QuotaWarning: 80},
+			plan:        plan,
+			wantStatus:  "active",
+			wantWarning: 80,
+		},
+		{
+			name:        "exhausted quota suspends",
+			user:        models.User{Status: "active", PeriodUsage: 1000, QuotaWarning: 80},
+			plan:        plan,
+			wantStatus:  "suspended",
+			wantReason:  models.SuspendedByQuota,
+			wantWarning: 100,
+			wantEvents:  []string{"QuotaExhausted", "Suspended"},
+		},
+		{
+			name:       "bonus resumes quota suspension",
+			user:       models.User{Status: "suspended", SuspendedReason: models.SuspendedByQuota, PeriodUsage: 1000, QuotaBonus: 1000, QuotaWarning: 100},
+			plan:       plan,
+			wantStatus: "active",
+			wantEvents: []string{"Resumed"},
+		},
+		{
+			name:       "administrative suspension is kept",
+			user:       models.User{Status: "suspended", SuspendedReason: models.SuspendedByAdmin, ExpiresAt: &past},
+			plan:       plan,
+			wantStatus: "suspended",
+			wantReason: models.SuspendedByAdmin,
+		},
+		{
+			name:       "inactive user is left alone",
+			user:       models.User{Status: "inactive", ExpiresAt: &past},
+			wantStatus: "inactive",
+		},
+		{
+			name:       "expiry suspends",
+			user:       models.User{Status: "active", ExpiresAt: &past},
+			wantStatus: "suspended",
+			wantReason: models.SuspendedByExpiry,
+			wantEvents: []string{"Expired"},
+		},
+		{
+			name:       "expiry takes over quota suspension",
+			user:       models.User{Status: "suspended", SuspendedReason: models.SuspendedByQuota, PeriodUsage: 1000, QuotaWarning: 100, ExpiresAt: &past},
+			plan:       plan,
+			wantStatus: "suspended",
+			wantReason: models.SuspendedByExpiry,
+			wantEvents: []string{"Expired"},
+			// Still over quota
+			wantWarning: 100,
+		},
+		{
+			name:       "extended expiry resumes",
+			user:       models.User{Status: "suspended", SuspendedReason: models.SuspendedByExpiry},
+			wantStatus: "active",
+			wantEvents: []string{"Resumed"},
+		},
+		{
+			name:       "inside access window",
+			user:       models.User{Status: "active", AccessSchedule: officeHours},
+			wantStatus: "active",
+		},
+		{
+			name:       "access window closes",
+			user:       models.User{Status: "active", AccessSchedule: officeHours},
+			now:        evening,
+			wantStatus: "suspended",
+			wantReason: models.SuspendedBySchedule,
+			wantEvents: []string{"AccessWindowClosed"},
+		},
+		{
+			name:       "access window opens",
+			user:       models.User{Status: "suspended", SuspendedReason: models.SuspendedBySchedule, AccessSchedule: officeHours},
+			wantStatus: "active",
+			wantEvents: []string{"AccessWindowOpened"},
+		},
+		{
+			name:       "quota reset outside access window stays suspended",
+			user:       models.User{Status: "suspended", SuspendedReason: models.SuspendedByQuota, AccessSchedule: officeHours},
+			plan:       plan,
+			now:        evening,
+			wantStatus: "suspended",
+			wantReason: models.SuspendedBySchedule,
+			wantEvents: []string{"AccessWindowClosed"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := tt.user
+			at := tt.now
+			if at.IsZero() {
+				at = now
+			}
+			events := Evaluate(&user, tt.plan, at)
+
+			if user.Status != tt.wantStatus || user.SuspendedReason != tt.wantReason {
+				t.Errorf("got status %q (%q), want %q (%q)", user.Status, user.SuspendedReason, tt.wantStatus, tt.wantReason)
+			}
+			if user.QuotaWarning != tt.wantWarning {
+				t.Errorf("got warning level %d, want %d", user.QuotaWarning, tt.wantWarning)
+			}
+			var reasons []string
+			for _, event := range events {
+				reasons = append(reasons, event.Reason)
+			}
+			if len(reasons) != len(tt.wantEvents) {
+				t.Fatalf("got events %v, want %v", reasons, tt.wantEvents)
+			}
+			for i := range reasons {
+				if reasons[i] != tt.wantEvents[i] {
+					t.Errorf("got events %v, want %v", reasons, tt.wantEvents)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/metrics"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+)
+
+// VPNDeleter removes the VPN resources of a user
+type VPNDeleter interface {
+	DeleteUserVPN(ctx context.Context, user *models.User) ([]models.ResourceRef, error)
+}
+
+// Scheduler periodically enforces every user's access, suspending and
+// resuming them at the boundaries of their access windows, expiry and quota
+// periods, and deletes users whose expiry is older than the grace period
+type Scheduler struct {
+	enforcer *Enforcer
+	store    store.Store
+	vpn      VPNDeleter
+	events   EventRecorder
+	grace    time.Duration
+	interval time.Duration
+}
+
+// NewScheduler creates a scheduler that runs at the interval of cfg
+func NewScheduler(enforcer *Enforcer, userStore store.Store, vpn VPNDeleter, events EventRecorder, cfg config.AccessConfig) *Scheduler {
+	interval := cfg.CheckInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	return &Scheduler{
+		enforcer: enforcer,
+		store:    userStore,
+		vpn:      vpn,
+		events:   events,
+		grace:    cfg.ExpiryGracePeriod,
+		interval: interval,
+	}
+}
+
+// Run checks immediately and then at every interval until ctx is done
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Check(ctx); err != nil {
+			logrus.Warnf("Access check incomplete: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check enforces the access of every user once. Failures are reported in the
+// returned error, failed suspensions and resumptions are retried on the next
+// check.
+func (s *Scheduler) Check(ctx context.Context) error {
+	var errs []error
+	now := s.enforcer.now()
+
+	for _, user := range s.store.ListUsers() {
+		var err error
+		if user.ExpiresAt != nil && !now.Before(user.ExpiresAt.Add(s.grace)) {
+			err = s.deleteExpired(ctx, user)
+		} else {
+			_, err = s.enforcer.Apply(ctx, user.ID, nil)
+		}
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			metrics.RecordError("access_check", "access")
+			errs = append(errs, fmt.Errorf("user %s: %v", user.ID, err))
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// deleteExpired deletes a user past their expiry and grace period
+func (s *Scheduler) deleteExpired(ctx context.Context, user *models.User) error {
+	// Remove the user from storage first so that only one caller tears down
+	// the VPN
+	deleted, err := s.store.DeleteUser(user.ID)
+	if err != nil {
+		return err
+	}
+	metrics.DeleteUserDataUsage(deleted.ID)
+
+	s.events.RecordUserEvent(deleted, corev1.EventTypeNormal, "ExpiredUserDeleted",
+		fmt.Sprintf("User %s deleted %v after expiring at %s", deleted.Username, s.grace, deleted.ExpiresAt.UTC().Format(time.RFC3339)))
+
+	if _, err := s.vpn.DeleteUserVPN(ctx, deleted); err != nil {
+		return fmt.Errorf("failed to delete VPN of expired user: %v", err)
+	}
+	return nil
+}
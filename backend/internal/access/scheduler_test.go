@@ -0,0 +1,91 @@
+package access
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+)
+
+func TestSchedulerCheck(t *testing.T) {
+	ctx := context.Background()
+	userStore := store.NewMemoryStore()
+	vpn := &fakeVPN{}
+
+	enforcer, err := NewEnforcer(userStore, vpn, vpn, config.QuotaConfig{})
+	if err != nil {
+		t.Fatalf("create enforcer: %v", err)
+	}
+	// A Wednesday, 18:00 in Berlin
+	now := time.Date(2026, time.October, 14, 16, 0, 0, 0, time.UTC)
+	enforcer.now = func() time.Time { return now }
+
+	scheduler := NewScheduler(enforcer, userStore, vpn, vpn, config.AccessConfig{})
+	scheduler.grace = 24 * time.Hour
+
+	newUser := func(name string) *models.User {
+		user := models.NewUser(name, name+"@example.com")
+		user.WorkloadName = "vpn-" + name
+		return user
+	}
+
+	scheduled := newUser("scheduled")
+	scheduled.AccessSchedule = officeHours
+	userStore.CreateUser(scheduled)
+
+	expiresAt := now.Add(-time.Hour)
+	expired := newUser("expired")
+	expired.ExpiresAt = &expiresAt
+	userStore.CreateUser(expired)
+
+	longAgo := now.Add(-48 * time.Hour)
+	stale := newUser("stale")
+	stale.ExpiresAt = &longAgo
+	userStore.CreateUser(stale)
+
+	if err := scheduler.Check(ctx); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+
+	got, _ := userStore.GetUser(scheduled.ID)
+	if got.Status != "suspended" || got.SuspendedReason != models.SuspendedBySchedule || !got.PeerRemoved {
+		t.Errorf("outside access window: got %q (%q), peer removed %v", got.Status, got.SuspendedReason, got.PeerRemoved)
+	}
+	got, _ = userStore.GetUser(expired.ID)
+	if got.Status != "suspended" || got.SuspendedReason != models.SuspendedByExpiry || !got.PeerRemoved {
+		t.Errorf("expired within grace: got %q (%q), peer removed %v", got.Status, got.SuspendedReason, got.PeerRemoved)
+	}
+	if _, err := userStore.GetUser(stale.ID); err == nil {
+		t.Errorf("user expired beyond the grace period was not deleted")
+	}
+	if len(vpn.deleted) != 1 || vpn.deleted[0] != stale.ID {
+		t.Errorf("got deleted VPNs %v, want %v", vpn.deleted, []string{stale.ID})
+	}
+
+	// The window opens the next morning
+	now = time.Date(2026, time.October, 15, 7, 30, 0, 0, time.UTC)
+	if err := scheduler.Check(ctx); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	got, _ = userStore.GetUser(scheduled.ID)
+	if got.Status != "active" || got.PeerRemoved {
+		t.Errorf("inside access window: got %q, peer removed %v", got.Status, got.PeerRemoved)
+	}
+
+	want := map[string]int{"AccessWindowClosed": 1, "Expired": 1, "ExpiredUserDeleted": 1, "AccessWindowOpened": 1}
+	seen := map[string]int{}
+	for _, reason := range vpn.events {
+		seen[reason]++
+	}
+	if len(seen) != len(want) {
+		t.Fatalf("got events %v, want %v", vpn.events, want)
+	}
+	for reason, count := range want {
+		if seen[reason] != count {
+			t.Errorf("got events %v, want %v", vpn.events, want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"vpnaas-backend/internal/metrics"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+)
+
+// UpdateUserAccess replaces a user's expiry and access schedule and suspends
+// or resumes the user to match right away
+func (s *Server) UpdateUserAccess(c *gin.Context) {
+	var req models.UpdateAccessRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateAccess(req.ExpiresAt, req.AccessSchedule); err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := s.access.Apply(requestContext(c), c.Param("id"), func(u *models.User) {
+		u.ExpiresAt = req.ExpiresAt
+		u.AccessSchedule = req.AccessSchedule
+		u.UpdatedAt = time.Now()
+	})
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	case err != nil && user != nil:
+		// The access is stored, the VPN is reconciled on the next access check
+		requestLogger(c).Errorf("Failed to update VPN of user %s after access change: %v", user.Username, err)
+		metrics.RecordError("vpn_update", "api")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Access updated but failed to update VPN"})
+		return
+	case err != nil:
+		metrics.RecordError("storage", "api")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update access"})
+		return
+	}
+
+	s.updateUserMetrics(s.store.ListUsers())
+
+	c.JSON(http.StatusOK, gin.H{
+		"user":    user,
+		"message": "Access updated successfully",
+	})
+}
+
+// validateAccess checks an expiry and access schedule given for a user
+func validateAccess(expiresAt *time.Time, schedule *models.AccessSchedule) error {
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return errors.New("expires_at must be in the future")
+	}
+	if schedule != nil {
+		if err := schedule.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+)
+
+func TestUserAccess(t *testing.T) {
+	provisioner := newFakeProvisioner()
+	userStore := store.NewMemoryStore()
+	router := newTestRouter(newTestServer(t, provisioner, userStore))
+
+	// A daily window opening two hours from now
+	closed := &models.AccessSchedule{
+		Windows: []models.AccessWindow{{Start: fmt.Sprintf("0 %d * * *", time.Now().UTC().Add(2*time.Hour).Hour()), Duration: "1h"}},
+	}
+
+	w := doRequest(router, http.MethodPost, "/api/v1/users", models.CreateUserRequest{
+		Username:       "alice",
+		Email:          "alice@example.com",
+		AccessSchedule: closed,
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create user: got status %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		User models.User `json:"user"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	user := resp.User
+
+	// Created outside the window, so suspended right away
+	stored, _ := userStore.GetUser(user.ID)
+	if user.Status != "suspended" || stored.SuspendedReason != models.SuspendedBySchedule || !provisioner.peerRemoved[user.ID] {
+		t.Fatalf("user created outside access window not suspended: %+v", stored)
+	}
+
+	// Removing the schedule resumes the user
+	expiresAt := time.Now().Add(24 * time.Hour)
+	w = doRequest(router, http.MethodPut, "/api/v1/users/"+user.ID+"/access", models.UpdateAccessRequest{ExpiresAt: &expiresAt})
+	if w.Code != http.StatusOK {
+		t.Fatalf("update access: got status %d: %s", w.Code, w.Body)
+	}
+	stored, _ = userStore.GetUser(user.ID)
+	if stored.Status != "active" || stored.AccessSchedule != nil || stored.ExpiresAt == nil || provisioner.peerRemoved[user.ID] {
+		t.Fatalf("user not resumed: %+v", stored)
+	}
+
+	wantEvents := []string{"AccessWindowClosed", "AccessWindowOpened"}
+	if len(provisioner.events) != len(wantEvents) {
+		t.Fatalf("got events %v, want %v", provisioner.events, wantEvents)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	invalid := []interface{}{
+		models.UpdateAccessRequest{ExpiresAt: &past},
+		models.UpdateAccessRequest{AccessSchedule: &models.AccessSchedule{}},
+		models.UpdateAccessRequest{AccessSchedule: &models.AccessSchedule{Timezone: "Nowhere/Special", Windows: closed.Windows}},
+	}
+	for _, req := range invalid {
+		if w := doRequest(router, http.MethodPut, "/api/v1/users/"+user.ID+"/access", req); w.Code != http.StatusBadRequest {
+			t.Errorf("invalid access %+v: got status %d", req, w.Code)
+		}
+	}
+	if w := doRequest(router, http.MethodPost, "/api/v1/users", models.CreateUserRequest{Username: "bob", Email: "bob@example.com", ExpiresAt: &past}); w.Code != http.StatusBadRequest {
+		t.Errorf("create expired user: got status %d", w.Code)
+	}
+	if w := doRequest(router, http.MethodPut, "/api/v1/users/missing/access", models.UpdateAccessRequest{}); w.Code != http.StatusNotFound {
+		t.Errorf("missing user: got status %d", w.Code)
+	}
+}
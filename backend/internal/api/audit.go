@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"vpnaas-backend/internal/audit"
+	"vpnaas-backend/internal/metrics"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// ListAudit returns the newest audit records matching the actor, action,
+// target, outcome, since and until query parameters, at most limit of them
+func (s *Server) ListAudit(c *gin.Context) {
+	filter, err := auditFilter(c)
+	if err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit := defaultAuditLimit
+	if value := c.Query("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			metrics.RecordError("validation", "api")
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxAuditLimit)})
+			return
+		}
+	}
+
+	records, err := s.audit.Query(filter)
+	if err != nil {
+		requestLogger(c).Errorf("Failed to query audit log: %v", err)
+		metrics.RecordError("storage", "api")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query audit log"})
+		return
+	}
+	total := len(records)
+
+	// Newest first
+	newest := make([]audit.Record, 0, limit)
+	for i := len(records) - 1; i >= 0 && len(newest) < limit; i-- {
+		newest = append(newest, records[i])
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"records": newest,
+		"total":   total,
+	})
+}
+
+// ExportAudit streams every audit record matching the same filters as
+// ListAudit as JSON lines, oldest first
+func (s *Server) ExportAudit(c *gin.Context) {
+	filter, err := auditFilter(c)
+	if err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	records, err := s.audit.Query(filter)
+	if err != nil {
+		requestLogger(c).Errorf("Failed to query audit log: %v", err)
+		metrics.RecordError("storage", "api")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query audit log"})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=audit.jsonl")
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	encoder := json.NewEncoder(c.Writer)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			requestLogger(c).Warnf("Audit export aborted: %v", err)
+			break
+		}
+	}
+}
+
+// auditFilter reads the audit filters from the query string
+func auditFilter(c *gin.Context) (audit.Filter, error) {
+	filter := audit.Filter{
+		Actor:   c.Query("actor"),
+		Action:  c.Query("action"),
+		Target:  c.Query("target"),
+		Outcome: c.Query("outcome"),
+	}
+	for _, bound := range []struct {
+		param string
+		value *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		raw := c.Query(bound.param)
+		if raw == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return filter, fmt.Errorf("%s must be an RFC 3339 time", bound.param)
+		}
+		*bound.value = parsed
+	}
+	return filter, nil
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"vpnaas-backend/internal/audit"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+)
+
+func TestAuditActorTrustedBehindGateway(t *testing.T) {
+	server := newTestServer(t, newFakeProvisioner(), store.NewMemoryStore())
+	cfg := *server.currentConfig()
+	cfg.Audit.TrustActorHeader = true
+	server.config.Store(&cfg)
+	router := newTestRouter(server)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/plans", strings.NewReader(`{"name":"pro"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-User", "admin@example.com")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	records, _ := server.audit.Query(audit.Filter{})
+	if len(records) != 1 || records[0].Actor != "admin@example.com" {
+		t.Errorf("got records %+v, want the header's user as actor", records)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	server := newTestServer(t, newFakeProvisioner(), store.NewMemoryStore())
+	router := newTestRouter(server)
+
+	user, _ := createUser(t, router, "alice")
+	doRequest(router, http.MethodGet, "/api/v1/users/"+user.ID, nil)
+	doRequest(router, http.MethodPost, "/api/v1/plans", models.Plan{Name: "pro"})
+	doRequest(router, http.MethodPost, "/api/v1/plans", models.Plan{Name: "pro"})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/users/"+user.ID+"/config", nil)
+	req.Header.Set("X-Forwarded-User", "admin@example.com")
+	req.Header.Set(audit.RequestIDHeader, "req-1")
+	req.RemoteAddr = "192.0.2.7:51234"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if got := w.Header().Get(audit.RequestIDHeader); got != "req-1" {
+		t.Errorf("got request ID %q, want req-1", got)
+	}
+
+	doRequest(router, http.MethodDelete, "/api/v1/users/"+user.ID, nil)
+
+	// Reads other than config downloads are not recorded
+	records, _ := server.audit.Query(audit.Filter{})
+	want := []struct{ action, target, outcome string }{
+		{"user.create", user.ID, audit.OutcomeSuccess},
+		{"plan.create", "pro", audit.OutcomeSuccess},
+		{"plan.create", "pro", audit.OutcomeFailure},
+		{"user.config.download", user.ID, audit.OutcomeSuccess},
+		{"user.delete", user.ID, audit.OutcomeSuccess},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d: %+v", len(records), len(want), records)
+	}
+	for i, w := range want {
+		r := records[i]
+		if r.Action != w.action || r.Target != w.target || r.Outcome != w.outcome || r.RequestID == "" {
+			t.Errorf("record %d: got %+v, want %+v", i, r, w)
+		}
+	}
+	download := records[3]
+	if download.Actor != "claimed:admin@example.com" || download.SourceIP != "192.0.2.7" || download.RequestID != "req-1" {
+		t.Errorf("config download recorded as %+v", download)
+	}
+	if records[0].Actor != "unauthenticated" {
+		t.Errorf("got actor %q for unauthenticated request", records[0].Actor)
+	}
+
+	// Queries return the newest records first
+	w = doRequest(router, http.MethodGet, "/api/v1/audit?action=plan.create&limit=1", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list audit: got status %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Records []audit.Record `json:"records"`
+		Total   int            `json:"total"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Total != 2 || len(resp.Records) != 1 || resp.Records[0].Outcome != audit.OutcomeFailure {
+		t.Fatalf("got %+v", resp)
+	}
+
+	for _, query := range []string{"limit=0", "limit=abc", "since=yesterday"} {
+		if w := doRequest(router, http.MethodGet, "/api/v1/audit?"+query, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", query, w.Code)
+		}
+	}
+
+	// Exports stream JSON lines, oldest first
+	w = doRequest(router, http.MethodGet, "/api/v1/audit/export?target="+user.ID, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("export: got status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var exported []string
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var record audit.Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("export line %q: %v", scanner.Text(), err)
+		}
+		exported = append(exported, record.Action)
+	}
+	if len(exported) != 3 || exported[0] != "user.create" || exported[2] != "user.delete" {
+		t.Fatalf("got exported actions %v", exported)
+	}
+}
@@ -0,0 +1,285 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/logging"
+	"vpnaas-backend/internal/metrics"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+)
+
+// currentConfig returns the configuration in effect
+func (s *Server) currentConfig() *config.Config {
+	return s.config.Load()
+}
+
+// configRollout runs rollouts of the configuration to the VPN workloads in
+// the background, one at a time
+type configRollout struct {
+	// start is held while a rollout replaces the previous one
+	start sync.Mutex
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	status *models.ConfigRollout
+}
+
+// ApplyConfig switches to a reloaded configuration, which must already be
+// valid. Every changed setting is logged; those that require a restart are
+// kept at their current values until then. Nothing is applied if the VPN
+// manager rejects the new VPN settings. With reload.rollout set, VPN
+// workloads are then rolled to the new VPN settings in the background, see
+// StartRollout; ctx bounds that rollout.
+func (s *Server) ApplyConfig(ctx context.Context, cfg *config.Config) error {
+	log := logging.FromContext(ctx)
+	current := s.currentConfig()
+
+	changes := config.Diff(current, cfg)
+	if len(changes) == 0 {
+		log.Debug("Configuration reloaded without changes")
+		return nil
+	}
+
+	reloaded := current.Reloaded(cfg)
+	vpnChanged := false
+	for _, change := range changes {
+		if config.RequiresRestart(change.Key) {
+			log.Warnf("Configuration change %s requires a restart", change)
+			continue
+		}
+		vpnChanged = vpnChanged || strings.HasPrefix(change.Key, "vpn.")
+		log.Infof("Configuration change %s", change)
+	}
+
+	if vpnChanged {
+		if err := s.vpnManager.ApplyConfig(ctx, reloaded.VPN); err != nil {
+			return fmt.Errorf("failed to apply VPN configuration: %v", err)
+		}
+	}
+	if err := logging.Configure(reloaded.Log, reloaded.Debug); err != nil {
+		return fmt.Errorf("failed to apply logging configuration: %v", err)
+	}
+	s.config.Store(reloaded)
+
+	if vpnChanged && reloaded.Reload.Rollout {
+		s.StartRollout(ctx)
+		log.Info("Rolling VPN configuration out in the background")
+	}
+	return nil
+}
+
+// StartRollout rolls the current configuration out to every provisioned
+// user's VPN workload in the background and returns the rollout's initial
+// state. A rollout still running is canceled first, and is waited for to
+// stop at the workload it was on, so that only the latest configuration is
+// rolled out. Canceling ctx stops the rollout.
+func (s *Server) StartRollout(ctx context.Context) *models.ConfigRollout {
+	s.rollout.start.Lock()
+	defer s.rollout.start.Unlock()
+
+	s.rollout.mu.Lock()
+	cancel, done := s.rollout.cancel, s.rollout.done
+	s.rollout.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+
+	// Only who to roll out is taken now: users are read again when their
+	// turn comes, as they may have changed or been deleted by then
+	users := s.provisionedUsers()
+	targets := make([]rolloutTarget, 0, len(users))
+	pending := make([]string, 0, len(users))
+	for _, user := range users {
+		targets = append(targets, rolloutTarget{userID: user.ID, workload: user.WorkloadName})
+		pending = append(pending, user.WorkloadName)
+	}
+	status := &models.ConfigRollout{
+		RolloutResult: models.RolloutResult{Updated: []string{}, Pending: pending},
+		State:         models.RolloutRunning,
+		StartedAt:     time.Now(),
+	}
+
+	ctx, cancel = context.WithCancel(ctx)
+	done = make(chan struct{})
+	s.rollout.mu.Lock()
+	s.rollout.cancel, s.rollout.done, s.rollout.status = cancel, done, status
+	started := status.Clone()
+	s.rollout.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		defer cancel()
+		s.rolloutConfig(ctx, targets)
+	}()
+	return started
+}
+
+// ConfigRollout returns the state of the latest configuration rollout, or nil
+// if none has been started
+func (s *Server) ConfigRollout() *models.ConfigRollout {
+	s.rollout.mu.Lock()
+	defer s.rollout.mu.Unlock()
+
+	if s.rollout.status == nil {
+		return nil
+	}
+	return s.rollout.status.Clone()
+}
+
+// updateRollout modifies the state of the current configuration rollout
+func (s *Server) updateRollout(fn func(status *models.ConfigRollout)) {
+	s.rollout.mu.Lock()
+	defer s.rollout.mu.Unlock()
+	fn(s.rollout.status)
+}
+
+// provisionedUsers returns the users with a VPN workload in user ID order
+func (s *Server) provisionedUsers() []*models.User {
+	var users []*models.User
+	for _, user := range s.store.ListUsers() {
+		if user.WorkloadName != "" {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users
+}
+
+// rolloutTarget is a workload a configuration rollout is to reach
+type rolloutTarget struct {
+	userID   string
+	workload string
+}
+
+// rolloutConfig rolls the targets' VPN workloads to the current
+// configuration one at a time, waiting for each to be ready before moving
+// on, and records its progress. Each user is read when their turn comes;
+// users deleted or deprovisioned since the rollout started are skipped. It
+// stops at the first failure so that a bad image or template takes down at
+// most one workload; the rest are left pending.
+func (s *Server) rolloutConfig(ctx context.Context, targets []rolloutTarget) {
+	log := logging.FromContext(ctx)
+
+	state := models.RolloutCompleted
+	for _, target := range targets {
+		if ctx.Err() != nil {
+			state = models.RolloutCanceled
+			break
+		}
+		changed, err := s.rolloutUserVPN(ctx, target.userID)
+		if err != nil && ctx.Err() != nil {
+			state = models.RolloutCanceled
+			break
+		}
+		skipped := errors.Is(err, store.ErrNotFound) || errors.Is(err, errNotProvisioned)
+		if skipped {
+			log.Debugf("Skipping VPN configuration rollout to %s: %v", target.workload, err)
+			err = nil
+		}
+		if err != nil {
+			log.Errorf("Failed to roll VPN configuration out to %s: %v", target.workload, err)
+			metrics.RecordError("vpn_rollout", "api")
+			state = models.RolloutFailed
+		}
+
+		s.updateRollout(func(status *models.ConfigRollout) {
+			status.Pending = status.Pending[1:]
+			switch {
+			case err != nil:
+				status.Errors = append(status.Errors, fmt.Sprintf("%s: %v", target.workload, err))
+			case skipped:
+				status.Skipped = append(status.Skipped, target.workload)
+			case changed:
+				status.Updated = append(status.Updated, target.workload)
+			default:
+				status.Unchanged = append(status.Unchanged, target.workload)
+			}
+		})
+		if err != nil {
+			break
+		}
+	}
+
+	var result models.ConfigRollout
+	s.updateRollout(func(status *models.ConfigRollout) {
+		finished := time.Now()
+		status.State = state
+		status.FinishedAt = &finished
+		result = *status.Clone()
+	})
+
+	switch state {
+	case models.RolloutFailed:
+		log.Errorf("Rolled VPN configuration out to %d workloads, %d pending: %s",
+			len(result.Updated), len(result.Pending), strings.Join(result.Errors, "; "))
+	case models.RolloutCanceled:
+		log.Infof("Canceled VPN configuration rollout after %d workloads, %d pending",
+			len(result.Updated), len(result.Pending))
+	default:
+		log.Infof("Rolled VPN configuration out to %d workloads, %d unchanged",
+			len(result.Updated), len(result.Unchanged))
+	}
+}
+
+// errNotProvisioned reports that a user no longer has a VPN workload
+var errNotProvisioned = errors.New("user has no VPN workload")
+
+// rolloutUserVPN rolls a user's workload to the current configuration, from
+// the user as currently stored, and stores what it applied. It reports
+// whether the workload changed.
+func (s *Server) rolloutUserVPN(ctx context.Context, userID string) (bool, error) {
+	user, err := s.store.GetUser(userID)
+	if err != nil {
+		return false, err
+	}
+	if user.WorkloadName == "" {
+		return false, errNotProvisioned
+	}
+	plan, err := s.userPlan(user)
+	if err != nil {
+		return false, err
+	}
+	changed, err := s.vpnManager.RolloutUserVPN(ctx, user, plan)
+	if err != nil {
+		return false, err
+	}
+	if _, err := store.UpdateApplied(s.store, user); err != nil {
+		return false, err
+	}
+	return changed, nil
+}
+
+// RolloutVPNConfig starts rolling the current configuration out to every VPN
+// workload in the background, replacing a rollout still running. Its
+// progress is served by GetVPNConfigRollout.
+func (s *Server) RolloutVPNConfig(c *gin.Context) {
+	// The rollout outlives the request
+	rollout := s.StartRollout(context.WithoutCancel(requestContext(c)))
+
+	c.JSON(http.StatusAccepted, gin.H{"rollout": rollout})
+}
+
+// GetVPNConfigRollout returns the progress of the latest configuration
+// rollout
+func (s *Server) GetVPNConfigRollout(c *gin.Context) {
+	rollout := s.ConfigRollout()
+	if rollout == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No configuration rollout has been started"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rollout": rollout})
+}
@@ -0,0 +1,282 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+)
+
+func TestApplyConfig(t *testing.T) {
+	ctx := context.Background()
+	provisioner := newFakeProvisioner()
+	server := newTestServer(t, provisioner, store.NewMemoryStore())
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() { logrus.SetLevel(logrus.InfoLevel) })
+
+	// Nothing changed, nothing applied
+	if err := server.ApplyConfig(ctx, config.Default()); err != nil {
+		t.Fatalf("apply unchanged: %v", err)
+	}
+	if len(provisioner.applied) != 0 {
+		t.Errorf("unchanged configuration applied to the VPN manager")
+	}
+
+	next := config.Default()
+	next.Log.Level = "warn"
+	next.Server.Port = 9090
+	next.VPN.Image = "wireguard:1.1"
+	next.VPN.ContainerName = "wg"
+
+	provisioner.failApply = true
+	if err := server.ApplyConfig(ctx, next); err == nil || !strings.Contains(err.Error(), "failed to apply VPN configuration") {
+		t.Fatalf("got error %v for a rejected VPN configuration", err)
+	}
+	if server.currentConfig().VPN.Image != config.Default().VPN.Image || logrus.GetLevel() != logrus.InfoLevel {
+		t.Fatalf("rejected configuration was swapped in")
+	}
+
+	provisioner.failApply = false
+	hook.Reset()
+	if err := server.ApplyConfig(ctx, next); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	current := server.currentConfig()
+	if current.VPN.Image != "wireguard:1.1" || current.Log.Level != "warn" || logrus.GetLevel() != logrus.WarnLevel {
+		t.Errorf("live settings not applied: image %s, log level %s", current.VPN.Image, logrus.GetLevel())
+	}
+	if current.Server.Port != 8080 || current.VPN.ContainerName != "wireguard" {
+		t.Errorf("settings requiring a restart were applied: port %d, container %s", current.Server.Port, current.VPN.ContainerName)
+	}
+	if len(provisioner.applied) != 1 || provisioner.applied[0].Image != "wireguard:1.1" || provisioner.applied[0].ContainerName != "wireguard" {
+		t.Errorf("got VPN configurations applied %+v", provisioner.applied)
+	}
+	if len(provisioner.rolledOut) != 0 {
+		t.Errorf("workloads rolled out without reload.rollout: %v", provisioner.rolledOut)
+	}
+
+	logged := map[string]logrus.Level{}
+	for _, entry := range hook.AllEntries() {
+		logged[entry.Message] = entry.Level
+	}
+	for message, level := range map[string]logrus.Level{
+		`Configuration change server.port: 8080 -> 9090 requires a restart`:                 logrus.WarnLevel,
+		`Configuration change vpn.container_name: "wireguard" -> "wg" requires a restart`:   logrus.WarnLevel,
+		`Configuration change vpn.image: "linuxserver/wireguard:latest" -> "wireguard:1.1"`: logrus.InfoLevel,
+	} {
+		if got, ok := logged[message]; !ok || got != level {
+			t.Errorf("%q not logged at %s: %v", message, level, logged)
+		}
+	}
+}
+
+// waitForConfigRollout waits for the latest configuration rollout to end and
+// returns its final state
+func waitForConfigRollout(t *testing.T, server *Server) *models.ConfigRollout {
+	t.Helper()
+	server.rollout.mu.Lock()
+	done := server.rollout.done
+	server.rollout.mu.Unlock()
+	if done == nil {
+		t.Fatalf("no configuration rollout was started")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("configuration rollout did not finish")
+	}
+	return server.ConfigRollout()
+}
+
+func TestApplyConfigRollsOut(t *testing.T) {
+	ctx := context.Background()
+	provisioner := newFakeProvisioner()
+	userStore := store.NewMemoryStore()
+	server := newTestServer(t, provisioner, userStore)
+	router := newTestRouter(server)
+
+	var ids []string
+	for _, name := range []string{"alice", "bob", "carol"} {
+		user, code := createUser(t, router, name)
+		if code != http.StatusCreated {
+			t.Fatalf("create %s: got status %d", name, code)
+		}
+		ids = append(ids, user.ID)
+	}
+	sort.Strings(ids)
+	provisioner.failRollout[ids[1]] = true
+
+	next := config.Default()
+	next.Reload.Rollout = true
+	next.VPN.PodMemoryLimit = "256Mi"
+	if err := server.ApplyConfig(ctx, next); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	result := waitForConfigRollout(t, server)
+
+	// The rollout stops at the failing workload
+	if result.State != models.RolloutFailed || len(result.Errors) != 1 {
+		t.Errorf("got rollout %+v, want it failed", result)
+	}
+	if len(provisioner.rolledOut) != 1 || provisioner.rolledOut[0] != "vpn-"+ids[0] {
+		t.Errorf("got workloads rolled out %v, want only vpn-%s", provisioner.rolledOut, ids[0])
+	}
+	if len(result.Pending) != 1 || result.Pending[0] != "vpn-"+ids[2] {
+		t.Errorf("got pending %v, want vpn-%s", result.Pending, ids[2])
+	}
+	rolled, _ := userStore.GetUser(ids[0])
+	if !strings.Contains(rolled.ConfigData, "rolled out") {
+		t.Errorf("rolled out configuration not stored: %q", rolled.ConfigData)
+	}
+	pending, _ := userStore.GetUser(ids[2])
+	if strings.Contains(pending.ConfigData, "rolled out") {
+		t.Errorf("workload after the failure was rolled out")
+	}
+}
+
+func TestRolloutVPNConfigHandler(t *testing.T) {
+	provisioner := newFakeProvisioner()
+	server := newTestServer(t, provisioner, store.NewMemoryStore())
+	router := newTestRouter(server)
+
+	var ids []string
+	for _, name := range []string{"alice", "bob"} {
+		user, _ := createUser(t, router, name)
+		ids = append(ids, user.ID)
+	}
+	sort.Strings(ids)
+
+	decode := func(body []byte) models.ConfigRollout {
+		t.Helper()
+		var resp struct {
+			Rollout models.ConfigRollout `json:"rollout"`
+		}
+		if err := json.Unmarshal(body, &resp); err != nil {
+			t.Fatalf("decode rollout: %v", err)
+		}
+		return resp.Rollout
+	}
+
+	if w := doRequest(router, http.MethodGet, "/api/v1/config/rollout", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("status before any rollout: got status %d", w.Code)
+	}
+
+	// Workloads already running the configuration are left alone
+	provisioner.unchanged[ids[1]] = true
+	w := doRequest(router, http.MethodPost, "/api/v1/config/rollout", nil)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("rollout: got status %d: %s", w.Code, w.Body)
+	}
+	if started := decode(w.Body.Bytes()); started.State != models.RolloutRunning || len(started.Pending) != 2 {
+		t.Errorf("got started rollout %+v, want both workloads pending", started)
+	}
+	waitForConfigRollout(t, server)
+	w = doRequest(router, http.MethodGet, "/api/v1/config/rollout", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("rollout status: got status %d", w.Code)
+	}
+	result := decode(w.Body.Bytes())
+	if result.State != models.RolloutCompleted || result.FinishedAt == nil {
+		t.Errorf("got rollout %+v, want it completed", result)
+	}
+	if len(result.Updated) != 1 || result.Updated[0] != "vpn-"+ids[0] || len(result.Unchanged) != 1 || len(result.Pending) != 0 {
+		t.Errorf("got rollout %+v, want vpn-%s updated and vpn-%s unchanged", result, ids[0], ids[1])
+	}
+
+	provisioner.failRollout[ids[0]] = true
+	if w := doRequest(router, http.MethodPost, "/api/v1/config/rollout", nil); w.Code != http.StatusAccepted {
+		t.Fatalf("failing rollout: got status %d", w.Code)
+	}
+	waitForConfigRollout(t, server)
+	result = decode(doRequest(router, http.MethodGet, "/api/v1/config/rollout", nil).Body.Bytes())
+	if result.State != models.RolloutFailed || len(result.Updated) != 0 || len(result.Pending) != 1 || result.Pending[0] != "vpn-"+ids[1] || len(result.Errors) != 1 {
+		t.Errorf("got rollout %+v, want vpn-%s pending", result, ids[1])
+	}
+}
+
+func TestRolloutReplacesRunningRollout(t *testing.T) {
+	provisioner := newFakeProvisioner()
+	server := newTestServer(t, provisioner, store.NewMemoryStore())
+	router := newTestRouter(server)
+	hook := logtest.NewGlobal()
+
+	for _, name := range []string{"alice", "bob"} {
+		createUser(t, router, name)
+	}
+
+	// The first rollout is stuck on its first workload when the second
+	// starts, and is canceled without rolling anything out
+	block := make(chan struct{})
+	provisioner.blockRollout = block
+	server.StartRollout(context.Background())
+	server.StartRollout(context.Background())
+	close(block)
+
+	result := waitForConfigRollout(t, server)
+	if result.State != models.RolloutCompleted || len(result.Updated) != 2 {
+		t.Errorf("got rollout %+v, want both workloads updated", result)
+	}
+	if len(provisioner.rolledOut) != 2 {
+		t.Errorf("got workloads rolled out %v, want each once", provisioner.rolledOut)
+	}
+
+	canceled := false
+	for _, entry := range hook.AllEntries() {
+		canceled = canceled || entry.Message == "Canceled VPN configuration rollout after 0 workloads, 2 pending"
+	}
+	if !canceled {
+		t.Errorf("first rollout was not canceled")
+	}
+}
+
+func TestRolloutReadsUsersWhenReached(t *testing.T) {
+	provisioner := newFakeProvisioner()
+	userStore := store.NewMemoryStore()
+	server := newTestServer(t, provisioner, userStore)
+	router := newTestRouter(server)
+
+	var ids []string
+	for _, name := range []string{"alice", "bob", "carol"} {
+		user, _ := createUser(t, router, name)
+		ids = append(ids, user.ID)
+	}
+	sort.Strings(ids)
+
+	// While the first workload rolls out, one user is deleted and another
+	// suspended
+	block := make(chan struct{})
+	provisioner.blockRollout = block
+	server.StartRollout(context.Background())
+	if _, err := userStore.DeleteUser(ids[1]); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := userStore.UpdateUser(ids[2], func(u *models.User) error {
+		u.Status = "suspended"
+		return nil
+	}); err != nil {
+		t.Fatalf("suspend: %v", err)
+	}
+	close(block)
+
+	result := waitForConfigRollout(t, server)
+	if result.State != models.RolloutCompleted || len(result.Updated) != 2 {
+		t.Errorf("got rollout %+v, want it completed past the deleted user", result)
+	}
+	if len(result.Skipped) != 1 || result.Skipped[0] != "vpn-"+ids[1] {
+		t.Errorf("got skipped %v, want vpn-%s", result.Skipped, ids[1])
+	}
+	suspended, _ := userStore.GetUser(ids[2])
+	if suspended.Status != "suspended" || !suspended.PeerRemoved {
+		t.Errorf("rollout worked from a stale copy of the suspended user: %+v", suspended)
+	}
+}
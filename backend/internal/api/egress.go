@@ -0,0 +1,33 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListEgressProfiles returns the egress profiles users can be assigned to,
+// with the public IP each one leaves the cluster from
+func (s *Server) ListEgressProfiles(c *gin.Context) {
+	profiles := s.vpnManager.EgressProfiles()
+
+	c.JSON(http.StatusOK, gin.H{
+		"egress_profiles": profiles,
+		"total":           len(profiles),
+	})
+}
+
+// validateEgressProfile checks that a user is assigned to a defined profile.
+// An empty name uses the default profile.
+func (s *Server) validateEgressProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+	for _, profile := range s.vpnManager.EgressProfiles() {
+		if profile.Name == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("egress profile %q is not defined", name)
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+)
+
+func TestUserEgressProfile(t *testing.T) {
+	provisioner := newFakeProvisioner()
+	provisioner.profiles = []models.EgressProfile{{Name: "partner-a", NodePool: "egress-a", PublicIP: "203.0.113.10"}}
+	userStore := store.NewMemoryStore()
+	router := newTestRouter(newTestServer(t, provisioner, userStore))
+
+	w := doRequest(router, http.MethodGet, "/api/v1/egress-profiles", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list egress profiles: got status %d: %s", w.Code, w.Body)
+	}
+
+	w = doRequest(router, http.MethodPost, "/api/v1/users", models.CreateUserRequest{
+		Username:      "alice",
+		Email:         "alice@example.com",
+		EgressProfile: "unknown",
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("create user with unknown profile: got status %d, want 400", w.Code)
+	}
+
+	user, _ := createUser(t, router, "bob")
+
+	unknown := "unknown"
+	w = doRequest(router, http.MethodPut, "/api/v1/users/"+user.ID, models.UpdateUserRequest{EgressProfile: &unknown})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("assign unknown profile: got status %d, want 400", w.Code)
+	}
+
+	profile := "partner-a"
+	w = doRequest(router, http.MethodPut, "/api/v1/users/"+user.ID, models.UpdateUserRequest{EgressProfile: &profile})
+	if w.Code != http.StatusOK {
+		t.Fatalf("assign profile: got status %d: %s", w.Code, w.Body)
+	}
+	stored, _ := userStore.GetUser(user.ID)
+	if stored.EgressProfile != "partner-a" || stored.EgressIP != "203.0.113.10" {
+		t.Fatalf("profile not applied: profile %q, egress IP %q", stored.EgressProfile, stored.EgressIP)
+	}
+
+	none := ""
+	w = doRequest(router, http.MethodPut, "/api/v1/users/"+user.ID, models.UpdateUserRequest{EgressProfile: &none})
+	if w.Code != http.StatusOK {
+		t.Fatalf("clear profile: got status %d: %s", w.Code, w.Body)
+	}
+	stored, _ = userStore.GetUser(user.ID)
+	if stored.EgressProfile != "" || stored.EgressIP != "" {
+		t.Fatalf("profile not cleared: profile %q, egress IP %q", stored.EgressProfile, stored.EgressIP)
+	}
+}
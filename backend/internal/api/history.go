@@ -0,0 +1,96 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"vpnaas-backend/internal/history"
+	"vpnaas-backend/internal/metrics"
+)
+
+const (
+	defaultHistoryRange = 24 * time.Hour
+	maxHistoryPoints    = 1000
+)
+
+// GetStatsHistory returns a usage series between from and to, one sample per
+// step. The user query parameter selects a user's series instead of the
+// global one. from defaults to a day before to, to to now, and step to the
+// sample interval, widened to keep the series within maxHistoryPoints.
+func (s *Server) GetStatsHistory(c *gin.Context) {
+	to := time.Now()
+	from := time.Time{}
+	for _, bound := range []struct {
+		param string
+		value *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		raw := c.Query(bound.param)
+		if raw == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			metrics.RecordError("validation", "api")
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s must be an RFC 3339 time", bound.param)})
+			return
+		}
+		*bound.value = parsed
+	}
+	if from.IsZero() {
+		from = to.Add(-defaultHistoryRange)
+	}
+	if !from.Before(to) {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+
+	step, err := historyStep(c.Query("step"), from, to, s.currentConfig().History.SampleInterval)
+	if err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.Query("user")
+	samples, err := s.history.Query(userID, from, to)
+	if err != nil {
+		requestLogger(c).Errorf("Failed to query usage history: %v", err)
+		metrics.RecordError("storage", "api")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query usage history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user":   userID,
+		"from":   from,
+		"to":     to,
+		"step":   step.String(),
+		"series": history.Downsample(samples, step),
+	})
+}
+
+// historyStep parses the step of a history query, choosing one no finer
+// than the sample interval when it is not given
+func historyStep(raw string, from, to time.Time, sampleInterval time.Duration) (time.Duration, error) {
+	span := to.Sub(from)
+	if raw == "" {
+		step := sampleInterval
+		if span/step > maxHistoryPoints {
+			step = (span/maxHistoryPoints + time.Second - 1).Truncate(time.Second)
+		}
+		return step, nil
+	}
+
+	step, err := time.ParseDuration(raw)
+	if err != nil || step <= 0 {
+		return 0, fmt.Errorf("step must be a positive duration such as 5m or 1h")
+	}
+	if span/step > maxHistoryPoints {
+		return 0, fmt.Errorf("step %s yields more than %d points, use a larger step or a shorter range", step, maxHistoryPoints)
+	}
+	return step, nil
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"vpnaas-backend/internal/history"
+	"vpnaas-backend/internal/store"
+)
+
+func TestGetStatsHistory(t *testing.T) {
+	server := newTestServer(t, newFakeProvisioner(), store.NewMemoryStore())
+	router := newTestRouter(server)
+
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	var samples []history.Sample
+	for minute := 0; minute < 120; minute += 5 {
+		at := start.Add(time.Duration(minute) * time.Minute)
+		samples = append(samples,
+			history.Sample{Time: at, DataUsage: int64(minute), Users: 1},
+			history.Sample{Time: at, UserID: "u1", DataUsage: int64(minute) * 10},
+		)
+	}
+	server.history.Append(samples)
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantStep   string
+		wantUsage  []int64
+	}{
+		{
+			name:       "global hourly",
+			query:      "?from=2024-03-01T00:00:00Z&to=2024-03-01T02:00:00Z&step=1h",
+			wantStatus: http.StatusOK,
+			wantStep:   "1h0m0s",
+			wantUsage:  []int64{55, 115},
+		},
+		{
+			name:       "user at the sample interval",
+			query:      "?user=u1&from=2024-03-01T00:00:00Z&to=2024-03-01T00:15:00Z",
+			wantStatus: http.StatusOK,
+			wantStep:   "5m0s",
+			wantUsage:  []int64{0, 50, 100},
+		},
+		{
+			name:       "unknown user has an empty series",
+			query:      "?user=missing&from=2024-03-01T00:00:00Z&to=2024-03-01T02:00:00Z",
+			wantStatus: http.StatusOK,
+			wantStep:   "5m0s",
+			wantUsage:  []int64{},
+		},
+		{
+			name:       "long range widens the step",
+			query:      "?from=2024-01-01T00:00:00Z&to=2024-03-01T00:00:00Z",
+			wantStatus: http.StatusOK,
+			wantStep:   "1h26m24s",
+			wantUsage:  []int64{},
+		},
+		{name: "invalid time", query: "?from=yesterday", wantStatus: http.StatusBadRequest},
+		{name: "reversed range", query: "?from=2024-03-02T00:00:00Z&to=2024-03-01T00:00:00Z", wantStatus: http.StatusBadRequest},
+		{name: "invalid step", query: "?step=-5m", wantStatus: http.StatusBadRequest},
+		{name: "too many points", query: "?from=2024-01-01T00:00:00Z&to=2024-03-01T00:00:00Z&step=1m", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(router, http.MethodGet, "/api/v1/stats/history"+tt.query, nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Step   string           `json:"step"`
+				Series []history.Sample `json:"series"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if resp.Step != tt.wantStep {
+				t.Errorf("got step %s, want %s", resp.Step, tt.wantStep)
+			}
+			if len(resp.Series) != len(tt.wantUsage) {
+				t.Fatalf("got %d samples, want %d", len(resp.Series), len(tt.wantUsage))
+			}
+			for i, want := range tt.wantUsage {
+				if resp.Series[i].DataUsage != want {
+					t.Errorf("sample %d: got usage %d, want %d", i, resp.Series[i].DataUsage, want)
+				}
+			}
+		})
+	}
+}
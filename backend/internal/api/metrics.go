@@ -0,0 +1,84 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"vpnaas-backend/internal/logging"
+	"vpnaas-backend/internal/models"
+)
+
+// MetricsSnapshot is what the latest metrics refresh published to
+// Prometheus. Pod counts are kept from the last refresh that could list the
+// pods.
+type MetricsSnapshot struct {
+	RefreshedAt     time.Time        `json:"refreshed_at"`
+	Users           models.UserStats `json:"users"`
+	Pods            *models.PodStats `json:"pods"`
+	PodsRefreshedAt *time.Time       `json:"pods_refreshed_at,omitempty"`
+	PodsError       string           `json:"pods_error,omitempty"`
+}
+
+// RunMetricsRefresh refreshes the user and pod gauges immediately and then
+// at metrics.refresh_interval until ctx is done
+func (s *Server) RunMetricsRefresh(ctx context.Context) {
+	interval := s.currentConfig().Metrics.RefreshInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.RefreshMetrics(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RefreshMetrics publishes the current user and pod counts and records them
+// for GetMetrics
+func (s *Server) RefreshMetrics(ctx context.Context) {
+	users := s.store.ListUsers()
+	s.updateUserMetrics(users)
+
+	now := time.Now()
+	snapshot := &MetricsSnapshot{
+		RefreshedAt: now,
+		Users:       *s.calculateStats(users),
+	}
+
+	pods, err := s.vpnManager.UpdatePodMetrics(ctx)
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+	if err != nil {
+		logging.FromContext(ctx).Errorf("Failed to update pod metrics: %v", err)
+		snapshot.PodsError = err.Error()
+		if s.snapshot != nil {
+			snapshot.Pods, snapshot.PodsRefreshedAt = s.snapshot.Pods, s.snapshot.PodsRefreshedAt
+		}
+	} else {
+		snapshot.Pods, snapshot.PodsRefreshedAt = &pods, &now
+	}
+	s.snapshot = snapshot
+}
+
+// GetMetrics returns the user and pod counts of the latest metrics refresh
+func (s *Server) GetMetrics(c *gin.Context) {
+	s.snapshotMu.RLock()
+	snapshot := s.snapshot
+	s.snapshotMu.RUnlock()
+
+	if snapshot == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Metrics have not been collected yet"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"metrics": snapshot})
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"vpnaas-backend/internal/store"
+)
+
+func TestGetMetrics(t *testing.T) {
+	provisioner := newFakeProvisioner()
+	server := newTestServer(t, provisioner, store.NewMemoryStore())
+	router := newTestRouter(server)
+
+	if w := doRequest(router, http.MethodGet, "/api/v1/metrics", nil); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("before refresh: got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	createUser(t, router, "alice")
+	createUser(t, router, "bob")
+	server.RefreshMetrics(context.Background())
+
+	getSnapshot := func() MetricsSnapshot {
+		t.Helper()
+		w := doRequest(router, http.MethodGet, "/api/v1/metrics", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d", w.Code)
+		}
+		var resp struct {
+			Metrics MetricsSnapshot `json:"metrics"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		return resp.Metrics
+	}
+
+	snapshot := getSnapshot()
+	if snapshot.Users.TotalUsers != 2 || snapshot.Users.ActiveUsers != 2 {
+		t.Errorf("got user stats %+v", snapshot.Users)
+	}
+	if snapshot.Pods == nil || snapshot.Pods.Running != 2 || snapshot.PodsError != "" {
+		t.Errorf("got pods %+v, error %q", snapshot.Pods, snapshot.PodsError)
+	}
+
+	// Reading the metrics does not refresh them
+	createUser(t, router, "carol")
+	if snapshot := getSnapshot(); snapshot.Users.TotalUsers != 2 {
+		t.Errorf("got %d users without a refresh, want 2", snapshot.Users.TotalUsers)
+	}
+
+	// Pod counts survive a failed refresh, which is reported
+	provisioner.mu.Lock()
+	provisioner.failPodMetrics = true
+	provisioner.mu.Unlock()
+	server.RefreshMetrics(context.Background())
+	snapshot = getSnapshot()
+	if snapshot.Users.TotalUsers != 3 {
+		t.Errorf("got %d users, want 3", snapshot.Users.TotalUsers)
+	}
+	if snapshot.Pods == nil || snapshot.Pods.Running != 2 || snapshot.PodsError == "" {
+		t.Errorf("got pods %+v, error %q after a failed refresh", snapshot.Pods, snapshot.PodsError)
+	}
+}
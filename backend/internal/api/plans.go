@@ -0,0 +1,186 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"vpnaas-backend/internal/audit"
+	"vpnaas-backend/internal/metrics"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+)
+
+// ListPlans returns all plans
+func (s *Server) ListPlans(c *gin.Context) {
+	plans := s.store.ListPlans()
+
+	c.JSON(http.StatusOK, gin.H{
+		"plans": plans,
+		"total": len(plans),
+	})
+}
+
+// CreatePlan creates a new plan
+func (s *Server) CreatePlan(c *gin.Context) {
+	var plan models.Plan
+	if err := c.ShouldBindJSON(&plan); err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := plan.Validate(); err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	plan.PodTemplate = strings.ToLower(plan.PodTemplate)
+	if err := s.validatePodTemplate(plan.PodTemplate); err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	plan.CreatedAt = now
+	plan.UpdatedAt = now
+	audit.SetTarget(c, plan.Name)
+
+	if err := s.store.CreatePlan(&plan); err != nil {
+		metrics.RecordError("duplicate_plan", "api")
+		c.JSON(http.StatusConflict, gin.H{"error": "Plan already exists"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"plan":    plan,
+		"message": "Plan created successfully",
+	})
+}
+
+// GetPlan returns a specific plan
+func (s *Server) GetPlan(c *gin.Context) {
+	plan, err := s.store.GetPlan(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"plan": plan})
+}
+
+// UpdatePlan replaces a plan's settings and rebuilds the workloads of the
+// users assigned to it
+func (s *Server) UpdatePlan(c *gin.Context) {
+	var req models.Plan
+	if err := c.ShouldBindJSON(&req); err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := c.Param("name")
+	req.Name = name
+	if err := req.Validate(); err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.PodTemplate = strings.ToLower(req.PodTemplate)
+	if err := s.validatePodTemplate(req.PodTemplate); err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	plan, err := s.store.UpdatePlan(name, func(p *models.Plan) error {
+		req.CreatedAt = p.CreatedAt
+		req.UpdatedAt = time.Now()
+		*p = req
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+
+	// Apply the new resources to every user on the plan
+	ctx := requestContext(c)
+	rebuilt, failed := 0, 0
+	for _, user := range s.store.ListUsers() {
+		if user.Plan != name || user.WorkloadName == "" {
+			continue
+		}
+		if err := s.rebuildUserVPN(ctx, user, plan); err != nil {
+			requestLogger(c).Errorf("Failed to apply plan %s to user %s: %v", name, user.Username, err)
+			metrics.RecordError("vpn_update", "api")
+			failed++
+			continue
+		}
+		rebuilt++
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"plan":            plan,
+		"rebuilt_users":   rebuilt,
+		"failed_rebuilds": failed,
+	})
+}
+
+// validatePodTemplate checks that a plan selects a loaded pod template. Names
+// are lowercase, as the VPN manager stores them. An empty name leaves the
+// choice to the tenant or default template.
+func (s *Server) validatePodTemplate(name string) error {
+	if name == "" {
+		return nil
+	}
+	for _, loaded := range s.vpnManager.PodTemplateNames() {
+		if loaded == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("pod template %q is not defined", name)
+}
+
+// DeletePlan deletes a plan that no user is assigned to
+func (s *Server) DeletePlan(c *gin.Context) {
+	err := s.store.DeletePlan(c.Param("name"))
+	switch {
+	case errors.Is(err, store.ErrPlanNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	case errors.Is(err, store.ErrPlanInUse):
+		c.JSON(http.StatusConflict, gin.H{"error": "Plan is assigned to users"})
+		return
+	case err != nil:
+		metrics.RecordError("storage", "api")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete plan"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Plan deleted successfully",
+	})
+}
+
+// rebuildUserVPN rebuilds a user's workload and stores what it applied
+func (s *Server) rebuildUserVPN(ctx context.Context, user *models.User, plan *models.Plan) error {
+	if err := s.vpnManager.UpdateUserVPN(ctx, user, plan); err != nil {
+		return err
+	}
+	_, err := store.UpdateApplied(s.store, user)
+	return err
+}
+
+// userPlan returns the plan a user is assigned to, or nil if it has none
+func (s *Server) userPlan(user *models.User) (*models.Plan, error) {
+	if user.Plan == "" {
+		return nil, nil
+	}
+	return s.store.GetPlan(user.Plan)
+}
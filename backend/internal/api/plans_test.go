@@ -0,0 +1,238 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+)
+
+func TestPlanLifecycle(t *testing.T) {
+	provisioner := newFakeProvisioner()
+	provisioner.templates = []string{"dedicated"}
+	router := newTestRouter(newTestServer(t, provisioner, store.NewMemoryStore()))
+
+	basic := models.Plan{Name: "basic", CPULimit: "100m", MemoryLimit: "128Mi", MonthlyDataQuota: 10 << 30}
+	pro := models.Plan{Name: "pro", CPULimit: "500m", MemoryLimit: "512Mi", MaxDevices: 1, PodTemplate: "Dedicated"}
+
+	for _, plan := range []models.Plan{basic, pro} {
+		if w := doRequest(router, http.MethodPost, "/api/v1/plans", plan); w.Code != http.StatusCreated {
+			t.Fatalf("create plan %s: got status %d: %s", plan.Name, w.Code, w.Body)
+		}
+	}
+	if w := doRequest(router, http.MethodPost, "/api/v1/plans", basic); w.Code != http.StatusConflict {
+		t.Fatalf("duplicate plan: got status %d", w.Code)
+	}
+	invalid := models.Plan{Name: "broken", CPURequest: "2", CPULimit: "1"}
+	if w := doRequest(router, http.MethodPost, "/api/v1/plans", invalid); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid plan: got status %d", w.Code)
+	}
+	unknownTemplate := models.Plan{Name: "custom", PodTemplate: "missing"}
+	if w := doRequest(router, http.MethodPost, "/api/v1/plans", unknownTemplate); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `pod template \"missing\" is not defined`) {
+		t.Fatalf("plan with an unknown template: got status %d: %s", w.Code, w.Body)
+	}
+
+	w := doRequest(router, http.MethodGet, "/api/v1/plans", nil)
+	var list struct {
+		Plans []models.Plan `json:"plans"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Plans) != 2 {
+		t.Fatalf("list plans: got %s", w.Body)
+	}
+
+	// Assign a plan on creation
+	w = doRequest(router, http.MethodPost, "/api/v1/users", models.CreateUserRequest{
+		Username: "alice", Email: "alice@example.com", Plan: "basic",
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create user: got status %d: %s", w.Code, w.Body)
+	}
+	var created struct {
+		User models.User `json:"user"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if created.User.Plan != "basic" || provisioner.planOf(created.User.ID) != "basic" {
+		t.Fatalf("plan not applied on create: %+v", created.User)
+	}
+
+	w = doRequest(router, http.MethodPost, "/api/v1/users", models.CreateUserRequest{
+		Username: "bob", Email: "bob@example.com", Plan: "missing",
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("create user with unknown plan: got status %d", w.Code)
+	}
+
+	// Change the plan later
+	w = doRequest(router, http.MethodPut, "/api/v1/users/"+created.User.ID, models.UpdateUserRequest{Plan: "pro"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("update plan: got status %d: %s", w.Code, w.Body)
+	}
+	var updated struct {
+		User models.User `json:"user"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &updated)
+	if updated.User.Plan != "pro" || updated.User.PodTemplate != "dedicated" || provisioner.planOf(created.User.ID) != "pro" {
+		t.Fatalf("plan change not applied: %+v", updated.User)
+	}
+
+	if w := doRequest(router, http.MethodPut, "/api/v1/users/"+created.User.ID, models.UpdateUserRequest{Plan: "missing"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("update to unknown plan: got status %d", w.Code)
+	}
+
+	// Updating a plan rebuilds its users
+	pro.MemoryLimit = "1Gi"
+	w = doRequest(router, http.MethodPut, "/api/v1/plans/pro", pro)
+	var planUpdate struct {
+		Rebuilt int `json:"rebuilt_users"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &planUpdate)
+	if w.Code != http.StatusOK || planUpdate.Rebuilt != 1 {
+		t.Fatalf("update plan: got status %d: %s", w.Code, w.Body)
+	}
+
+	// Plans in use cannot be deleted
+	if w := doRequest(router, http.MethodDelete, "/api/v1/plans/pro", nil); w.Code != http.StatusConflict {
+		t.Fatalf("delete plan in use: got status %d", w.Code)
+	}
+	if w := doRequest(router, http.MethodDelete, "/api/v1/plans/basic", nil); w.Code != http.StatusOK {
+		t.Fatalf("delete unused plan: got status %d", w.Code)
+	}
+	if w := doRequest(router, http.MethodGet, "/api/v1/plans/basic", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("get deleted plan: got status %d", w.Code)
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	router := newTestRouter(newTestServer(t, newFakeProvisioner(), store.NewMemoryStore()))
+
+	alice, _ := createUser(t, router, "alice")
+	createUser(t, router, "bob")
+
+	tests := []struct {
+		name     string
+		req      models.UpdateUserRequest
+		wantCode int
+	}{
+		{"change email", models.UpdateUserRequest{Email: "alice@corp.example.com"}, http.StatusOK},
+		{"invalid email", models.UpdateUserRequest{Email: "not-an-email"}, http.StatusBadRequest},
+		{"invalid status", models.UpdateUserRequest{Status: "deleted"}, http.StatusBadRequest},
+		{"taken username", models.UpdateUserRequest{Username: "bob"}, http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(router, http.MethodPut, "/api/v1/users/"+alice.ID, tt.req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+		})
+	}
+
+	if w := doRequest(router, http.MethodPut, "/api/v1/users/missing", models.UpdateUserRequest{Status: "inactive"}); w.Code != http.StatusNotFound {
+		t.Fatalf("update missing user: got status %d", w.Code)
+	}
+}
+
+func TestUpdateUserBandwidth(t *testing.T) {
+	userStore := store.NewMemoryStore()
+	router := newTestRouter(newTestServer(t, newFakeProvisioner(), userStore))
+
+	plan := models.Plan{Name: "basic", Bandwidth: models.BandwidthLimits{Upload: "5M", Download: "20M"}}
+	doRequest(router, http.MethodPost, "/api/v1/plans", plan)
+	w := doRequest(router, http.MethodPost, "/api/v1/users", models.CreateUserRequest{
+		Username: "alice", Email: "alice@example.com", Plan: "basic",
+	})
+	var created struct {
+		User models.User `json:"user"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	w = doRequest(router, http.MethodPut, "/api/v1/users/"+created.User.ID, models.UpdateUserRequest{
+		Bandwidth: &models.BandwidthLimits{Download: "100M"},
+	})
+	var updated struct {
+		User models.User `json:"user"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &updated)
+	want := models.BandwidthLimits{Upload: "5M", Download: "100M"}
+	if w.Code != http.StatusOK || updated.User.AppliedBandwidth != want {
+		t.Fatalf("got status %d, applied limits %+v, want %+v", w.Code, updated.User.AppliedBandwidth, want)
+	}
+
+	// Clearing the override falls back to the plan
+	w = doRequest(router, http.MethodPut, "/api/v1/users/"+created.User.ID, models.UpdateUserRequest{
+		Bandwidth: &models.BandwidthLimits{},
+	})
+	json.Unmarshal(w.Body.Bytes(), &updated)
+	if updated.User.AppliedBandwidth != plan.Bandwidth {
+		t.Fatalf("got applied limits %+v, want plan limits", updated.User.AppliedBandwidth)
+	}
+
+	if w := doRequest(router, http.MethodPut, "/api/v1/users/"+created.User.ID, models.UpdateUserRequest{
+		Bandwidth: &models.BandwidthLimits{Upload: "-1M"},
+	}); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid limit: got status %d", w.Code)
+	}
+}
+
+func TestUpdateUserRouting(t *testing.T) {
+	userStore := store.NewMemoryStore()
+	router := newTestRouter(newTestServer(t, newFakeProvisioner(), userStore))
+
+	if w := doRequest(router, http.MethodPost, "/api/v1/plans", models.Plan{
+		Name:    "office",
+		Routing: &models.RoutingPolicy{AllowedIPs: []string{"10.0.0.64/26"}},
+	}); w.Code != http.StatusBadRequest {
+		t.Fatalf("plan routing within the tunnel pool: got status %d", w.Code)
+	}
+
+	user, _ := createUser(t, router, "alice")
+	routing := &models.RoutingPolicy{AllowedIPs: []string{"10.20.0.0/16"}, DNS: []string{"10.20.0.53"}}
+	if w := doRequest(router, http.MethodPut, "/api/v1/users/"+user.ID, models.UpdateUserRequest{Routing: routing}); w.Code != http.StatusOK {
+		t.Fatalf("set routing: got status %d: %s", w.Code, w.Body)
+	}
+	if stored, _ := userStore.GetUser(user.ID); stored.Routing == nil || stored.Routing.DNS[0] != "10.20.0.53" {
+		t.Fatalf("routing not stored: %+v", stored.Routing)
+	}
+
+	// An empty policy falls back to the plan
+	doRequest(router, http.MethodPut, "/api/v1/users/"+user.ID, models.UpdateUserRequest{Routing: &models.RoutingPolicy{}})
+	if stored, _ := userStore.GetUser(user.ID); stored.Routing != nil {
+		t.Fatalf("routing not cleared: %+v", stored.Routing)
+	}
+
+	if w := doRequest(router, http.MethodPut, "/api/v1/users/"+user.ID, models.UpdateUserRequest{
+		Routing: &models.RoutingPolicy{AllowedIPs: []string{"10.20.0.0/16"}, DNS: []string{"8.8.8.8"}},
+	}); w.Code != http.StatusBadRequest {
+		t.Fatalf("DNS outside the split tunnel: got status %d", w.Code)
+	}
+}
+
+func TestUpdateUserNetworkPolicy(t *testing.T) {
+	userStore := store.NewMemoryStore()
+	router := newTestRouter(newTestServer(t, newFakeProvisioner(), userStore))
+
+	user, _ := createUser(t, router, "alice")
+	policy := &models.NetworkPolicy{Egress: []models.EgressRule{{Namespaces: []string{"intranet"}, Ports: []models.EgressPort{{Port: 443}}}}}
+	if w := doRequest(router, http.MethodPut, "/api/v1/users/"+user.ID, models.UpdateUserRequest{NetworkPolicy: policy}); w.Code != http.StatusOK {
+		t.Fatalf("set network policy: got status %d: %s", w.Code, w.Body)
+	}
+	if stored, _ := userStore.GetUser(user.ID); stored.NetworkPolicy == nil || stored.NetworkPolicy.Egress[0].Namespaces[0] != "intranet" {
+		t.Fatalf("network policy not stored: %+v", stored.NetworkPolicy)
+	}
+
+	// An empty policy falls back to the plan
+	doRequest(router, http.MethodPut, "/api/v1/users/"+user.ID, models.UpdateUserRequest{NetworkPolicy: &models.NetworkPolicy{}})
+	if stored, _ := userStore.GetUser(user.ID); stored.NetworkPolicy != nil {
+		t.Fatalf("network policy not cleared: %+v", stored.NetworkPolicy)
+	}
+
+	if w := doRequest(router, http.MethodPut, "/api/v1/users/"+user.ID, models.UpdateUserRequest{
+		NetworkPolicy: &models.NetworkPolicy{Egress: []models.EgressRule{{Namespaces: []string{"Not A Namespace"}}}},
+	}); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid namespace: got status %d", w.Code)
+	}
+}
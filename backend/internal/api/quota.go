@@ -0,0 +1,83 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"vpnaas-backend/internal/metrics"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+)
+
+// GetUserQuota returns a user's usage against their data quota
+func (s *Server) GetUserQuota(c *gin.Context) {
+	user, err := s.store.GetUser(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	status, err := s.access.Status(user)
+	if err != nil {
+		metrics.RecordError("storage", "api")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get quota"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"quota": status})
+}
+
+// OverrideUserQuota lets an administrator set a user's own quota, grant extra
+// allowance for the current period or reset the period's usage. A user
+// suspended by their quota is resumed once it has room again.
+func (s *Server) OverrideUserQuota(c *gin.Context) {
+	var req models.QuotaOverrideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := s.access.Apply(requestContext(c), c.Param("id"), func(u *models.User) {
+		if req.DataQuota != nil {
+			u.DataQuota = *req.DataQuota
+		}
+		u.QuotaBonus += req.GrantBytes
+		if req.ResetUsage {
+			u.PeriodUsage = 0
+		}
+		u.UpdatedAt = time.Now()
+	})
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	case err != nil && user != nil:
+		// The override is stored, the VPN is reconciled on the next access check
+		requestLogger(c).Errorf("Failed to update VPN of user %s after quota override: %v", user.Username, err)
+		metrics.RecordError("vpn_update", "api")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Quota updated but failed to update VPN"})
+		return
+	case err != nil:
+		metrics.RecordError("storage", "api")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quota"})
+		return
+	}
+
+	requestLogger(c).Infof("Quota of user %s overridden: %+v", user.Username, req)
+
+	status, err := s.access.Status(user)
+	if err != nil {
+		metrics.RecordError("storage", "api")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get quota"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user":  user,
+		"quota": status,
+	})
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+)
+
+func TestQuotaOverride(t *testing.T) {
+	provisioner := newFakeProvisioner()
+	userStore := store.NewMemoryStore()
+	server := newTestServer(t, provisioner, userStore)
+	router := newTestRouter(server)
+
+	user, code := createUser(t, router, "alice")
+	if code != http.StatusCreated {
+		t.Fatalf("create user: got status %d", code)
+	}
+
+	// Exhaust a personal quota of 1000 bytes
+	quotaBytes := int64(1000)
+	if w := doRequest(router, http.MethodPost, "/api/v1/users/"+user.ID+"/quota", models.QuotaOverrideRequest{DataQuota: &quotaBytes}); w.Code != http.StatusOK {
+		t.Fatalf("set quota: got status %d: %s", w.Code, w.Body)
+	}
+	if _, err := server.access.Apply(context.Background(), user.ID, func(u *models.User) { u.AddDataUsage(1500) }); err != nil {
+		t.Fatalf("record usage: %v", err)
+	}
+	if stored, _ := userStore.GetUser(user.ID); stored.Status != "suspended" || !provisioner.peerRemoved[user.ID] {
+		t.Fatalf("user not suspended: %+v", stored)
+	}
+
+	w := doRequest(router, http.MethodGet, "/api/v1/users/"+user.ID+"/quota", nil)
+	var status struct {
+		Quota models.QuotaStatus `json:"quota"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if w.Code != http.StatusOK || status.Quota.Limit != 1000 || status.Quota.Used != 1500 || !status.Quota.Suspended {
+		t.Fatalf("got quota status %d %+v", w.Code, status.Quota)
+	}
+
+	// Granting extra allowance resumes the user
+	w = doRequest(router, http.MethodPost, "/api/v1/users/"+user.ID+"/quota", models.QuotaOverrideRequest{GrantBytes: 1000})
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if w.Code != http.StatusOK || status.Quota.Remaining != 500 || status.Quota.Suspended {
+		t.Fatalf("grant: got status %d %+v", w.Code, status.Quota)
+	}
+	if stored, _ := userStore.GetUser(user.ID); stored.Status != "active" || provisioner.peerRemoved[user.ID] {
+		t.Fatalf("user not resumed: %+v", stored)
+	}
+
+	// Resetting the counter clears the period's usage but keeps the total
+	doRequest(router, http.MethodPost, "/api/v1/users/"+user.ID+"/quota", models.QuotaOverrideRequest{ResetUsage: true})
+	if stored, _ := userStore.GetUser(user.ID); stored.PeriodUsage != 0 || stored.DataUsage != 1500 {
+		t.Fatalf("usage not reset: %+v", stored)
+	}
+
+	wantEvents := []string{"QuotaExhausted", "Suspended", "Resumed"}
+	if len(provisioner.events) != len(wantEvents) {
+		t.Fatalf("got events %v, want %v", provisioner.events, wantEvents)
+	}
+
+	if w := doRequest(router, http.MethodPost, "/api/v1/users/"+user.ID+"/quota", map[string]int64{"grant_bytes": -1}); w.Code != http.StatusBadRequest {
+		t.Fatalf("negative grant: got status %d", w.Code)
+	}
+	if w := doRequest(router, http.MethodPost, "/api/v1/users/missing/quota", models.QuotaOverrideRequest{}); w.Code != http.StatusNotFound {
+		t.Fatalf("missing user: got status %d", w.Code)
+	}
+}
+
+func TestAdminSuspension(t *testing.T) {
+	provisioner := newFakeProvisioner()
+	userStore := store.NewMemoryStore()
+	router := newTestRouter(newTestServer(t, provisioner, userStore))
+
+	user, _ := createUser(t, router, "alice")
+
+	if w := doRequest(router, http.MethodPut, "/api/v1/users/"+user.ID, models.UpdateUserRequest{Status: "suspended"}); w.Code != http.StatusOK {
+		t.Fatalf("suspend: got status %d: %s", w.Code, w.Body)
+	}
+	stored, _ := userStore.GetUser(user.ID)
+	if stored.SuspendedReason != "admin" || !stored.PeerRemoved || !provisioner.peerRemoved[user.ID] {
+		t.Fatalf("peer not removed on suspension: %+v", stored)
+	}
+
+	// Quota changes do not lift an administrative suspension
+	doRequest(router, http.MethodPost, "/api/v1/users/"+user.ID+"/quota", models.QuotaOverrideRequest{GrantBytes: 1 << 30})
+	if stored, _ := userStore.GetUser(user.ID); stored.Status != "suspended" {
+		t.Fatalf("administrative suspension lifted by quota override")
+	}
+
+	// A failed resume can be retried
+	provisioner.failUpdating = true
+	if w := doRequest(router, http.MethodPut, "/api/v1/users/"+user.ID, models.UpdateUserRequest{Status: "active"}); w.Code != http.StatusInternalServerError {
+		t.Fatalf("failing resume: got status %d", w.Code)
+	}
+	provisioner.failUpdating = false
+	if w := doRequest(router, http.MethodPut, "/api/v1/users/"+user.ID, models.UpdateUserRequest{Status: "active"}); w.Code != http.StatusOK {
+		t.Fatalf("retried resume: got status %d", w.Code)
+	}
+	if provisioner.peerRemoved[user.ID] {
+		t.Fatalf("peer not restored")
+	}
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"vpnaas-backend/internal/audit"
+	"vpnaas-backend/internal/metrics"
+	"vpnaas-backend/internal/reports"
+)
+
+// ListReports summarizes the generated usage reports, newest first
+func (s *Server) ListReports(c *gin.Context) {
+	summaries, err := s.reports.Store().List()
+	if err != nil {
+		requestLogger(c).Errorf("Failed to list usage reports: %v", err)
+		metrics.RecordError("storage", "api")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list usage reports"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"reports": summaries,
+		"total":   len(summaries),
+	})
+}
+
+// CreateReport generates the report of a period that has ended. A period's
+// report is generated once; later requests are refused.
+func (s *Server) CreateReport(c *gin.Context) {
+	var req struct {
+		Period string `json:"period" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.SetTarget(c, req.Period)
+
+	report, err := s.reports.Generate(req.Period)
+	switch {
+	case errors.Is(err, reports.ErrInvalidPeriod), errors.Is(err, reports.ErrPeriodNotEnded):
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, reports.ErrExists):
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Report for %s already exists", req.Period)})
+		return
+	case err != nil:
+		requestLogger(c).Errorf("Failed to generate usage report for %s: %v", req.Period, err)
+		metrics.RecordError("report_generation", "api")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate usage report"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Report generated successfully",
+		"report":  report,
+	})
+}
+
+// GetReport returns the report of a period as JSON, or as CSV with
+// format=csv
+func (s *Server) GetReport(c *gin.Context) {
+	period := c.Param("period")
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+		return
+	}
+
+	report, err := s.reports.Store().Get(period)
+	switch {
+	case errors.Is(err, reports.ErrInvalidPeriod):
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, reports.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+		return
+	case err != nil:
+		requestLogger(c).Errorf("Failed to read usage report for %s: %v", period, err)
+		metrics.RecordError("storage", "api")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read usage report"})
+		return
+	}
+
+	if format == "json" {
+		c.JSON(http.StatusOK, gin.H{"report": report})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=vpnaas-usage-%s.csv", period))
+	c.Header("Content-Type", "text/csv")
+	c.Status(http.StatusOK)
+	if err := reports.WriteCSV(c.Writer, report); err != nil {
+		requestLogger(c).Warnf("Report export aborted: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"vpnaas-backend/internal/history"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/reports"
+	"vpnaas-backend/internal/store"
+)
+
+func TestReports(t *testing.T) {
+	userStore := store.NewMemoryStore()
+	userStore.CreatePlan(&models.Plan{Name: "pro", HourlyRate: 0.5})
+	server := newTestServer(t, newFakeProvisioner(), userStore)
+	router := newTestRouter(server)
+
+	march := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	server.history.Append([]history.Sample{
+		{Time: march, UserID: "u1", Username: "alice", Tenant: "acme", Plan: "pro", Provisioned: true, DataUsage: 100, ActiveConnections: 1},
+		{Time: march.Add(time.Hour), UserID: "u1", Username: "alice", Tenant: "acme", Plan: "pro", Provisioned: true, DataUsage: 600},
+	})
+
+	current := reports.PeriodOf(time.Now())
+	tests := []struct {
+		name       string
+		period     string
+		wantStatus int
+	}{
+		{name: "ended period", period: "2024-03", wantStatus: http.StatusCreated},
+		{name: "generated once", period: "2024-03", wantStatus: http.StatusConflict},
+		{name: "current period", period: current, wantStatus: http.StatusBadRequest},
+		{name: "invalid period", period: "March", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(router, http.MethodPost, "/api/v1/reports", map[string]string{"period": tt.period})
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+		})
+	}
+
+	w := doRequest(router, http.MethodGet, "/api/v1/reports/2024-03", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get: got status %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Report reports.Report `json:"report"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	if total := resp.Report.Total; total.DataBytes != 500 || total.ConnectedHours != 1 || total.PodHours != 2 || total.Cost != 1 {
+		t.Errorf("got total %+v", total)
+	}
+
+	w = doRequest(router, http.MethodGet, "/api/v1/reports/2024-03?format=csv", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("csv: got status %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/csv" {
+		t.Errorf("got content type %q", got)
+	}
+	if !strings.Contains(w.Body.String(), "user,u1,alice,acme,pro,500,1.00,2.00,1.00") {
+		t.Errorf("got CSV without alice's row:\n%s", w.Body.String())
+	}
+
+	if w := doRequest(router, http.MethodGet, "/api/v1/reports/2024-03?format=xml", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := doRequest(router, http.MethodGet, "/api/v1/reports/2024-04", nil); w.Code != http.StatusNotFound {
+		t.Errorf("missing report: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	w = doRequest(router, http.MethodGet, "/api/v1/reports", nil)
+	var list struct {
+		Reports []reports.Summary `json:"reports"`
+		Total   int               `json:"total"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("decode list: %v", err)
+	}
+	if list.Total != 1 || list.Reports[0].Period != "2024-03" {
+		t.Errorf("got reports %+v", list.Reports)
+	}
+}
@@ -2,47 +2,77 @@ package api
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 
-	"vpnaas-backend/internal/k8s"
+	"vpnaas-backend/internal/access"
+	"vpnaas-backend/internal/audit"
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/history"
+	"vpnaas-backend/internal/logging"
 	"vpnaas-backend/internal/metrics"
 	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/reports"
+	"vpnaas-backend/internal/store"
 )
 
+// VPNProvisioner manages the VPN resources backing a user
+type VPNProvisioner interface {
+	CreateUserVPN(ctx context.Context, user *models.User, plan *models.Plan) error
+	UpdateUserVPN(ctx context.Context, user *models.User, plan *models.Plan) error
+	DeleteUserVPN(ctx context.Context, user *models.User) ([]models.ResourceRef, error)
+	GetPodStatus(ctx context.Context, user *models.User) (string, error)
+	UpdatePodMetrics(ctx context.Context) (models.PodStats, error)
+	RolloutImage(ctx context.Context, image string) ([]string, error)
+	RolloutUserVPN(ctx context.Context, user *models.User, plan *models.Plan) (bool, error)
+	ApplyConfig(ctx context.Context, cfg config.VPNConfig) error
+	EgressProfiles() []models.EgressProfile
+	PodTemplateNames() []string
+}
+
 // Server represents the API server
 type Server struct {
-	vpnManager *k8s.VPNManager
-	users      map[string]*models.User // In-memory storage for demo
+	vpnManager VPNProvisioner
+	store      store.Store
+	access     *access.Enforcer
+	audit      audit.Log
+	history    history.Store
+	reports    *reports.Generator
+
+	// config is swapped by ApplyConfig when the configuration is reloaded
+	config atomic.Pointer[config.Config]
+	// rollout runs and reports rollouts of the configuration
+	rollout configRollout
+
+	snapshotMu sync.RWMutex
+	snapshot   *MetricsSnapshot
 }
 
 // NewServer creates a new API server
-func NewServer(vpnManager *k8s.VPNManager) *Server {
-	return &Server{
+func NewServer(vpnManager VPNProvisioner, userStore store.Store, enforcer *access.Enforcer, auditLog audit.Log, usageHistory history.Store, reportGenerator *reports.Generator, cfg *config.Config) *Server {
+	s := &Server{
 		vpnManager: vpnManager,
-		users:      make(map[string]*models.User),
+		store:      userStore,
+		access:     enforcer,
+		audit:      auditLog,
+		history:    usageHistory,
+		reports:    reportGenerator,
 	}
+	s.config.Store(cfg)
+	return s
 }
 
 // ListUsers returns all users
 func (s *Server) ListUsers(c *gin.Context) {
-	start := time.Now()
-	defer func() {
-		metrics.RecordAPIRequestDuration("GET", "/users", time.Since(start).Seconds())
-	}()
-
-	users := make([]*models.User, 0, len(s.users))
-	for _, user := range s.users {
-		users = append(users, user)
-	}
+	users := s.store.ListUsers()
 
-	// Update metrics
-	s.updateUserMetrics()
-
-	metrics.RecordAPIRequest("GET", "/users", "200")
 	c.JSON(http.StatusOK, gin.H{
 		"users": users,
 		"total": len(users),
@@ -51,50 +81,120 @@ func (s *Server) ListUsers(c *gin.Context) {
 
 // CreateUser creates a new user
 func (s *Server) CreateUser(c *gin.Context) {
-	start := time.Now()
-	defer func() {
-		metrics.RecordAPIRequestDuration("POST", "/users", time.Since(start).Seconds())
-	}()
-
 	var req models.CreateUserRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		metrics.RecordAPIRequest("POST", "/users", "400")
 		metrics.RecordError("validation", "api")
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Check if user already exists
-	for _, user := range s.users {
-		if user.Username == req.Username || user.Email == req.Email {
-			metrics.RecordAPIRequest("POST", "/users", "409")
+	if err := validateAccess(req.ExpiresAt, req.AccessSchedule); err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validatePolicies(req.Routing, req.NetworkPolicy); err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.validateEgressProfile(req.EgressProfile); err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Create new user, reserving the username and email before provisioning
+	// so concurrent requests for the same user cannot both succeed
+	user := models.NewUser(req.Username, req.Email)
+	// Tenants select pod templates, whose names are not case-sensitive
+	user.Tenant = strings.ToLower(req.Tenant)
+	user.Plan = req.Plan
+	if !req.Routing.IsZero() {
+		user.Routing = req.Routing
+	}
+	if !req.NetworkPolicy.IsZero() {
+		user.NetworkPolicy = req.NetworkPolicy
+	}
+	user.EgressProfile = req.EgressProfile
+	user.ExpiresAt = req.ExpiresAt
+	user.AccessSchedule = req.AccessSchedule
+	plan, err := s.userPlan(user)
+	if err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Plan not found"})
+		return
+	}
+
+	if err := s.store.CreateUser(user); err != nil {
+		if errors.Is(err, store.ErrConflict) {
 			metrics.RecordError("duplicate_user", "api")
 			c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
 			return
 		}
+		if errors.Is(err, store.ErrPlanNotFound) {
+			metrics.RecordError("validation", "api")
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Plan not found"})
+			return
+		}
+		if errors.Is(err, store.ErrTunnelPoolExhausted) {
+			metrics.RecordError("tunnel_pool", "api")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No tunnel address available"})
+			return
+		}
+		metrics.RecordError("storage", "api")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store user"})
+		return
 	}
 
-	// Create new user
-	user := models.NewUser(req.Username, req.Email)
-
 	// Create VPN pod
-	ctx := context.Background()
-	if err := s.vpnManager.CreateUserVPN(ctx, user); err != nil {
-		logrus.Errorf("Failed to create VPN for user %s: %v", user.Username, err)
-		metrics.RecordAPIRequest("POST", "/users", "500")
+	ctx := requestContext(c)
+	if err := s.vpnManager.CreateUserVPN(ctx, user, plan); err != nil {
+		requestLogger(c).Errorf("Failed to create VPN for user %s: %v", user.Username, err)
+		// Remove whatever was created before the failure
+		if _, err := s.vpnManager.DeleteUserVPN(ctx, user); err != nil {
+			requestLogger(c).Errorf("Failed to clean up VPN for user %s: %v", user.Username, err)
+		}
+		if _, err := s.store.DeleteUser(user.ID); err != nil && !errors.Is(err, store.ErrNotFound) {
+			requestLogger(c).Errorf("Failed to release user %s: %v", user.Username, err)
+		}
 		metrics.RecordError("vpn_creation", "api")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create VPN"})
 		return
 	}
 
-	// Store user
-	s.users[user.ID] = user
+	// Store the provisioned state
+	stored, err := s.store.UpdateUser(user.ID, func(u *models.User) error {
+		*u = *user
+		return nil
+	})
+	if err != nil {
+		// The user was deleted while its VPN was being provisioned
+		requestLogger(c).Warnf("User %s removed during provisioning: %v", user.Username, err)
+		if _, err := s.vpnManager.DeleteUserVPN(ctx, user); err != nil {
+			requestLogger(c).Errorf("Failed to delete VPN for user %s: %v", user.Username, err)
+		}
+		metrics.RecordError("vpn_creation", "api")
+		c.JSON(http.StatusConflict, gin.H{"error": "User was deleted during creation"})
+		return
+	}
+	user = stored
+	audit.SetTarget(c, user.ID)
+
+	// Suspend users created outside their access schedule right away
+	if user.AccessSchedule != nil && s.access != nil {
+		enforced, err := s.access.Apply(ctx, user.ID, nil)
+		if err != nil {
+			requestLogger(c).Errorf("Failed to enforce access of user %s: %v", user.Username, err)
+		}
+		if enforced != nil {
+			user = enforced
+		}
+	}
 
 	// Update metrics
-	s.updateUserMetrics()
-	metrics.IncrementConnections()
+	s.updateUserMetrics(s.store.ListUsers())
 
-	metrics.RecordAPIRequest("POST", "/users", "201")
 	c.JSON(http.StatusCreated, gin.H{
 		"user":    user,
 		"message": "User created successfully",
@@ -103,83 +203,189 @@ func (s *Server) CreateUser(c *gin.Context) {
 
 // GetUser returns a specific user
 func (s *Server) GetUser(c *gin.Context) {
-	start := time.Now()
-	defer func() {
-		metrics.RecordAPIRequestDuration("GET", "/users/:id", time.Since(start).Seconds())
-	}()
-
 	userID := c.Param("id")
-	user, exists := s.users[userID]
-	if !exists {
-		metrics.RecordAPIRequest("GET", "/users/:id", "404")
+	user, err := s.store.GetUser(userID)
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
-	// Get pod status
-	if user.PodName != "" {
-		ctx := context.Background()
-		status, err := s.vpnManager.GetPodStatus(ctx, user.PodName)
+	// Get pod status. The user is a private copy, so the stored status is
+	// left untouched.
+	if user.WorkloadName != "" {
+		ctx := requestContext(c)
+		status, err := s.vpnManager.GetPodStatus(ctx, user)
 		if err == nil {
 			user.Status = status
 		}
 	}
 
-	metrics.RecordAPIRequest("GET", "/users/:id", "200")
 	c.JSON(http.StatusOK, gin.H{"user": user})
 }
 
+// UpdateUser updates a user's details and plan. Changing the plan rebuilds
+// the user's VPN workload with the plan's resources, changing the egress
+// profile moves it onto the profile's nodes.
+func (s *Server) UpdateUser(c *gin.Context) {
+	var req models.UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Bandwidth != nil {
+		if err := req.Bandwidth.Validate(); err != nil {
+			metrics.RecordError("validation", "api")
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := validatePolicies(req.Routing, req.NetworkPolicy); err != nil {
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.EgressProfile != nil {
+		if err := s.validateEgressProfile(*req.EgressProfile); err != nil {
+			metrics.RecordError("validation", "api")
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	user, err := s.store.UpdateUser(c.Param("id"), func(u *models.User) error {
+		if req.Username != "" {
+			u.Username = req.Username
+		}
+		if req.Email != "" {
+			u.Email = req.Email
+		}
+		if req.Status != "" && req.Status != u.Status {
+			// Users suspended here stay suspended until resumed here
+			u.Status = req.Status
+			u.SuspendedReason = ""
+			if req.Status == "suspended" {
+				u.SuspendedReason = models.SuspendedByAdmin
+			}
+		}
+		if req.Plan != "" {
+			u.Plan = req.Plan
+		}
+		if req.Bandwidth != nil {
+			u.Bandwidth = *req.Bandwidth
+		}
+		if req.Routing != nil {
+			u.Routing = nil
+			if !req.Routing.IsZero() {
+				u.Routing = req.Routing
+			}
+		}
+		if req.NetworkPolicy != nil {
+			u.NetworkPolicy = nil
+			if !req.NetworkPolicy.IsZero() {
+				u.NetworkPolicy = req.NetworkPolicy
+			}
+		}
+		if req.EgressProfile != nil {
+			u.EgressProfile = *req.EgressProfile
+		}
+		u.UpdatedAt = time.Now()
+		return nil
+	})
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	case errors.Is(err, store.ErrConflict):
+		metrics.RecordError("duplicate_user", "api")
+		c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+		return
+	case errors.Is(err, store.ErrPlanNotFound):
+		metrics.RecordError("validation", "api")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Plan not found"})
+		return
+	case err != nil:
+		metrics.RecordError("storage", "api")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+
+	// Rebuild the workload whenever a plan, limits or policies are given or
+	// the peer does not match the status, so a failed rebuild can be retried
+	// by repeating the request
+	peerMismatch := user.PeerRemoved != (user.Status == "suspended")
+	policyChanged := req.Routing != nil || req.NetworkPolicy != nil || req.EgressProfile != nil
+	if (req.Plan != "" || req.Bandwidth != nil || policyChanged || peerMismatch) && user.WorkloadName != "" {
+		plan, err := s.userPlan(user)
+		if err == nil {
+			err = s.rebuildUserVPN(requestContext(c), user, plan)
+		}
+		if err != nil {
+			requestLogger(c).Errorf("Failed to update VPN of user %s: %v", user.Username, err)
+			metrics.RecordError("vpn_update", "api")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update VPN"})
+			return
+		}
+		if updated, err := s.store.GetUser(user.ID); err == nil {
+			user = updated
+		}
+	}
+
+	s.updateUserMetrics(s.store.ListUsers())
+
+	c.JSON(http.StatusOK, gin.H{
+		"user":    user,
+		"message": "User updated successfully",
+	})
+}
+
 // DeleteUser deletes a user
 func (s *Server) DeleteUser(c *gin.Context) {
-	start := time.Now()
-	defer func() {
-		metrics.RecordAPIRequestDuration("DELETE", "/users/:id", time.Since(start).Seconds())
-	}()
-
+	// Remove user from storage first so that only one request tears down
+	// the VPN
 	userID := c.Param("id")
-	user, exists := s.users[userID]
-	if !exists {
-		metrics.RecordAPIRequest("DELETE", "/users/:id", "404")
+	user, err := s.store.DeleteUser(userID)
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
-	// Delete VPN pod
-	ctx := context.Background()
-	if err := s.vpnManager.DeleteUserVPN(ctx, user); err != nil {
-		logrus.Errorf("Failed to delete VPN for user %s: %v", user.Username, err)
+	// Delete VPN resources
+	ctx := requestContext(c)
+	removed, err := s.vpnManager.DeleteUserVPN(ctx, user)
+	if err != nil {
+		requestLogger(c).Errorf("Failed to delete VPN for user %s: %v", user.Username, err)
 		metrics.RecordError("vpn_deletion", "api")
 	}
-
-	// Remove user from storage
-	delete(s.users, userID)
+	if removed == nil {
+		removed = []models.ResourceRef{}
+	}
 
 	// Update metrics
-	s.updateUserMetrics()
+	s.updateUserMetrics(s.store.ListUsers())
 
-	metrics.RecordAPIRequest("DELETE", "/users/:id", "200")
-	c.JSON(http.StatusOK, gin.H{
-		"message": "User deleted successfully",
-	})
+	response := gin.H{
+		"message":           "User deleted successfully",
+		"removed_resources": removed,
+	}
+	if err != nil {
+		response["cleanup_error"] = err.Error()
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
 // GetUserConfig returns the VPN configuration for a user
 func (s *Server) GetUserConfig(c *gin.Context) {
-	start := time.Now()
-	defer func() {
-		metrics.RecordAPIRequestDuration("GET", "/users/:id/config", time.Since(start).Seconds())
-	}()
-
 	userID := c.Param("id")
-	user, exists := s.users[userID]
-	if !exists {
-		metrics.RecordAPIRequest("GET", "/users/:id/config", "404")
+	user, err := s.store.GetUser(userID)
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
 	if user.ConfigData == "" {
-		metrics.RecordAPIRequest("GET", "/users/:id/config", "404")
 		c.JSON(http.StatusNotFound, gin.H{"error": "VPN configuration not found"})
 		return
 	}
@@ -188,53 +394,70 @@ func (s *Server) GetUserConfig(c *gin.Context) {
 	c.Header("Content-Disposition", "attachment; filename=vpn-"+user.Username+".conf")
 	c.Header("Content-Type", "text/plain")
 
-	metrics.RecordAPIRequest("GET", "/users/:id/config", "200")
 	c.String(http.StatusOK, user.ConfigData)
 }
 
-// GetMetrics returns system metrics
-func (s *Server) GetMetrics(c *gin.Context) {
-	start := time.Now()
-	defer func() {
-		metrics.RecordAPIRequestDuration("GET", "/metrics", time.Since(start).Seconds())
-	}()
-
-	// Update pod metrics
-	ctx := context.Background()
-	if err := s.vpnManager.UpdatePodMetrics(ctx); err != nil {
-		logrus.Errorf("Failed to update pod metrics: %v", err)
+// RolloutVPNs rolls a new image out to every VPN workload
+func (s *Server) RolloutVPNs(c *gin.Context) {
+	var req models.RolloutRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			metrics.RecordError("validation", "api")
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 	}
 
-	// Update user metrics
-	s.updateUserMetrics()
+	ctx := requestContext(c)
+	updated, err := s.vpnManager.RolloutImage(ctx, req.Image)
+	result := &models.RolloutResult{
+		Image:   req.Image,
+		Updated: updated,
+	}
+	if err != nil {
+		requestLogger(c).Errorf("Failed to roll out VPN image: %v", err)
+		metrics.RecordError("vpn_rollout", "api")
+		result.Errors = []string{err.Error()}
+		if len(updated) == 0 {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to roll out VPN image", "rollout": result})
+			return
+		}
+	}
 
-	metrics.RecordAPIRequest("GET", "/metrics", "200")
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Metrics updated successfully",
-	})
+	c.JSON(http.StatusOK, gin.H{"rollout": result})
 }
 
 // GetStats returns system statistics
 func (s *Server) GetStats(c *gin.Context) {
-	start := time.Now()
-	defer func() {
-		metrics.RecordAPIRequestDuration("GET", "/stats", time.Since(start).Seconds())
-	}()
+	stats := s.calculateStats(s.store.ListUsers())
 
-	stats := s.calculateStats()
-
-	metrics.RecordAPIRequest("GET", "/stats", "200")
 	c.JSON(http.StatusOK, gin.H{
 		"stats": stats,
 	})
 }
 
-// updateUserMetrics updates user-related metrics
-func (s *Server) updateUserMetrics() {
-	total := len(s.users)
+// validatePolicies checks the routing and network policies given for a user
+func validatePolicies(routing *models.RoutingPolicy, network *models.NetworkPolicy) error {
+	if routing != nil {
+		if err := routing.Validate(); err != nil {
+			return err
+		}
+	}
+	if network != nil {
+		if err := network.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateUserMetrics updates user-related metrics, including the usage
+// aggregates and per-user series
+func (s *Server) updateUserMetrics(users []*models.User) {
+	total := len(users)
 	active, inactive, suspended := 0, 0, 0
 
-	for _, user := range s.users {
+	for _, user := range users {
 		switch user.Status {
 		case "active":
 			active++
@@ -246,13 +469,14 @@ func (s *Server) updateUserMetrics() {
 	}
 
 	metrics.UpdateUserMetrics(total, active, inactive, suspended)
+	metrics.UpdateUsageMetrics(users, s.currentConfig().Metrics.PerUser)
 }
 
 // calculateStats calculates system statistics
-func (s *Server) calculateStats() *models.UserStats {
+func (s *Server) calculateStats(users []*models.User) *models.UserStats {
 	stats := &models.UserStats{}
 
-	for _, user := range s.users {
+	for _, user := range users {
 		stats.TotalUsers++
 		stats.TotalDataUsage += user.DataUsage
 		stats.TotalConnections += user.ConnectionCount
@@ -269,3 +493,16 @@ func (s *Server) calculateStats() *models.UserStats {
 
 	return stats
 }
+
+// requestContext returns the context for the work of a request. It carries
+// the request's trace but is not cancelled when the client goes away, so
+// that provisioning and its cleanup run to completion.
+func requestContext(c *gin.Context) context.Context {
+	return context.WithoutCancel(c.Request.Context())
+}
+
+// requestLogger returns the logger of a request, which tags every line with
+// the request's ID
+func requestLogger(c *gin.Context) *logrus.Entry {
+	return logging.FromContext(c.Request.Context())
+}
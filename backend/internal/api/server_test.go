@@ -0,0 +1,488 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"vpnaas-backend/internal/access"
+	"vpnaas-backend/internal/audit"
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/history"
+	"vpnaas-backend/internal/logging"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/reports"
+	"vpnaas-backend/internal/store"
+)
+
+// fakeProvisioner is an in-memory VPNProvisioner that tracks live VPNs
+type fakeProvisioner struct {
+	mu           sync.Mutex
+	vpns         map[string]bool
+	plans        map[string]string
+	peerRemoved  map[string]bool
+	events       []string
+	profiles     []models.EgressProfile
+	templates    []string
+	created      int
+	deleted      int
+	failUpdating bool
+	failRollout  map[string]bool
+	unchanged    map[string]bool
+	blockRollout chan struct{}
+	rolledOut    []string
+	applied      []config.VPNConfig
+
+	failPodMetrics bool
+	failApply      bool
+}
+
+func newFakeProvisioner() *fakeProvisioner {
+	return &fakeProvisioner{
+		vpns:        make(map[string]bool),
+		plans:       make(map[string]string),
+		peerRemoved: make(map[string]bool),
+		failRollout: make(map[string]bool),
+		unchanged:   make(map[string]bool),
+	}
+}
+
+// newTestServer returns a server backed by the provisioner and store
+func newTestServer(t *testing.T, provisioner *fakeProvisioner, userStore store.Store) *Server {
+	t.Helper()
+	cfg := config.Default()
+	enforcer, err := access.NewEnforcer(userStore, provisioner, provisioner, cfg.Quota)
+	if err != nil {
+		t.Fatalf("create enforcer: %v", err)
+	}
+	usageHistory := history.NewMemoryStore()
+	generator := reports.NewGenerator(reports.NewMemoryStore(), usageHistory, userStore, cfg.History)
+	return NewServer(provisioner, userStore, enforcer, audit.NewMemoryLog(), usageHistory, generator, cfg)
+}
+
+func (f *fakeProvisioner) CreateUserVPN(ctx context.Context, user *models.User, plan *models.Plan) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if plan != nil {
+		f.plans[user.ID] = plan.Name
+	}
+	user.WorkloadName = "vpn-" + user.ID
+	user.PodName = "vpn-" + user.ID
+	user.PublicKey = "public-" + user.ID
+	user.PrivateKey = "private-" + user.ID
+	user.ConfigData = "[Interface]\n"
+	f.vpns[user.ID] = true
+	f.created++
+	return nil
+}
+
+func (f *fakeProvisioner) UpdateUserVPN(ctx context.Context, user *models.User, plan *models.Plan) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.vpns[user.ID] {
+		return fmt.Errorf("vpn for user %s not found", user.ID)
+	}
+	if f.failUpdating {
+		return fmt.Errorf("apiserver unavailable")
+	}
+	user.PeerRemoved = user.Status == "suspended"
+	f.peerRemoved[user.ID] = user.PeerRemoved
+	user.EgressIP = ""
+	for _, profile := range f.profiles {
+		if profile.Name == user.EgressProfile {
+			user.EgressIP = profile.PublicIP
+		}
+	}
+	f.plans[user.ID] = ""
+	user.AppliedBandwidth = user.Bandwidth
+	if plan != nil {
+		f.plans[user.ID] = plan.Name
+		user.PodTemplate = plan.PodTemplate
+		if user.AppliedBandwidth.Upload == "" {
+			user.AppliedBandwidth.Upload = plan.Bandwidth.Upload
+		}
+		if user.AppliedBandwidth.Download == "" {
+			user.AppliedBandwidth.Download = plan.Bandwidth.Download
+		}
+	}
+	return nil
+}
+
+func (f *fakeProvisioner) RecordUserEvent(user *models.User, eventType, reason, message string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, reason)
+}
+
+func (f *fakeProvisioner) planOf(userID string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.plans[userID]
+}
+
+func (f *fakeProvisioner) DeleteUserVPN(ctx context.Context, user *models.User) ([]models.ResourceRef, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.vpns[user.ID] {
+		return nil, fmt.Errorf("vpn for user %s not found", user.ID)
+	}
+	delete(f.vpns, user.ID)
+	f.deleted++
+	return []models.ResourceRef{{Kind: "Deployment", Name: "vpn-" + user.ID}}, nil
+}
+
+func (f *fakeProvisioner) GetPodStatus(ctx context.Context, user *models.User) (string, error) {
+	return "Running", nil
+}
+
+func (f *fakeProvisioner) UpdatePodMetrics(ctx context.Context) (models.PodStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failPodMetrics {
+		return models.PodStats{}, fmt.Errorf("apiserver down")
+	}
+	running := 0
+	for _, live := range f.vpns {
+		if live {
+			running++
+		}
+	}
+	return models.PodStats{Running: running}, nil
+}
+
+func (f *fakeProvisioner) RolloutImage(ctx context.Context, image string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	updated := make([]string, 0, len(f.vpns))
+	for id := range f.vpns {
+		updated = append(updated, "vpn-"+id)
+	}
+	return updated, nil
+}
+
+func (f *fakeProvisioner) RolloutUserVPN(ctx context.Context, user *models.User, plan *models.Plan) (bool, error) {
+	f.mu.Lock()
+	block := f.blockRollout
+	f.mu.Unlock()
+	if block != nil {
+		select {
+		case <-block:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+
+	if err := f.UpdateUserVPN(ctx, user, plan); err != nil {
+		return false, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failRollout[user.ID] {
+		return false, fmt.Errorf("timed out waiting for VPN deployment %s to roll out", user.WorkloadName)
+	}
+	if f.unchanged[user.ID] {
+		return false, nil
+	}
+	user.ConfigData = "[Interface]\n# rolled out\n"
+	f.rolledOut = append(f.rolledOut, user.WorkloadName)
+	return true, nil
+}
+
+func (f *fakeProvisioner) ApplyConfig(ctx context.Context, cfg config.VPNConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failApply {
+		return fmt.Errorf("default egress profile %q is not defined", cfg.DefaultEgressProfile)
+	}
+	f.applied = append(f.applied, cfg)
+	return nil
+}
+
+func (f *fakeProvisioner) EgressProfiles() []models.EgressProfile {
+	return f.profiles
+}
+
+func (f *fakeProvisioner) PodTemplateNames() []string {
+	return f.templates
+}
+
+func (f *fakeProvisioner) live() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.vpns)
+}
+
+func newTestRouter(server *Server) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(logging.Middleware())
+	apiGroup := router.Group("/api/v1")
+	apiGroup.Use(audit.Middleware(server.audit, server.currentConfig().Audit))
+	apiGroup.GET("/users", server.ListUsers)
+	apiGroup.POST("/users", server.CreateUser)
+	apiGroup.GET("/users/:id", server.GetUser)
+	apiGroup.PUT("/users/:id", server.UpdateUser)
+	apiGroup.DELETE("/users/:id", server.DeleteUser)
+	apiGroup.GET("/users/:id/config", server.GetUserConfig)
+	apiGroup.GET("/users/:id/quota", server.GetUserQuota)
+	apiGroup.POST("/users/:id/quota", server.OverrideUserQuota)
+	apiGroup.PUT("/users/:id/access", server.UpdateUserAccess)
+	apiGroup.GET("/egress-profiles", server.ListEgressProfiles)
+	apiGroup.GET("/plans", server.ListPlans)
+	apiGroup.POST("/plans", server.CreatePlan)
+	apiGroup.GET("/plans/:name", server.GetPlan)
+	apiGroup.PUT("/plans/:name", server.UpdatePlan)
+	apiGroup.DELETE("/plans/:name", server.DeletePlan)
+	apiGroup.POST("/vpn/rollout", server.RolloutVPNs)
+	apiGroup.POST("/config/rollout", server.RolloutVPNConfig)
+	apiGroup.GET("/config/rollout", server.GetVPNConfigRollout)
+	apiGroup.GET("/metrics", server.GetMetrics)
+	apiGroup.GET("/stats", server.GetStats)
+	apiGroup.GET("/stats/history", server.GetStatsHistory)
+	apiGroup.GET("/reports", server.ListReports)
+	apiGroup.POST("/reports", server.CreateReport)
+	apiGroup.GET("/reports/:period", server.GetReport)
+	apiGroup.GET("/audit", server.ListAudit)
+	apiGroup.GET("/audit/export", server.ExportAudit)
+	return router
+}
+
+func doRequest(router http.Handler, method, path string, body interface{}) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func createUser(t *testing.T, router http.Handler, username string) (*models.User, int) {
+	t.Helper()
+
+	w := doRequest(router, http.MethodPost, "/api/v1/users", models.CreateUserRequest{
+		Username: username,
+		Email:    username + "@example.com",
+	})
+	if w.Code != http.StatusCreated {
+		return nil, w.Code
+	}
+
+	var resp struct {
+		User *models.User `json:"user"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Errorf("decode create response: %v", err)
+		return nil, w.Code
+	}
+	return resp.User, w.Code
+}
+
+func TestCreateGetDeleteUser(t *testing.T) {
+	provisioner := newFakeProvisioner()
+	router := newTestRouter(newTestServer(t, provisioner, store.NewMemoryStore()))
+
+	user, code := createUser(t, router, "alice")
+	if code != http.StatusCreated {
+		t.Fatalf("create: got status %d, want %d", code, http.StatusCreated)
+	}
+	if user.PodName == "" {
+		t.Fatalf("create: expected provisioned pod name")
+	}
+
+	if _, code := createUser(t, router, "alice"); code != http.StatusConflict {
+		t.Fatalf("duplicate create: got status %d, want %d", code, http.StatusConflict)
+	}
+
+	for _, path := range []string{"/api/v1/users", "/api/v1/users/" + user.ID} {
+		w := doRequest(router, http.MethodGet, path, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("get %s: got status %d, want %d", path, w.Code, http.StatusOK)
+		}
+		// Only the audited config download hands out the client's secrets
+		if body := w.Body.String(); strings.Contains(body, "private-"+user.ID) || strings.Contains(body, "[Interface]") {
+			t.Fatalf("get %s exposes the client configuration: %s", path, body)
+		}
+	}
+	if w := doRequest(router, http.MethodGet, "/api/v1/users/"+user.ID+"/config", nil); w.Code != http.StatusOK {
+		t.Fatalf("config: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	w := doRequest(router, http.MethodDelete, "/api/v1/users/"+user.ID, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	var deleted struct {
+		Removed []models.ResourceRef `json:"removed_resources"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &deleted); err != nil {
+		t.Fatalf("decode delete response: %v", err)
+	}
+	if len(deleted.Removed) != 1 || deleted.Removed[0].Name != "vpn-"+user.ID {
+		t.Fatalf("unexpected removed resources %+v", deleted.Removed)
+	}
+	if w := doRequest(router, http.MethodGet, "/api/v1/users/"+user.ID, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("get after delete: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if live := provisioner.live(); live != 0 {
+		t.Fatalf("expected no live VPNs, got %d", live)
+	}
+}
+
+func TestGetUserDoesNotMutateStoredUser(t *testing.T) {
+	userStore := store.NewMemoryStore()
+	router := newTestRouter(newTestServer(t, newFakeProvisioner(), userStore))
+
+	user, code := createUser(t, router, "bob")
+	if code != http.StatusCreated {
+		t.Fatalf("create: got status %d", code)
+	}
+
+	doRequest(router, http.MethodGet, "/api/v1/users/"+user.ID, nil)
+
+	stored, err := userStore.GetUser(user.ID)
+	if err != nil {
+		t.Fatalf("get stored user: %v", err)
+	}
+	if stored.Status != "active" {
+		t.Fatalf("stored status changed to %q", stored.Status)
+	}
+}
+
+// TestConcurrentHandlers hammers the handlers in parallel. Run with -race.
+func TestConcurrentHandlers(t *testing.T) {
+	provisioner := newFakeProvisioner()
+	router := newTestRouter(newTestServer(t, provisioner, store.NewMemoryStore()))
+
+	const workers = 16
+	const perWorker = 20
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				user, code := createUser(t, router, fmt.Sprintf("user-%d-%d", worker, i))
+				if code != http.StatusCreated {
+					t.Errorf("create: got status %d", code)
+					continue
+				}
+
+				doRequest(router, http.MethodGet, "/api/v1/users/"+user.ID, nil)
+				doRequest(router, http.MethodGet, "/api/v1/users", nil)
+				doRequest(router, http.MethodGet, "/api/v1/stats", nil)
+
+				if i%2 == 0 {
+					if w := doRequest(router, http.MethodDelete, "/api/v1/users/"+user.ID, nil); w.Code != http.StatusOK {
+						t.Errorf("delete: got status %d", w.Code)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	w := doRequest(router, http.MethodGet, "/api/v1/users", nil)
+	var resp struct {
+		Total int `json:"total"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode list response: %v", err)
+	}
+
+	want := workers * perWorker / 2
+	if resp.Total != want {
+		t.Fatalf("got %d users, want %d", resp.Total, want)
+	}
+	if live := provisioner.live(); live != want {
+		t.Fatalf("got %d live VPNs, want %d", live, want)
+	}
+}
+
+// TestConcurrentDuplicateCreates checks that only one of several racing
+// creates for the same username succeeds
+func TestConcurrentDuplicateCreates(t *testing.T) {
+	provisioner := newFakeProvisioner()
+	router := newTestRouter(newTestServer(t, provisioner, store.NewMemoryStore()))
+
+	const attempts = 16
+	codes := make(chan int, attempts)
+
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, code := createUser(t, router, "carol")
+			codes <- code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Errorf("unexpected status %d", code)
+		}
+	}
+
+	if created != 1 {
+		t.Fatalf("got %d successful creates, want 1", created)
+	}
+	if live := provisioner.live(); live != 1 {
+		t.Fatalf("got %d live VPNs, want 1", live)
+	}
+}
+
+// TestConcurrentDeletes checks that racing deletes tear the VPN down once
+func TestConcurrentDeletes(t *testing.T) {
+	provisioner := newFakeProvisioner()
+	router := newTestRouter(newTestServer(t, provisioner, store.NewMemoryStore()))
+
+	user, code := createUser(t, router, "dave")
+	if code != http.StatusCreated {
+		t.Fatalf("create: got status %d", code)
+	}
+
+	const attempts = 8
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doRequest(router, http.MethodDelete, "/api/v1/users/"+user.ID, nil)
+		}()
+	}
+	wg.Wait()
+
+	provisioner.mu.Lock()
+	deleted := provisioner.deleted
+	provisioner.mu.Unlock()
+	if deleted != 1 {
+		t.Fatalf("VPN deleted %d times, want 1", deleted)
+	}
+}
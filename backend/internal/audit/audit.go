@@ -0,0 +1,108 @@
+// Package audit records who performed which administrative action on what,
+// from where and with which outcome
+package audit
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Outcomes of an audited action
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeDenied  = "denied"
+)
+
+// Record is a single audited action
+type Record struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target,omitempty"`
+	SourceIP  string    `json:"source_ip"`
+	RequestID string    `json:"request_id"`
+	Outcome   string    `json:"outcome"`
+	Status    int       `json:"status"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+}
+
+// Filter selects records. Empty fields match every record.
+type Filter struct {
+	Actor   string
+	Action  string
+	Target  string
+	Outcome string
+	Since   time.Time // inclusive
+	Until   time.Time // exclusive
+}
+
+// Match reports whether a record passes the filter
+func (f Filter) Match(r Record) bool {
+	switch {
+	case f.Actor != "" && r.Actor != f.Actor:
+		return false
+	case f.Action != "" && r.Action != f.Action:
+		return false
+	case f.Target != "" && r.Target != f.Target:
+		return false
+	case f.Outcome != "" && r.Outcome != f.Outcome:
+		return false
+	case !f.Since.IsZero() && r.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !r.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// Log stores audit records. Implementations are safe for concurrent use.
+type Log interface {
+	// Append stores a record durably before returning
+	Append(record Record) error
+	// Query returns the records passing the filter, oldest first
+	Query(filter Filter) ([]Record, error)
+}
+
+// ErrInvalidRecord is returned when appending a record without an action
+var ErrInvalidRecord = errors.New("audit record has no action")
+
+// MemoryLog is a Log that keeps records in memory only
+type MemoryLog struct {
+	mu      sync.RWMutex
+	records []Record
+}
+
+// NewMemoryLog creates an empty in-memory log
+func NewMemoryLog() *MemoryLog {
+	return &MemoryLog{}
+}
+
+// Append stores a record
+func (l *MemoryLog) Append(record Record) error {
+	if record.Action == "" {
+		return ErrInvalidRecord
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, record)
+	return nil
+}
+
+// Query returns the matching records, oldest first
+func (l *MemoryLog) Query(filter Filter) ([]Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var records []Record
+	for _, record := range l.records {
+		if filter.Match(record) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
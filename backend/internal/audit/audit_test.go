@@ -0,0 +1,102 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	record := Record{Actor: "alice", Action: "user.delete", Target: "42", Outcome: OutcomeSuccess, Time: at}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   bool
+	}{
+		{"empty filter", Filter{}, true},
+		{"all fields", Filter{Actor: "alice", Action: "user.delete", Target: "42", Outcome: OutcomeSuccess}, true},
+		{"other actor", Filter{Actor: "bob"}, false},
+		{"other action", Filter{Action: "user.create"}, false},
+		{"other target", Filter{Target: "7"}, false},
+		{"other outcome", Filter{Outcome: OutcomeFailure}, false},
+		{"since is inclusive", Filter{Since: at}, true},
+		{"since later", Filter{Since: at.Add(time.Second)}, false},
+		{"until is exclusive", Filter{Until: at}, false},
+		{"until later", Filter{Until: at.Add(time.Second)}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Match(record); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileLog(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "audit")
+	path := filepath.Join(dir, "backend-0.jsonl")
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	log, err := NewFileLog(dir, "backend-0")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := log.Append(Record{}); err != ErrInvalidRecord {
+		t.Fatalf("got %v for record without action, want ErrInvalidRecord", err)
+	}
+	for i, action := range []string{"user.create", "user.delete"} {
+		record := Record{ID: action, Action: action, Actor: "alice", Time: at.Add(time.Duration(2*i) * time.Minute)}
+		if err := log.Append(record); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	log.Close()
+
+	// Simulate a crash in the middle of a record
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	file.WriteString(`{"id":"partial","act`)
+	file.Close()
+
+	// Records survive reopening and a record cut short is skipped without
+	// damaging the next one
+	log, err = NewFileLog(dir, "backend-0")
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer log.Close()
+	if err := log.Append(Record{ID: "plan.create", Action: "plan.create", Actor: "bob", Time: at.Add(3 * time.Minute)}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	// Records of another replica sharing the directory are merged in order
+	other, err := NewFileLog(dir, "backend-1")
+	if err != nil {
+		t.Fatalf("open second log: %v", err)
+	}
+	defer other.Close()
+	if err := other.Append(Record{ID: "vpn.rollout", Action: "vpn.rollout", Actor: "bob", Time: at.Add(time.Minute)}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	records, err := log.Query(Filter{})
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	var ids []string
+	for _, record := range records {
+		ids = append(ids, record.ID)
+	}
+	if len(ids) != 4 || ids[0] != "user.create" || ids[1] != "vpn.rollout" || ids[2] != "user.delete" || ids[3] != "plan.create" {
+		t.Fatalf("got records %v", ids)
+	}
+
+	records, _ = log.Query(Filter{Actor: "alice", Action: "user.delete"})
+	if len(records) != 1 || records[0].ID != "user.delete" {
+		t.Fatalf("filtered query got %+v", records)
+	}
+}
@@ -0,0 +1,139 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fileSuffix ends the name of every audit log file
+const fileSuffix = ".jsonl"
+
+// FileLog is a Log appending records as JSON lines to a file of its own in a
+// directory, synced to disk after every record. Replicas sharing the
+// directory each write their own file; queries merge all of them. Queries
+// scan the files, so memory use does not grow with the log.
+type FileLog struct {
+	mu   sync.Mutex
+	dir  string
+	file *os.File
+}
+
+// NewFileLog opens the log file named name in dir, creating both if needed
+func NewFileLog(dir, name string) (*FileLog, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %v", err)
+	}
+	path := filepath.Join(dir, name+fileSuffix)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	if err := terminateLastLine(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to repair audit log: %v", err)
+	}
+	return &FileLog{dir: dir, file: file}, nil
+}
+
+// terminateLastLine ends a record cut short by a crash with a newline, so
+// that it does not swallow the next record
+func terminateLastLine(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	_, err = file.Write([]byte{'\n'})
+	return err
+}
+
+// Append writes a record and syncs it to disk
+func (l *FileLog) Append(record Record) error {
+	if record.Action == "" {
+		return ErrInvalidRecord
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.file.Write(line); err != nil {
+		return fmt.Errorf("failed to write audit record: %v", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync audit log: %v", err)
+	}
+	return nil
+}
+
+// Query scans every log file in the directory for matching records, oldest
+// first
+func (l *FileLog) Query(filter Filter) ([]Record, error) {
+	paths, err := filepath.Glob(filepath.Join(l.dir, "*"+fileSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for _, path := range paths {
+		matched, err := readRecords(path, filter)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, matched...)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return records, nil
+}
+
+// readRecords returns the matching records of a file. Lines that cannot be
+// decoded, such as one cut short by a crash, are skipped.
+func readRecords(path string, filter Filter) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			logrus.Warnf("Skipping unreadable audit record in %s on line %d: %v", filepath.Base(path), line, err)
+			continue
+		}
+		if filter.Match(record) {
+			records = append(records, record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log %s: %v", filepath.Base(path), err)
+	}
+	return records, nil
+}
+
+// Close closes the log file
+func (l *FileLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,136 @@
+package audit
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/logging"
+	"vpnaas-backend/internal/metrics"
+)
+
+const (
+	// RequestIDHeader carries the ID of a request
+	RequestIDHeader = logging.RequestIDHeader
+	// unauthenticated is the actor of requests that name no user
+	unauthenticated = "unauthenticated"
+	// claimedPrefix marks actors named by a header nothing vouches for
+	claimedPrefix = "claimed:"
+	targetKey     = "audit.target"
+)
+
+// actions names the audited routes. Mutating routes missing here are
+// recorded under their method and path.
+var actions = map[string]string{
+	"POST /api/v1/users":           "user.create",
+	"PUT /api/v1/users/:id":        "user.update",
+	"DELETE /api/v1/users/:id":     "user.delete",
+	"GET /api/v1/users/:id/config": "user.config.download",
+	"POST /api/v1/users/:id/quota": "user.quota.override",
+	"PUT /api/v1/users/:id/access": "user.access.update",
+	"POST /api/v1/plans":           "plan.create",
+	"PUT /api/v1/plans/:name":      "plan.update",
+	"DELETE /api/v1/plans/:name":   "plan.delete",
+	"POST /api/v1/vpn/rollout":     "vpn.rollout",
+	"POST /api/v1/config/rollout":  "config.rollout",
+	"POST /api/v1/reports":         "report.generate",
+	"GET /api/v1/reports/:period":  "report.download",
+}
+
+// SetTarget names the object a request acted on when the route does not,
+// such as the ID of a user just created
+func SetTarget(c *gin.Context, target string) {
+	c.Set(targetKey, target)
+}
+
+// Middleware records every mutating request and every config and report
+// download once it has been handled. The actor is taken from the
+// audit.actor_header header. Any client can send it, so it is recorded as
+// claimed:<user> unless audit.trust_actor_header says a gateway
+// authenticates callers and overwrites it. A record that cannot be stored is
+// logged; the request has already taken effect by then.
+func Middleware(log Log, cfg config.AuditConfig) gin.HandlerFunc {
+	actorHeader := cfg.ActorHeader
+	if actorHeader == "" {
+		actorHeader = "X-Forwarded-User"
+	}
+
+	return func(c *gin.Context) {
+		// The logging middleware assigns request IDs in front of this one
+		requestID := logging.RequestID(c.Request.Context())
+		if requestID == "" {
+			requestID = uuid.New().String()
+			c.Header(RequestIDHeader, requestID)
+		}
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+		action, audited := actions[c.Request.Method+" "+route]
+		if !audited {
+			if !mutating(c.Request.Method) {
+				return
+			}
+			action = c.Request.Method + " " + route
+		}
+
+		actor := c.GetHeader(actorHeader)
+		switch {
+		case actor == "":
+			actor = unauthenticated
+		case !cfg.TrustActorHeader:
+			actor = claimedPrefix + actor
+		}
+		target := c.GetString(targetKey)
+		if target == "" {
+			target = c.Param("id")
+		}
+		if target == "" {
+			target = c.Param("name")
+		}
+
+		record := Record{
+			ID:        uuid.New().String(),
+			Time:      time.Now().UTC(),
+			Actor:     actor,
+			Action:    action,
+			Target:    target,
+			SourceIP:  c.ClientIP(),
+			RequestID: requestID,
+			Outcome:   outcome(c.Writer.Status()),
+			Status:    c.Writer.Status(),
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+		}
+		if err := log.Append(record); err != nil {
+			logging.FromContext(c.Request.Context()).Errorf("Failed to record audit event %s %s by %s: %v", action, target, actor, err)
+			metrics.RecordError("audit_write", "audit")
+		}
+	}
+}
+
+// mutating reports whether a request method changes state
+func mutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// outcome classifies a response status
+func outcome(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return OutcomeDenied
+	case status >= http.StatusBadRequest:
+		return OutcomeFailure
+	}
+	return OutcomeSuccess
+}
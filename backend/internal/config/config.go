@@ -1,60 +1,326 @@
+// Package config reads the backend's configuration at startup from
+// config.yaml and VPNAAS_* environment variables into a Config, which is
+// validated as a whole and handed to the components that need it. Watch
+// reloads it when the file changes.
 package config
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
+
+	"vpnaas-backend/internal/models"
 )
 
-// Load initializes configuration from environment variables and config files
-func Load() error {
-	// Set default values
-	viper.SetDefault("server.port", "8080")
-	viper.SetDefault("server.host", "0.0.0.0")
-	viper.SetDefault("debug", false)
-	viper.SetDefault("vpn.wireguard_port", "51820")
-	viper.SetDefault("vpn.pod_cpu_limit", "100m")
-	viper.SetDefault("vpn.pod_memory_limit", "128Mi")
-	viper.SetDefault("vpn.pod_cpu_request", "50m")
-	viper.SetDefault("vpn.pod_memory_request", "64Mi")
-	viper.SetDefault("vpn.image", "linuxserver/wireguard:latest")
-	viper.SetDefault("k8s.namespace", "vpnaas")
-	viper.SetDefault("k8s.pod_labels", map[string]string{
-		"app": "vpnaas",
-		"component": "vpn",
-	})
+// Config is the complete backend configuration
+type Config struct {
+	Debug   bool          `mapstructure:"debug"`
+	Server  ServerConfig  `mapstructure:"server"`
+	Log     LogConfig     `mapstructure:"log"`
+	VPN     VPNConfig     `mapstructure:"vpn"`
+	K8s     K8sConfig     `mapstructure:"k8s"`
+	Usage   UsageConfig   `mapstructure:"usage"`
+	Metrics MetricsConfig `mapstructure:"metrics"`
+	Health  HealthConfig  `mapstructure:"health"`
+	Quota   QuotaConfig   `mapstructure:"quota"`
+	Access  AccessConfig  `mapstructure:"access"`
+	Audit   AuditConfig   `mapstructure:"audit"`
+	History HistoryConfig `mapstructure:"history"`
+	Reports ReportsConfig `mapstructure:"reports"`
+	Tracing TracingConfig `mapstructure:"tracing"`
+	Reload  ReloadConfig  `mapstructure:"reload"`
+}
+
+// ServerConfig is where the API listens
+type ServerConfig struct {
+	Host string `mapstructure:"host"`
+	Port int    `mapstructure:"port"`
+}
+
+// LogConfig selects the log format and level
+type LogConfig struct {
+	Format string `mapstructure:"format"` // "text" or "json"
+	Level  string `mapstructure:"level"`
+}
+
+// VPNConfig describes the VPN workloads and the configs handed to users
+type VPNConfig struct {
+	Endpoint           string        `mapstructure:"endpoint"` // public host name or IP of the VPN service
+	WireGuardPort      int           `mapstructure:"wireguard_port"`
+	Image              string        `mapstructure:"image"`
+	PodCPURequest      string        `mapstructure:"pod_cpu_request"`
+	PodCPULimit        string        `mapstructure:"pod_cpu_limit"`
+	PodMemoryRequest   string        `mapstructure:"pod_memory_request"`
+	PodMemoryLimit     string        `mapstructure:"pod_memory_limit"`
+	ServiceType        string        `mapstructure:"service_type"`
+	ReadyTimeout       time.Duration `mapstructure:"ready_timeout"`
+	ContainerName      string        `mapstructure:"container_name"`
+	ConfigMountPath    string        `mapstructure:"config_mount_path"`
+	WireGuardInterface string        `mapstructure:"wireguard_interface"`
+	DualStack          bool          `mapstructure:"dual_stack"`
+	ClusterCIDRs       []string      `mapstructure:"cluster_cidrs"`
+
+	PodTemplate          string            `mapstructure:"pod_template"`
+	PodTemplateConfigMap string            `mapstructure:"pod_template_configmap"`
+	PodTemplates         map[string]string `mapstructure:"pod_templates"`
+	TenantPodTemplates   map[string]string `mapstructure:"tenant_pod_templates"`
+
+	NodePoolLabel        string                          `mapstructure:"node_pool_label"`
+	DefaultEgressProfile string                          `mapstructure:"default_egress_profile"`
+	EgressProfiles       map[string]models.EgressProfile `mapstructure:"egress_profiles"`
+}
+
+// K8sConfig locates the cluster and the namespace VPN workloads live in
+type K8sConfig struct {
+	Namespace  string `mapstructure:"namespace"`
+	Kubeconfig string `mapstructure:"kubeconfig"` // used outside of a cluster
+}
+
+// UsageConfig sets how often usage is collected from the VPN pods
+type UsageConfig struct {
+	CollectInterval time.Duration `mapstructure:"collect_interval"`
+}
+
+// MetricsConfig sets how gauges are refreshed and which per-user series are
+// exported
+type MetricsConfig struct {
+	RefreshInterval time.Duration  `mapstructure:"refresh_interval"`
+	PerUser         PerUserMetrics `mapstructure:"per_user"`
+}
+
+// PerUserMetrics selects the per-user usage series
+type PerUserMetrics struct {
+	Mode     string `mapstructure:"mode"` // "off", "all" or "top_n"
+	TopN     int    `mapstructure:"top_n"`
+	Username string `mapstructure:"username"` // "plain", "hashed" or "omit"
+}
+
+// HealthConfig bounds the readiness checks
+type HealthConfig struct {
+	CheckTimeout time.Duration `mapstructure:"check_timeout"`
+}
+
+// QuotaConfig sets when data quotas reset
+type QuotaConfig struct {
+	ResetPeriod string `mapstructure:"reset_period"` // "daily", "weekly" or "monthly"
+}
+
+// AccessConfig sets how often expiry, quotas and schedules are enforced
+type AccessConfig struct {
+	CheckInterval     time.Duration `mapstructure:"check_interval"`
+	ExpiryGracePeriod time.Duration `mapstructure:"expiry_grace_period"`
+}
 
-	// Read from environment variables
-	viper.SetEnvPrefix("VPNAAS")
-	viper.AutomaticEnv()
+// AuditConfig locates the audit log and the header naming the caller
+type AuditConfig struct {
+	Dir              string `mapstructure:"dir"`
+	ActorHeader      string `mapstructure:"actor_header"`
+	TrustActorHeader bool   `mapstructure:"trust_actor_header"` // only behind a gateway that sets it
+}
+
+// HistoryConfig sets where and how often usage is sampled and how long
+// samples are kept
+type HistoryConfig struct {
+	Dir            string        `mapstructure:"dir"`
+	SampleInterval time.Duration `mapstructure:"sample_interval"`
+	RawRetention   time.Duration `mapstructure:"raw_retention"`
+	Resolution     time.Duration `mapstructure:"resolution"`
+	Retention      time.Duration `mapstructure:"retention"`
+}
 
-	// Read from config file
-	viper.SetConfigName("config")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath(".")
-	viper.AddConfigPath("./config")
-	viper.AddConfigPath("/etc/vpnaas")
+// ReportsConfig locates the usage reports
+type ReportsConfig struct {
+	Dir string `mapstructure:"dir"`
+}
 
-	// Ignore config file not found error
-	viper.ReadInConfig()
+// TracingConfig sets where spans are exported
+type TracingConfig struct {
+	Enabled     bool    `mapstructure:"enabled"`
+	Endpoint    string  `mapstructure:"endpoint"` // host:port of an OTLP/HTTP collector
+	Insecure    bool    `mapstructure:"insecure"`
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+	ServiceName string  `mapstructure:"service_name"`
+}
 
-	return nil
+// ReloadConfig sets whether changes to config.yaml are applied without a
+// restart and whether VPN workloads are then rolled to them
+type ReloadConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	Rollout bool `mapstructure:"rollout"`
 }
 
-// GetString returns a string configuration value
-func GetString(key string) string {
-	return viper.GetString(key)
+// setDefaults registers the default of every setting. Settings without a
+// default cannot be overridden from the environment.
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("debug", false)
+	v.SetDefault("server.host", "0.0.0.0")
+	v.SetDefault("server.port", 8080)
+	v.SetDefault("log.format", "text")
+	v.SetDefault("log.level", "info")
+	v.SetDefault("vpn.endpoint", "")
+	v.SetDefault("vpn.wireguard_port", 51820)
+	v.SetDefault("vpn.image", "linuxserver/wireguard:latest")
+	v.SetDefault("vpn.pod_cpu_request", "50m")
+	v.SetDefault("vpn.pod_cpu_limit", "100m")
+	v.SetDefault("vpn.pod_memory_request", "64Mi")
+	v.SetDefault("vpn.pod_memory_limit", "128Mi")
+	v.SetDefault("vpn.service_type", "ClusterIP")
+	v.SetDefault("vpn.ready_timeout", "2m")
+	v.SetDefault("vpn.container_name", "wireguard")
+	v.SetDefault("vpn.config_mount_path", "/config/wg_confs")
+	v.SetDefault("vpn.wireguard_interface", "wg0")
+	v.SetDefault("vpn.dual_stack", false)
+	v.SetDefault("vpn.cluster_cidrs", []string{})
+	v.SetDefault("vpn.pod_template", "")
+	v.SetDefault("vpn.pod_template_configmap", "")
+	v.SetDefault("vpn.node_pool_label", "node-pool")
+	v.SetDefault("vpn.default_egress_profile", "")
+	v.SetDefault("k8s.namespace", "vpnaas")
+	v.SetDefault("k8s.kubeconfig", "")
+	v.SetDefault("usage.collect_interval", "1m")
+	v.SetDefault("metrics.refresh_interval", "30s")
+	v.SetDefault("metrics.per_user.mode", "off")
+	v.SetDefault("metrics.per_user.top_n", 20)
+	v.SetDefault("metrics.per_user.username", "hashed")
+	v.SetDefault("health.check_timeout", "5s")
+	v.SetDefault("quota.reset_period", "monthly")
+	v.SetDefault("access.check_interval", "1m")
+	v.SetDefault("access.expiry_grace_period", "168h")
+	v.SetDefault("audit.dir", "/var/lib/vpnaas/audit")
+	v.SetDefault("audit.actor_header", "X-Forwarded-User")
+	v.SetDefault("audit.trust_actor_header", false)
+	v.SetDefault("history.dir", "/var/lib/vpnaas/history")
+	v.SetDefault("history.sample_interval", "5m")
+	v.SetDefault("history.raw_retention", "48h")
+	v.SetDefault("history.resolution", "1h")
+	v.SetDefault("history.retention", "2160h")
+	v.SetDefault("reports.dir", "/var/lib/vpnaas/reports")
+	v.SetDefault("tracing.enabled", false)
+	v.SetDefault("tracing.endpoint", "localhost:4318")
+	v.SetDefault("tracing.insecure", true)
+	v.SetDefault("tracing.sample_ratio", 1.0)
+	v.SetDefault("tracing.service_name", "vpnaas-backend")
+	v.SetDefault("reload.enabled", true)
+	v.SetDefault("reload.rollout", false)
 }
 
-// GetInt returns an integer configuration value
-func GetInt(key string) int {
-	return viper.GetInt(key)
+// Default returns the configuration made of the defaults alone. It is not
+// validated: it has no VPN endpoint, for one.
+func Default() *Config {
+	v := viper.New()
+	setDefaults(v)
+	cfg, _, err := decode(v)
+	if err != nil {
+		panic(fmt.Sprintf("invalid default configuration: %v", err))
+	}
+	return cfg
 }
 
-// GetBool returns a boolean configuration value
-func GetBool(key string) bool {
-	return viper.GetBool(key)
+// Load reads the configuration from the first config.yaml found in the
+// working directory, ./config or /etc/vpnaas, overridden by VPNAAS_*
+// environment variables such as VPNAAS_VPN_ENDPOINT, and validates it. A
+// missing file is fine; one that cannot be read or parsed is not.
+func Load() (*Config, error) {
+	v := newViper()
+	if err := v.ReadInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if !errors.As(err, &notFound) {
+			return nil, fmt.Errorf("failed to read configuration: %v", err)
+		}
+	}
+
+	return load(v)
 }
 
-// GetStringMap returns a string map configuration value
-func GetStringMap(key string) map[string]interface{} {
-	return viper.GetStringMap(key)
+// Watch calls onChange with the reloaded configuration, or the reason it is
+// invalid, whenever the config.yaml Load reads from changes. A mounted
+// ConfigMap is updated by swapping a symlink, which is followed. It returns
+// the path of the watched file, and an error if there is none to watch.
+func Watch(onChange func(cfg *Config, err error)) (string, error) {
+	v := newViper()
+	if err := v.ReadInConfig(); err != nil {
+		return "", fmt.Errorf("no configuration file to watch: %v", err)
+	}
+
+	v.OnConfigChange(func(fsnotify.Event) {
+		// viper keeps the previous settings when the new file cannot be
+		// parsed; read it again to report why
+		if err := v.ReadInConfig(); err != nil {
+			onChange(nil, fmt.Errorf("failed to read configuration: %v", err))
+			return
+		}
+		onChange(load(v))
+	})
+	v.WatchConfig()
+	return v.ConfigFileUsed(), nil
+}
+
+// newViper returns a viper instance with the defaults, environment and
+// config.yaml locations Load and Watch read from
+func newViper() *viper.Viper {
+	v := viper.New()
+	setDefaults(v)
+
+	v.SetEnvPrefix("VPNAAS")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+
+	v.SetConfigName("config")
+	v.SetConfigType("yaml")
+	v.AddConfigPath(".")
+	v.AddConfigPath("./config")
+	v.AddConfigPath("/etc/vpnaas")
+	return v
+}
+
+// LoadYAML reads and validates a configuration from YAML on top of the
+// defaults, without consulting files or the environment
+func LoadYAML(yaml string) (*Config, error) {
+	v := viper.New()
+	setDefaults(v)
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(strings.NewReader(yaml)); err != nil {
+		return nil, fmt.Errorf("failed to parse configuration: %v", err)
+	}
+	return load(v)
+}
+
+// load decodes and validates the configuration held by v. Settings that do
+// not exist, typically misspelt ones, are reported with the invalid values.
+func load(v *viper.Viper) (*Config, error) {
+	cfg, unused, err := decode(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode configuration: %v", err)
+	}
+
+	var problems []string
+	for _, key := range unused {
+		problems = append(problems, fmt.Sprintf("%s: unknown setting", key))
+	}
+	problems = append(problems, cfg.problems()...)
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	return cfg, nil
+}
+
+// decode unmarshals the settings of v and returns the keys that match no
+// field
+func decode(v *viper.Viper) (*Config, []string, error) {
+	var cfg Config
+	var metadata mapstructure.Metadata
+	err := v.Unmarshal(&cfg, func(dc *mapstructure.DecoderConfig) {
+		dc.Metadata = &metadata
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(metadata.Unused)
+	return &cfg, metadata.Unused, nil
 }
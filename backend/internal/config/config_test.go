@@ -0,0 +1,226 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestLoadShippedConfig(t *testing.T) {
+	raw, err := os.ReadFile(filepath.Join("..", "..", "..", "k8s", "configmap.yaml"))
+	if err != nil {
+		t.Fatalf("read ConfigMap: %v", err)
+	}
+	var cm corev1.ConfigMap
+	if err := yaml.Unmarshal(raw, &cm); err != nil {
+		t.Fatalf("decode ConfigMap: %v", err)
+	}
+
+	cfg, err := LoadYAML(cm.Data["config.yaml"])
+	if err != nil {
+		t.Fatalf("shipped configuration is invalid: %v", err)
+	}
+	if cfg.Server.Port != 8080 || cfg.VPN.WireGuardPort != 51820 || cfg.VPN.ReadyTimeout != 2*time.Minute {
+		t.Errorf("got server %+v, VPN %+v", cfg.Server, cfg.VPN)
+	}
+	// IPv6 needs sysctls that are not shipped, so it is opt-in
+	if cfg.VPN.DualStack || Default().VPN.DualStack {
+		t.Errorf("dual-stack tunnels enabled by default")
+	}
+}
+
+func TestLoadYAML(t *testing.T) {
+	const valid = "vpn:\n  endpoint: vpn.example.com\n  cluster_cidrs: [10.244.0.0/16]\n"
+
+	tests := []struct {
+		name         string
+		yaml         string
+		wantProblems []string
+	}{
+		{name: "defaults with an endpoint", yaml: valid},
+		{name: "IPv6 endpoint", yaml: "vpn:\n  endpoint: \"2001:db8::1\"\n  cluster_cidrs: [10.244.0.0/16]\n"},
+		{
+			name:         "missing endpoint and cluster networks",
+			yaml:         "server:\n  port: 8080\n",
+			wantProblems: []string{"vpn.endpoint: is required", "vpn.cluster_cidrs: is required"},
+		},
+		{
+			name: "endpoint with scheme and port",
+			yaml: "vpn:\n  endpoint: \"https://vpn.example.com:51820\"\n  cluster_cidrs: [10.244.0.0/16]\n",
+			wantProblems: []string{
+				`vpn.endpoint: "https://vpn.example.com:51820" must be a host name or IP address without scheme or port`,
+			},
+		},
+		{
+			name:         "misspelt setting",
+			yaml:         valid + "  pod_cpu_limt: 200m\n",
+			wantProblems: []string{"vpn.pod_cpu_limt: unknown setting"},
+		},
+		{
+			name:         "misspelt egress profile field",
+			yaml:         valid + "  egress_profiles:\n    partner-a:\n      node_pol: egress-a\n      public_ip: 203.0.113.10\n",
+			wantProblems: []string{"vpn.egress_profiles[partner-a].node_pol: unknown setting"},
+		},
+		{
+			name: "every problem is reported",
+			yaml: "server:\n  port: 0\n" +
+				"vpn:\n  endpoint: vpn.example.com\n  wireguard_port: 70000\n  image: \"Wire Guard\"\n" +
+				"  pod_cpu_limit: 100 millicores\n  pod_memory_request: 1Gi\n  service_type: External\n" +
+				"  cluster_cidrs: [\"10.244.0.0/16\", \"10.96.0.0/33\"]\n" +
+				"quota:\n  reset_period: yearly\n" +
+				"history:\n  retention: 1h\n" +
+				"tracing:\n  enabled: true\n  endpoint: \"http://collector\"\n  sample_ratio: 2\n",
+			wantProblems: []string{
+				"server.port: port 0 is not between 1 and 65535",
+				"vpn.wireguard_port: port 70000 is not between 1 and 65535",
+				`vpn.image: "Wire Guard" is not an image reference`,
+				`vpn.pod_cpu_limit: "100 millicores" is not a quantity`,
+				"vpn.pod_memory_request: 1Gi exceeds vpn.pod_memory_limit 128Mi",
+				`vpn.service_type: "External" is not ClusterIP, NodePort or LoadBalancer`,
+				"vpn.cluster_cidrs[1]:",
+				`quota.reset_period: invalid quota reset period "yearly"`,
+				"history.retention: 1h0m0s is shorter than history.raw_retention 48h0m0s",
+				`tracing.endpoint: "http://collector" is not host:port`,
+				"tracing.sample_ratio: 2 is not between 0 and 1",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadYAML(tt.yaml)
+			if len(tt.wantProblems) == 0 {
+				if err != nil {
+					t.Fatalf("got error %v", err)
+				}
+				if cfg.VPN.Image != "linuxserver/wireguard:latest" {
+					t.Errorf("got image %q, want the default", cfg.VPN.Image)
+				}
+				return
+			}
+
+			var invalid *ValidationError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("got error %v, want a ValidationError", err)
+			}
+			if len(invalid.Problems) != len(tt.wantProblems) {
+				t.Errorf("got %d problems, want %d:\n%v", len(invalid.Problems), len(tt.wantProblems), err)
+			}
+			for _, want := range tt.wantProblems {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error does not report %q:\n%v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	config := "vpn:\n  endpoint: vpn.example.com\n  cluster_cidrs: [10.244.0.0/16]\n  pod_cpu_limit: 200m\n"
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(config), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	t.Setenv("VPNAAS_SERVER_PORT", "9090")
+	t.Setenv("VPNAAS_VPN_WIREGUARD_PORT", "51821")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Server.Port != 9090 || cfg.VPN.WireGuardPort != 51821 {
+		t.Errorf("environment not applied: server port %d, WireGuard port %d", cfg.Server.Port, cfg.VPN.WireGuardPort)
+	}
+	if cfg.VPN.PodCPULimit != "200m" || cfg.VPN.Endpoint != "vpn.example.com" {
+		t.Errorf("config file not applied: %+v", cfg.VPN)
+	}
+
+	// A file that exists but cannot be parsed is an error
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("vpn: [\n"), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "failed to read configuration") {
+		t.Errorf("got error %v for an unparsable file", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	// Replace the file in one step, as the kubelet does with a ConfigMap,
+	// so that each change is noticed once
+	write := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(path+".tmp", []byte(config), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			t.Fatalf("replace config: %v", err)
+		}
+	}
+	write("vpn:\n  endpoint: vpn.example.com\n  cluster_cidrs: [10.244.0.0/16]\n")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	type reload struct {
+		cfg *Config
+		err error
+	}
+	reloads := make(chan reload, 10)
+	watched, err := Watch(func(cfg *Config, err error) { reloads <- reload{cfg, err} })
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	if filepath.Base(watched) != "config.yaml" {
+		t.Errorf("got watched file %s", watched)
+	}
+
+	next := func() reload {
+		t.Helper()
+		select {
+		case r := <-reloads:
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatalf("configuration change not noticed")
+			return reload{}
+		}
+	}
+
+	write("vpn:\n  endpoint: vpn2.example.com\n  cluster_cidrs: [10.244.0.0/16]\n")
+	if r := next(); r.err != nil || r.cfg.VPN.Endpoint != "vpn2.example.com" {
+		t.Errorf("got %+v, %v after a valid change", r.cfg, r.err)
+	}
+
+	write("vpn:\n  endpoint: \"\"\n")
+	var invalid *ValidationError
+	if r := next(); !errors.As(r.err, &invalid) {
+		t.Errorf("got error %v, want a ValidationError", r.err)
+	}
+
+	write("vpn: [\n")
+	if r := next(); r.err == nil || !strings.Contains(r.err.Error(), "failed to read configuration") {
+		t.Errorf("got error %v for an unparsable file", r.err)
+	}
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Change is a setting whose value differs between two configurations
+type Change struct {
+	Key string
+	Old string
+	New string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Key, c.Old, c.New)
+}
+
+// restartOnly lists the settings below otherwise live sections that are
+// only read at startup
+var restartOnly = map[string]bool{
+	"vpn.ready_timeout":       true,
+	"vpn.container_name":      true,
+	"vpn.config_mount_path":   true,
+	"vpn.wireguard_interface": true,
+}
+
+// RequiresRestart reports whether a change to key only takes effect when the
+// backend restarts. Logging, reload.rollout and most vpn.* settings are
+// applied as they change.
+func RequiresRestart(key string) bool {
+	switch {
+	case key == "debug", key == "reload.rollout", strings.HasPrefix(key, "log."):
+		return false
+	case strings.HasPrefix(key, "vpn."):
+		return restartOnly[key]
+	}
+	return true
+}
+
+// Reloaded returns the configuration in effect once next has been loaded
+// while c is: next's settings, except those that require a restart, which
+// keep c's values
+func (c *Config) Reloaded(next *Config) *Config {
+	reloaded := *c
+	reloaded.Debug = next.Debug
+	reloaded.Log = next.Log
+	reloaded.Reload.Rollout = next.Reload.Rollout
+	reloaded.VPN = next.VPN
+	reloaded.VPN.ReadyTimeout = c.VPN.ReadyTimeout
+	reloaded.VPN.ContainerName = c.VPN.ContainerName
+	reloaded.VPN.ConfigMountPath = c.VPN.ConfigMountPath
+	reloaded.VPN.WireGuardInterface = c.VPN.WireGuardInterface
+	return &reloaded
+}
+
+// Diff returns the settings that differ between before and after, keyed like
+// the configuration file with map entries in brackets, e.g.
+// vpn.egress_profiles[partner-a].public_ip, sorted by key
+func Diff(before, after *Config) []Change {
+	var changes []Change
+	diff(&changes, "", reflect.ValueOf(*before), reflect.ValueOf(*after))
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// diff walks before and after, which have the same type, down to their
+// settings
+func diff(changes *[]Change, key string, before, after reflect.Value) {
+	switch before.Kind() {
+	case reflect.Struct:
+		for i := 0; i < before.NumField(); i++ {
+			name := strings.Split(before.Type().Field(i).Tag.Get("mapstructure"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			if key != "" {
+				name = key + "." + name
+			}
+			diff(changes, name, before.Field(i), after.Field(i))
+		}
+	case reflect.Map:
+		keys := map[string]reflect.Value{}
+		for _, k := range append(before.MapKeys(), after.MapKeys()...) {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		for name, k := range keys {
+			diff(changes, fmt.Sprintf("%s[%s]", key, name), mapIndex(before, k), mapIndex(after, k))
+		}
+	default:
+		if !reflect.DeepEqual(before.Interface(), after.Interface()) {
+			*changes = append(*changes, Change{Key: key, Old: format(before), New: format(after)})
+		}
+	}
+}
+
+// mapIndex returns the value of k in m, or the zero value if it is missing
+func mapIndex(m, k reflect.Value) reflect.Value {
+	if value := m.MapIndex(k); value.IsValid() {
+		return value
+	}
+	return reflect.Zero(m.Type().Elem())
+}
+
+// format renders a setting for the log, quoting strings so that empty and
+// multi-line values stay readable
+func format(value reflect.Value) string {
+	if value.Kind() == reflect.String {
+		return strconv.Quote(value.String())
+	}
+	return fmt.Sprint(value.Interface())
+}
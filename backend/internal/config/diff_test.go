@@ -0,0 +1,100 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"vpnaas-backend/internal/models"
+)
+
+func TestDiff(t *testing.T) {
+	before := Default()
+	before.VPN.EgressProfiles = map[string]models.EgressProfile{
+		"partner-a": {NodePool: "egress-a", PublicIP: "203.0.113.10"},
+	}
+
+	after := Default()
+	after.Log.Level = "debug"
+	after.VPN.Endpoint = "vpn.example.com"
+	after.VPN.ReadyTimeout = 0
+	after.VPN.ClusterCIDRs = []string{"10.0.0.0/8"}
+	after.VPN.EgressProfiles = map[string]models.EgressProfile{
+		"partner-a": {NodePool: "egress-a", PublicIP: "203.0.113.11"},
+	}
+
+	want := []Change{
+		{Key: "log.level", Old: `"info"`, New: `"debug"`},
+		{Key: "vpn.cluster_cidrs", Old: "[]", New: "[10.0.0.0/8]"},
+		{Key: "vpn.egress_profiles[partner-a].public_ip", Old: `"203.0.113.10"`, New: `"203.0.113.11"`},
+		{Key: "vpn.endpoint", Old: `""`, New: `"vpn.example.com"`},
+		{Key: "vpn.ready_timeout", Old: "2m0s", New: "0s"},
+	}
+	if got := Diff(before, after); !reflect.DeepEqual(got, want) {
+		t.Errorf("got changes\n%v\nwant\n%v", got, want)
+	}
+	if got := Diff(after, after); len(got) != 0 {
+		t.Errorf("got changes %v between equal configurations", got)
+	}
+
+	// A profile added or removed shows up field by field
+	after.VPN.EgressProfiles = nil
+	got := Diff(before, after)
+	removed := 0
+	for _, change := range got {
+		if change.Key == "vpn.egress_profiles[partner-a].node_pool" && change.New == `""` {
+			removed++
+		}
+	}
+	if removed != 1 {
+		t.Errorf("removed profile not reported: %v", got)
+	}
+}
+
+func TestRequiresRestart(t *testing.T) {
+	tests := map[string]bool{
+		"debug":                            false,
+		"log.level":                        false,
+		"reload.rollout":                   false,
+		"vpn.image":                        false,
+		"vpn.endpoint":                     false,
+		"vpn.egress_profiles[a].public_ip": false,
+		"vpn.container_name":               true,
+		"vpn.ready_timeout":                true,
+		"reload.enabled":                   true,
+		"server.port":                      true,
+		"k8s.namespace":                    true,
+	}
+	for key, want := range tests {
+		if got := RequiresRestart(key); got != want {
+			t.Errorf("RequiresRestart(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestReloaded(t *testing.T) {
+	current := Default()
+	next := Default()
+	next.Debug = true
+	next.Server.Port = 9090
+	next.VPN.Image = "wireguard:1.1"
+	next.VPN.ContainerName = "wg"
+	next.History.SampleInterval = time.Minute
+
+	reloaded := current.Reloaded(next)
+	if !reloaded.Debug || reloaded.VPN.Image != "wireguard:1.1" {
+		t.Errorf("live settings not reloaded: debug %v, image %s", reloaded.Debug, reloaded.VPN.Image)
+	}
+	// Whatever differs from the current configuration takes effect live
+	for _, change := range Diff(current, reloaded) {
+		if RequiresRestart(change.Key) {
+			t.Errorf("%s requires a restart but was reloaded", change)
+		}
+	}
+	// and whatever was left out requires a restart
+	for _, change := range Diff(reloaded, next) {
+		if !RequiresRestart(change.Key) {
+			t.Errorf("%s takes effect live but was not reloaded", change)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"vpnaas-backend/internal/quota"
+)
+
+// imageReference matches container image references such as
+// "linuxserver/wireguard:latest" or "registry:5000/wg@sha256:<digest>"
+var imageReference = regexp.MustCompile(`^` +
+	`(?:[a-zA-Z0-9](?:[a-zA-Z0-9.-]*[a-zA-Z0-9])?(?::[0-9]+)?/)?` + // registry
+	`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` + // repository
+	`(?::[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127})?` + // tag
+	`(?:@sha256:[a-f0-9]{64})?$`) // digest
+
+// ValidationError lists every problem found in a configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration:\n  %s", strings.Join(e.Problems, "\n  "))
+}
+
+// Validate checks the whole configuration and returns a *ValidationError
+// listing every problem, or nil
+func (c *Config) Validate() error {
+	if problems := c.problems(); len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// problems returns a description of every invalid setting, prefixed with
+// its key
+func (c *Config) problems() []string {
+	var p problems
+
+	p.port("server.port", c.Server.Port)
+
+	if format := strings.ToLower(c.Log.Format); format != "text" && format != "json" {
+		p.addf("log.format", "%q is not text or json", c.Log.Format)
+	}
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		p.add("log.level", err)
+	}
+
+	vpn := c.VPN
+	p.endpoint("vpn.endpoint", vpn.Endpoint)
+	p.port("vpn.wireguard_port", vpn.WireGuardPort)
+	if !imageReference.MatchString(vpn.Image) {
+		p.addf("vpn.image", "%q is not an image reference", vpn.Image)
+	}
+	cpuRequest := p.quantity("vpn.pod_cpu_request", vpn.PodCPURequest)
+	cpuLimit := p.quantity("vpn.pod_cpu_limit", vpn.PodCPULimit)
+	memoryRequest := p.quantity("vpn.pod_memory_request", vpn.PodMemoryRequest)
+	memoryLimit := p.quantity("vpn.pod_memory_limit", vpn.PodMemoryLimit)
+	if cpuRequest != nil && cpuLimit != nil && cpuRequest.Cmp(*cpuLimit) > 0 {
+		p.addf("vpn.pod_cpu_request", "%s exceeds vpn.pod_cpu_limit %s", vpn.PodCPURequest, vpn.PodCPULimit)
+	}
+	if memoryRequest != nil && memoryLimit != nil && memoryRequest.Cmp(*memoryLimit) > 0 {
+		p.addf("vpn.pod_memory_request", "%s exceeds vpn.pod_memory_limit %s", vpn.PodMemoryRequest, vpn.PodMemoryLimit)
+	}
+	switch vpn.ServiceType {
+	case "ClusterIP", "NodePort", "LoadBalancer":
+	default:
+		p.addf("vpn.service_type", "%q is not ClusterIP, NodePort or LoadBalancer", vpn.ServiceType)
+	}
+	p.positive("vpn.ready_timeout", vpn.ReadyTimeout)
+	p.dnsLabel("vpn.container_name", vpn.ContainerName)
+	if !strings.HasPrefix(vpn.ConfigMountPath, "/") {
+		p.addf("vpn.config_mount_path", "%q is not an absolute path", vpn.ConfigMountPath)
+	}
+	if vpn.WireGuardInterface == "" || len(vpn.WireGuardInterface) > 15 || strings.ContainsAny(vpn.WireGuardInterface, "/ \t") {
+		p.addf("vpn.wireguard_interface", "%q is not an interface name", vpn.WireGuardInterface)
+	}
+	if len(vpn.ClusterCIDRs) == 0 {
+		p.add("vpn.cluster_cidrs", "is required: set the pod and service networks of the cluster")
+	}
+	for i, cidr := range vpn.ClusterCIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			p.add(fmt.Sprintf("vpn.cluster_cidrs[%d]", i), err)
+		}
+	}
+	if vpn.PodTemplateConfigMap != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(vpn.PodTemplateConfigMap) {
+			p.add("vpn.pod_template_configmap", msg)
+		}
+	}
+	for _, msg := range validation.IsQualifiedName(vpn.NodePoolLabel) {
+		p.add("vpn.node_pool_label", msg)
+	}
+
+	p.dnsLabel("k8s.namespace", c.K8s.Namespace)
+
+	p.positive("usage.collect_interval", c.Usage.CollectInterval)
+	p.positive("metrics.refresh_interval", c.Metrics.RefreshInterval)
+	switch c.Metrics.PerUser.Mode {
+	case "off", "all":
+	case "top_n":
+		if c.Metrics.PerUser.TopN <= 0 {
+			p.addf("metrics.per_user.top_n", "%d is not positive", c.Metrics.PerUser.TopN)
+		}
+	default:
+		p.addf("metrics.per_user.mode", "%q is not off, all or top_n", c.Metrics.PerUser.Mode)
+	}
+	switch c.Metrics.PerUser.Username {
+	case "plain", "hashed", "omit":
+	default:
+		p.addf("metrics.per_user.username", "%q is not plain, hashed or omit", c.Metrics.PerUser.Username)
+	}
+	p.positive("health.check_timeout", c.Health.CheckTimeout)
+
+	if _, err := quota.ParsePeriod(c.Quota.ResetPeriod); err != nil {
+		p.add("quota.reset_period", err)
+	}
+	p.positive("access.check_interval", c.Access.CheckInterval)
+	if c.Access.ExpiryGracePeriod < 0 {
+		p.addf("access.expiry_grace_period", "%s is negative", c.Access.ExpiryGracePeriod)
+	}
+
+	p.required("audit.dir", c.Audit.Dir)
+	p.required("audit.actor_header", c.Audit.ActorHeader)
+	p.required("history.dir", c.History.Dir)
+	p.positive("history.sample_interval", c.History.SampleInterval)
+	p.positive("history.raw_retention", c.History.RawRetention)
+	p.positive("history.resolution", c.History.Resolution)
+	if c.History.Retention < c.History.RawRetention {
+		p.addf("history.retention", "%s is shorter than history.raw_retention %s", c.History.Retention, c.History.RawRetention)
+	}
+	p.required("reports.dir", c.Reports.Dir)
+
+	if c.Tracing.Enabled {
+		// The OTLP exporter takes host:port and adds the scheme itself
+		host, port, err := net.SplitHostPort(c.Tracing.Endpoint)
+		if n, _ := strconv.Atoi(port); err != nil || host == "" || strings.Contains(host, "/") || n < 1 || n > 65535 {
+			p.addf("tracing.endpoint", "%q is not host:port", c.Tracing.Endpoint)
+		}
+		p.required("tracing.service_name", c.Tracing.ServiceName)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		p.addf("tracing.sample_ratio", "%v is not between 0 and 1", c.Tracing.SampleRatio)
+	}
+
+	return p
+}
+
+// problems collects validation problems
+type problems []string
+
+func (p *problems) add(key string, problem interface{}) {
+	*p = append(*p, fmt.Sprintf("%s: %v", key, problem))
+}
+
+func (p *problems) addf(key, format string, args ...interface{}) {
+	p.add(key, fmt.Sprintf(format, args...))
+}
+
+func (p *problems) required(key, value string) {
+	if value == "" {
+		p.add(key, "is required")
+	}
+}
+
+func (p *problems) port(key string, port int) {
+	if port < 1 || port > 65535 {
+		p.addf(key, "port %d is not between 1 and 65535", port)
+	}
+}
+
+func (p *problems) positive(key string, d time.Duration) {
+	if d <= 0 {
+		p.addf(key, "%s is not positive", d)
+	}
+}
+
+func (p *problems) dnsLabel(key, value string) {
+	for _, msg := range validation.IsDNS1123Label(value) {
+		p.add(key, msg)
+	}
+}
+
+// quantity parses a Kubernetes quantity, returning nil if it is invalid
+func (p *problems) quantity(key, value string) *resource.Quantity {
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		p.addf(key, "%q is not a quantity", value)
+		return nil
+	}
+	if q.Sign() <= 0 {
+		p.addf(key, "%s is not positive", value)
+		return nil
+	}
+	return &q
+}
+
+// endpoint checks that value is a host name or IP address clients can reach,
+// without a scheme or port: the port is vpn.wireguard_port
+func (p *problems) endpoint(key, value string) {
+	if value == "" {
+		p.add(key, "is required: set the public host name or IP address of the VPN service")
+		return
+	}
+	if _, err := netip.ParseAddr(strings.Trim(value, "[]")); err == nil {
+		return
+	}
+	if strings.Contains(value, "://") || strings.Contains(value, ":") {
+		p.addf(key, "%q must be a host name or IP address without scheme or port", value)
+		return
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(strings.ToLower(value)) {
+		p.addf(key, "%q: %s", value, msg)
+	}
+}
@@ -0,0 +1,102 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Check is a named condition the backend must meet to serve traffic
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Result is the outcome of a check
+type Result struct {
+	Name     string `json:"name"`
+	Healthy  bool   `json:"healthy"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Checker runs the readiness checks
+type Checker struct {
+	checks  []Check
+	timeout time.Duration
+}
+
+// NewChecker creates a checker failing checks that take longer than timeout
+func NewChecker(timeout time.Duration, checks ...Check) *Checker {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &Checker{checks: checks, timeout: timeout}
+}
+
+// Run runs every check in parallel and reports whether all of them passed.
+// A check that does not return within the timeout fails, even if the call it
+// makes cannot be cancelled.
+func (ch *Checker) Run(ctx context.Context) ([]Result, bool) {
+	ctx, cancel := context.WithTimeout(ctx, ch.timeout)
+	defer cancel()
+
+	results := make([]Result, len(ch.checks))
+	var wg sync.WaitGroup
+	for i, check := range ch.checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = runCheck(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	healthy := true
+	for _, result := range results {
+		healthy = healthy && result.Healthy
+	}
+	return results, healthy
+}
+
+// runCheck runs a check until it returns or ctx is done
+func runCheck(ctx context.Context, check Check) Result {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check.Run(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out: %v", ctx.Err())
+	}
+
+	result := Result{Name: check.Name, Healthy: err == nil, Duration: time.Since(start).String()}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// Readyz reports each check and answers 503 unless all of them passed, so
+// that the pod only receives traffic it can serve
+func (ch *Checker) Readyz(c *gin.Context) {
+	results, healthy := ch.Run(c.Request.Context())
+	status, code := "ready", http.StatusOK
+	if !healthy {
+		status, code = "not ready", http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{"status": status, "checks": results})
+}
+
+// Livez answers as long as the process serves HTTP. It checks no
+// dependencies, so that an outage of the Kubernetes API does not get every
+// replica restarted.
+func Livez(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "alive"})
+}
@@ -0,0 +1,64 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReadyz(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	pass := Check{Name: "store", Run: func(ctx context.Context) error { return nil }}
+	fail := Check{Name: "kubernetes_api", Run: func(ctx context.Context) error { return errors.New("connection refused") }}
+	hang := Check{Name: "informers", Run: func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}}
+
+	tests := []struct {
+		name       string
+		checks     []Check
+		wantStatus int
+		wantErrors map[string]bool
+	}{
+		{name: "all pass", checks: []Check{pass}, wantStatus: http.StatusOK, wantErrors: map[string]bool{"store": false}},
+		{name: "one fails", checks: []Check{pass, fail}, wantStatus: http.StatusServiceUnavailable, wantErrors: map[string]bool{"store": false, "kubernetes_api": true}},
+		{name: "timeout", checks: []Check{pass, hang}, wantStatus: http.StatusServiceUnavailable, wantErrors: map[string]bool{"store": false, "informers": true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := NewChecker(50*time.Millisecond, tt.checks...)
+			router := gin.New()
+			router.GET("/readyz", checker.Readyz)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			var resp struct {
+				Checks []Result `json:"checks"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if len(resp.Checks) != len(tt.wantErrors) {
+				t.Fatalf("got %d results, want %d", len(resp.Checks), len(tt.wantErrors))
+			}
+			for _, result := range resp.Checks {
+				if failed := result.Error != ""; failed != tt.wantErrors[result.Name] || result.Healthy == failed {
+					t.Errorf("check %s: got %+v", result.Name, result)
+				}
+			}
+		})
+	}
+}
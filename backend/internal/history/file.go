@@ -0,0 +1,283 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// fileSuffix ends the name of every history file
+	fileSuffix = ".jsonl"
+	// claimPrefix starts the name a history file is renamed to while a
+	// replica merges it into its own
+	claimPrefix = ".merging-"
+)
+
+// FileStore is a Store appending samples as JSON lines to a file of its own
+// in a directory. Replicas sharing the directory each write their own file;
+// queries merge all of them. Compaction rewrites the store's own file,
+// merging in the files of replicas that have stopped writing, such as those
+// of replaced pods, and removes files nobody has written to within the
+// retention.
+type FileStore struct {
+	mu   sync.Mutex
+	dir  string
+	path string
+	file *os.File
+}
+
+// NewFileStore opens the history file named name in dir, creating both if
+// needed
+func NewFileStore(dir, name string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create history directory: %v", err)
+	}
+	path := filepath.Join(dir, name+fileSuffix)
+	file, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := terminateLastLine(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to repair history file: %v", err)
+	}
+	return &FileStore{dir: dir, path: path, file: file}, nil
+}
+
+// openAppend opens a history file for appending
+func openAppend(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history file: %v", err)
+	}
+	return file, nil
+}
+
+// terminateLastLine ends a sample cut short by a crash with a newline, so
+// that it does not swallow the next sample
+func terminateLastLine(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	_, err = file.Write([]byte{'\n'})
+	return err
+}
+
+// Append writes samples to the store's file
+func (s *FileStore) Append(samples []Sample) error {
+	var lines []byte
+	for _, sample := range samples {
+		line, err := json.Marshal(sample)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line...)
+		lines = append(lines, '\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Write(lines); err != nil {
+		return fmt.Errorf("failed to write history samples: %v", err)
+	}
+	return nil
+}
+
+// Query scans every history file in the directory for the samples of a
+// series taken in [from, to), oldest first
+func (s *FileStore) Query(userID string, from, to time.Time) ([]Sample, error) {
+	return s.filter(func(sample Sample) bool {
+		return sample.UserID == userID && inRange(sample, from, to)
+	})
+}
+
+// Range scans every history file in the directory for the samples of every
+// series taken in [from, to), oldest first
+func (s *FileStore) Range(from, to time.Time) ([]Sample, error) {
+	return s.filter(func(sample Sample) bool { return inRange(sample, from, to) })
+}
+
+// filter returns the samples of every history file matching match, oldest
+// first
+func (s *FileStore) filter(match func(Sample) bool) ([]Sample, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+fileSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Sample
+	for _, path := range paths {
+		err := readSamples(path, func(sample Sample) {
+			if match(sample) {
+				result = append(result, sample)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sortSamples(result)
+	return result, nil
+}
+
+// Compact rewrites the store's file with its old samples downsampled and its
+// expired ones dropped. Files of other replicas not written to since
+// rawBefore are merged into it so that their samples are downsampled too,
+// and those not written to since dropBefore are removed. A replica claims a
+// file by renaming it before merging it, so no two replicas merge the same
+// file.
+func (s *FileStore) Compact(rawBefore, dropBefore time.Time, resolution time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+fileSuffix))
+	if err != nil {
+		return err
+	}
+	var samples []Sample
+	var claimed []string
+	for _, path := range paths {
+		if path == s.path {
+			continue
+		}
+		info, err := os.Stat(path)
+		switch {
+		case err != nil:
+			continue
+		case info.ModTime().Before(dropBefore):
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				logrus.Warnf("Failed to remove expired history file %s: %v", filepath.Base(path), err)
+			}
+		case info.ModTime().Before(rawBefore) && !strings.HasPrefix(filepath.Base(path), claimPrefix):
+			// Another replica may be claiming it right now; only one rename
+			// succeeds
+			claim := filepath.Join(s.dir, claimPrefix+filepath.Base(path))
+			if err := os.Rename(path, claim); err != nil {
+				continue
+			}
+			claimed = append(claimed, path)
+			if err := readSamples(claim, func(sample Sample) { samples = append(samples, sample) }); err != nil {
+				releaseClaims(claimed)
+				return err
+			}
+		}
+	}
+
+	if err := readSamples(s.path, func(sample Sample) { samples = append(samples, sample) }); err != nil {
+		releaseClaims(claimed)
+		return err
+	}
+	if err := s.rewrite(compact(samples, rawBefore, dropBefore, resolution)); err != nil {
+		releaseClaims(claimed)
+		return err
+	}
+	for _, path := range claimed {
+		if err := os.Remove(filepath.Join(s.dir, claimPrefix+filepath.Base(path))); err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("Failed to remove merged history file %s: %v", filepath.Base(path), err)
+		}
+	}
+	return nil
+}
+
+// releaseClaims gives claimed history files their names back after a failed
+// compaction
+func releaseClaims(paths []string) {
+	for _, path := range paths {
+		if err := os.Rename(filepath.Join(filepath.Dir(path), claimPrefix+filepath.Base(path)), path); err != nil {
+			logrus.Warnf("Failed to release history file %s: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+// rewrite atomically replaces the store's file with samples and reopens it
+// for appending
+func (s *FileStore) rewrite(samples []Sample) error {
+	temp, err := os.CreateTemp(s.dir, ".compact-*")
+	if err != nil {
+		return fmt.Errorf("failed to compact history: %v", err)
+	}
+	defer os.Remove(temp.Name())
+
+	writer := bufio.NewWriter(temp)
+	encoder := json.NewEncoder(writer)
+	for _, sample := range samples {
+		if err := encoder.Encode(sample); err != nil {
+			temp.Close()
+			return fmt.Errorf("failed to compact history: %v", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to compact history: %v", err)
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to compact history: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to compact history: %v", err)
+	}
+	if err := os.Rename(temp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to compact history: %v", err)
+	}
+
+	file, err := openAppend(s.path)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	return nil
+}
+
+// readSamples calls fn with every sample of a file. Lines that cannot be
+// decoded, such as one cut short by a crash, are skipped.
+func readSamples(path string, fn func(Sample)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Removed by another replica's compaction
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open history file: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var sample Sample
+		if err := json.Unmarshal(scanner.Bytes(), &sample); err != nil {
+			logrus.Warnf("Skipping unreadable history sample in %s on line %d: %v", filepath.Base(path), line, err)
+			continue
+		}
+		fn(sample)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read history file %s: %v", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// Close closes the history file
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
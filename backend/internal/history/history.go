@@ -0,0 +1,199 @@
+package history
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sample is the state of a usage series at a point in time. The global
+// series, with an empty UserID, sums every user and also counts them. Each
+// replica samples only the users it holds, so global samples name the
+// replica that took them and are summed across replicas when downsampled.
+// User samples record who the user was at the time, so that reports can
+// account for users that have since been deleted or moved to another plan.
+type Sample struct {
+	Time              time.Time `json:"time"`
+	UserID            string    `json:"user_id,omitempty"`
+	Replica           string    `json:"replica,omitempty"`
+	Username          string    `json:"username,omitempty"`
+	Tenant            string    `json:"tenant,omitempty"`
+	Plan              string    `json:"plan,omitempty"`
+	Provisioned       bool      `json:"provisioned,omitempty"` // the user's VPN workload exists
+	DataUsage         int64     `json:"data_usage"`            // cumulative bytes
+	Connections       int       `json:"connections"`           // cumulative connection count
+	ActiveConnections int       `json:"active_connections"`
+	Users             int       `json:"users,omitempty"`
+	ActiveUsers       int       `json:"active_users,omitempty"`
+}
+
+// Store keeps usage samples
+type Store interface {
+	// Append stores samples
+	Append(samples []Sample) error
+	// Query returns the samples of a series taken in [from, to), oldest
+	// first. An empty userID selects the global series.
+	Query(userID string, from, to time.Time) ([]Sample, error)
+	// Range returns the samples of every series taken in [from, to),
+	// oldest first
+	Range(from, to time.Time) ([]Sample, error)
+	// Compact downsamples the samples taken before rawBefore to one per
+	// resolution and drops the samples taken before dropBefore
+	Compact(rawBefore, dropBefore time.Time, resolution time.Duration) error
+}
+
+// Downsample keeps the latest sample of every series in each step-long
+// bucket, timestamped with the start of its bucket. Every field is either
+// cumulative or a point-in-time count, so the latest sample is the one that
+// represents the bucket. The global samples of the replicas in a bucket are
+// summed into one. The result is ordered by time.
+func Downsample(samples []Sample, step time.Duration) []Sample {
+	type bucket struct {
+		userID string
+		start  time.Time
+	}
+	merged := make(map[bucket]Sample)
+	for _, sample := range downsample(samples, step) {
+		key := bucket{userID: sample.UserID, start: sample.Time}
+		sample.Replica = ""
+		if total, exists := merged[key]; exists {
+			sample = sum(total, sample)
+		}
+		merged[key] = sample
+	}
+
+	result := make([]Sample, 0, len(merged))
+	for _, sample := range merged {
+		result = append(result, sample)
+	}
+	sortSamples(result)
+	return result
+}
+
+// downsample keeps the latest sample of every series and replica in each
+// step-long bucket, timestamped with the start of its bucket
+func downsample(samples []Sample, step time.Duration) []Sample {
+	type bucket struct {
+		userID  string
+		replica string
+		start   time.Time
+	}
+	latest := make(map[bucket]Sample)
+	for _, sample := range samples {
+		key := bucket{userID: sample.UserID, replica: sample.Replica, start: sample.Time.Truncate(step)}
+		if current, exists := latest[key]; !exists || !sample.Time.Before(current.Time) {
+			latest[key] = sample
+		}
+	}
+
+	result := make([]Sample, 0, len(latest))
+	for key, sample := range latest {
+		sample.Time = key.start
+		result = append(result, sample)
+	}
+	sortSamples(result)
+	return result
+}
+
+// sum adds up the global samples of two replicas
+func sum(a, b Sample) Sample {
+	a.DataUsage += b.DataUsage
+	a.Connections += b.Connections
+	a.ActiveConnections += b.ActiveConnections
+	a.Users += b.Users
+	a.ActiveUsers += b.ActiveUsers
+	return a
+}
+
+// compact splits samples at rawBefore, downsamples the older part to
+// resolution and drops what was taken before dropBefore. Replicas are kept
+// apart, so that their samples can still be summed when queried.
+func compact(samples []Sample, rawBefore, dropBefore time.Time, resolution time.Duration) []Sample {
+	var old, recent []Sample
+	for _, sample := range samples {
+		switch {
+		case sample.Time.Before(dropBefore):
+		case sample.Time.Before(rawBefore):
+			old = append(old, sample)
+		default:
+			recent = append(recent, sample)
+		}
+	}
+	result := append(downsample(old, resolution), recent...)
+	sortSamples(result)
+	return result
+}
+
+// sortSamples orders samples by time, then by series and replica
+func sortSamples(samples []Sample) {
+	sort.SliceStable(samples, func(i, j int) bool {
+		if !samples[i].Time.Equal(samples[j].Time) {
+			return samples[i].Time.Before(samples[j].Time)
+		}
+		if samples[i].UserID != samples[j].UserID {
+			return samples[i].UserID < samples[j].UserID
+		}
+		return samples[i].Replica < samples[j].Replica
+	})
+}
+
+// inRange reports whether a sample was taken in [from, to)
+func inRange(sample Sample, from, to time.Time) bool {
+	return !sample.Time.Before(from) && sample.Time.Before(to)
+}
+
+// MemoryStore is a Store held in memory, for tests and single-replica setups
+// that can afford to lose the history on restart
+type MemoryStore struct {
+	mu      sync.RWMutex
+	samples []Sample
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Append stores samples
+func (s *MemoryStore) Append(samples []Sample) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples = append(s.samples, samples...)
+	return nil
+}
+
+// Query returns the samples of a series taken in [from, to), oldest first
+func (s *MemoryStore) Query(userID string, from, to time.Time) ([]Sample, error) {
+	return s.filter(func(sample Sample) bool {
+		return sample.UserID == userID && inRange(sample, from, to)
+	}), nil
+}
+
+// Range returns the samples of every series taken in [from, to), oldest
+// first
+func (s *MemoryStore) Range(from, to time.Time) ([]Sample, error) {
+	return s.filter(func(sample Sample) bool { return inRange(sample, from, to) }), nil
+}
+
+// filter returns the samples matching match, oldest first
+func (s *MemoryStore) filter(match func(Sample) bool) []Sample {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []Sample
+	for _, sample := range s.samples {
+		if match(sample) {
+			result = append(result, sample)
+		}
+	}
+	sortSamples(result)
+	return result
+}
+
+// Compact downsamples old samples and drops expired ones
+func (s *MemoryStore) Compact(rawBefore, dropBefore time.Time, resolution time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples = compact(s.samples, rawBefore, dropBefore, resolution)
+	return nil
+}
@@ -0,0 +1,278 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+)
+
+var base = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func at(minutes int, userID string, usage int64) Sample {
+	return Sample{Time: base.Add(time.Duration(minutes) * time.Minute), UserID: userID, DataUsage: usage}
+}
+
+func TestDownsample(t *testing.T) {
+	samples := []Sample{
+		at(0, "", 10),
+		at(5, "", 20),
+		at(55, "", 30),
+		at(60, "", 40),
+		at(5, "u1", 1),
+		at(50, "u1", 2),
+	}
+
+	got := Downsample(samples, time.Hour)
+	want := []Sample{
+		at(0, "", 30),
+		at(0, "u1", 2),
+		at(60, "", 40),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d samples, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if !got[i].Time.Equal(want[i].Time) || got[i].UserID != want[i].UserID || got[i].DataUsage != want[i].DataUsage {
+			t.Errorf("sample %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestDownsampleSumsReplicas(t *testing.T) {
+	replica := func(minutes int, name string, usage int64, users int) Sample {
+		sample := at(minutes, "", usage)
+		sample.Replica = name
+		sample.Users = users
+		return sample
+	}
+	samples := []Sample{
+		replica(0, "replica-a", 10, 1),
+		replica(50, "replica-a", 20, 2),
+		replica(55, "replica-b", 5, 1),
+		replica(60, "replica-b", 7, 1),
+	}
+
+	// Each replica's latest sample counts once, whichever sampled last
+	got := Downsample(samples, time.Hour)
+	if len(got) != 2 {
+		t.Fatalf("got %d samples, want 2: %+v", len(got), got)
+	}
+	if got[0].DataUsage != 25 || got[0].Users != 3 || got[0].Replica != "" {
+		t.Errorf("got first hour %+v, want the latest samples of both replicas summed", got[0])
+	}
+	if got[1].DataUsage != 7 || got[1].Users != 1 {
+		t.Errorf("got second hour %+v, want replica-b alone", got[1])
+	}
+
+	// Compaction keeps the replicas apart so that they can still be summed
+	store := NewMemoryStore()
+	store.Append(samples)
+	if err := store.Compact(base.Add(2*time.Hour), base, time.Hour); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	compacted, _ := store.Query("", base, base.Add(2*time.Hour))
+	if len(compacted) != 3 || compacted[0].Replica != "replica-a" || compacted[1].Replica != "replica-b" {
+		t.Fatalf("got %+v after compaction, want a sample per replica and hour", compacted)
+	}
+	if got := Downsample(compacted, time.Hour); got[0].DataUsage != 25 {
+		t.Errorf("got first hour %+v after compaction, want both replicas summed", got[0])
+	}
+}
+
+// testStores runs a test against every Store implementation
+func testStores(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("memory", func(t *testing.T) { test(t, NewMemoryStore()) })
+	t.Run("file", func(t *testing.T) {
+		store, err := NewFileStore(t.TempDir(), "replica-a")
+		if err != nil {
+			t.Fatalf("open store: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		test(t, store)
+	})
+}
+
+func TestStoreQueryAndCompact(t *testing.T) {
+	testStores(t, func(t *testing.T, store Store) {
+		var samples []Sample
+		for minute := 0; minute < 180; minute += 5 {
+			samples = append(samples, at(minute, "", int64(minute)), at(minute, "u1", int64(minute)*2))
+		}
+		if err := store.Append(samples); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+
+		got, err := store.Query("u1", base.Add(30*time.Minute), base.Add(60*time.Minute))
+		if err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		if len(got) != 6 || got[0].DataUsage != 60 || got[5].DataUsage != 110 {
+			t.Fatalf("got %+v, want the six samples from minute 30 to 55", got)
+		}
+
+		// The first hour is dropped, the second downsampled and the third
+		// kept as sampled
+		if err := store.Compact(base.Add(2*time.Hour), base.Add(time.Hour), time.Hour); err != nil {
+			t.Fatalf("compact: %v", err)
+		}
+		got, err = store.Query("", base, base.Add(3*time.Hour))
+		if err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		if len(got) != 13 {
+			t.Fatalf("got %d samples after compaction, want 13", len(got))
+		}
+		if !got[0].Time.Equal(base.Add(time.Hour)) || got[0].DataUsage != 115 {
+			t.Errorf("got downsampled sample %+v, want the last of the second hour", got[0])
+		}
+		if !got[1].Time.Equal(base.Add(2 * time.Hour)) {
+			t.Errorf("got %v, want raw samples from the third hour", got[1].Time)
+		}
+
+		// The store keeps working after compaction
+		if err := store.Append([]Sample{at(180, "", 999)}); err != nil {
+			t.Fatalf("append after compaction: %v", err)
+		}
+		got, _ = store.Query("", base.Add(3*time.Hour), base.Add(4*time.Hour))
+		if len(got) != 1 || got[0].DataUsage != 999 {
+			t.Errorf("got %+v after appending to the compacted store", got)
+		}
+	})
+}
+
+func TestFileStoreReplicas(t *testing.T) {
+	dir := t.TempDir()
+	a, err := NewFileStore(dir, "replica-a")
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer a.Close()
+	b, err := NewFileStore(dir, "replica-b")
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer b.Close()
+
+	a.Append([]Sample{at(0, "", 1)})
+	b.Append([]Sample{at(1, "", 2)})
+
+	// A crash left a partial line behind in a third file
+	if err := os.WriteFile(filepath.Join(dir, "replica-c.jsonl"), []byte(`{"time":"2024-03-01T12:02:00Z","data_usage":3}`+"\n"+`{"time":`), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := a.Query("", base, base.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if len(got) != 3 || got[0].DataUsage != 1 || got[1].DataUsage != 2 || got[2].DataUsage != 3 {
+		t.Fatalf("got %+v, want the samples of every replica in order", got)
+	}
+
+	// Files nobody has written to within the retention are removed
+	stale := filepath.Join(dir, "replica-c.jsonl")
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Compact(time.Now().Add(-time.Hour), time.Now().Add(-24*time.Hour), time.Hour); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale history file still exists: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "replica-b.jsonl")); err != nil {
+		t.Errorf("live history file of another replica removed: %v", err)
+	}
+}
+
+func TestFileStoreCompactsStaleReplicas(t *testing.T) {
+	dir := t.TempDir()
+	a, err := NewFileStore(dir, "replica-a")
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer a.Close()
+	b, err := NewFileStore(dir, "replica-b")
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+
+	sample := func(minutes int, replica string, usage int64) Sample {
+		s := at(minutes, "", usage)
+		s.Replica = replica
+		return s
+	}
+	a.Append([]Sample{sample(0, "replica-a", 1), sample(30, "replica-a", 2)})
+	b.Append([]Sample{sample(0, "replica-b", 10), sample(10, "replica-b", 20), sample(20, "replica-b", 30)})
+	b.Close()
+
+	// Replica b's pod was replaced an hour after its last sample
+	stale := filepath.Join(dir, "replica-b.jsonl")
+	stopped := base.Add(time.Hour)
+	if err := os.Chtimes(stale, stopped, stopped); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Compact(base.Add(2*time.Hour), base.Add(-time.Hour), time.Hour); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale history file of replica-b still exists: %v", err)
+	}
+	got, err := a.Range(base, base.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("range: %v", err)
+	}
+	want := []Sample{sample(0, "replica-a", 2), sample(0, "replica-b", 30)}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want each replica downsampled to %+v", got, want)
+	}
+	for i := range want {
+		if !got[i].Time.Equal(want[i].Time) || got[i].Replica != want[i].Replica || got[i].DataUsage != want[i].DataUsage {
+			t.Errorf("sample %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSampler(t *testing.T) {
+	users := store.NewMemoryStore()
+	alice := models.NewUser("alice", "alice@example.com")
+	alice.DataUsage = 100
+	alice.ConnectionCount = 3
+	alice.PeerCounters = map[string]models.PeerCounters{"a": {Connected: true}}
+	bob := models.NewUser("bob", "bob@example.com")
+	bob.Status = "suspended"
+	bob.DataUsage = 50
+	for _, user := range []*models.User{alice, bob} {
+		if err := users.CreateUser(user); err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+
+	history := NewMemoryStore()
+	sampler := NewSampler(users, history, "replica-a", config.HistoryConfig{})
+	sampler.now = func() time.Time { return base }
+	if err := sampler.Sample(); err != nil {
+		t.Fatalf("sample: %v", err)
+	}
+
+	global, _ := history.Query("", base, base.Add(time.Minute))
+	if len(global) != 1 {
+		t.Fatalf("got %d global samples, want 1", len(global))
+	}
+	want := Sample{Time: base, Replica: "replica-a", DataUsage: 150, Connections: 3, ActiveConnections: 1, Users: 2, ActiveUsers: 1}
+	if global[0] != want {
+		t.Errorf("got global sample %+v, want %+v", global[0], want)
+	}
+
+	user, _ := history.Query(alice.ID, base, base.Add(time.Minute))
+	if len(user) != 1 || user[0].DataUsage != 100 || user[0].ActiveConnections != 1 {
+		t.Errorf("got user samples %+v", user)
+	}
+}
@@ -0,0 +1,138 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/metrics"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+)
+
+// Sampler periodically records the usage of every user and of the whole
+// service, and compacts the history once per resolution: samples older than
+// the raw retention are downsampled to the resolution and samples older than
+// the retention are dropped.
+type Sampler struct {
+	users        store.Store
+	history      Store
+	replica      string
+	interval     time.Duration
+	rawRetention time.Duration
+	resolution   time.Duration
+	retention    time.Duration
+	now          func() time.Time
+	lastCompact  time.Time
+}
+
+// NewSampler creates a sampler using the interval, resolution and retentions
+// of cfg. Its global samples are recorded as those of replica.
+func NewSampler(userStore store.Store, history Store, replica string, cfg config.HistoryConfig) *Sampler {
+	return &Sampler{
+		users:        userStore,
+		history:      history,
+		replica:      replica,
+		interval:     durationOr(cfg.SampleInterval, 5*time.Minute),
+		rawRetention: durationOr(cfg.RawRetention, 48*time.Hour),
+		resolution:   durationOr(cfg.Resolution, time.Hour),
+		retention:    durationOr(cfg.Retention, 90*24*time.Hour),
+		now:          time.Now,
+	}
+}
+
+// durationOr returns d, or fallback when d is not positive
+func durationOr(d, fallback time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return fallback
+}
+
+// Run samples immediately and then at every interval until ctx is done
+func (s *Sampler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Sample(); err != nil {
+			metrics.RecordError("history_sample", "history")
+			logrus.Warnf("Usage history sample failed: %v", err)
+		}
+		if err := s.compactIfDue(); err != nil {
+			metrics.RecordError("history_compaction", "history")
+			logrus.Warnf("Usage history compaction failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sample records the current usage of every user and the global totals of
+// the replica
+func (s *Sampler) Sample() error {
+	now := s.now()
+	users := s.users.ListUsers()
+
+	global := Sample{Time: now, Replica: s.replica}
+	samples := make([]Sample, 0, len(users)+1)
+	for _, user := range users {
+		sample := userSample(user, now)
+		samples = append(samples, sample)
+
+		global.Users++
+		if user.Status == "active" {
+			global.ActiveUsers++
+		}
+		global.DataUsage += sample.DataUsage
+		global.Connections += sample.Connections
+		global.ActiveConnections += sample.ActiveConnections
+	}
+	samples = append(samples, global)
+
+	if err := s.history.Append(samples); err != nil {
+		return fmt.Errorf("failed to store usage samples: %v", err)
+	}
+	return nil
+}
+
+// userSample describes a user's usage at now
+func userSample(user *models.User, now time.Time) Sample {
+	sample := Sample{
+		Time:        now,
+		UserID:      user.ID,
+		Username:    user.Username,
+		Tenant:      user.Tenant,
+		Plan:        user.Plan,
+		Provisioned: user.WorkloadName != "",
+		DataUsage:   user.DataUsage,
+		Connections: user.ConnectionCount,
+	}
+	for _, counters := range user.PeerCounters {
+		if counters.Connected {
+			sample.ActiveConnections++
+		}
+	}
+	return sample
+}
+
+// compactIfDue compacts the history if a resolution has passed since the
+// last compaction
+func (s *Sampler) compactIfDue() error {
+	now := s.now()
+	if now.Sub(s.lastCompact) < s.resolution {
+		return nil
+	}
+	if err := s.history.Compact(now.Add(-s.rawRetention), now.Add(-s.retention), s.resolution); err != nil {
+		return err
+	}
+	s.lastCompact = now
+	return nil
+}
@@ -0,0 +1,196 @@
+package k8s
+
+import (
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/models"
+)
+
+// defaultNodePoolLabel is the node label naming a node's pool when
+// vpn.node_pool_label is not set
+const defaultNodePoolLabel = "node-pool"
+
+// egressProfiles holds the validated egress profiles and the node
+// requirements each one schedules VPN pods with
+type egressProfiles struct {
+	profiles       map[string]models.EgressProfile
+	requirements   map[string][]corev1.NodeSelectorRequirement
+	defaultProfile string
+}
+
+// LoadEgressProfiles reads the egress profiles from vpn.egress_profiles,
+// validates them and makes them available to workloads. It should be called
+// at startup so that a bad profile is reported before any user is
+// provisioned.
+func (vm *VPNManager) LoadEgressProfiles() error {
+	profiles, err := buildEgressProfiles(vm.vpnConfig())
+	if err != nil {
+		return err
+	}
+
+	vm.mu.Lock()
+	vm.egressProfiles = profiles
+	vm.mu.Unlock()
+
+	return nil
+}
+
+// buildEgressProfiles validates the egress profiles of cfg
+func buildEgressProfiles(cfg config.VPNConfig) (*egressProfiles, error) {
+	sources := cfg.EgressProfiles
+	poolLabel := cfg.NodePoolLabel
+	if poolLabel == "" {
+		poolLabel = defaultNodePoolLabel
+	}
+
+	profiles := &egressProfiles{
+		profiles:       make(map[string]models.EgressProfile, len(sources)),
+		requirements:   make(map[string][]corev1.NodeSelectorRequirement, len(sources)),
+		defaultProfile: cfg.DefaultEgressProfile,
+	}
+
+	var errs []error
+	for name, profile := range sources {
+		profile.Name = name
+		if err := profile.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("egress profile %q: %v", name, err))
+			continue
+		}
+		requirements, err := nodeRequirements(profile, poolLabel)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("egress profile %q: %v", name, err))
+			continue
+		}
+		profiles.profiles[name] = profile
+		profiles.requirements[name] = requirements
+	}
+
+	if name := profiles.defaultProfile; name != "" {
+		if _, exists := sources[name]; !exists {
+			errs = append(errs, fmt.Errorf("default egress profile %q is not defined", name))
+		}
+	}
+
+	if err := utilerrors.NewAggregate(errs); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// EgressProfiles returns the loaded egress profiles sorted by name
+func (vm *VPNManager) EgressProfiles() []models.EgressProfile {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+
+	profiles := make([]models.EgressProfile, 0, len(vm.egressProfiles.profiles))
+	for _, profile := range vm.egressProfiles.profiles {
+		profiles = append(profiles, profile)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles
+}
+
+// resolveEgressProfile picks the egress profile for a user: the user's own,
+// then the default. It returns nil requirements and an empty profile when
+// none applies.
+func (vm *VPNManager) resolveEgressProfile(user *models.User) (models.EgressProfile, []corev1.NodeSelectorRequirement, error) {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+
+	name := user.EgressProfile
+	if name == "" {
+		name = vm.egressProfiles.defaultProfile
+	}
+	if name == "" {
+		return models.EgressProfile{}, nil, nil
+	}
+
+	profile, exists := vm.egressProfiles.profiles[name]
+	if !exists {
+		return models.EgressProfile{}, nil, fmt.Errorf("egress profile %q is not defined", name)
+	}
+
+	return profile, vm.egressProfiles.requirements[name], nil
+}
+
+// nodeRequirements translates a profile's node pool and selector into node
+// affinity requirements
+func nodeRequirements(profile models.EgressProfile, poolLabel string) ([]corev1.NodeSelectorRequirement, error) {
+	var requirements []corev1.NodeSelectorRequirement
+	if profile.NodePool != "" {
+		requirements = append(requirements, corev1.NodeSelectorRequirement{
+			Key:      poolLabel,
+			Operator: corev1.NodeSelectorOpIn,
+			Values:   []string{profile.NodePool},
+		})
+	}
+	if profile.NodeSelector == "" {
+		return requirements, nil
+	}
+
+	selector, err := labels.Parse(profile.NodeSelector)
+	if err != nil {
+		return nil, fmt.Errorf("node_selector: %v", err)
+	}
+	parsed, _ := selector.Requirements()
+	for _, requirement := range parsed {
+		var operator corev1.NodeSelectorOperator
+		switch requirement.Operator() {
+		case selection.Equals, selection.DoubleEquals, selection.In:
+			operator = corev1.NodeSelectorOpIn
+		case selection.NotEquals, selection.NotIn:
+			operator = corev1.NodeSelectorOpNotIn
+		case selection.Exists:
+			operator = corev1.NodeSelectorOpExists
+		case selection.DoesNotExist:
+			operator = corev1.NodeSelectorOpDoesNotExist
+		case selection.GreaterThan:
+			operator = corev1.NodeSelectorOpGt
+		case selection.LessThan:
+			operator = corev1.NodeSelectorOpLt
+		default:
+			return nil, fmt.Errorf("node_selector: unsupported operator %s", requirement.Operator())
+		}
+		requirements = append(requirements, corev1.NodeSelectorRequirement{
+			Key:      requirement.Key(),
+			Operator: operator,
+			Values:   requirement.Values().List(),
+		})
+	}
+	return requirements, nil
+}
+
+// requireNodes restricts a pod to nodes meeting every requirement, on top of
+// any node affinity the pod template already declares
+func requireNodes(spec *corev1.PodSpec, requirements []corev1.NodeSelectorRequirement) {
+	if len(requirements) == 0 {
+		return
+	}
+	if spec.Affinity == nil {
+		spec.Affinity = &corev1.Affinity{}
+	}
+	if spec.Affinity.NodeAffinity == nil {
+		spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	affinity := spec.Affinity.NodeAffinity
+	if affinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		affinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+	required := affinity.RequiredDuringSchedulingIgnoredDuringExecution
+
+	// Terms are alternatives, so every one of them must carry the requirements
+	if len(required.NodeSelectorTerms) == 0 {
+		required.NodeSelectorTerms = []corev1.NodeSelectorTerm{{}}
+	}
+	for i := range required.NodeSelectorTerms {
+		term := &required.NodeSelectorTerms[i]
+		term.MatchExpressions = append(term.MatchExpressions, requirements...)
+	}
+}
@@ -0,0 +1,175 @@
+package k8s
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/models"
+)
+
+func TestLoadEgressProfiles(t *testing.T) {
+	tests := []struct {
+		name           string
+		profiles       map[string]models.EgressProfile
+		defaultProfile string
+		wantErr        string
+	}{
+		{
+			name: "valid profiles",
+			profiles: map[string]models.EgressProfile{
+				"partner-a": {NodePool: "egress-a", PublicIP: "203.0.113.10"},
+				"eu":        {NodeSelector: "topology.kubernetes.io/region in (eu-west-1)", PublicIP: "2001:db8::10"},
+			},
+			defaultProfile: "eu",
+		},
+		{
+			name:     "no nodes",
+			profiles: map[string]models.EgressProfile{"partner-a": {PublicIP: "203.0.113.10"}},
+			wantErr:  "node_pool or node_selector is required",
+		},
+		{
+			name:     "invalid public IP",
+			profiles: map[string]models.EgressProfile{"partner-a": {NodePool: "egress-a", PublicIP: "egress.example.com"}},
+			wantErr:  "public_ip",
+		},
+		{
+			name:     "invalid selector",
+			profiles: map[string]models.EgressProfile{"partner-a": {NodeSelector: "zone in (", PublicIP: "203.0.113.10"}},
+			wantErr:  "node_selector",
+		},
+		{
+			name:           "undefined default",
+			profiles:       map[string]models.EgressProfile{},
+			defaultProfile: "missing",
+			wantErr:        `default egress profile "missing" is not defined`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := newTestManager(fake.NewSimpleClientset(), func(cfg *config.VPNConfig) {
+				cfg.EgressProfiles = tt.profiles
+				cfg.DefaultEgressProfile = tt.defaultProfile
+			})
+			err := vm.LoadEgressProfiles()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				if len(vm.EgressProfiles()) != 0 {
+					t.Errorf("profiles loaded despite error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if got := vm.EgressProfiles(); len(got) != len(tt.profiles) || got[0].Name != "eu" {
+				t.Errorf("got profiles %+v", got)
+			}
+		})
+	}
+}
+
+func TestBuildDeploymentWithEgressProfile(t *testing.T) {
+	vm := newTestManager(fake.NewSimpleClientset(), func(cfg *config.VPNConfig) {
+		cfg.EgressProfiles = map[string]models.EgressProfile{
+			"partner-a": {
+				NodePool:     "egress-a",
+				NodeSelector: "zone in (b,a),spot!=true",
+				PublicIP:     "203.0.113.10",
+			},
+			"fallback": {NodePool: "egress", PublicIP: "198.51.100.1"},
+		}
+		cfg.DefaultEgressProfile = "fallback"
+		cfg.NodePoolLabel = "cloud.example.com/pool"
+		cfg.PodTemplates = map[string]string{
+			"zonal": "spec:\n  affinity:\n    nodeAffinity:\n      requiredDuringSchedulingIgnoredDuringExecution:\n" +
+				"        nodeSelectorTerms:\n        - matchExpressions:\n          - {key: arch, operator: In, values: [amd64]}\n" +
+				"        - matchExpressions:\n          - {key: arch, operator: In, values: [arm64]}\n",
+		}
+	})
+	if err := vm.LoadPodTemplates(context.Background()); err != nil {
+		t.Fatalf("load templates: %v", err)
+	}
+	if err := vm.LoadEgressProfiles(); err != nil {
+		t.Fatalf("load profiles: %v", err)
+	}
+
+	partnerA := []corev1.NodeSelectorRequirement{
+		{Key: "cloud.example.com/pool", Operator: corev1.NodeSelectorOpIn, Values: []string{"egress-a"}},
+		{Key: "spot", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"true"}},
+		{Key: "zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"a", "b"}},
+	}
+	arch := func(value string) corev1.NodeSelectorRequirement {
+		return corev1.NodeSelectorRequirement{Key: "arch", Operator: corev1.NodeSelectorOpIn, Values: []string{value}}
+	}
+
+	tests := []struct {
+		name      string
+		user      *models.User
+		plan      *models.Plan
+		wantIP    string
+		wantTerms []corev1.NodeSelectorTerm
+	}{
+		{
+			name:   "default profile",
+			user:   &models.User{ID: "1"},
+			wantIP: "198.51.100.1",
+			wantTerms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{
+				{Key: "cloud.example.com/pool", Operator: corev1.NodeSelectorOpIn, Values: []string{"egress"}},
+			}}},
+		},
+		{
+			name:      "assigned profile",
+			user:      &models.User{ID: "2", EgressProfile: "partner-a"},
+			wantIP:    "203.0.113.10",
+			wantTerms: []corev1.NodeSelectorTerm{{MatchExpressions: partnerA}},
+		},
+		{
+			name:   "template affinity is kept in every term",
+			user:   &models.User{ID: "3", EgressProfile: "partner-a"},
+			plan:   &models.Plan{Name: "zonal", PodTemplate: "zonal"},
+			wantIP: "203.0.113.10",
+			wantTerms: []corev1.NodeSelectorTerm{
+				{MatchExpressions: append([]corev1.NodeSelectorRequirement{arch("amd64")}, partnerA...)},
+				{MatchExpressions: append([]corev1.NodeSelectorRequirement{arch("arm64")}, partnerA...)},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deployment, err := vm.buildDeployment(tt.user, tt.plan, "vpn-"+tt.user.ID, "vpn-config-"+tt.user.ID)
+			if err != nil {
+				t.Fatalf("build: %v", err)
+			}
+			if tt.user.EgressIP != tt.wantIP {
+				t.Errorf("got egress IP %q, want %q", tt.user.EgressIP, tt.wantIP)
+			}
+			terms := deployment.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+			if !reflect.DeepEqual(terms, tt.wantTerms) {
+				t.Errorf("got node selector terms %+v, want %+v", terms, tt.wantTerms)
+			}
+		})
+	}
+
+	// The loaded template is not modified by the requirements added to it
+	if _, err := vm.buildDeployment(&models.User{ID: "4"}, &models.Plan{Name: "zonal", PodTemplate: "zonal"}, "vpn-4", "vpn-config-4"); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	_, tmpl, _ := vm.resolvePodTemplate(&models.User{ID: "4"}, &models.Plan{PodTemplate: "zonal"})
+	if got := tmpl.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions; len(got) != 1 {
+		t.Errorf("pod template modified: %+v", got)
+	}
+
+	if _, err := vm.buildDeployment(&models.User{ID: "5", EgressProfile: "deleted"}, nil, "vpn-5", "vpn-config-5"); err == nil {
+		t.Fatalf("expected error for undefined egress profile")
+	}
+}
@@ -0,0 +1,51 @@
+package k8s
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	"vpnaas-backend/internal/logging"
+	"vpnaas-backend/internal/models"
+)
+
+// eventComponent is the source reported on Kubernetes Events
+const eventComponent = "vpnaas-backend"
+
+// EnableEvents publishes user events as Kubernetes Events on the users'
+// Deployments in addition to logging them
+func (vm *VPNManager) EnableEvents() {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: vm.clientset.CoreV1().Events(vm.namespace)})
+	vm.recorder = broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+}
+
+// RecordUserEvent logs an event about a user's VPN and, once events are
+// enabled, records it on the user's Deployment. eventType is one of
+// corev1.EventTypeNormal and corev1.EventTypeWarning.
+func (vm *VPNManager) RecordUserEvent(user *models.User, eventType, reason, message string) {
+	entry := logging.FromContext(withUserLogger(context.Background(), user)).WithField("reason", reason)
+	if eventType == corev1.EventTypeWarning {
+		entry.Warn(message)
+	} else {
+		entry.Info(message)
+	}
+
+	if vm.recorder == nil {
+		return
+	}
+
+	name := user.WorkloadName
+	if name == "" {
+		name = workloadName(user.ID)
+	}
+	vm.recorder.Event(&corev1.ObjectReference{
+		APIVersion: "apps/v1",
+		Kind:       "Deployment",
+		Namespace:  vm.namespace,
+		Name:       name,
+	}, eventType, reason, message)
+}
@@ -0,0 +1,148 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// permission is an API permission the backend needs in its namespace
+type permission struct {
+	group, resource, subresource string
+	verbs                        []string
+}
+
+// requiredPermissions lists what provisioning, cleanup, rollouts, usage
+// collection and events need. RBAC must grant all of it for the backend to
+// be ready.
+var requiredPermissions = []permission{
+	{group: "apps", resource: "deployments", verbs: []string{"get", "list", "create", "update", "delete"}},
+	{group: "apps", resource: "replicasets", verbs: []string{"list", "delete"}},
+	{resource: "pods", verbs: []string{"get", "list", "watch", "delete"}},
+	{resource: "pods", subresource: "exec", verbs: []string{"create"}},
+	{resource: "secrets", verbs: []string{"get", "list", "create", "update", "delete"}},
+	{resource: "services", verbs: []string{"list", "create", "delete"}},
+	{resource: "configmaps", verbs: []string{"get", "list", "delete"}},
+	{group: "networking.k8s.io", resource: "networkpolicies", verbs: []string{"get", "list", "create", "update", "delete"}},
+	{resource: "events", verbs: []string{"create", "patch"}},
+}
+
+// CheckAPI verifies that the Kubernetes API server answers
+func (vm *VPNManager) CheckAPI(ctx context.Context) error {
+	if _, err := vm.clientset.Discovery().ServerVersion(); err != nil {
+		return fmt.Errorf("kubernetes API unreachable: %v", err)
+	}
+	return nil
+}
+
+// CheckPermissions verifies that the backend holds every required
+// permission. The rules granted in the namespace are fetched in a single
+// review; anything they do not cover, such as permissions granted by a
+// non-RBAC authorizer, is asked about individually.
+func (vm *VPNManager) CheckPermissions(ctx context.Context) error {
+	review, err := vm.clientset.AuthorizationV1().SelfSubjectRulesReviews().Create(ctx, &authorizationv1.SelfSubjectRulesReview{
+		Spec: authorizationv1.SelfSubjectRulesReviewSpec{Namespace: vm.namespace},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to review permissions: %v", err)
+	}
+
+	var missing []string
+	for _, perm := range requiredPermissions {
+		for _, verb := range perm.verbs {
+			if rulesAllow(review.Status.ResourceRules, perm, verb) {
+				continue
+			}
+			allowed, err := vm.accessAllowed(ctx, perm, verb)
+			if err != nil {
+				return fmt.Errorf("failed to review permissions: %v", err)
+			}
+			if !allowed {
+				missing = append(missing, perm.describe(verb))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing permissions in namespace %s: %s", vm.namespace, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// CheckInformers verifies that the pod informer has been started and has
+// filled its cache
+func (vm *VPNManager) CheckInformers(ctx context.Context) error {
+	vm.mu.RLock()
+	informer := vm.podInformer
+	vm.mu.RUnlock()
+
+	switch {
+	case informer == nil:
+		return fmt.Errorf("pod informer not started")
+	case !informer.HasSynced():
+		return fmt.Errorf("pod informer not synced")
+	}
+	return nil
+}
+
+// accessAllowed asks the API server whether the backend may perform verb
+func (vm *VPNManager) accessAllowed(ctx context.Context, perm permission, verb string) (bool, error) {
+	review, err := vm.clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   vm.namespace,
+				Verb:        verb,
+				Group:       perm.group,
+				Resource:    perm.resource,
+				Subresource: perm.subresource,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+	return review.Status.Allowed, nil
+}
+
+// describe names a permission such as "create pods/exec"
+func (p permission) describe(verb string) string {
+	resource := p.resource
+	if p.subresource != "" {
+		resource += "/" + p.subresource
+	}
+	if p.group != "" {
+		resource += "." + p.group
+	}
+	return verb + " " + resource
+}
+
+// rulesAllow reports whether any of the rules grants verb on the permission's
+// resource. Rules naming specific objects do not count, since the backend
+// acts on objects it creates.
+func rulesAllow(rules []authorizationv1.ResourceRule, perm permission, verb string) bool {
+	resource := perm.resource
+	if perm.subresource != "" {
+		resource += "/" + perm.subresource
+	}
+	for _, rule := range rules {
+		if len(rule.ResourceNames) > 0 {
+			continue
+		}
+		if matches(rule.APIGroups, perm.group) && matches(rule.Resources, resource) && matches(rule.Verbs, verb) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether values contain value or the wildcard
+func matches(values []string, value string) bool {
+	for _, v := range values {
+		if v == value || v == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package k8s
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/yaml"
+)
+
+// grantRules makes rules reviews return rules and access reviews allow the
+// given "verb resource" pairs
+func grantRules(client *fake.Clientset, rules []authorizationv1.ResourceRule, allowed ...string) {
+	client.PrependReactor("create", "selfsubjectrulesreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectRulesReview).DeepCopy()
+		review.Status.ResourceRules = rules
+		return true, review, nil
+	})
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview).DeepCopy()
+		attrs := review.Spec.ResourceAttributes
+		resource := attrs.Resource
+		if attrs.Subresource != "" {
+			resource += "/" + attrs.Subresource
+		}
+		for _, grant := range allowed {
+			if grant == attrs.Verb+" "+resource {
+				review.Status.Allowed = true
+			}
+		}
+		return true, review, nil
+	})
+}
+
+func TestCheckPermissions(t *testing.T) {
+	everything := []authorizationv1.ResourceRule{{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"*"}}}
+	withoutExec := []authorizationv1.ResourceRule{
+		{APIGroups: []string{"apps"}, Resources: []string{"deployments", "replicasets"}, Verbs: []string{"*"}},
+		{APIGroups: []string{""}, Resources: []string{"pods", "secrets", "services", "configmaps", "events"}, Verbs: []string{"*"}},
+		{APIGroups: []string{"networking.k8s.io"}, Resources: []string{"networkpolicies"}, Verbs: []string{"*"}},
+		// Rules limited to named objects do not count
+		{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}, ResourceNames: []string{"vpn-1"}},
+	}
+
+	tests := []struct {
+		name        string
+		rules       []authorizationv1.ResourceRule
+		allowed     []string
+		wantMissing string
+	}{
+		{name: "wildcard rules", rules: everything},
+		{name: "missing exec", rules: withoutExec, wantMissing: "create pods/exec"},
+		{name: "exec granted by access review", rules: withoutExec, allowed: []string{"create pods/exec"}},
+		{name: "no rules", wantMissing: "get deployments.apps"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			grantRules(client, tt.rules, tt.allowed...)
+
+			err := newTestManager(client).CheckPermissions(context.Background())
+			if tt.wantMissing == "" {
+				if err != nil {
+					t.Fatalf("got error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantMissing) {
+				t.Fatalf("got error %v, want one naming %q", err, tt.wantMissing)
+			}
+		})
+	}
+
+	t.Run("review error", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		failOn(client, "create", "selfsubjectrulesreviews", apierrors.NewServiceUnavailable("apiserver down"))
+		if err := newTestManager(client).CheckPermissions(context.Background()); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func TestPodInformer(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		testPod("vpn-1", corev1.PodRunning, vpnLabels),
+		testPod("vpn-2", corev1.PodPending, vpnLabels),
+	)
+	vm := newTestManager(client)
+
+	if err := vm.CheckInformers(context.Background()); err == nil {
+		t.Fatal("expected an error before the informer is started")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	vm.StartPodInformer(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for vm.CheckInformers(ctx) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("informer did not sync: %v", vm.CheckInformers(ctx))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Once synced, pods are counted from the cache without listing them
+	failOn(client, "list", "pods", apierrors.NewServiceUnavailable("apiserver down"))
+	stats, err := vm.UpdatePodMetrics(ctx)
+	if err != nil {
+		t.Fatalf("update pod metrics: %v", err)
+	}
+	if stats.Running != 1 || stats.Pending != 1 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+func TestCheckAPI(t *testing.T) {
+	if err := newTestManager(fake.NewSimpleClientset()).CheckAPI(context.Background()); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+func TestShippedRoleGrantsRequiredPermissions(t *testing.T) {
+	raw, err := os.ReadFile(filepath.Join("..", "..", "..", "k8s", "rbac.yaml"))
+	if err != nil {
+		t.Fatalf("read RBAC manifest: %v", err)
+	}
+
+	var role *rbacv1.Role
+	for _, doc := range strings.Split(string(raw), "\n---\n") {
+		var meta metav1.TypeMeta
+		if err := yaml.Unmarshal([]byte(doc), &meta); err != nil {
+			t.Fatalf("decode RBAC manifest: %v", err)
+		}
+		if meta.Kind == "Role" {
+			role = &rbacv1.Role{}
+			if err := yaml.Unmarshal([]byte(doc), role); err != nil {
+				t.Fatalf("decode Role: %v", err)
+			}
+		}
+	}
+	if role == nil {
+		t.Fatalf("no Role in the RBAC manifest")
+	}
+
+	var rules []authorizationv1.ResourceRule
+	for _, rule := range role.Rules {
+		rules = append(rules, authorizationv1.ResourceRule{
+			Verbs: rule.Verbs, APIGroups: rule.APIGroups, Resources: rule.Resources, ResourceNames: rule.ResourceNames,
+		})
+	}
+
+	// Everything /readyz checks for is granted
+	required := map[string]bool{}
+	for _, perm := range requiredPermissions {
+		for _, verb := range perm.verbs {
+			required[perm.describe(verb)] = true
+			if !rulesAllow(rules, perm, verb) {
+				t.Errorf("Role does not grant %s", perm.describe(verb))
+			}
+		}
+	}
+
+	// and nothing more
+	for _, rule := range role.Rules {
+		for _, group := range rule.APIGroups {
+			for _, resource := range rule.Resources {
+				perm := permission{group: group, resource: resource}
+				if parts := strings.SplitN(resource, "/", 2); len(parts) == 2 {
+					perm.resource, perm.subresource = parts[0], parts[1]
+				}
+				for _, verb := range rule.Verbs {
+					if !required[perm.describe(verb)] {
+						t.Errorf("Role grants %s, which the backend does not need", perm.describe(verb))
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/util/retry"
+
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/tracing"
+)
+
+// namespaceNameLabel is set by Kubernetes on every namespace to its name
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+// userNetworkPolicy returns the network policy for a user, the user's own
+// replacing the plan's, or nil if neither declares one
+func userNetworkPolicy(user *models.User, plan *models.Plan) *models.NetworkPolicy {
+	if !user.NetworkPolicy.IsZero() {
+		return user.NetworkPolicy
+	}
+	if plan != nil && !plan.NetworkPolicy.IsZero() {
+		return plan.NetworkPolicy
+	}
+	return nil
+}
+
+// parseClusterCIDRs parses the networks of the cluster's pods and services,
+// skipping invalid ones
+func parseClusterCIDRs(values []string) []netip.Prefix {
+	var cidrs []netip.Prefix
+	for _, value := range values {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			logrus.Warnf("Ignoring invalid cluster CIDR %q: %v", value, err)
+			continue
+		}
+		cidrs = append(cidrs, prefix.Masked())
+	}
+	return cidrs
+}
+
+// buildNetworkPolicy builds the NetworkPolicy limiting the egress of a user's
+// VPN pod. Without a declared policy all egress is allowed but to the VPN
+// namespace. Either way other VPN pods, the backend and the UI are
+// unreachable: the VPN namespace is never matched and networks exclude the
+// cluster's own, which are only reachable through namespaces.
+func (vm *VPNManager) buildNetworkPolicy(user *models.User, plan *models.Plan, owner metav1.OwnerReference) (*networkingv1.NetworkPolicy, error) {
+	var rules []networkingv1.NetworkPolicyEgressRule
+	if policy := userNetworkPolicy(user, plan); policy != nil {
+		for i, rule := range policy.Egress {
+			egress, err := vm.egressRule(rule)
+			if err != nil {
+				return nil, fmt.Errorf("egress rule %d: %v", i, err)
+			}
+			rules = append(rules, egress)
+		}
+	} else {
+		rules = []networkingv1.NetworkPolicyEgressRule{{To: vm.anywhere()}}
+	}
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: ownedObjectMeta(user, workloadName(user.ID), vm.namespace, owner),
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: workloadLabels(user)},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+			Egress:      rules,
+		},
+	}, nil
+}
+
+// egressRule renders a declared rule in the order it was declared
+func (vm *VPNManager) egressRule(rule models.EgressRule) (networkingv1.NetworkPolicyEgressRule, error) {
+	var result networkingv1.NetworkPolicyEgressRule
+
+	for _, value := range rule.CIDRs {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return result, err
+		}
+		result.To = append(result.To, vm.ipBlockPeer(prefix))
+	}
+	for _, namespace := range rule.Namespaces {
+		if namespace == vm.namespace {
+			return result, fmt.Errorf("namespace %s holds the VPN service and cannot be reached", namespace)
+		}
+		result.To = append(result.To, networkingv1.NetworkPolicyPeer{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{namespaceNameLabel: namespace}},
+			PodSelector:       nonVPNPods(),
+		})
+	}
+	if len(result.To) == 0 {
+		result.To = vm.anywhere()
+	}
+
+	for _, port := range rule.Ports {
+		protocol := corev1.Protocol(port.Protocol)
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+		number := intstr.FromInt32(int32(port.Port))
+		policyPort := networkingv1.NetworkPolicyPort{Protocol: &protocol, Port: &number}
+		if port.EndPort != 0 {
+			endPort := int32(port.EndPort)
+			policyPort.EndPort = &endPort
+		}
+		result.Ports = append(result.Ports, policyPort)
+	}
+
+	return result, nil
+}
+
+// anywhere returns peers matching every destination but the VPN namespace,
+// which holds the VPN pods, the backend and the UI
+func (vm *VPNManager) anywhere() []networkingv1.NetworkPolicyPeer {
+	peers := []networkingv1.NetworkPolicyPeer{vm.ipBlockPeer(netip.MustParsePrefix("0.0.0.0/0"))}
+	if vm.vpnConfig().DualStack {
+		peers = append(peers, vm.ipBlockPeer(netip.MustParsePrefix("::/0")))
+	}
+	return append(peers, networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: otherNamespaces(vm.namespace),
+	})
+}
+
+// otherNamespaces selects every namespace but the given one
+func otherNamespaces(namespace string) *metav1.LabelSelector {
+	return &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: namespaceNameLabel, Operator: metav1.LabelSelectorOpNotIn, Values: []string{namespace}},
+		},
+	}
+}
+
+// ipBlockPeer returns a peer for a network without the cluster networks in it
+func (vm *VPNManager) ipBlockPeer(prefix netip.Prefix) networkingv1.NetworkPolicyPeer {
+	vm.mu.RLock()
+	clusterCIDRs := vm.clusterCIDRs
+	vm.mu.RUnlock()
+
+	block := &networkingv1.IPBlock{CIDR: prefix.String()}
+	for _, cluster := range clusterCIDRs {
+		if cluster.Addr().Is4() == prefix.Addr().Is4() && cluster.Bits() > prefix.Bits() && prefix.Contains(cluster.Addr()) {
+			block.Except = append(block.Except, cluster.String())
+		}
+	}
+	return networkingv1.NetworkPolicyPeer{IPBlock: block}
+}
+
+// nonVPNPods selects every pod but VPN pods
+func nonVPNPods() *metav1.LabelSelector {
+	return &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "component", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"vpn"}},
+		},
+	}
+}
+
+// applyNetworkPolicy creates or updates a user's NetworkPolicy
+func (vm *VPNManager) applyNetworkPolicy(ctx context.Context, user *models.User, plan *models.Plan, owner metav1.OwnerReference) (err error) {
+	ctx, span := tracing.Start(ctx, "VPNManager.applyNetworkPolicy", attribute.String("user.id", user.ID))
+	defer func() { tracing.End(span, err) }()
+
+	desired, err := vm.buildNetworkPolicy(user, plan, owner)
+	if err != nil {
+		return err
+	}
+	policies := vm.clientset.NetworkingV1().NetworkPolicies(vm.namespace)
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := policies.Get(ctx, desired.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			_, err = policies.Create(ctx, desired, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		current.Labels = desired.Labels
+		current.OwnerReferences = desired.OwnerReferences
+		current.Spec = desired.Spec
+		_, err = policies.Update(ctx, current, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return apiFailure("failed to apply NetworkPolicy", err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package k8s
+
+import (
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/models"
+)
+
+func TestBuildNetworkPolicy(t *testing.T) {
+	vm := newTestManager(fake.NewSimpleClientset(), func(cfg *config.VPNConfig) { cfg.DualStack = false })
+	vm.clusterCIDRs = parseClusterCIDRs([]string{"10.244.0.0/16", "10.96.0.0/12", "not-a-cidr"})
+	owner := ownerReference(&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "vpn-1", UID: "uid-1"}})
+
+	plan := &models.Plan{Name: "office", NetworkPolicy: &models.NetworkPolicy{Egress: []models.EgressRule{
+		{
+			CIDRs:      []string{"10.0.0.0/8", "192.168.10.0/24"},
+			Namespaces: []string{"intranet"},
+			Ports:      []models.EgressPort{{Port: 443}, {Protocol: "UDP", Port: 50000, EndPort: 50100}},
+		},
+		{Ports: []models.EgressPort{{Protocol: "UDP", Port: 53}}},
+	}}}
+
+	tests := []struct {
+		name string
+		user *models.User
+		plan *models.Plan
+		want []networkingv1.NetworkPolicyEgressRule
+	}{
+		{
+			name: "no declared policy allows everything but the VPN namespace",
+			user: &models.User{ID: "1"},
+			want: []networkingv1.NetworkPolicyEgressRule{{To: []networkingv1.NetworkPolicyPeer{
+				{IPBlock: &networkingv1.IPBlock{CIDR: "0.0.0.0/0", Except: []string{"10.244.0.0/16", "10.96.0.0/12"}}},
+				{NamespaceSelector: otherNamespaces(testNamespace)},
+			}}},
+		},
+		{
+			name: "plan policy",
+			user: &models.User{ID: "1"},
+			plan: plan,
+			want: []networkingv1.NetworkPolicyEgressRule{
+				{
+					To: []networkingv1.NetworkPolicyPeer{
+						{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/8", Except: []string{"10.244.0.0/16", "10.96.0.0/12"}}},
+						{IPBlock: &networkingv1.IPBlock{CIDR: "192.168.10.0/24"}},
+						{
+							NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{namespaceNameLabel: "intranet"}},
+							PodSelector:       nonVPNPods(),
+						},
+					},
+					Ports: []networkingv1.NetworkPolicyPort{policyPort("TCP", 443, 0), policyPort("UDP", 50000, 50100)},
+				},
+				{
+					To: []networkingv1.NetworkPolicyPeer{
+						{IPBlock: &networkingv1.IPBlock{CIDR: "0.0.0.0/0", Except: []string{"10.244.0.0/16", "10.96.0.0/12"}}},
+						{NamespaceSelector: otherNamespaces(testNamespace)},
+					},
+					Ports: []networkingv1.NetworkPolicyPort{policyPort("UDP", 53, 0)},
+				},
+			},
+		},
+		{
+			name: "user policy replaces plan policy",
+			user: &models.User{ID: "1", NetworkPolicy: &models.NetworkPolicy{Egress: []models.EgressRule{
+				{CIDRs: []string{"203.0.113.0/24"}},
+			}}},
+			plan: plan,
+			want: []networkingv1.NetworkPolicyEgressRule{{To: []networkingv1.NetworkPolicyPeer{
+				{IPBlock: &networkingv1.IPBlock{CIDR: "203.0.113.0/24"}},
+			}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := vm.buildNetworkPolicy(tt.user, tt.plan, owner)
+			if err != nil {
+				t.Fatalf("build: %v", err)
+			}
+			if !reflect.DeepEqual(policy.Spec.Egress, tt.want) {
+				t.Errorf("got egress %+v, want %+v", policy.Spec.Egress, tt.want)
+			}
+			if !reflect.DeepEqual(policy.Spec.PodSelector.MatchLabels, userLabels("1")) {
+				t.Errorf("policy selects %v", policy.Spec.PodSelector.MatchLabels)
+			}
+			if len(policy.OwnerReferences) != 1 || policy.OwnerReferences[0].UID != "uid-1" {
+				t.Errorf("policy not owned by the deployment: %+v", policy.OwnerReferences)
+			}
+
+			// Rendering is deterministic
+			again, _ := vm.buildNetworkPolicy(tt.user, tt.plan, owner)
+			if !reflect.DeepEqual(policy, again) {
+				t.Errorf("rendering differs between calls")
+			}
+		})
+	}
+}
+
+func TestBuildNetworkPolicyRejectsVPNNamespace(t *testing.T) {
+	vm := newTestManager(fake.NewSimpleClientset())
+	user := &models.User{ID: "1", NetworkPolicy: &models.NetworkPolicy{Egress: []models.EgressRule{
+		{Namespaces: []string{"intranet", testNamespace}},
+	}}}
+	if _, err := vm.buildNetworkPolicy(user, nil, metav1.OwnerReference{}); err == nil {
+		t.Fatalf("expected error for a rule reaching the VPN namespace")
+	}
+}
+
+func policyPort(protocol string, port, endPort int32) networkingv1.NetworkPolicyPort {
+	p := corev1.Protocol(protocol)
+	number := intstr.FromInt32(port)
+	result := networkingv1.NetworkPolicyPort{Protocol: &p, Port: &number}
+	if endPort != 0 {
+		result.EndPort = &endPort
+	}
+	return result
+}
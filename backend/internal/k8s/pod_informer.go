@@ -0,0 +1,58 @@
+package k8s
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+)
+
+// podResync is how often the pod informer replays its cache
+const podResync = 10 * time.Minute
+
+// StartPodInformer watches the VPN pods in the namespace until ctx is done,
+// so that they are counted from a local cache instead of being listed on
+// every metrics refresh
+func (vm *VPNManager) StartPodInformer(ctx context.Context) {
+	factory := informers.NewSharedInformerFactoryWithOptions(vm.clientset, podResync,
+		informers.WithNamespace(vm.namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = vpnSelector
+		}),
+	)
+	pods := factory.Core().V1().Pods()
+	informer := pods.Informer()
+	lister := pods.Lister()
+	factory.Start(ctx.Done())
+
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.podInformer = informer
+	vm.podLister = lister
+}
+
+// listVPNPods returns the VPN pods from the informer's cache once it has
+// synced, and from the API otherwise
+func (vm *VPNManager) listVPNPods(ctx context.Context) ([]*corev1.Pod, error) {
+	vm.mu.RLock()
+	informer, lister := vm.podInformer, vm.podLister
+	vm.mu.RUnlock()
+	if informer != nil && informer.HasSynced() {
+		return lister.List(labels.Everything())
+	}
+
+	list, err := vm.clientset.CoreV1().Pods(vm.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: vpnSelector,
+	})
+	if err != nil {
+		return nil, err
+	}
+	pods := make([]*corev1.Pod, 0, len(list.Items))
+	for i := range list.Items {
+		pods = append(pods, &list.Items[i])
+	}
+	return pods, nil
+}
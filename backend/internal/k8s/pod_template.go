@@ -0,0 +1,300 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/yaml"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/models"
+)
+
+// configVolume is the name of the volume carrying the WireGuard config. It is
+// reserved and may not be used by pod templates.
+const configVolume = "config"
+
+// podTemplates holds the validated pod templates and how they are selected.
+// Template and tenant names are lowercased: viper lowercases the keys it
+// reads, so names are matched regardless of case wherever they come from.
+type podTemplates struct {
+	templates       map[string]*corev1.PodTemplateSpec
+	defaultTemplate string
+	tenantTemplates map[string]string
+}
+
+// LoadPodTemplates reads the pod templates from vpn.pod_templates and the
+// optional ConfigMap named by vpn.pod_template_configmap, validates them and
+// makes them available to new workloads. It should be called at startup so
+// that a bad template is reported before any user is provisioned.
+func (vm *VPNManager) LoadPodTemplates(ctx context.Context) error {
+	templates, err := vm.buildPodTemplates(ctx, vm.vpnConfig())
+	if err != nil {
+		return err
+	}
+
+	vm.mu.Lock()
+	vm.podTemplates = templates
+	vm.mu.Unlock()
+
+	return nil
+}
+
+// buildPodTemplates reads and validates the pod templates cfg refers to
+func (vm *VPNManager) buildPodTemplates(ctx context.Context, cfg config.VPNConfig) (*podTemplates, error) {
+	sources := make(map[string]string, len(cfg.PodTemplates))
+	for name, raw := range cfg.PodTemplates {
+		sources[strings.ToLower(name)] = raw
+	}
+
+	var errs []error
+	if name := cfg.PodTemplateConfigMap; name != "" {
+		cm, err := vm.clientset.CoreV1().ConfigMaps(vm.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load pod template ConfigMap %s: %v", name, err)
+		}
+		for key, raw := range cm.Data {
+			lower := strings.ToLower(key)
+			if _, exists := sources[lower]; exists {
+				errs = append(errs, fmt.Errorf("pod template %q is defined more than once in config and ConfigMap %s; names are not case-sensitive", key, name))
+				continue
+			}
+			sources[lower] = raw
+		}
+	}
+
+	templates := &podTemplates{
+		templates:       make(map[string]*corev1.PodTemplateSpec, len(sources)),
+		defaultTemplate: strings.ToLower(cfg.PodTemplate),
+		tenantTemplates: make(map[string]string, len(cfg.TenantPodTemplates)),
+	}
+	for tenant, name := range cfg.TenantPodTemplates {
+		templates.tenantTemplates[strings.ToLower(tenant)] = strings.ToLower(name)
+	}
+
+	for name, raw := range sources {
+		tmpl, err := parsePodTemplate(raw)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pod template %q: %v", name, err))
+			continue
+		}
+		for _, err := range validatePodTemplate(tmpl, vm.containerName) {
+			errs = append(errs, fmt.Errorf("pod template %q: %v", name, err))
+		}
+		templates.templates[name] = tmpl
+	}
+
+	if name := templates.defaultTemplate; name != "" && !hasKey(sources, name) {
+		errs = append(errs, fmt.Errorf("default pod template %q is not defined", name))
+	}
+	for tenant, name := range templates.tenantTemplates {
+		if !hasKey(sources, name) {
+			errs = append(errs, fmt.Errorf("pod template %q for tenant %q is not defined", name, tenant))
+		}
+	}
+
+	if err := utilerrors.NewAggregate(errs); err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+// PodTemplateNames returns the names of the loaded pod templates
+func (vm *VPNManager) PodTemplateNames() []string {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+
+	names := make([]string, 0, len(vm.podTemplates.templates))
+	for name := range vm.podTemplates.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolvePodTemplate picks the template for a user: the plan's template, then
+// the tenant's, then the default, matching names regardless of case. It
+// returns an empty name and nil template when no template applies.
+func (vm *VPNManager) resolvePodTemplate(user *models.User, plan *models.Plan) (string, *corev1.PodTemplateSpec, error) {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+
+	var name string
+	if plan != nil {
+		name = strings.ToLower(plan.PodTemplate)
+	}
+	if name == "" && user.Tenant != "" {
+		name = vm.podTemplates.tenantTemplates[strings.ToLower(user.Tenant)]
+	}
+	if name == "" {
+		name = vm.podTemplates.defaultTemplate
+	}
+	if name == "" {
+		return "", nil, nil
+	}
+
+	tmpl, exists := vm.podTemplates.templates[name]
+	if !exists {
+		return "", nil, fmt.Errorf("pod template %q is not defined", name)
+	}
+
+	return name, tmpl, nil
+}
+
+// hasKey reports whether key is present in m
+func hasKey(m map[string]string, key string) bool {
+	_, ok := m[key]
+	return ok
+}
+
+// parsePodTemplate decodes a YAML PodTemplateSpec, rejecting unknown fields
+func parsePodTemplate(raw string) (*corev1.PodTemplateSpec, error) {
+	tmpl := &corev1.PodTemplateSpec{}
+	if err := yaml.UnmarshalStrict([]byte(raw), tmpl); err != nil {
+		return nil, fmt.Errorf("invalid YAML: %v", err)
+	}
+	return tmpl, nil
+}
+
+// validatePodTemplate checks that a template can be merged with the fields
+// VPNManager generates
+func validatePodTemplate(tmpl *corev1.PodTemplateSpec, containerName string) []error {
+	var errs []error
+	spec := &tmpl.Spec
+
+	if spec.RestartPolicy != "" && spec.RestartPolicy != corev1.RestartPolicyAlways {
+		errs = append(errs, fmt.Errorf("restartPolicy must be Always, got %s", spec.RestartPolicy))
+	}
+
+	seen := map[string]bool{}
+	for _, container := range append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...) {
+		if container.Name == "" {
+			errs = append(errs, fmt.Errorf("container without a name"))
+			continue
+		}
+		if seen[container.Name] {
+			errs = append(errs, fmt.Errorf("duplicate container %q", container.Name))
+		}
+		seen[container.Name] = true
+	}
+
+	for _, container := range spec.Containers {
+		if container.Name == containerName {
+			if container.Image != "" {
+				errs = append(errs, fmt.Errorf("container %q may not set image, it is managed by vpn.image", containerName))
+			}
+			continue
+		}
+		if container.Image == "" {
+			errs = append(errs, fmt.Errorf("container %q has no image", container.Name))
+		}
+	}
+
+	for _, volume := range spec.Volumes {
+		if volume.Name == configVolume {
+			errs = append(errs, fmt.Errorf("volume name %q is reserved", configVolume))
+		}
+	}
+
+	for _, toleration := range spec.Tolerations {
+		switch toleration.Operator {
+		case "", corev1.TolerationOpEqual:
+		case corev1.TolerationOpExists:
+			if toleration.Value != "" {
+				errs = append(errs, fmt.Errorf("toleration %q with operator Exists may not set a value", toleration.Key))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("toleration %q has invalid operator %s", toleration.Key, toleration.Operator))
+		}
+		switch toleration.Effect {
+		case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			errs = append(errs, fmt.Errorf("toleration %q has invalid effect %s", toleration.Key, toleration.Effect))
+		}
+	}
+
+	if spec.SecurityContext != nil {
+		for _, sysctl := range spec.SecurityContext.Sysctls {
+			if sysctl.Name == "" {
+				errs = append(errs, fmt.Errorf("sysctl without a name"))
+			}
+		}
+	}
+
+	return errs
+}
+
+// mergePodTemplate overlays the generated VPN pod onto a template. Generated
+// labels, image, ports, config mount and resources always win; everything
+// else, such as probes, scheduling constraints and sysctls, comes from the
+// template. The VPN container keeps the template's security context if it
+// sets one.
+func mergePodTemplate(tmpl *corev1.PodTemplateSpec, generated corev1.PodTemplateSpec, containerName string) corev1.PodTemplateSpec {
+	merged := *tmpl.DeepCopy()
+
+	if merged.Labels == nil {
+		merged.Labels = map[string]string{}
+	}
+	for key, value := range generated.Labels {
+		merged.Labels[key] = value
+	}
+	for key, value := range generated.Annotations {
+		if merged.Annotations == nil {
+			merged.Annotations = map[string]string{}
+		}
+		merged.Annotations[key] = value
+	}
+
+	var vpnContainer corev1.Container
+	for _, container := range generated.Spec.Containers {
+		if container.Name == containerName {
+			vpnContainer = container
+		}
+	}
+
+	found := false
+	for i := range merged.Spec.Containers {
+		container := &merged.Spec.Containers[i]
+		if container.Name != containerName {
+			continue
+		}
+		found = true
+
+		container.Image = vpnContainer.Image
+		container.Resources = vpnContainer.Resources
+		container.Ports = mergePorts(container.Ports, vpnContainer.Ports)
+		container.VolumeMounts = append(container.VolumeMounts, vpnContainer.VolumeMounts...)
+		if container.SecurityContext == nil {
+			container.SecurityContext = vpnContainer.SecurityContext
+		}
+	}
+	if !found {
+		merged.Spec.Containers = append([]corev1.Container{vpnContainer}, merged.Spec.Containers...)
+	}
+
+	merged.Spec.Volumes = append(merged.Spec.Volumes, generated.Spec.Volumes...)
+	merged.Spec.RestartPolicy = corev1.RestartPolicyAlways
+
+	return merged
+}
+
+// mergePorts adds the generated ports, replacing template ports of the same name
+func mergePorts(template, generated []corev1.ContainerPort) []corev1.ContainerPort {
+	names := map[string]bool{}
+	for _, port := range generated {
+		names[port.Name] = true
+	}
+
+	ports := make([]corev1.ContainerPort, 0, len(template)+len(generated))
+	for _, port := range template {
+		if !names[port.Name] {
+			ports = append(ports, port)
+		}
+	}
+	return append(ports, generated...)
+}
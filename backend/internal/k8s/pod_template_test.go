@@ -0,0 +1,314 @@
+package k8s
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/models"
+)
+
+const dedicatedTemplate = `
+metadata:
+  annotations:
+    prometheus.io/scrape: "true"
+  labels:
+    pool: vpn
+spec:
+  nodeSelector:
+    node-role.example.com/vpn: "true"
+  tolerations:
+  - key: dedicated
+    operator: Equal
+    value: vpn
+    effect: NoSchedule
+  priorityClassName: vpn-critical
+  securityContext:
+    sysctls:
+    - name: net.ipv4.ip_forward
+      value: "1"
+  containers:
+  - name: wireguard
+    livenessProbe:
+      exec:
+        command: ["wg", "show"]
+    ports:
+    - name: metrics
+      containerPort: 9586
+  - name: exporter
+    image: mindflavor/prometheus-wireguard-exporter:3.6.6
+`
+
+func TestLoadPodTemplates(t *testing.T) {
+	templateConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "vpn-templates", Namespace: testNamespace},
+		Data:       map[string]string{"from-configmap": "spec:\n  priorityClassName: low\n"},
+	}
+
+	tests := []struct {
+		name      string
+		configure func(cfg *config.VPNConfig)
+		objects   []runtime.Object
+		wantNames []string
+		wantErr   []string
+	}{
+		{
+			name:      "no templates",
+			configure: func(cfg *config.VPNConfig) {},
+		},
+		{
+			name: "inline and configmap templates",
+			configure: func(cfg *config.VPNConfig) {
+				cfg.PodTemplates = map[string]string{"dedicated": dedicatedTemplate}
+				cfg.PodTemplateConfigMap = "vpn-templates"
+				cfg.PodTemplate = "dedicated"
+				cfg.TenantPodTemplates = map[string]string{"acme": "from-configmap"}
+			},
+			objects:   []runtime.Object{templateConfigMap},
+			wantNames: []string{"dedicated", "from-configmap"},
+		},
+		{
+			name:      "missing configmap",
+			configure: func(cfg *config.VPNConfig) { cfg.PodTemplateConfigMap = "vpn-templates" },
+			wantErr:   []string{"failed to load pod template ConfigMap"},
+		},
+		{
+			name: "all errors are reported together",
+			configure: func(cfg *config.VPNConfig) {
+				cfg.PodTemplates = map[string]string{
+					"typo":     "spec:\n  nodeSelecter: {}\n",
+					"bad":      "spec:\n  restartPolicy: Never\n  volumes:\n  - name: config\n    emptyDir: {}\n  containers:\n  - name: wireguard\n    image: custom\n  - name: sidecar\n",
+					"tolerant": "spec:\n  tolerations:\n  - key: a\n    operator: Exists\n    value: b\n  - key: c\n    operator: Maybe\n    effect: Sometimes\n",
+				}
+				cfg.PodTemplate = "missing"
+				cfg.TenantPodTemplates = map[string]string{"acme": "absent"}
+			},
+			wantErr: []string{
+				`pod template "typo": invalid YAML`,
+				"restartPolicy must be Always",
+				`volume name "config" is reserved`,
+				`container "wireguard" may not set image`,
+				`container "sidecar" has no image`,
+				"operator Exists may not set a value",
+				"invalid operator Maybe",
+				"invalid effect Sometimes",
+				`default pod template "missing" is not defined`,
+				`pod template "absent" for tenant "acme" is not defined`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := newTestManager(fake.NewSimpleClientset(tt.objects...), tt.configure)
+			err := vm.LoadPodTemplates(context.Background())
+
+			if len(tt.wantErr) > 0 {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				for _, want := range tt.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("error %q does not mention %q", err, want)
+					}
+				}
+				if len(vm.PodTemplateNames()) != 0 {
+					t.Errorf("templates were applied despite errors")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := strings.Join(vm.PodTemplateNames(), ","); got != strings.Join(tt.wantNames, ",") {
+				t.Fatalf("got templates %q, want %v", got, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestBuildDeploymentWithPodTemplate(t *testing.T) {
+	vm := newTestManager(fake.NewSimpleClientset(), func(cfg *config.VPNConfig) {
+		cfg.PodTemplates = map[string]string{
+			"dedicated": dedicatedTemplate,
+			"basic":     "metadata:\n  labels:\n    app: overridden\n",
+		}
+		cfg.PodTemplate = "basic"
+		cfg.TenantPodTemplates = map[string]string{"acme": "dedicated"}
+	})
+	if err := vm.LoadPodTemplates(context.Background()); err != nil {
+		t.Fatalf("load templates: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		user         *models.User
+		plan         *models.Plan
+		wantTemplate string
+	}{
+		{"default template", &models.User{ID: "1"}, nil, "basic"},
+		{"tenant template", &models.User{ID: "2", Tenant: "acme"}, nil, "dedicated"},
+		{"unmapped tenant falls back to default", &models.User{ID: "3", Tenant: "other"}, nil, "basic"},
+		{"plan template wins", &models.User{ID: "4", Tenant: "acme"}, &models.Plan{Name: "pro", PodTemplate: "basic"}, "basic"},
+		{"plan without template", &models.User{ID: "5", Tenant: "acme"}, &models.Plan{Name: "pro"}, "dedicated"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deployment, err := vm.buildDeployment(tt.user, tt.plan, "vpn-"+tt.user.ID, "vpn-config-"+tt.user.ID)
+			if err != nil {
+				t.Fatalf("build: %v", err)
+			}
+			if tt.user.PodTemplate != tt.wantTemplate {
+				t.Fatalf("got template %q, want %q", tt.user.PodTemplate, tt.wantTemplate)
+			}
+
+			// Generated labels always win over the template
+			if got := deployment.Spec.Template.Labels["app"]; got != "vpnaas" {
+				t.Errorf("got app label %q", got)
+			}
+			if got := deployment.Spec.Template.Spec.RestartPolicy; got != corev1.RestartPolicyAlways {
+				t.Errorf("got restart policy %q", got)
+			}
+		})
+	}
+
+	if _, _, err := vm.resolvePodTemplate(&models.User{ID: "6"}, &models.Plan{PodTemplate: "deleted"}); err == nil {
+		t.Fatalf("expected error for unknown plan template")
+	}
+}
+
+func TestPodTemplateNamesIgnoreCase(t *testing.T) {
+	// Viper lowercases the keys it reads, while ConfigMap keys, plans and
+	// users keep the case they were given
+	loaded, err := config.LoadYAML(`
+vpn:
+  endpoint: vpn.example.com
+  cluster_cidrs: [10.244.0.0/16]
+  pod_templates:
+    Basic: "metadata:\n  labels:\n    tier: basic\n"
+  pod_template: Basic
+  pod_template_configmap: vpn-templates
+  tenant_pod_templates:
+    ACME: Dedicated
+`)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	templateConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "vpn-templates", Namespace: testNamespace},
+		Data:       map[string]string{"Dedicated": dedicatedTemplate},
+	}
+	vm := newTestManager(fake.NewSimpleClientset(templateConfigMap), func(cfg *config.VPNConfig) {
+		cfg.PodTemplates = loaded.VPN.PodTemplates
+		cfg.PodTemplate = loaded.VPN.PodTemplate
+		cfg.PodTemplateConfigMap = loaded.VPN.PodTemplateConfigMap
+		cfg.TenantPodTemplates = loaded.VPN.TenantPodTemplates
+	})
+	if err := vm.LoadPodTemplates(context.Background()); err != nil {
+		t.Fatalf("load templates: %v", err)
+	}
+	if got := strings.Join(vm.PodTemplateNames(), ","); got != "basic,dedicated" {
+		t.Fatalf("got templates %q, want basic,dedicated", got)
+	}
+
+	tests := []struct {
+		name         string
+		user         *models.User
+		plan         *models.Plan
+		wantTemplate string
+	}{
+		{"default template", &models.User{ID: "1"}, nil, "basic"},
+		{"tenant in another case", &models.User{ID: "2", Tenant: "Acme"}, nil, "dedicated"},
+		{"plan template in another case", &models.User{ID: "3"}, &models.Plan{Name: "pro", PodTemplate: "DEDICATED"}, "dedicated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, tmpl, err := vm.resolvePodTemplate(tt.user, tt.plan)
+			if err != nil {
+				t.Fatalf("resolve: %v", err)
+			}
+			if name != tt.wantTemplate || tmpl == nil {
+				t.Errorf("got template %q, want %q", name, tt.wantTemplate)
+			}
+		})
+	}
+
+	// Names differing only in case collide
+	templateConfigMap.Data = map[string]string{"BASIC": dedicatedTemplate}
+	vm = newTestManager(fake.NewSimpleClientset(templateConfigMap), func(cfg *config.VPNConfig) {
+		cfg.PodTemplates = loaded.VPN.PodTemplates
+		cfg.PodTemplateConfigMap = "vpn-templates"
+	})
+	if err := vm.LoadPodTemplates(context.Background()); err == nil || !strings.Contains(err.Error(), `pod template "BASIC" is defined more than once`) {
+		t.Errorf("got error %v for templates differing only in case", err)
+	}
+}
+
+func TestMergePodTemplate(t *testing.T) {
+	tmpl, err := parsePodTemplate(dedicatedTemplate)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	vm := newTestManager(fake.NewSimpleClientset())
+	user := &models.User{ID: "1"}
+	generated, err := vm.buildDeployment(user, nil, "vpn-1", "vpn-config-1")
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+
+	merged := mergePodTemplate(tmpl, generated.Spec.Template, "wireguard")
+	spec := merged.Spec
+
+	if merged.Labels["pool"] != "vpn" || merged.Labels["user"] != "1" {
+		t.Errorf("unexpected labels %v", merged.Labels)
+	}
+	if merged.Annotations["prometheus.io/scrape"] != "true" {
+		t.Errorf("template annotations lost: %v", merged.Annotations)
+	}
+	if spec.NodeSelector["node-role.example.com/vpn"] != "true" || len(spec.Tolerations) != 1 || spec.PriorityClassName != "vpn-critical" {
+		t.Errorf("scheduling constraints lost: %+v", spec)
+	}
+	if spec.SecurityContext == nil || len(spec.SecurityContext.Sysctls) != 1 {
+		t.Errorf("sysctls lost: %+v", spec.SecurityContext)
+	}
+
+	if len(spec.Containers) != 2 || spec.Containers[0].Name != "wireguard" || spec.Containers[1].Name != "exporter" {
+		t.Fatalf("unexpected containers %+v", spec.Containers)
+	}
+	wg := spec.Containers[0]
+	if wg.Image != vm.image {
+		t.Errorf("got image %q, want %q", wg.Image, vm.image)
+	}
+	if wg.LivenessProbe == nil {
+		t.Errorf("template probe lost")
+	}
+	if len(wg.Ports) != 2 {
+		t.Errorf("got ports %+v, want template and generated port", wg.Ports)
+	}
+	if len(wg.VolumeMounts) != 1 || wg.VolumeMounts[0].MountPath != "/config/wg_confs" {
+		t.Errorf("unexpected volume mounts %+v", wg.VolumeMounts)
+	}
+	if wg.SecurityContext == nil || len(wg.SecurityContext.Capabilities.Add) != 2 {
+		t.Errorf("default capabilities not applied: %+v", wg.SecurityContext)
+	}
+	if wg.Resources.Limits.Cpu().IsZero() {
+		t.Errorf("generated resources not applied")
+	}
+
+	if len(spec.Volumes) != 1 || spec.Volumes[0].Name != configVolume {
+		t.Errorf("unexpected volumes %+v", spec.Volumes)
+	}
+
+	// The template itself is not modified
+	if len(tmpl.Spec.Containers[0].VolumeMounts) != 0 {
+		t.Errorf("template was mutated")
+	}
+}
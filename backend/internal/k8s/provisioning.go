@@ -0,0 +1,116 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"vpnaas-backend/internal/metrics"
+)
+
+// provisioningError is a provisioning failure together with the reason it is
+// reported under in vpnaas_provisioning_failures_total
+type provisioningError struct {
+	reason string
+	err    error
+}
+
+func (e *provisioningError) Error() string {
+	return e.err.Error()
+}
+
+func (e *provisioningError) Unwrap() error {
+	return e.err
+}
+
+// apiFailure describes a failed Kubernetes API call, attributing it to a
+// ResourceQuota when one rejected the call
+func apiFailure(message string, err error) error {
+	reason := metrics.FailureAPIError
+	if isQuotaExceeded(err) {
+		reason = metrics.FailureQuota
+	}
+	return &provisioningError{reason: reason, err: fmt.Errorf("%s: %v", message, err)}
+}
+
+// failureReason returns the reason a provisioning error is reported under.
+// Errors that never reached the cluster, such as an invalid pod template,
+// are internal.
+func failureReason(err error) string {
+	var provisioningErr *provisioningError
+	if errors.As(err, &provisioningErr) {
+		return provisioningErr.reason
+	}
+	return metrics.FailureInternal
+}
+
+// isQuotaExceeded reports whether the API server rejected a request because
+// it would exceed a ResourceQuota in the namespace
+func isQuotaExceeded(err error) bool {
+	return apierrors.IsForbidden(err) && strings.Contains(err.Error(), "exceeded quota")
+}
+
+// timeStep records the duration of a provisioning step when the returned
+// function is called
+func timeStep(step string) func() {
+	start := time.Now()
+	return func() {
+		metrics.RecordProvisioningStep(step, time.Since(start))
+	}
+}
+
+// stalledReason works out why a workload did not become ready in time from
+// the Deployment's conditions and the conditions and container statuses of
+// its pod
+func (vm *VPNManager) stalledReason(ctx context.Context, name, userID string) string {
+	deployment, err := vm.clientset.AppsV1().Deployments(vm.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err == nil {
+		// Pods rejected by a ResourceQuota are never created, the ReplicaSet
+		// controller reports them on the Deployment instead
+		for _, condition := range deployment.Status.Conditions {
+			if condition.Type == appsv1.DeploymentReplicaFailure && condition.Status == corev1.ConditionTrue &&
+				strings.Contains(condition.Message, "exceeded quota") {
+				return metrics.FailureQuota
+			}
+		}
+	}
+
+	pod, err := vm.currentPod(ctx, userID)
+	if err != nil || pod == nil {
+		return metrics.FailureTimeout
+	}
+	return podFailureReason(pod)
+}
+
+// podFailureReason returns why a pod is not ready, or the timeout reason when
+// nothing in its status explains it
+func podFailureReason(pod *corev1.Pod) string {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse &&
+			condition.Reason == corev1.PodReasonUnschedulable {
+			return metrics.FailureUnschedulable
+		}
+	}
+
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		if status.State.Waiting == nil {
+			continue
+		}
+		switch status.State.Waiting.Reason {
+		case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "ErrImageNeverPull":
+			return metrics.FailureImagePull
+		case "CrashLoopBackOff":
+			return metrics.FailureCrashLoop
+		}
+	}
+
+	return metrics.FailureTimeout
+}
@@ -0,0 +1,188 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"vpnaas-backend/internal/metrics"
+	"vpnaas-backend/internal/models"
+)
+
+// observations returns how many values a histogram series has recorded
+func observations(t *testing.T, observer prometheus.Observer) uint64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := observer.(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatalf("read histogram: %v", err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestCreateUserVPNFailureReasons(t *testing.T) {
+	quotaErr := apierrors.NewForbidden(schema.GroupResource{Resource: "services"}, "vpn-x",
+		errors.New("exceeded quota: vpnaas, requested: services.loadbalancers=1, used: services.loadbalancers=5, limited: services.loadbalancers=5"))
+
+	waiting := func(reason string) *corev1.PodStatus {
+		return &corev1.PodStatus{
+			Phase: corev1.PodPending,
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:  "wireguard",
+				State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason}},
+			}},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		setup      func(client *fake.Clientset)
+		podStatus  *corev1.PodStatus
+		egress     string
+		wantReason string
+	}{
+		{
+			name: "api error",
+			setup: func(client *fake.Clientset) {
+				failOn(client, "create", "deployments", apierrors.NewInternalError(errors.New("etcd unavailable")))
+			},
+			wantReason: metrics.FailureAPIError,
+		},
+		{
+			name: "service rejected by quota",
+			setup: func(client *fake.Clientset) {
+				failOn(client, "create", "services", quotaErr)
+			},
+			wantReason: metrics.FailureQuota,
+		},
+		{
+			name: "pods rejected by quota",
+			setup: func(client *fake.Clientset) {
+				client.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					name := action.(k8stesting.GetAction).GetName()
+					obj, err := client.Tracker().Get(appsv1.SchemeGroupVersion.WithResource("deployments"), action.GetNamespace(), name)
+					if err != nil {
+						return true, nil, err
+					}
+					deployment := obj.(*appsv1.Deployment).DeepCopy()
+					deployment.Status.Conditions = []appsv1.DeploymentCondition{{
+						Type:    appsv1.DeploymentReplicaFailure,
+						Status:  corev1.ConditionTrue,
+						Reason:  "FailedCreate",
+						Message: `pods "vpn-x-1" is forbidden: exceeded quota: vpnaas`,
+					}}
+					return true, deployment, nil
+				})
+			},
+			wantReason: metrics.FailureQuota,
+		},
+		{
+			name: "unschedulable",
+			podStatus: &corev1.PodStatus{
+				Phase: corev1.PodPending,
+				Conditions: []corev1.PodCondition{{
+					Type:   corev1.PodScheduled,
+					Status: corev1.ConditionFalse,
+					Reason: corev1.PodReasonUnschedulable,
+				}},
+			},
+			wantReason: metrics.FailureUnschedulable,
+		},
+		{
+			name:       "image pull",
+			podStatus:  waiting("ImagePullBackOff"),
+			wantReason: metrics.FailureImagePull,
+		},
+		{
+			name:       "crash loop",
+			podStatus:  waiting("CrashLoopBackOff"),
+			wantReason: metrics.FailureCrashLoop,
+		},
+		{
+			name:       "timeout",
+			podStatus:  &corev1.PodStatus{Phase: corev1.PodRunning},
+			wantReason: metrics.FailureTimeout,
+		},
+		{
+			name:       "undefined egress profile",
+			egress:     "missing",
+			wantReason: metrics.FailureInternal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := models.NewUser("alice", "alice@example.com")
+			user.EgressProfile = tt.egress
+
+			client := fake.NewSimpleClientset()
+			simulateReadyReplicas(client, 0)
+			if tt.setup != nil {
+				tt.setup(client)
+			}
+			if tt.podStatus != nil {
+				pod := testPod("vpn-pod", tt.podStatus.Phase, userLabels(user.ID))
+				pod.Status = *tt.podStatus
+				if err := client.Tracker().Add(pod); err != nil {
+					t.Fatalf("add pod: %v", err)
+				}
+			}
+
+			failures := testutil.ToFloat64(metrics.ProvisioningFailures.WithLabelValues(tt.wantReason))
+			attempts := observations(t, metrics.ProvisioningDuration.WithLabelValues("failure"))
+
+			err := newTestManager(client).CreateUserVPN(context.Background(), user, nil)
+			if err == nil {
+				t.Fatalf("expected error")
+			}
+			if got := failureReason(err); got != tt.wantReason {
+				t.Errorf("got reason %q, want %q", got, tt.wantReason)
+			}
+			if got := testutil.ToFloat64(metrics.ProvisioningFailures.WithLabelValues(tt.wantReason)) - failures; got != 1 {
+				t.Errorf("got %v new %s failures, want 1", got, tt.wantReason)
+			}
+			if got := observations(t, metrics.ProvisioningDuration.WithLabelValues("failure")); got != attempts+1 {
+				t.Errorf("got %d failed provisioning durations, want %d", got, attempts+1)
+			}
+		})
+	}
+}
+
+func TestCreateUserVPNRecordsSteps(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	simulateReadyReplicas(client, 1)
+
+	before := map[string]uint64{}
+	steps := []string{
+		metrics.StepDeploymentCreate,
+		metrics.StepSecretCreate,
+		metrics.StepServiceCreate,
+		metrics.StepNetworkPolicyApply,
+		metrics.StepReadinessWait,
+	}
+	for _, step := range steps {
+		before[step] = observations(t, metrics.ProvisioningStepDuration.WithLabelValues(step))
+	}
+
+	user := models.NewUser("alice", "alice@example.com")
+	if err := newTestManager(client).CreateUserVPN(context.Background(), user, nil); err != nil {
+		t.Fatalf("CreateUserVPN: %v", err)
+	}
+
+	for _, step := range steps {
+		got := observations(t, metrics.ProvisioningStepDuration.WithLabelValues(step))
+		if got != before[step]+1 {
+			t.Errorf("%s: got %d observations, want %d", step, got, before[step]+1)
+		}
+	}
+}
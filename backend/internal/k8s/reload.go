@@ -0,0 +1,172 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/logging"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/tracing"
+)
+
+const (
+	// templateHashAnnotation records on a Deployment the pod template it was
+	// last given, so that rollouts can skip workloads that would not change
+	templateHashAnnotation = "vpnaas.io/template-hash"
+	// baseHashAnnotation records the same pod template without the VPN
+	// image, so that an image rollout can work out the new template hash
+	// without rendering the template again
+	baseHashAnnotation = "vpnaas.io/base-template-hash"
+)
+
+// templateHashes hashes a rendered pod template without the image of its VPN
+// container, and then together with that image
+func templateHashes(template corev1.PodTemplateSpec, containerName string) (base, full string, err error) {
+	var image string
+	template = *template.DeepCopy()
+	for i := range template.Spec.Containers {
+		if container := &template.Spec.Containers[i]; container.Name == containerName {
+			image = container.Image
+			container.Image = ""
+		}
+	}
+
+	data, err := json.Marshal(template)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to hash pod template: %v", err)
+	}
+	base = configHash(string(data))
+	return base, imageTemplateHash(base, image), nil
+}
+
+// imageTemplateHash combines the base hash of a pod template with the image
+// of its VPN container
+func imageTemplateHash(base, image string) string {
+	return configHash(base + "\n" + image)
+}
+
+// vpnConfig returns the configuration currently applied
+func (vm *VPNManager) vpnConfig() config.VPNConfig {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+	return vm.config
+}
+
+// ApplyConfig switches the manager to a new configuration. Pod templates and
+// egress profiles are rebuilt from it first, and nothing changes unless they
+// are all valid. Workloads created or updated afterwards use the new
+// configuration; existing ones keep theirs until they are updated, see
+// RolloutUserVPN. The container name, mount path, interface and ready
+// timeout are fixed at startup.
+func (vm *VPNManager) ApplyConfig(ctx context.Context, cfg config.VPNConfig) error {
+	var errs []error
+	templates, err := vm.buildPodTemplates(ctx, cfg)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	profiles, err := buildEgressProfiles(cfg)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if err := utilerrors.NewAggregate(errs); err != nil {
+		return err
+	}
+
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	// An image rolled out explicitly is kept until vpn.image itself changes
+	if cfg.Image != vm.config.Image {
+		vm.image = cfg.Image
+	}
+	vm.config = cfg
+	vm.clusterCIDRs = parseClusterCIDRs(cfg.ClusterCIDRs)
+	vm.podTemplates = templates
+	vm.egressProfiles = profiles
+	return nil
+}
+
+// RolloutUserVPN updates a user's VPN workload to the current configuration
+// like UpdateUserVPN, then waits until the Deployment has replaced its pods
+// and one is ready, so that workloads can be rolled one at a time. A workload
+// whose pod template would not change is left running and reported as
+// unchanged; only the user's network policy and client configuration, which
+// do not restart the pod, are brought up to date.
+func (vm *VPNManager) RolloutUserVPN(ctx context.Context, user *models.User, plan *models.Plan) (changed bool, err error) {
+	ctx, span := tracing.Start(ctx, "VPNManager.RolloutUserVPN", attribute.String("user.id", user.ID))
+	defer func() { tracing.End(span, err) }()
+	ctx = withUserLogger(ctx, user)
+
+	desired, err := vm.buildDeployment(user, plan, user.WorkloadName, configSecretName(user.ID))
+	if err != nil {
+		return false, err
+	}
+	current, err := vm.clientset.AppsV1().Deployments(vm.namespace).Get(ctx, user.WorkloadName, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to get VPN deployment: %v", err)
+	}
+
+	if current.Annotations[templateHashAnnotation] == desired.Annotations[templateHashAnnotation] {
+		if err := vm.applyNetworkPolicy(ctx, user, plan, ownerReference(current)); err != nil {
+			return false, err
+		}
+		user.PeerRemoved = user.Status == "suspended"
+		user.ConfigData = vm.clientConfig(user, plan)
+		logging.FromContext(ctx).Debugf("VPN deployment %s is up to date", user.WorkloadName)
+		return false, nil
+	}
+
+	if err := vm.UpdateUserVPN(ctx, user, plan); err != nil {
+		return false, err
+	}
+	return true, vm.waitForRollout(ctx, user.WorkloadName)
+}
+
+// waitForRollout waits until a Deployment's controller has seen its latest
+// spec and every replica runs the new pod template
+func (vm *VPNManager) waitForRollout(ctx context.Context, name string) error {
+	err := wait.PollUntilContextTimeout(ctx, vm.pollInterval, vm.readyTimeout, true, func(ctx context.Context) (bool, error) {
+		deployment, err := vm.clientset.AppsV1().Deployments(vm.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return false, err
+			}
+			logging.FromContext(ctx).Debugf("Waiting for VPN deployment %s to roll out: %v", name, err)
+			return false, nil
+		}
+		return rolledOut(deployment), nil
+	})
+	if err != nil {
+		if wait.Interrupted(err) {
+			return fmt.Errorf("timed out waiting for VPN deployment %s to roll out", name)
+		}
+		return fmt.Errorf("failed waiting for VPN deployment %s to roll out: %v", name, err)
+	}
+
+	logging.FromContext(ctx).Infof("Rolled out VPN deployment %s", name)
+	return nil
+}
+
+// rolledOut reports whether a Deployment's rollout is complete, as
+// kubectl rollout status does
+func rolledOut(deployment *appsv1.Deployment) bool {
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	status := deployment.Status
+	return status.ObservedGeneration >= deployment.Generation &&
+		status.UpdatedReplicas >= replicas &&
+		status.Replicas == status.UpdatedReplicas &&
+		status.ReadyReplicas >= 1
+}
@@ -0,0 +1,194 @@
+package k8s
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/models"
+)
+
+func TestApplyConfig(t *testing.T) {
+	ctx := context.Background()
+	user := &models.User{ID: "1", Username: "alice", ServerPublicKey: "server-key"}
+	vm := newTestManager(fake.NewSimpleClientset())
+
+	invalid := testConfig(func(cfg *config.VPNConfig) {
+		cfg.Endpoint = "vpn2.example.com"
+		cfg.DefaultEgressProfile = "missing"
+	})
+	if err := vm.ApplyConfig(ctx, invalid); err == nil || !strings.Contains(err.Error(), `"missing"`) {
+		t.Fatalf("got error %v for an undefined egress profile", err)
+	}
+	if got := vm.clientConfig(user, nil); !strings.Contains(got, "Endpoint = vpn.example.com:51820") {
+		t.Errorf("rejected configuration was applied:\n%s", got)
+	}
+
+	if _, err := vm.RolloutImage(ctx, "wireguard:pinned"); err != nil {
+		t.Fatalf("rollout image: %v", err)
+	}
+	changed := testConfig(func(cfg *config.VPNConfig) {
+		cfg.Endpoint = "vpn2.example.com"
+		cfg.PodCPULimit = "250m"
+		cfg.EgressProfiles = map[string]models.EgressProfile{"partner-a": {NodePool: "egress-a", PublicIP: "203.0.113.10"}}
+	})
+	if err := vm.ApplyConfig(ctx, changed); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if got := vm.clientConfig(user, nil); !strings.Contains(got, "Endpoint = vpn2.example.com:51820") {
+		t.Errorf("client config does not use the new endpoint:\n%s", got)
+	}
+	if got := vm.EgressProfiles(); len(got) != 1 || got[0].Name != "partner-a" {
+		t.Errorf("got egress profiles %+v", got)
+	}
+	deployment, err := vm.buildDeployment(user, nil, "vpn-1", "vpn-config-1")
+	if err != nil {
+		t.Fatalf("build deployment: %v", err)
+	}
+	container := deployment.Spec.Template.Spec.Containers[0]
+	if got := container.Resources.Limits.Cpu().String(); got != "250m" {
+		t.Errorf("got cpu limit %s, want 250m", got)
+	}
+	if container.Image != "wireguard:pinned" {
+		t.Errorf("got image %s, want the rolled out image kept while vpn.image is unchanged", container.Image)
+	}
+
+	changed.Image = "wireguard:1.1"
+	if err := vm.ApplyConfig(ctx, changed); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	deployment, _ = vm.buildDeployment(user, nil, "vpn-1", "vpn-config-1")
+	if got := deployment.Spec.Template.Spec.Containers[0].Image; got != "wireguard:1.1" {
+		t.Errorf("got image %s, want the new vpn.image", got)
+	}
+}
+
+func TestRolloutUserVPN(t *testing.T) {
+	tests := []struct {
+		name      string
+		unchanged bool
+		complete  bool
+		wantErr   string
+	}{
+		{name: "waits for the rollout", complete: true},
+		{name: "rollout never completes", wantErr: "timed out waiting for VPN deployment vpn-1 to roll out"},
+		{name: "unchanged workload is skipped", unchanged: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			user := &models.User{ID: "1", Username: "alice"}
+
+			vm := newTestManager(fake.NewSimpleClientset())
+			deployment, err := vm.buildDeployment(user, nil, "vpn-1", "vpn-config-1")
+			if err != nil {
+				t.Fatalf("build deployment: %v", err)
+			}
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "vpn-config-1", Namespace: testNamespace},
+				Data:       map[string][]byte{serverConfigKey: []byte(vm.serverConfig(user))},
+			}
+			client := fake.NewSimpleClientset(deployment, secret)
+			vm = newTestManager(client, func(cfg *config.VPNConfig) {
+				if !tt.unchanged {
+					cfg.PodMemoryLimit = "256Mi"
+				}
+			})
+			user.WorkloadName = "vpn-1"
+
+			// The fake clientset has no Deployment controller; report the
+			// new pods as rolled out after a few polls
+			gets := 0
+			client.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				obj, err := client.Tracker().Get(appsv1.SchemeGroupVersion.WithResource("deployments"), testNamespace, "vpn-1")
+				if err != nil {
+					return true, nil, err
+				}
+				deployment := obj.(*appsv1.Deployment).DeepCopy()
+				deployment.Generation = 2
+				deployment.Status = appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 2, UpdatedReplicas: 1, ReadyReplicas: 1}
+				if gets++; tt.complete && gets > 3 {
+					deployment.Status = appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 1, UpdatedReplicas: 1, ReadyReplicas: 1}
+				}
+				return true, deployment, nil
+			})
+
+			changed, err := vm.RolloutUserVPN(ctx, user, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rollout: %v", err)
+			}
+			if changed == tt.unchanged {
+				t.Errorf("got changed %v", changed)
+			}
+			if user.ConfigData == "" {
+				t.Errorf("client configuration not rendered")
+			}
+
+			updates := 0
+			for _, action := range client.Actions() {
+				if action.Matches("update", "deployments") {
+					updates++
+				}
+			}
+			if tt.unchanged {
+				if updates != 0 || gets != 1 {
+					t.Errorf("unchanged workload was updated %d times and polled %d times", updates, gets)
+				}
+				return
+			}
+			updated, _ := client.AppsV1().Deployments(testNamespace).Get(ctx, "vpn-1", metav1.GetOptions{})
+			if got := updated.Spec.Template.Spec.Containers[0].Resources.Limits.Memory().String(); got != "256Mi" {
+				t.Errorf("got memory limit %s, want the new configuration", got)
+			}
+			if updated.Annotations[templateHashAnnotation] == deployment.Annotations[templateHashAnnotation] {
+				t.Errorf("template hash not updated")
+			}
+		})
+	}
+}
+
+func TestRolloutImageKeepsTemplateHash(t *testing.T) {
+	ctx := context.Background()
+	user := &models.User{ID: "1", Username: "alice", WorkloadName: "vpn-1"}
+
+	vm := newTestManager(fake.NewSimpleClientset())
+	deployment, err := vm.buildDeployment(user, nil, "vpn-1", "vpn-config-1")
+	if err != nil {
+		t.Fatalf("build deployment: %v", err)
+	}
+	client := fake.NewSimpleClientset(deployment)
+	vm = newTestManager(client)
+
+	if updated, err := vm.RolloutImage(ctx, "wireguard:2"); err != nil || len(updated) != 1 {
+		t.Fatalf("rollout image: got %v, %v", updated, err)
+	}
+	rolled, _ := client.AppsV1().Deployments(testNamespace).Get(ctx, "vpn-1", metav1.GetOptions{})
+	if rolled.Annotations[templateHashAnnotation] == deployment.Annotations[templateHashAnnotation] {
+		t.Fatalf("template hash not updated with the image")
+	}
+
+	// The hash matches the template rendered with the new image, so a
+	// configuration rollout leaves the workload alone
+	changed, err := vm.RolloutUserVPN(ctx, user, nil)
+	if err != nil {
+		t.Fatalf("rollout: %v", err)
+	}
+	if changed {
+		t.Errorf("workload on the rolled out image was updated again")
+	}
+}
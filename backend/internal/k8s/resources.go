@@ -0,0 +1,183 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"vpnaas-backend/internal/models"
+)
+
+// workloadLabels returns the labels shared by all objects of a user's VPN
+func workloadLabels(user *models.User) map[string]string {
+	return userLabels(user.ID)
+}
+
+// workloadName returns the name of a user's Deployment and Service
+func workloadName(userID string) string {
+	return fmt.Sprintf("vpn-%s", userID)
+}
+
+// configSecretName returns the name of the Secret holding a user's WireGuard
+// configuration
+func configSecretName(userID string) string {
+	return fmt.Sprintf("vpn-config-%s", userID)
+}
+
+// userLabels returns the labels identifying the objects of a user's VPN
+func userLabels(userID string) map[string]string {
+	return map[string]string{
+		"app":       "vpnaas",
+		"component": "vpn",
+		"user":      userID,
+	}
+}
+
+// userSelector returns a label selector matching every object of a user's VPN
+func userSelector(userID string) string {
+	return labels.Set(userLabels(userID)).String()
+}
+
+// ownerReference returns a controller reference to a user's Deployment, the
+// root object that every other per-user object hangs off
+func ownerReference(deployment *appsv1.Deployment) metav1.OwnerReference {
+	return *metav1.NewControllerRef(deployment, appsv1.SchemeGroupVersion.WithKind("Deployment"))
+}
+
+// ownedObjectMeta returns the metadata for a per-user object owned by the
+// user's Deployment, so it is garbage collected when the Deployment goes
+func ownedObjectMeta(user *models.User, name, namespace string, owner metav1.OwnerReference) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:            name,
+		Namespace:       namespace,
+		Labels:          workloadLabels(user),
+		OwnerReferences: []metav1.OwnerReference{owner},
+	}
+}
+
+// userResourceKind lists and deletes one kind of per-user object
+type userResourceKind struct {
+	kind   string
+	list   func(ctx context.Context, selector string) ([]metav1.Object, error)
+	delete func(ctx context.Context, name string, opts metav1.DeleteOptions) error
+}
+
+// userResourceKinds returns every kind of object the manager creates for a
+// user, root first. Objects created by older versions without an owner
+// reference are found through their labels as well.
+func (vm *VPNManager) userResourceKinds() []userResourceKind {
+	apps := vm.clientset.AppsV1()
+	core := vm.clientset.CoreV1()
+	networking := vm.clientset.NetworkingV1()
+
+	return []userResourceKind{
+		{
+			kind: "Deployment",
+			list: func(ctx context.Context, selector string) ([]metav1.Object, error) {
+				list, err := apps.Deployments(vm.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+				if err != nil {
+					return nil, err
+				}
+				objects := make([]metav1.Object, 0, len(list.Items))
+				for i := range list.Items {
+					objects = append(objects, &list.Items[i])
+				}
+				return objects, nil
+			},
+			delete: apps.Deployments(vm.namespace).Delete,
+		},
+		{
+			kind: "ReplicaSet",
+			list: func(ctx context.Context, selector string) ([]metav1.Object, error) {
+				list, err := apps.ReplicaSets(vm.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+				if err != nil {
+					return nil, err
+				}
+				objects := make([]metav1.Object, 0, len(list.Items))
+				for i := range list.Items {
+					objects = append(objects, &list.Items[i])
+				}
+				return objects, nil
+			},
+			delete: apps.ReplicaSets(vm.namespace).Delete,
+		},
+		{
+			kind: "Pod",
+			list: func(ctx context.Context, selector string) ([]metav1.Object, error) {
+				list, err := core.Pods(vm.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+				if err != nil {
+					return nil, err
+				}
+				objects := make([]metav1.Object, 0, len(list.Items))
+				for i := range list.Items {
+					objects = append(objects, &list.Items[i])
+				}
+				return objects, nil
+			},
+			delete: core.Pods(vm.namespace).Delete,
+		},
+		{
+			kind: "Secret",
+			list: func(ctx context.Context, selector string) ([]metav1.Object, error) {
+				list, err := core.Secrets(vm.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+				if err != nil {
+					return nil, err
+				}
+				objects := make([]metav1.Object, 0, len(list.Items))
+				for i := range list.Items {
+					objects = append(objects, &list.Items[i])
+				}
+				return objects, nil
+			},
+			delete: core.Secrets(vm.namespace).Delete,
+		},
+		{
+			kind: "ConfigMap",
+			list: func(ctx context.Context, selector string) ([]metav1.Object, error) {
+				list, err := core.ConfigMaps(vm.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+				if err != nil {
+					return nil, err
+				}
+				objects := make([]metav1.Object, 0, len(list.Items))
+				for i := range list.Items {
+					objects = append(objects, &list.Items[i])
+				}
+				return objects, nil
+			},
+			delete: core.ConfigMaps(vm.namespace).Delete,
+		},
+		{
+			kind: "Service",
+			list: func(ctx context.Context, selector string) ([]metav1.Object, error) {
+				list, err := core.Services(vm.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+				if err != nil {
+					return nil, err
+				}
+				objects := make([]metav1.Object, 0, len(list.Items))
+				for i := range list.Items {
+					objects = append(objects, &list.Items[i])
+				}
+				return objects, nil
+			},
+			delete: core.Services(vm.namespace).Delete,
+		},
+		{
+			kind: "NetworkPolicy",
+			list: func(ctx context.Context, selector string) ([]metav1.Object, error) {
+				list, err := networking.NetworkPolicies(vm.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+				if err != nil {
+					return nil, err
+				}
+				objects := make([]metav1.Object, 0, len(list.Items))
+				for i := range list.Items {
+					objects = append(objects, &list.Items[i])
+				}
+				return objects, nil
+			},
+			delete: networking.NetworkPolicies(vm.namespace).Delete,
+		},
+	}
+}
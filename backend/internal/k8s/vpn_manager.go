@@ -5,24 +5,58 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"net/netip"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/crypto/curve25519"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 
 	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/logging"
 	"vpnaas-backend/internal/metrics"
 	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/tracing"
 )
 
-// VPNManager handles VPN pod lifecycle and configuration
+// vpnSelector matches every VPN workload managed by the backend
+const vpnSelector = "app=vpnaas,component=vpn"
+
+// VPNManager handles VPN workload lifecycle and configuration
 type VPNManager struct {
-	clientset *kubernetes.Clientset
-	namespace string
+	clientset     kubernetes.Interface
+	namespace     string
+	containerName string
+	mountPath     string
+	wgInterface   string
+	readyTimeout  time.Duration
+	pollInterval  time.Duration
+	exec          podExecFunc
+	recorder      record.EventRecorder
+
+	// The configuration and what is derived from it are swapped together by
+	// ApplyConfig
+	mu             sync.RWMutex
+	config         config.VPNConfig
+	clusterCIDRs   []netip.Prefix
+	image          string
+	podTemplates   *podTemplates
+	egressProfiles *egressProfiles
+	podInformer    cache.SharedIndexInformer
+	podLister      corelisters.PodLister
 }
 
 // WireGuardKeys represents a pair of WireGuard keys
@@ -31,104 +65,325 @@ type WireGuardKeys struct {
 	PublicKey  string `json:"public_key"`
 }
 
-// NewVPNManager creates a new VPN manager
-func NewVPNManager(clientset *kubernetes.Clientset) *VPNManager {
-	namespace := config.GetString("k8s.namespace")
+// NewVPNManager creates a new VPN manager for the workloads in namespace
+func NewVPNManager(clientset kubernetes.Interface, namespace string, cfg config.VPNConfig) *VPNManager {
 	if namespace == "" {
 		namespace = "vpnaas"
 	}
 
-	return &VPNManager{
-		clientset: clientset,
-		namespace: namespace,
+	readyTimeout := cfg.ReadyTimeout
+	if readyTimeout <= 0 {
+		readyTimeout = 2 * time.Minute
+	}
+
+	containerName := cfg.ContainerName
+	if containerName == "" {
+		containerName = "wireguard"
+	}
+
+	mountPath := cfg.ConfigMountPath
+	if mountPath == "" {
+		mountPath = "/config/wg_confs"
+	}
+
+	wgInterface := cfg.WireGuardInterface
+	if wgInterface == "" {
+		wgInterface = "wg0"
+	}
+
+	vm := &VPNManager{
+		clientset:      clientset,
+		config:         cfg,
+		namespace:      namespace,
+		containerName:  containerName,
+		mountPath:      mountPath,
+		wgInterface:    wgInterface,
+		clusterCIDRs:   parseClusterCIDRs(cfg.ClusterCIDRs),
+		readyTimeout:   readyTimeout,
+		pollInterval:   2 * time.Second,
+		image:          cfg.Image,
+		podTemplates:   &podTemplates{},
+		egressProfiles: &egressProfiles{},
 	}
+	vm.exec = vm.execUnavailable
+	return vm
 }
 
-// CreateUserVPN creates a VPN pod for a user
-func (vm *VPNManager) CreateUserVPN(ctx context.Context, user *models.User) error {
-	// Generate WireGuard keys
-	keys, err := vm.generateWireGuardKeys()
+// CreateUserVPN creates a VPN workload for a user and waits for it to become
+// ready. The plan, if not nil, supplies the workload's resources and pod
+// template.
+func (vm *VPNManager) CreateUserVPN(ctx context.Context, user *models.User, plan *models.Plan) (err error) {
+	ctx, span := tracing.Start(ctx, "VPNManager.CreateUserVPN", attribute.String("user.id", user.ID))
+	defer func() { tracing.End(span, err) }()
+	ctx = withUserLogger(ctx, user)
+
+	start := time.Now()
+	defer func() {
+		var reason string
+		if err != nil {
+			reason = failureReason(err)
+		}
+		metrics.RecordProvisioning(time.Since(start), reason)
+	}()
+
+	// Generate WireGuard keys for the server in the pod and the user's device
+	serverKeys, err := vm.generateWireGuardKeys()
+	if err != nil {
+		return fmt.Errorf("failed to generate WireGuard keys: %v", err)
+	}
+	clientKeys, err := vm.generateWireGuardKeys()
 	if err != nil {
 		return fmt.Errorf("failed to generate WireGuard keys: %v", err)
 	}
 
-	user.PublicKey = keys.PublicKey
-	user.PrivateKey = keys.PrivateKey
+	user.ServerPublicKey = serverKeys.PublicKey
+	user.ServerPrivateKey = serverKeys.PrivateKey
+	user.PublicKey = clientKeys.PublicKey
+	user.PrivateKey = clientKeys.PrivateKey
 
-	// Generate WireGuard configuration
-	config, err := vm.generateWireGuardConfig(user, keys)
+	// The client configuration is handed to the user, the server
+	// configuration only lives in the pod's Secret
+	user.ConfigData = vm.clientConfig(user, plan)
+	user.PeerRemoved = user.Status == "suspended"
+
+	// Create Kubernetes workload
+	deployment, err := vm.createVPNWorkload(ctx, user, plan)
 	if err != nil {
-		return fmt.Errorf("failed to generate WireGuard config: %v", err)
+		return fmt.Errorf("failed to create VPN workload: %w", err)
 	}
 
-	user.ConfigData = config
+	user.WorkloadName = deployment.Name
 
-	// Create Kubernetes pod
-	pod, err := vm.createVPNPod(ctx, user)
+	pod, err := vm.waitForWorkloadReady(ctx, deployment.Name, user.ID)
 	if err != nil {
-		return fmt.Errorf("failed to create VPN pod: %v", err)
+		return err
 	}
 
-	user.PodName = pod.Name
-	user.PodIP = pod.Status.PodIP
-
-	logrus.Infof("Created VPN pod %s for user %s", pod.Name, user.Username)
+	if pod != nil {
+		user.PodName = pod.Name
+		user.PodIP = pod.Status.PodIP
+	}
 
-	// Update metrics
-	metrics.IncrementConnections()
+	logging.FromContext(withUserLogger(ctx, user)).Infof("Created VPN deployment %s for user %s", deployment.Name, user.Username)
 
 	return nil
 }
 
-// DeleteUserVPN deletes a VPN pod for a user
-func (vm *VPNManager) DeleteUserVPN(ctx context.Context, user *models.User) error {
-	if user.PodName == "" {
-		return nil
+// UpdateUserVPN rebuilds the server configuration, pod template and network
+// policy of a user's workload from the user's state, the current plan, pod templates and
+// image, letting the Deployment controller roll the pod if anything changed.
+// The user's client configuration is rendered again as well.
+func (vm *VPNManager) UpdateUserVPN(ctx context.Context, user *models.User, plan *models.Plan) (err error) {
+	ctx, span := tracing.Start(ctx, "VPNManager.UpdateUserVPN", attribute.String("user.id", user.ID))
+	defer func() { tracing.End(span, err) }()
+	ctx = withUserLogger(ctx, user)
+
+	if user.WorkloadName == "" {
+		return fmt.Errorf("user %s has no VPN workload", user.ID)
+	}
+
+	desired, err := vm.buildDeployment(user, plan, user.WorkloadName, configSecretName(user.ID))
+	if err != nil {
+		return err
+	}
+
+	// Write the server configuration first; the config hash on the new pod
+	// template makes the Deployment roll a pod that loads it
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := vm.clientset.CoreV1().Secrets(vm.namespace).Get(ctx, configSecretName(user.ID), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		secret.Data = map[string][]byte{serverConfigKey: []byte(vm.serverConfig(user))}
+		_, err = vm.clientset.CoreV1().Secrets(vm.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update VPN config: %v", err)
 	}
 
-	err := vm.clientset.CoreV1().Pods(vm.namespace).Delete(ctx, user.PodName, metav1.DeleteOptions{})
+	var updated *appsv1.Deployment
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := vm.clientset.AppsV1().Deployments(vm.namespace).Get(ctx, user.WorkloadName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		deployment.Spec.Template = desired.Spec.Template
+		if deployment.Annotations == nil {
+			deployment.Annotations = make(map[string]string)
+		}
+		deployment.Annotations[baseHashAnnotation] = desired.Annotations[baseHashAnnotation]
+		deployment.Annotations[templateHashAnnotation] = desired.Annotations[templateHashAnnotation]
+		updated, err = vm.clientset.AppsV1().Deployments(vm.namespace).Update(ctx, deployment, metav1.UpdateOptions{})
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("failed to delete VPN pod: %v", err)
+		return fmt.Errorf("failed to update VPN deployment: %v", err)
+	}
+
+	// Workloads created before network policies get theirs here
+	if err := vm.applyNetworkPolicy(ctx, user, plan, ownerReference(updated)); err != nil {
+		return err
 	}
+	user.PeerRemoved = user.Status == "suspended"
+	user.ConfigData = vm.clientConfig(user, plan)
 
-	logrus.Infof("Deleted VPN pod %s for user %s", user.PodName, user.Username)
+	logging.FromContext(ctx).Infof("Updated VPN deployment %s for user %s", user.WorkloadName, user.Username)
 
 	return nil
 }
 
-// GetPodStatus returns the status of a VPN pod
-func (vm *VPNManager) GetPodStatus(ctx context.Context, podName string) (string, error) {
-	pod, err := vm.clientset.CoreV1().Pods(vm.namespace).Get(ctx, podName, metav1.GetOptions{})
+// DeleteUserVPN deletes every Kubernetes object of a user's VPN and reports
+// what was removed. Deleting the root Deployment with foreground propagation
+// cascades to everything it owns; objects without an owner, such as those
+// left behind by older versions, are deleted individually.
+func (vm *VPNManager) DeleteUserVPN(ctx context.Context, user *models.User) (removed []models.ResourceRef, err error) {
+	ctx, span := tracing.Start(ctx, "VPNManager.DeleteUserVPN", attribute.String("user.id", user.ID))
+	defer func() { tracing.End(span, err) }()
+	ctx = withUserLogger(ctx, user)
+
+	selector := userSelector(user.ID)
+	propagation := metav1.DeletePropagationForeground
+	opts := metav1.DeleteOptions{PropagationPolicy: &propagation}
+
+	var errs []error
+	for _, kind := range vm.userResourceKinds() {
+		objects, err := kind.list(ctx, selector)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list %ss: %v", kind.kind, err))
+			continue
+		}
+
+		for _, obj := range objects {
+			// Owned objects are removed by the garbage collector
+			if len(obj.GetOwnerReferences()) == 0 {
+				err := kind.delete(ctx, obj.GetName(), opts)
+				if err != nil && !apierrors.IsNotFound(err) {
+					errs = append(errs, fmt.Errorf("failed to delete %s %s: %v", kind.kind, obj.GetName(), err))
+					continue
+				}
+			}
+			removed = append(removed, models.ResourceRef{Kind: kind.kind, Name: obj.GetName()})
+		}
+	}
+
+	if len(removed) > 0 {
+		logging.FromContext(ctx).Infof("Deleted %d VPN resources for user %s", len(removed), user.Username)
+	}
+
+	return removed, utilerrors.NewAggregate(errs)
+}
+
+// GetPodStatus returns the phase of the newest pod backing a user's VPN
+func (vm *VPNManager) GetPodStatus(ctx context.Context, user *models.User) (string, error) {
+	pod, err := vm.currentPod(ctx, user.ID)
 	if err != nil {
 		return "", err
 	}
+	if pod == nil {
+		return "", fmt.Errorf("no VPN pod found for user %s", user.ID)
+	}
 
 	return string(pod.Status.Phase), nil
 }
 
-// UpdatePodMetrics updates pod-related metrics
-func (vm *VPNManager) UpdatePodMetrics(ctx context.Context) error {
-	pods, err := vm.clientset.CoreV1().Pods(vm.namespace).List(ctx, metav1.ListOptions{
-		LabelSelector: "app=vpnaas,component=vpn",
-	})
+// UpdatePodMetrics counts the VPN pods by phase and publishes the counts.
+// Pods are counted from the pod informer's cache once it has synced, and
+// listed from the API before that.
+func (vm *VPNManager) UpdatePodMetrics(ctx context.Context) (models.PodStats, error) {
+	pods, err := vm.listVPNPods(ctx)
 	if err != nil {
-		return err
+		return models.PodStats{}, err
 	}
 
-	running, failed, pending := 0, 0, 0
-	for _, pod := range pods.Items {
+	var stats models.PodStats
+	for _, pod := range pods {
 		switch pod.Status.Phase {
 		case corev1.PodRunning:
-			running++
+			stats.Running++
 		case corev1.PodFailed:
-			failed++
+			stats.Failed++
 		case corev1.PodPending:
-			pending++
+			stats.Pending++
 		}
 	}
 
-	metrics.UpdatePodMetrics(running, failed, pending)
-	return nil
+	metrics.UpdatePodMetrics(stats.Running, stats.Failed, stats.Pending)
+	return stats, nil
+}
+
+// RolloutImage switches every VPN workload to image, letting the Deployment
+// controller roll the pods, and returns the workloads it updated; those
+// already running image are left alone. An empty image rolls out the
+// configured vpn.image. New workloads are created with the same image
+// afterwards.
+func (vm *VPNManager) RolloutImage(ctx context.Context, image string) (updated []string, err error) {
+	ctx, span := tracing.Start(ctx, "VPNManager.RolloutImage", attribute.String("image", image))
+	defer func() { tracing.End(span, err) }()
+
+	if image == "" {
+		image = vm.vpnConfig().Image
+	}
+
+	vm.mu.Lock()
+	vm.image = image
+	vm.mu.Unlock()
+
+	deployments, err := vm.clientset.AppsV1().Deployments(vm.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: vpnSelector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VPN deployments: %v", err)
+	}
+
+	updated = make([]string, 0, len(deployments.Items))
+	var errs []error
+	for _, item := range deployments.Items {
+		name := item.Name
+		changed := false
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			deployment, err := vm.clientset.AppsV1().Deployments(vm.namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+
+			changed = false
+			for i := range deployment.Spec.Template.Spec.Containers {
+				container := &deployment.Spec.Template.Spec.Containers[i]
+				if container.Name == vm.containerName && container.Image != image {
+					container.Image = image
+					changed = true
+				}
+			}
+			if !changed {
+				return nil
+			}
+
+			// Keep the template hash in step with the image. Deployments
+			// without a base hash are left for the next rollout to hash.
+			if base, ok := deployment.Annotations[baseHashAnnotation]; ok {
+				deployment.Annotations[templateHashAnnotation] = imageTemplateHash(base, image)
+			} else {
+				delete(deployment.Annotations, templateHashAnnotation)
+			}
+
+			_, err = vm.clientset.AppsV1().Deployments(vm.namespace).Update(ctx, deployment, metav1.UpdateOptions{})
+			return err
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("deployment %s: %v", name, err))
+			continue
+		}
+		if changed {
+			updated = append(updated, name)
+		}
+	}
+
+	logging.FromContext(ctx).Infof("Rolled out image %s to %d VPN deployments", image, len(updated))
+
+	return updated, utilerrors.NewAggregate(errs)
 }
 
 // generateWireGuardKeys generates a new WireGuard key pair
@@ -147,153 +402,315 @@ func (vm *VPNManager) generateWireGuardKeys() (*WireGuardKeys, error) {
 	}, nil
 }
 
-// generateWireGuardConfig generates WireGuard configuration for a user
-func (vm *VPNManager) generateWireGuardConfig(user *models.User, keys *WireGuardKeys) (string, error) {
-	// Generate a unique IP for the user (10.0.0.x)
-	userIP := fmt.Sprintf("10.0.0.%d", len(user.ID)%254+1)
-
-	config := fmt.Sprintf(`[Interface]
-PrivateKey = %s
-Address = %s/24
-ListenPort = %s
-PostUp = iptables -A FORWARD -i %%i -j ACCEPT; iptables -t nat -A POSTROUTING -o eth0 -j MASQUERADE
-PostDown = iptables -D FORWARD -i %%i -j ACCEPT; iptables -t nat -D POSTROUTING -o eth0 -j MASQUERADE
-
-[Peer]
-PublicKey = %s
-AllowedIPs = 0.0.0.0/0
-Endpoint = %s:%s
-PersistentKeepalive = 25
-`,
-		keys.PrivateKey,
-		userIP,
-		config.GetString("vpn.wireguard_port"),
-		keys.PublicKey,
-		config.GetString("vpn.endpoint"),
-		config.GetString("vpn.wireguard_port"),
-	)
-
-	return config, nil
-}
+// createVPNWorkload creates the Deployment for a user's VPN together with the
+// Secret, Service and NetworkPolicy it owns
+func (vm *VPNManager) createVPNWorkload(ctx context.Context, user *models.User, plan *models.Plan) (deployment *appsv1.Deployment, err error) {
+	ctx, span := tracing.Start(ctx, "VPNManager.createVPNWorkload", attribute.String("user.id", user.ID))
+	defer func() { tracing.End(span, err) }()
 
-// createVPNPod creates a Kubernetes pod for VPN
-func (vm *VPNManager) createVPNPod(ctx context.Context, user *models.User) (*corev1.Pod, error) {
-	podName := fmt.Sprintf("vpn-%s", user.ID)
+	name := workloadName(user.ID)
+	secretName := configSecretName(user.ID)
 
-	// Create ConfigMap for WireGuard configuration
-	configMap := &corev1.ConfigMap{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      fmt.Sprintf("vpn-config-%s", user.ID),
-			Namespace: vm.namespace,
-			Labels: map[string]string{
-				"app":       "vpnaas",
-				"component": "vpn",
-				"user":      user.ID,
-			},
+	deployment, err = vm.buildDeployment(user, plan, name, secretName)
+	if err != nil {
+		return nil, err
+	}
+
+	done := timeStep(metrics.StepDeploymentCreate)
+	deployment, err = vm.clientset.AppsV1().Deployments(vm.namespace).Create(ctx, deployment, metav1.CreateOptions{})
+	done()
+	if err != nil {
+		return nil, apiFailure("failed to create Deployment", err)
+	}
+	logging.FromContext(ctx).Debugf("Created VPN deployment %s", deployment.Name)
+
+	owner := ownerReference(deployment)
+
+	// Create Secret for WireGuard configuration, which carries the private key
+	secret := &corev1.Secret{
+		ObjectMeta: ownedObjectMeta(user, secretName, vm.namespace, owner),
+		Type:       corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			serverConfigKey: []byte(vm.serverConfig(user)),
 		},
-		Data: map[string]string{
-			"wg0.conf": user.ConfigData,
+	}
+
+	done = timeStep(metrics.StepSecretCreate)
+	_, err = vm.clientset.CoreV1().Secrets(vm.namespace).Create(ctx, secret, metav1.CreateOptions{})
+	done()
+	if err != nil {
+		vm.cleanupWorkload(ctx, name)
+		return nil, apiFailure("failed to create Secret", err)
+	}
+	logging.FromContext(ctx).Debugf("Created VPN config secret %s", secretName)
+
+	cfg := vm.vpnConfig()
+	service := &corev1.Service{
+		ObjectMeta: ownedObjectMeta(user, name, vm.namespace, owner),
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceType(cfg.ServiceType),
+			Selector: workloadLabels(user),
+			Ports: []corev1.ServicePort{
+				{
+					Name:     "wireguard",
+					Port:     int32(cfg.WireGuardPort),
+					Protocol: corev1.ProtocolUDP,
+				},
+			},
 		},
 	}
 
-	_, err := vm.clientset.CoreV1().ConfigMaps(vm.namespace).Create(ctx, configMap, metav1.CreateOptions{})
+	done = timeStep(metrics.StepServiceCreate)
+	_, err = vm.clientset.CoreV1().Services(vm.namespace).Create(ctx, service, metav1.CreateOptions{})
+	done()
+	if err != nil {
+		vm.cleanupWorkload(ctx, name)
+		return nil, apiFailure("failed to create Service", err)
+	}
+	logging.FromContext(ctx).Debugf("Created VPN service %s", name)
+
+	done = timeStep(metrics.StepNetworkPolicyApply)
+	err = vm.applyNetworkPolicy(ctx, user, plan, owner)
+	done()
+	if err != nil {
+		vm.cleanupWorkload(ctx, name)
+		return nil, err
+	}
+
+	return deployment, nil
+}
+
+// cleanupWorkload removes a partially created workload and everything it owns
+func (vm *VPNManager) cleanupWorkload(ctx context.Context, name string) {
+	ctx, span := tracing.Start(ctx, "VPNManager.cleanupWorkload", attribute.String("workload", name))
+	defer span.End()
+
+	propagation := metav1.DeletePropagationForeground
+	err := vm.clientset.AppsV1().Deployments(vm.namespace).Delete(ctx, name, metav1.DeleteOptions{
+		PropagationPolicy: &propagation,
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		logging.FromContext(ctx).Errorf("Failed to clean up VPN deployment %s: %v", name, err)
+	}
+}
+
+// buildDeployment builds the single-replica Deployment running a user's VPN,
+// sized by the user's plan, merged with the pod template that applies and
+// scheduled onto the nodes of the user's egress profile. The chosen template
+// and egress IP are recorded on the user.
+func (vm *VPNManager) buildDeployment(user *models.User, plan *models.Plan, name, secretName string) (*appsv1.Deployment, error) {
+	vm.mu.RLock()
+	image := vm.image
+	cfg := vm.config
+	vm.mu.RUnlock()
+
+	templateName, tmpl, err := vm.resolvePodTemplate(user, plan)
+	if err != nil {
+		return nil, err
+	}
+	profile, nodes, err := vm.resolveEgressProfile(user)
+	if err != nil {
+		return nil, err
+	}
+	user.PodTemplate = templateName
+	user.EgressIP = profile.PublicIP
+	user.AppliedBandwidth = bandwidthLimits(user, plan)
+
+	resources, err := resourceRequirements(plan, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create ConfigMap: %v", err)
+		return nil, err
 	}
 
-	// Create the pod
-	pod := &corev1.Pod{
+	replicas := int32(1)
+	configMode := int32(0400)
+
+	deployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      podName,
+			Name:      name,
 			Namespace: vm.namespace,
-			Labels: map[string]string{
-				"app":       "vpnaas",
-				"component": "vpn",
-				"user":      user.ID,
-			},
+			Labels:    workloadLabels(user),
 		},
-		Spec: corev1.PodSpec{
-			Containers: []corev1.Container{
-				{
-					Name:  "wireguard",
-					Image: config.GetString("vpn.image"),
-					Ports: []corev1.ContainerPort{
-						{
-							Name:          "wireguard",
-							ContainerPort: int32(config.GetInt("vpn.wireguard_port")),
-							Protocol:      corev1.ProtocolUDP,
-						},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: workloadLabels(user),
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: workloadLabels(user),
+					Annotations: map[string]string{
+						configHashAnnotation: configHash(vm.serverConfig(user)),
 					},
-					VolumeMounts: []corev1.VolumeMount{
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
 						{
-							Name:      "config",
-							MountPath: "/config/wg_confs",
-						},
-					},
-					SecurityContext: &corev1.SecurityContext{
-						Capabilities: &corev1.Capabilities{
-							Add: []corev1.Capability{
-								"NET_ADMIN",
-								"SYS_MODULE",
+							Name:  vm.containerName,
+							Image: image,
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "wireguard",
+									ContainerPort: int32(cfg.WireGuardPort),
+									Protocol:      corev1.ProtocolUDP,
+								},
 							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      configVolume,
+									MountPath: vm.mountPath,
+								},
+							},
+							SecurityContext: &corev1.SecurityContext{
+								Capabilities: &corev1.Capabilities{
+									Add: []corev1.Capability{
+										"NET_ADMIN",
+										"SYS_MODULE",
+									},
+								},
+							},
+							Resources: resources,
 						},
 					},
-					Resources: corev1.ResourceRequirements{
-						Requests: corev1.ResourceList{
-							corev1.ResourceCPU:    resource.MustParse(config.GetString("vpn.pod_cpu_request")),
-							corev1.ResourceMemory: resource.MustParse(config.GetString("vpn.pod_memory_request")),
-						},
-						Limits: corev1.ResourceList{
-							corev1.ResourceCPU:    resource.MustParse(config.GetString("vpn.pod_cpu_limit")),
-							corev1.ResourceMemory: resource.MustParse(config.GetString("vpn.pod_memory_limit")),
-						},
-					},
-				},
-			},
-			Volumes: []corev1.Volume{
-				{
-					Name: "config",
-					VolumeSource: corev1.VolumeSource{
-						ConfigMap: &corev1.ConfigMapVolumeSource{
-							LocalObjectReference: corev1.LocalObjectReference{
-								Name: configMap.Name,
+					Volumes: []corev1.Volume{
+						{
+							Name: configVolume,
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{
+									SecretName:  secretName,
+									DefaultMode: &configMode,
+								},
 							},
 						},
 					},
+					RestartPolicy: corev1.RestartPolicyAlways,
 				},
 			},
-			RestartPolicy: corev1.RestartPolicyAlways,
 		},
 	}
 
-	createdPod, err := vm.clientset.CoreV1().Pods(vm.namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if tmpl != nil {
+		deployment.Spec.Template = mergePodTemplate(tmpl, deployment.Spec.Template, vm.containerName)
+	}
+	requireNodes(&deployment.Spec.Template.Spec, nodes)
+
+	base, full, err := templateHashes(deployment.Spec.Template, vm.containerName)
 	if err != nil {
 		return nil, err
 	}
+	deployment.Annotations = map[string]string{
+		baseHashAnnotation:     base,
+		templateHashAnnotation: full,
+	}
 
-	// Wait for pod to be ready
-	err = vm.waitForPodReady(ctx, createdPod.Name)
+	return deployment, nil
+}
+
+// resourceRequirements returns the VPN container resources, taking each value
+// from the plan when it sets one and from the vpn.pod_* defaults otherwise
+func resourceRequirements(plan *models.Plan, cfg config.VPNConfig) (corev1.ResourceRequirements, error) {
+	if plan == nil {
+		plan = &models.Plan{}
+	}
+
+	requests, err := resourceList(plan.CPURequest, cfg.PodCPURequest, plan.MemoryRequest, cfg.PodMemoryRequest)
 	if err != nil {
-		return nil, err
+		return corev1.ResourceRequirements{}, err
+	}
+	limits, err := resourceList(plan.CPULimit, cfg.PodCPULimit, plan.MemoryLimit, cfg.PodMemoryLimit)
+	if err != nil {
+		return corev1.ResourceRequirements{}, err
 	}
 
-	return createdPod, nil
+	return corev1.ResourceRequirements{Requests: requests, Limits: limits}, nil
 }
 
-// waitForPodReady waits for a pod to be ready
-func (vm *VPNManager) waitForPodReady(ctx context.Context, podName string) error {
-	return retry.OnError(retry.DefaultRetry, func(err error) bool {
-		return true
-	}, func() error {
-		pod, err := vm.clientset.CoreV1().Pods(vm.namespace).Get(ctx, podName, metav1.GetOptions{})
+// resourceList builds a CPU and memory resource list, falling back to the
+// given defaults for unset values
+func resourceList(cpu, defaultCPU, memory, defaultMemory string) (corev1.ResourceList, error) {
+	if cpu == "" {
+		cpu = defaultCPU
+	}
+	if memory == "" {
+		memory = defaultMemory
+	}
+
+	cpuQuantity, err := resource.ParseQuantity(cpu)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cpu quantity %q: %v", cpu, err)
+	}
+	memoryQuantity, err := resource.ParseQuantity(memory)
+	if err != nil {
+		return nil, fmt.Errorf("invalid memory quantity %q: %v", memory, err)
+	}
+
+	return corev1.ResourceList{
+		corev1.ResourceCPU:    cpuQuantity,
+		corev1.ResourceMemory: memoryQuantity,
+	}, nil
+}
+
+// waitForWorkloadReady waits for a user's Deployment to report a ready
+// replica and returns the pod serving it, if one can be found
+func (vm *VPNManager) waitForWorkloadReady(ctx context.Context, name, userID string) (pod *corev1.Pod, err error) {
+	ctx, span := tracing.Start(ctx, "VPNManager.waitForWorkloadReady", attribute.String("workload", name))
+	defer func() { tracing.End(span, err) }()
+	defer timeStep(metrics.StepReadinessWait)()
+
+	err = wait.PollUntilContextTimeout(ctx, vm.pollInterval, vm.readyTimeout, true, func(ctx context.Context) (bool, error) {
+		deployment, err := vm.clientset.AppsV1().Deployments(vm.namespace).Get(ctx, name, metav1.GetOptions{})
 		if err != nil {
-			return err
+			if apierrors.IsNotFound(err) {
+				return false, err
+			}
+			logging.FromContext(ctx).Debugf("Waiting for VPN deployment %s: %v", name, err)
+			return false, nil
 		}
 
-		if pod.Status.Phase == corev1.PodRunning {
-			return nil
+		return deployment.Status.ReadyReplicas >= 1, nil
+	})
+	if err != nil {
+		if wait.Interrupted(err) {
+			return nil, &provisioningError{
+				reason: vm.stalledReason(ctx, name, userID),
+				err:    fmt.Errorf("timed out waiting for VPN deployment %s to become ready", name),
+			}
 		}
+		return nil, apiFailure(fmt.Sprintf("failed waiting for VPN deployment %s", name), err)
+	}
+
+	return vm.currentPod(ctx, userID)
+}
 
-		return fmt.Errorf("pod not ready yet")
+// currentPod returns the newest pod belonging to a user's VPN, or nil if the
+// workload has no pods
+func (vm *VPNManager) currentPod(ctx context.Context, userID string) (*corev1.Pod, error) {
+	pods, err := vm.clientset.CoreV1().Pods(vm.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: userSelector(userID),
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	var newest *corev1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		if newest == nil || newest.CreationTimestamp.Before(&pod.CreationTimestamp) {
+			newest = pod
+		}
+	}
+
+	return newest, nil
+}
+
+// withUserLogger scopes a logger tagging every line with the user and, once
+// known, the user's pod to ctx, on top of the request's fields
+func withUserLogger(ctx context.Context, user *models.User) context.Context {
+	fields := logrus.Fields{"user_id": user.ID}
+	if user.PodName != "" {
+		fields["pod"] = user.PodName
+	}
+	return logging.WithFields(ctx, fields)
 }
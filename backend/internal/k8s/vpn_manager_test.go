@@ -0,0 +1,797 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/logging"
+	"vpnaas-backend/internal/metrics"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/tracing"
+)
+
+const testNamespace = "vpnaas"
+
+// testConfig returns the default VPN configuration with an endpoint and the
+// kubeadm cluster networks, changed by configure
+func testConfig(configure ...func(cfg *config.VPNConfig)) config.VPNConfig {
+	cfg := config.Default().VPN
+	cfg.Endpoint = "vpn.example.com"
+	cfg.ClusterCIDRs = []string{"10.244.0.0/16", "10.96.0.0/12"}
+	for _, fn := range configure {
+		fn(&cfg)
+	}
+	return cfg
+}
+
+// newTestManager returns a VPNManager that polls fast enough for tests, with
+// the default configuration changed by configure
+func newTestManager(client *fake.Clientset, configure ...func(cfg *config.VPNConfig)) *VPNManager {
+	vm := NewVPNManager(client, testNamespace, testConfig(configure...))
+	vm.pollInterval = time.Millisecond
+	vm.readyTimeout = 100 * time.Millisecond
+	return vm
+}
+
+// simulateReadyReplicas makes successive Deployment GETs report the given
+// ready replica counts. The last count is repeated once the list is
+// exhausted.
+func simulateReadyReplicas(client *fake.Clientset, ready ...int32) {
+	var mu sync.Mutex
+	calls := 0
+
+	client.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		name := action.(k8stesting.GetAction).GetName()
+		obj, err := client.Tracker().Get(appsv1.SchemeGroupVersion.WithResource("deployments"), action.GetNamespace(), name)
+		if err != nil {
+			return true, nil, err
+		}
+
+		mu.Lock()
+		idx := calls
+		calls++
+		mu.Unlock()
+		if idx >= len(ready) {
+			idx = len(ready) - 1
+		}
+
+		deployment := obj.(*appsv1.Deployment).DeepCopy()
+		deployment.Status.ReadyReplicas = ready[idx]
+		return true, deployment, nil
+	})
+}
+
+// failOn makes the given verb on resource return err
+func failOn(client *fake.Clientset, verb, resource string, err error) {
+	client.PrependReactor(verb, resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, err
+	})
+}
+
+func testPod(name string, phase corev1.PodPhase, labels map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			Labels:    labels,
+		},
+		Status: corev1.PodStatus{Phase: phase},
+	}
+}
+
+var vpnLabels = map[string]string{"app": "vpnaas", "component": "vpn"}
+
+func TestCreateUserVPN(t *testing.T) {
+	apiErr := apierrors.NewInternalError(errors.New("etcd unavailable"))
+
+	tests := []struct {
+		name    string
+		ready   []int32
+		withPod bool
+		setup   func(client *fake.Clientset)
+		wantErr string
+	}{
+		{
+			name:    "workload ready immediately",
+			ready:   []int32{1},
+			withPod: true,
+		},
+		{
+			name:    "workload becomes ready after pod starts",
+			ready:   []int32{0, 0, 1},
+			withPod: true,
+		},
+		{
+			name:  "ready without a visible pod",
+			ready: []int32{1},
+		},
+		{
+			name:    "workload never becomes ready",
+			ready:   []int32{0},
+			wantErr: "timed out",
+		},
+		{
+			name:  "deployment create error",
+			ready: []int32{1},
+			setup: func(client *fake.Clientset) {
+				failOn(client, "create", "deployments", apiErr)
+			},
+			wantErr: "failed to create Deployment",
+		},
+		{
+			name:  "secret create error",
+			ready: []int32{1},
+			setup: func(client *fake.Clientset) {
+				failOn(client, "create", "secrets", apiErr)
+			},
+			wantErr: "failed to create Secret",
+		},
+		{
+			name:  "service already exists",
+			ready: []int32{1},
+			setup: func(client *fake.Clientset) {
+				failOn(client, "create", "services", apierrors.NewAlreadyExists(corev1.Resource("services"), "vpn"))
+			},
+			wantErr: "already exists",
+		},
+		{
+			name:  "network policy create error",
+			ready: []int32{1},
+			setup: func(client *fake.Clientset) {
+				failOn(client, "create", "networkpolicies", apiErr)
+			},
+			wantErr: "failed to apply NetworkPolicy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			user := models.NewUser("alice", "alice@example.com")
+
+			var objects []runtime.Object
+			if tt.withPod {
+				pod := testPod("vpn-"+user.ID+"-abc12", corev1.PodRunning, workloadLabels(user))
+				pod.Status.PodIP = "10.244.0.7"
+				objects = append(objects, pod)
+			}
+
+			client := fake.NewSimpleClientset(objects...)
+			simulateReadyReplicas(client, tt.ready...)
+			if tt.setup != nil {
+				tt.setup(client)
+			}
+
+			err := newTestManager(client).CreateUserVPN(ctx, user, nil)
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want it to contain %q", err, tt.wantErr)
+				}
+				// Partially created workloads are cleaned up
+				if strings.HasPrefix(tt.name, "secret") || strings.HasPrefix(tt.name, "service") || strings.HasPrefix(tt.name, "network") {
+					_, err := client.AppsV1().Deployments(testNamespace).Get(ctx, "vpn-"+user.ID, metav1.GetOptions{})
+					if !apierrors.IsNotFound(err) {
+						t.Fatalf("expected deployment to be cleaned up, got %v", err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if user.WorkloadName != "vpn-"+user.ID {
+				t.Errorf("got workload name %q", user.WorkloadName)
+			}
+			if tt.withPod && (user.PodName != "vpn-"+user.ID+"-abc12" || user.PodIP != "10.244.0.7") {
+				t.Errorf("got pod %q/%q", user.PodName, user.PodIP)
+			}
+			if user.PublicKey == "" || user.PrivateKey == "" || user.ServerPublicKey == "" || user.ServerPrivateKey == "" {
+				t.Errorf("expected generated keys")
+			}
+			if !strings.Contains(user.ConfigData, "PrivateKey = "+user.PrivateKey) || !strings.Contains(user.ConfigData, "PublicKey = "+user.ServerPublicKey) {
+				t.Errorf("client config does not pair the device with the server:\n%s", user.ConfigData)
+			}
+
+			deployment, err := client.AppsV1().Deployments(testNamespace).Get(ctx, user.WorkloadName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("get deployment: %v", err)
+			}
+			if *deployment.Spec.Replicas != 1 {
+				t.Errorf("got %d replicas, want 1", *deployment.Spec.Replicas)
+			}
+			if deployment.Spec.Template.Labels["user"] != user.ID {
+				t.Errorf("got user label %q", deployment.Spec.Template.Labels["user"])
+			}
+			containers := deployment.Spec.Template.Spec.Containers
+			if len(containers) != 1 || containers[0].Image != testConfig().Image {
+				t.Errorf("unexpected containers: %+v", containers)
+			}
+
+			secret, err := client.CoreV1().Secrets(testNamespace).Get(ctx, "vpn-config-"+user.ID, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("get secret: %v", err)
+			}
+			serverConf := string(secret.Data["wg0.conf"])
+			if !strings.Contains(serverConf, "PrivateKey = "+user.ServerPrivateKey) || !strings.Contains(serverConf, "PublicKey = "+user.PublicKey) {
+				t.Errorf("server config does not pair the server with the device:\n%s", serverConf)
+			}
+			if strings.Contains(serverConf, user.PrivateKey) {
+				t.Errorf("server config contains the device's private key")
+			}
+			assertOwnedBy(t, secret.OwnerReferences, deployment)
+
+			service, err := client.CoreV1().Services(testNamespace).Get(ctx, user.WorkloadName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("get service: %v", err)
+			}
+			assertOwnedBy(t, service.OwnerReferences, deployment)
+		})
+	}
+}
+
+func assertOwnedBy(t *testing.T, refs []metav1.OwnerReference, deployment *appsv1.Deployment) {
+	t.Helper()
+
+	if len(refs) != 1 {
+		t.Fatalf("got %d owner references, want 1", len(refs))
+	}
+	if refs[0].Kind != "Deployment" || refs[0].Name != deployment.Name || refs[0].UID != deployment.UID {
+		t.Errorf("unexpected owner reference %+v", refs[0])
+	}
+	if refs[0].Controller == nil || !*refs[0].Controller {
+		t.Errorf("owner reference is not a controller reference")
+	}
+}
+
+func testDeployment(name, image string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			Labels:    vpnLabels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "wireguard", Image: image}},
+				},
+			},
+		},
+	}
+}
+
+func TestCreateUserVPNSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	if _, err := tracing.Setup("vpnaas-backend", sdktrace.NewSimpleSpanProcessor(exporter), sdktrace.AlwaysSample()); err != nil {
+		t.Fatalf("setup tracing: %v", err)
+	}
+
+	client := fake.NewSimpleClientset()
+	simulateReadyReplicas(client, 1)
+	failOn(client, "create", "networkpolicies", apierrors.NewInternalError(errors.New("etcd unavailable")))
+
+	user := models.NewUser("alice", "alice@example.com")
+	if err := newTestManager(client).CreateUserVPN(context.Background(), user, nil); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Each step is a child of the step it is part of and failures are
+	// recorded on every step they pass through
+	want := map[string]struct {
+		parent string
+		failed bool
+	}{
+		"VPNManager.applyNetworkPolicy": {"VPNManager.createVPNWorkload", true},
+		"VPNManager.cleanupWorkload":    {"VPNManager.createVPNWorkload", false},
+		"VPNManager.createVPNWorkload":  {"VPNManager.CreateUserVPN", true},
+		"VPNManager.CreateUserVPN":      {"", true},
+	}
+	spans := exporter.GetSpans()
+	names := map[trace.SpanID]string{}
+	for _, span := range spans {
+		names[span.SpanContext.SpanID()] = span.Name
+	}
+	if len(spans) != len(want) {
+		t.Fatalf("got %d spans, want %d", len(spans), len(want))
+	}
+	for _, span := range spans {
+		w, ok := want[span.Name]
+		if !ok {
+			t.Errorf("unexpected span %s", span.Name)
+			continue
+		}
+		if parent := names[span.Parent.SpanID()]; parent != w.parent {
+			t.Errorf("%s: got parent %q, want %q", span.Name, parent, w.parent)
+		}
+		if failed := span.Status.Code == codes.Error; failed != w.failed {
+			t.Errorf("%s: got failed %v, want %v", span.Name, failed, w.failed)
+		}
+	}
+}
+
+func TestCreateUserVPNLogsCarryRequestAndUser(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	user := models.NewUser("alice", "alice@example.com")
+	client := fake.NewSimpleClientset(testPod("vpn-"+user.ID+"-abc12", corev1.PodRunning, workloadLabels(user)))
+	simulateReadyReplicas(client, 1)
+
+	ctx := logging.WithFields(context.Background(), logrus.Fields{"request_id": "req-1"})
+	if err := newTestManager(client).CreateUserVPN(ctx, user, nil); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("expected a log entry")
+	}
+	want := logrus.Fields{"request_id": "req-1", "user_id": user.ID, "pod": "vpn-" + user.ID + "-abc12"}
+	for key, value := range want {
+		if entry.Data[key] != value {
+			t.Errorf("got %s=%v, want %v in %q", key, entry.Data[key], value, entry.Message)
+		}
+	}
+}
+
+func TestDeleteUserVPN(t *testing.T) {
+	user := &models.User{ID: "1", Username: "alice", WorkloadName: "vpn-1"}
+	labels := workloadLabels(user)
+
+	root := testDeployment("vpn-1", "wg:1")
+	root.Labels = labels
+	root.UID = "deployment-uid"
+	owner := ownerReference(root)
+
+	ownedSecret := &corev1.Secret{ObjectMeta: ownedObjectMeta(user, "vpn-config-1", testNamespace, owner)}
+	ownedService := &corev1.Service{ObjectMeta: ownedObjectMeta(user, "vpn-1", testNamespace, owner)}
+	ownedPod := testPod("vpn-1-abc12", corev1.PodRunning, labels)
+	ownedPod.OwnerReferences = []metav1.OwnerReference{owner}
+
+	// Objects created by the bare-pod implementation had no owner
+	legacyPod := testPod("vpn-1", corev1.PodRunning, labels)
+	legacyConfigMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "vpn-config-1", Namespace: testNamespace, Labels: labels}}
+
+	otherUser := testPod("vpn-2", corev1.PodRunning, workloadLabels(&models.User{ID: "2"}))
+
+	tests := []struct {
+		name        string
+		objects     []runtime.Object
+		setup       func(client *fake.Clientset)
+		wantRemoved []string
+		wantDeleted []string
+		wantErr     string
+	}{
+		{
+			name:        "deletes root and reports owned objects",
+			objects:     []runtime.Object{root, ownedSecret, ownedService, ownedPod, otherUser},
+			wantRemoved: []string{"Deployment/vpn-1", "Pod/vpn-1-abc12", "Secret/vpn-config-1", "Service/vpn-1"},
+			wantDeleted: []string{"deployments/vpn-1"},
+		},
+		{
+			name:        "deletes legacy objects without owner",
+			objects:     []runtime.Object{legacyPod, legacyConfigMap, otherUser},
+			wantRemoved: []string{"Pod/vpn-1", "ConfigMap/vpn-config-1"},
+			wantDeleted: []string{"pods/vpn-1", "configmaps/vpn-config-1"},
+		},
+		{
+			name:    "nothing to delete",
+			objects: []runtime.Object{otherUser},
+		},
+		{
+			name:    "delete error",
+			objects: []runtime.Object{root, ownedSecret},
+			setup: func(client *fake.Clientset) {
+				failOn(client, "delete", "deployments", apierrors.NewForbidden(appsv1.Resource("deployments"), "vpn-1", errors.New("rbac")))
+			},
+			wantRemoved: []string{"Secret/vpn-config-1"},
+			wantDeleted: []string{"deployments/vpn-1"},
+			wantErr:     "forbidden",
+		},
+		{
+			name:    "list error",
+			objects: []runtime.Object{root},
+			setup: func(client *fake.Clientset) {
+				failOn(client, "list", "secrets", apierrors.NewServiceUnavailable("apiserver down"))
+			},
+			wantRemoved: []string{"Deployment/vpn-1"},
+			wantDeleted: []string{"deployments/vpn-1"},
+			wantErr:     "failed to list Secrets",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(tt.objects...)
+			if tt.setup != nil {
+				tt.setup(client)
+			}
+
+			removed, err := newTestManager(client).DeleteUserVPN(context.Background(), user)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want it to contain %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var gotRemoved []string
+			for _, ref := range removed {
+				gotRemoved = append(gotRemoved, ref.Kind+"/"+ref.Name)
+			}
+			if strings.Join(gotRemoved, ",") != strings.Join(tt.wantRemoved, ",") {
+				t.Errorf("removed: got %v, want %v", gotRemoved, tt.wantRemoved)
+			}
+
+			var gotDeleted []string
+			for _, action := range client.Actions() {
+				del, ok := action.(k8stesting.DeleteAction)
+				if !ok {
+					continue
+				}
+				policy := del.GetDeleteOptions().PropagationPolicy
+				if policy == nil || *policy != metav1.DeletePropagationForeground {
+					t.Errorf("expected foreground propagation, got %v", policy)
+				}
+				gotDeleted = append(gotDeleted, del.GetResource().Resource+"/"+del.GetName())
+			}
+			if strings.Join(gotDeleted, ",") != strings.Join(tt.wantDeleted, ",") {
+				t.Errorf("deleted: got %v, want %v", gotDeleted, tt.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestGetPodStatus(t *testing.T) {
+	user := &models.User{ID: "1"}
+	labels := workloadLabels(user)
+
+	older := testPod("vpn-1-old", corev1.PodFailed, labels)
+	older.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+	newer := testPod("vpn-1-new", corev1.PodPending, labels)
+	newer.CreationTimestamp = metav1.NewTime(time.Now())
+
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		want    string
+		wantErr bool
+	}{
+		{"running", []runtime.Object{testPod("vpn-1-a", corev1.PodRunning, labels)}, "Running", false},
+		{"pending", []runtime.Object{testPod("vpn-1-a", corev1.PodPending, labels)}, "Pending", false},
+		{"failed", []runtime.Object{testPod("vpn-1-a", corev1.PodFailed, labels)}, "Failed", false},
+		{"newest pod wins", []runtime.Object{older, newer}, "Pending", false},
+		{"other user's pod", []runtime.Object{testPod("vpn-2-a", corev1.PodRunning, workloadLabels(&models.User{ID: "2"}))}, "", true},
+		{"missing", nil, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := newTestManager(fake.NewSimpleClientset(tt.objects...))
+			got, err := vm.GetPodStatus(context.Background(), user)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("got status %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRolloutImage(t *testing.T) {
+	other := testDeployment("unrelated", "nginx:1")
+	other.Labels = map[string]string{"app": "other"}
+
+	tests := []struct {
+		name        string
+		image       string
+		objects     []runtime.Object
+		setup       func(client *fake.Clientset)
+		wantImage   string
+		wantUpdated int
+		wantErr     bool
+	}{
+		{
+			name:        "updates all vpn deployments",
+			image:       "wg:2",
+			objects:     []runtime.Object{testDeployment("vpn-1", "wg:1"), testDeployment("vpn-2", "wg:1"), other},
+			wantImage:   "wg:2",
+			wantUpdated: 2,
+		},
+		{
+			name:        "deployments already on the image are not counted",
+			image:       "wg:2",
+			objects:     []runtime.Object{testDeployment("vpn-1", "wg:1"), testDeployment("vpn-2", "wg:2")},
+			wantImage:   "wg:2",
+			wantUpdated: 1,
+		},
+		{
+			name:        "defaults to configured image",
+			objects:     []runtime.Object{testDeployment("vpn-1", "wg:1")},
+			wantImage:   testConfig().Image,
+			wantUpdated: 1,
+		},
+		{
+			name:    "update error is reported",
+			image:   "wg:2",
+			objects: []runtime.Object{testDeployment("vpn-1", "wg:1")},
+			setup: func(client *fake.Clientset) {
+				failOn(client, "update", "deployments", apierrors.NewServiceUnavailable("apiserver down"))
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := fake.NewSimpleClientset(tt.objects...)
+			if tt.setup != nil {
+				tt.setup(client)
+			}
+
+			vm := newTestManager(client)
+			updated, err := vm.RolloutImage(ctx, tt.image)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(updated) != tt.wantUpdated {
+				t.Fatalf("got %d updated deployments, want %d", len(updated), tt.wantUpdated)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			for _, name := range updated {
+				deployment, _ := client.AppsV1().Deployments(testNamespace).Get(ctx, name, metav1.GetOptions{})
+				if got := deployment.Spec.Template.Spec.Containers[0].Image; got != tt.wantImage {
+					t.Errorf("%s: got image %q, want %q", name, got, tt.wantImage)
+				}
+			}
+
+			unrelated, err := client.AppsV1().Deployments(testNamespace).Get(ctx, "unrelated", metav1.GetOptions{})
+			if err == nil && unrelated.Spec.Template.Spec.Containers[0].Image != "nginx:1" {
+				t.Errorf("unrelated deployment was modified")
+			}
+
+			// New workloads pick up the rolled out image
+			deployment, err := vm.buildDeployment(&models.User{ID: "3"}, nil, "vpn-3", "vpn-config-3")
+			if err != nil {
+				t.Fatalf("build deployment: %v", err)
+			}
+			if got := deployment.Spec.Template.Spec.Containers[0].Image; got != tt.wantImage {
+				t.Errorf("new workload image: got %q, want %q", got, tt.wantImage)
+			}
+		})
+	}
+}
+
+func TestUpdateUserVPNAppliesPlan(t *testing.T) {
+	ctx := context.Background()
+	user := &models.User{ID: "1", Username: "alice"}
+
+	vm := newTestManager(fake.NewSimpleClientset())
+	deployment, err := vm.buildDeployment(user, nil, "vpn-1", "vpn-config-1")
+	if err != nil {
+		t.Fatalf("build deployment: %v", err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "vpn-config-1", Namespace: testNamespace},
+		Data:       map[string][]byte{"wg0.conf": []byte(vm.serverConfig(user))},
+	}
+	client := fake.NewSimpleClientset(deployment, secret)
+	vm = newTestManager(client)
+
+	if err := vm.UpdateUserVPN(ctx, user, nil); err == nil {
+		t.Fatalf("expected error for user without workload")
+	}
+
+	user.WorkloadName = "vpn-1"
+	plan := &models.Plan{Name: "pro", CPULimit: "2", MemoryRequest: "256Mi"}
+	if err := vm.UpdateUserVPN(ctx, user, plan); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	updated, _ := client.AppsV1().Deployments(testNamespace).Get(ctx, "vpn-1", metav1.GetOptions{})
+	resources := updated.Spec.Template.Spec.Containers[0].Resources
+	if got := resources.Limits.Cpu().String(); got != "2" {
+		t.Errorf("got cpu limit %s, want plan value 2", got)
+	}
+	if got := resources.Requests.Memory().String(); got != "256Mi" {
+		t.Errorf("got memory request %s, want plan value 256Mi", got)
+	}
+	if got := resources.Limits.Memory().String(); got != testConfig().PodMemoryLimit {
+		t.Errorf("got memory limit %s, want configured default", got)
+	}
+	if _, err := client.NetworkingV1().NetworkPolicies(testNamespace).Get(ctx, "vpn-1", metav1.GetOptions{}); err != nil {
+		t.Errorf("network policy not created for existing workload: %v", err)
+	}
+
+	if err := vm.UpdateUserVPN(ctx, user, &models.Plan{Name: "bad", CPULimit: "lots"}); err == nil {
+		t.Fatalf("expected error for invalid plan quantity")
+	}
+}
+
+func TestUpdateUserVPNRemovesSuspendedPeer(t *testing.T) {
+	ctx := context.Background()
+	user := &models.User{ID: "1", Username: "alice", Status: "active", PublicKey: "client-key", ServerPrivateKey: "server-key"}
+
+	vm := newTestManager(fake.NewSimpleClientset())
+	deployment, err := vm.buildDeployment(user, nil, "vpn-1", "vpn-config-1")
+	if err != nil {
+		t.Fatalf("build deployment: %v", err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "vpn-config-1", Namespace: testNamespace},
+		Data:       map[string][]byte{"wg0.conf": []byte(vm.serverConfig(user))},
+	}
+	client := fake.NewSimpleClientset(deployment, secret)
+	vm = newTestManager(client)
+	user.WorkloadName = "vpn-1"
+
+	readState := func() (string, string) {
+		secret, _ := client.CoreV1().Secrets(testNamespace).Get(ctx, "vpn-config-1", metav1.GetOptions{})
+		deployment, _ := client.AppsV1().Deployments(testNamespace).Get(ctx, "vpn-1", metav1.GetOptions{})
+		return string(secret.Data["wg0.conf"]), deployment.Spec.Template.Annotations[configHashAnnotation]
+	}
+	activeConf, activeHash := readState()
+	if !strings.Contains(activeConf, "PublicKey = client-key") || activeHash == "" {
+		t.Fatalf("active user has no peer or config hash:\n%s", activeConf)
+	}
+
+	user.Status = "suspended"
+	if err := vm.UpdateUserVPN(ctx, user, nil); err != nil {
+		t.Fatalf("suspend: %v", err)
+	}
+	suspendedConf, suspendedHash := readState()
+	if strings.Contains(suspendedConf, "[Peer]") {
+		t.Errorf("suspended user still has a peer:\n%s", suspendedConf)
+	}
+	if suspendedHash == activeHash {
+		t.Errorf("config hash unchanged, the pod would not be rolled")
+	}
+
+	user.Status = "active"
+	if err := vm.UpdateUserVPN(ctx, user, nil); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if conf, hash := readState(); conf != activeConf || hash != activeHash {
+		t.Errorf("resumed config differs from the original")
+	}
+}
+
+func TestUpdatePodMetrics(t *testing.T) {
+	tests := []struct {
+		name                     string
+		objects                  []runtime.Object
+		setup                    func(client *fake.Clientset)
+		running, failed, pending float64
+		wantErr                  bool
+	}{
+		{
+			name: "counts vpn pods by phase",
+			objects: []runtime.Object{
+				testPod("vpn-1", corev1.PodRunning, vpnLabels),
+				testPod("vpn-2", corev1.PodRunning, vpnLabels),
+				testPod("vpn-3", corev1.PodFailed, vpnLabels),
+				testPod("vpn-4", corev1.PodPending, vpnLabels),
+				testPod("backend", corev1.PodRunning, map[string]string{"app": "vpnaas", "component": "backend"}),
+			},
+			running: 2, failed: 1, pending: 1,
+		},
+		{
+			name: "no pods",
+		},
+		{
+			name: "list error",
+			setup: func(client *fake.Clientset) {
+				failOn(client, "list", "pods", apierrors.NewServiceUnavailable("apiserver down"))
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(tt.objects...)
+			if tt.setup != nil {
+				tt.setup(client)
+			}
+			metrics.UpdatePodMetrics(0, 0, 0)
+
+			stats, err := newTestManager(client).UpdatePodMetrics(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+			if want := (models.PodStats{Running: int(tt.running), Failed: int(tt.failed), Pending: int(tt.pending)}); stats != want {
+				t.Errorf("got stats %+v, want %+v", stats, want)
+			}
+
+			if got := testutil.ToFloat64(metrics.VPNPodsRunning); got != tt.running {
+				t.Errorf("running: got %v, want %v", got, tt.running)
+			}
+			if got := testutil.ToFloat64(metrics.VPNPodsFailed); got != tt.failed {
+				t.Errorf("failed: got %v, want %v", got, tt.failed)
+			}
+			if got := testutil.ToFloat64(metrics.VPNPodsPending); got != tt.pending {
+				t.Errorf("pending: got %v, want %v", got, tt.pending)
+			}
+		})
+	}
+}
+
+func TestReadWireGuardDump(t *testing.T) {
+	running := testPod("vpn-1-abc", corev1.PodRunning, userLabels("1"))
+	pending := testPod("vpn-2-abc", corev1.PodPending, userLabels("2"))
+
+	tests := []struct {
+		name    string
+		userID  string
+		execErr error
+		wantPod string
+		wantErr string
+	}{
+		{name: "running pod", userID: "1", wantPod: "vpn-1-abc"},
+		{name: "pending pod", userID: "2", wantErr: "is Pending"},
+		{name: "no pod", userID: "3", wantErr: "no VPN pod"},
+		{name: "exec failure", userID: "1", execErr: errors.New("container not found"), wantErr: "container not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := newTestManager(fake.NewSimpleClientset(running, pending))
+
+			var gotCommand []string
+			vm.exec = func(ctx context.Context, pod, container string, command []string) (string, error) {
+				gotCommand = append([]string{pod, container}, command...)
+				return "dump", tt.execErr
+			}
+
+			pod, output, err := vm.ReadWireGuardDump(context.Background(), &models.User{ID: tt.userID})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if pod != tt.wantPod || output != "dump" {
+				t.Fatalf("got pod %q output %q", pod, output)
+			}
+			if got := strings.Join(gotCommand, " "); got != "vpn-1-abc wireguard wg show wg0 dump" {
+				t.Fatalf("got command %q", got)
+			}
+		})
+	}
+
+	vm := newTestManager(fake.NewSimpleClientset(running))
+	if _, _, err := vm.ReadWireGuardDump(context.Background(), &models.User{ID: "1"}); err == nil || !strings.Contains(err.Error(), "not enabled") {
+		t.Fatalf("got error %v, want exec disabled", err)
+	}
+}
@@ -0,0 +1,220 @@
+package k8s
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"vpnaas-backend/internal/models"
+)
+
+const (
+	// serverConfigKey is the key of the server configuration in a user's
+	// Secret, which the image loads as interface wg0
+	serverConfigKey = "wg0.conf"
+	// configHashAnnotation records the server configuration a pod was started
+	// with, so changing it rolls the pod
+	configHashAnnotation = "vpnaas.io/config-hash"
+)
+
+// tunnelPools returns the pools tunnel addresses are taken from
+func tunnelPools(dualStack bool) []netip.Prefix {
+	if dualStack {
+		return []netip.Prefix{models.TunnelPool, models.TunnelPool6}
+	}
+	return []netip.Prefix{models.TunnelPool}
+}
+
+// serverAddresses returns the tunnel addresses of the server in every VPN pod,
+// the first host of each pool, with the pool's prefix length
+func serverAddresses(dualStack bool) []string {
+	var addresses []string
+	for _, pool := range tunnelPools(dualStack) {
+		addresses = append(addresses, netip.PrefixFrom(hostAddress(pool, 1), pool.Bits()).String())
+	}
+	return addresses
+}
+
+// clientAddresses returns the tunnel addresses of a user's device as single
+// host prefixes. The host part is the user's tunnel host in every pool.
+func clientAddresses(user *models.User, dualStack bool) []string {
+	var addresses []string
+	for _, pool := range tunnelPools(dualStack) {
+		addr := hostAddress(pool, user.TunnelHost)
+		addresses = append(addresses, netip.PrefixFrom(addr, addr.BitLen()).String())
+	}
+	return addresses
+}
+
+// hostAddress returns the address with the given host number in a pool
+func hostAddress(pool netip.Prefix, host int) netip.Addr {
+	addr := pool.Addr().AsSlice()
+	addr[len(addr)-1] += byte(host)
+	result, _ := netip.AddrFromSlice(addr)
+	return result
+}
+
+// routingPolicy returns the routing policy for a user, the user's own
+// replacing the plan's
+func routingPolicy(user *models.User, plan *models.Plan) *models.RoutingPolicy {
+	if !user.Routing.IsZero() {
+		return user.Routing
+	}
+	if plan != nil && !plan.Routing.IsZero() {
+		return plan.Routing
+	}
+	return &models.RoutingPolicy{}
+}
+
+// clientConfig renders the configuration the user imports on their device.
+// Without allowed IPs in the routing policy all traffic of the tunnel's
+// address families is tunneled.
+func (vm *VPNManager) clientConfig(user *models.User, plan *models.Plan) string {
+	cfg := vm.vpnConfig()
+	routing := routingPolicy(user, plan)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Interface]\nPrivateKey = %s\nAddress = %s\n", user.PrivateKey, strings.Join(clientAddresses(user, cfg.DualStack), ", "))
+	// wg-quick takes search domains as non-address DNS entries
+	if dns := append(append([]string(nil), routing.DNS...), routing.SearchDomains...); len(dns) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", strings.Join(dns, ", "))
+	}
+	if routing.MTU != 0 {
+		fmt.Fprintf(&b, "MTU = %d\n", routing.MTU)
+	}
+
+	allowedIPs := append([]string(nil), routing.AllowedIPs...)
+	if len(allowedIPs) == 0 {
+		allowedIPs = append(allowedIPs, "0.0.0.0/0")
+		if cfg.DualStack {
+			allowedIPs = append(allowedIPs, "::/0")
+		}
+	}
+	if routing.IPv6DefaultRoute && !slices.Contains(allowedIPs, "::/0") {
+		allowedIPs = append(allowedIPs, "::/0")
+	}
+	fmt.Fprintf(&b, `
+[Peer]
+PublicKey = %s
+AllowedIPs = %s
+Endpoint = %s
+PersistentKeepalive = 25
+`,
+		user.ServerPublicKey,
+		strings.Join(allowedIPs, ", "),
+		net.JoinHostPort(cfg.Endpoint, strconv.Itoa(cfg.WireGuardPort)),
+	)
+
+	return b.String()
+}
+
+// serverConfig renders the configuration of the WireGuard server in a user's
+// pod. The user's device is only added as a peer while the user is not
+// suspended.
+func (vm *VPNManager) serverConfig(user *models.User) string {
+	cfg := vm.vpnConfig()
+	var b strings.Builder
+	fmt.Fprintf(&b, `[Interface]
+PrivateKey = %s
+Address = %s
+ListenPort = %d
+`,
+		user.ServerPrivateKey,
+		strings.Join(serverAddresses(cfg.DualStack), ", "),
+		cfg.WireGuardPort,
+	)
+	tables := []string{"iptables"}
+	if cfg.DualStack {
+		tables = append(tables, "ip6tables")
+	}
+	for _, table := range tables {
+		fmt.Fprintf(&b, "PostUp = %s -A FORWARD -i %%i -j ACCEPT; %s -t nat -A POSTROUTING -o eth0 -j MASQUERADE\n", table, table)
+		fmt.Fprintf(&b, "PostDown = %s -D FORWARD -i %%i -j ACCEPT; %s -t nat -D POSTROUTING -o eth0 -j MASQUERADE\n", table, table)
+	}
+	for _, rule := range shapingRules(user.AppliedBandwidth) {
+		fmt.Fprintf(&b, "PostUp = %s\n", rule)
+	}
+
+	if user.Status != "suspended" {
+		fmt.Fprintf(&b, `
+[Peer]
+PublicKey = %s
+AllowedIPs = %s
+`,
+			user.PublicKey,
+			strings.Join(clientAddresses(user, cfg.DualStack), ", "),
+		)
+	}
+
+	return b.String()
+}
+
+// bandwidthLimits returns the rate limits for a user, each direction set on
+// the user taking precedence over the plan's
+func bandwidthLimits(user *models.User, plan *models.Plan) models.BandwidthLimits {
+	limits := user.Bandwidth
+	if plan != nil {
+		if limits.Upload == "" {
+			limits.Upload = plan.Bandwidth.Upload
+		}
+		if limits.Download == "" {
+			limits.Download = plan.Bandwidth.Download
+		}
+	}
+	return limits
+}
+
+// shapingRules returns the tc commands that rate limit the tunnel interface.
+// Traffic leaving wg0 is the user's download and is shaped by a token bucket;
+// traffic arriving on wg0 is the user's upload and is policed on ingress.
+func shapingRules(limits models.BandwidthLimits) []string {
+	var rules []string
+
+	if rate, ok := rateBits(limits.Download); ok {
+		rules = append(rules, fmt.Sprintf("tc qdisc replace dev %%i root tbf rate %dbit burst %d latency 50ms", rate, burstBytes(rate)))
+	}
+	if rate, ok := rateBits(limits.Upload); ok {
+		rules = append(rules,
+			"tc qdisc replace dev %i handle ffff: ingress",
+			fmt.Sprintf("tc filter add dev %%i parent ffff: protocol all prio 1 u32 match u32 0 0 police rate %dbit burst %d drop flowid :1", rate, burstBytes(rate)),
+		)
+	}
+
+	return rules
+}
+
+// rateBits parses a rate limit in bits per second. Limits are validated when
+// set, anything unparsable is treated as no limit.
+func rateBits(limit string) (int64, bool) {
+	if limit == "" {
+		return 0, false
+	}
+	q, err := resource.ParseQuantity(limit)
+	if err != nil || q.Sign() <= 0 {
+		return 0, false
+	}
+	return q.Value(), true
+}
+
+// burstBytes sizes a token bucket to 100ms worth of traffic, at least a few
+// full-sized packets
+func burstBytes(rate int64) int64 {
+	burst := rate / 8 / 10
+	if burst < 16*1024 {
+		burst = 16 * 1024
+	}
+	return burst
+}
+
+// configHash returns a short digest of a configuration
+func configHash(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,204 @@
+package k8s
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+)
+
+func TestServerConfigBandwidth(t *testing.T) {
+	plan := &models.Plan{Name: "basic", Bandwidth: models.BandwidthLimits{Upload: "5M", Download: "20M"}}
+
+	tests := []struct {
+		name        string
+		user        *models.User
+		plan        *models.Plan
+		wantApplied models.BandwidthLimits
+		wantRules   []string
+	}{
+		{
+			name: "unlimited",
+			user: &models.User{ID: "1"},
+		},
+		{
+			name:        "plan limits",
+			user:        &models.User{ID: "2"},
+			plan:        plan,
+			wantApplied: plan.Bandwidth,
+			wantRules: []string{
+				"PostUp = tc qdisc replace dev %i root tbf rate 20000000bit burst 250000 latency 50ms",
+				"PostUp = tc qdisc replace dev %i handle ffff: ingress",
+				"PostUp = tc filter add dev %i parent ffff: protocol all prio 1 u32 match u32 0 0 police rate 5000000bit burst 62500 drop flowid :1",
+			},
+		},
+		{
+			name:        "user overrides one direction",
+			user:        &models.User{ID: "3", Bandwidth: models.BandwidthLimits{Download: "1Mi"}},
+			plan:        plan,
+			wantApplied: models.BandwidthLimits{Upload: "5M", Download: "1Mi"},
+			wantRules: []string{
+				"PostUp = tc qdisc replace dev %i root tbf rate 1048576bit burst 16384 latency 50ms",
+				"police rate 5000000bit",
+			},
+		},
+		{
+			name:        "user limit without plan",
+			user:        &models.User{ID: "4", Bandwidth: models.BandwidthLimits{Upload: "100k"}},
+			wantApplied: models.BandwidthLimits{Upload: "100k"},
+			wantRules:   []string{"police rate 100000bit burst 16384"},
+		},
+	}
+
+	vm := newTestManager(fake.NewSimpleClientset())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deployment, err := vm.buildDeployment(tt.user, tt.plan, "vpn-"+tt.user.ID, "vpn-config-"+tt.user.ID)
+			if err != nil {
+				t.Fatalf("build: %v", err)
+			}
+			if tt.user.AppliedBandwidth != tt.wantApplied {
+				t.Errorf("got applied limits %+v, want %+v", tt.user.AppliedBandwidth, tt.wantApplied)
+			}
+
+			conf := vm.serverConfig(tt.user)
+			if len(tt.wantRules) == 0 && strings.Contains(conf, "tc ") {
+				t.Errorf("unexpected shaping rules:\n%s", conf)
+			}
+			for _, rule := range tt.wantRules {
+				if !strings.Contains(conf, rule) {
+					t.Errorf("config lacks %q:\n%s", rule, conf)
+				}
+			}
+			if got := deployment.Spec.Template.Annotations[configHashAnnotation]; got != configHash(conf) {
+				t.Errorf("config hash %q does not match the rendered config", got)
+			}
+		})
+	}
+}
+
+func TestClientConfig(t *testing.T) {
+	plan := &models.Plan{Name: "office", Routing: &models.RoutingPolicy{
+		AllowedIPs:    []string{"10.20.0.0/16", "192.168.10.0/24"},
+		DNS:           []string{"10.20.0.53"},
+		SearchDomains: []string{"corp.example.com"},
+		MTU:           1380,
+	}}
+
+	tests := []struct {
+		name      string
+		routing   *models.RoutingPolicy
+		plan      *models.Plan
+		dualStack bool
+		want      []string
+		wantNone  []string
+	}{
+		{
+			name:     "full tunnel by default",
+			want:     []string{"Address = 10.0.0.2/32\n", "AllowedIPs = 0.0.0.0/0\n"},
+			wantNone: []string{"DNS =", "MTU ="},
+		},
+		{
+			name:      "dual-stack full tunnel",
+			dualStack: true,
+			want:      []string{"Address = 10.0.0.2/32, fd76:706e:6161::2/128\n", "AllowedIPs = 0.0.0.0/0, ::/0\n"},
+		},
+		{
+			name:      "dual-stack IPv6 default route is not repeated",
+			routing:   &models.RoutingPolicy{IPv6DefaultRoute: true},
+			dualStack: true,
+			want:      []string{"AllowedIPs = 0.0.0.0/0, ::/0\n"},
+		},
+		{
+			name:    "IPv6 default route listed before other routes is not repeated",
+			routing: &models.RoutingPolicy{AllowedIPs: []string{"::/0", "10.20.0.0/16"}, IPv6DefaultRoute: true},
+			want:    []string{"AllowedIPs = ::/0, 10.20.0.0/16\n"},
+		},
+		{
+			name: "plan policy",
+			plan: plan,
+			want: []string{
+				"AllowedIPs = 10.20.0.0/16, 192.168.10.0/24\n",
+				"DNS = 10.20.0.53, corp.example.com\n",
+				"MTU = 1380\n",
+			},
+		},
+		{
+			name:     "user policy replaces plan policy",
+			routing:  &models.RoutingPolicy{DNS: []string{"1.1.1.1"}, IPv6DefaultRoute: true},
+			plan:     plan,
+			want:     []string{"AllowedIPs = 0.0.0.0/0, ::/0\n", "DNS = 1.1.1.1\n"},
+			wantNone: []string{"MTU =", "corp.example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := newTestManager(fake.NewSimpleClientset(), func(cfg *config.VPNConfig) { cfg.DualStack = tt.dualStack })
+			user := &models.User{ID: "1", TunnelHost: 2, PrivateKey: "client-private", ServerPublicKey: "server-public", Routing: tt.routing}
+			conf := vm.clientConfig(user, tt.plan)
+
+			want := append([]string{"PrivateKey = client-private", "PublicKey = server-public", "Endpoint = vpn.example.com:51820"}, tt.want...)
+			for _, w := range want {
+				if !strings.Contains(conf, w) {
+					t.Errorf("client config lacks %q:\n%s", w, conf)
+				}
+			}
+			for _, w := range tt.wantNone {
+				if strings.Contains(conf, w) {
+					t.Errorf("client config contains %q:\n%s", w, conf)
+				}
+			}
+		})
+	}
+}
+
+func TestServerConfigDualStack(t *testing.T) {
+	vm := newTestManager(fake.NewSimpleClientset(), func(cfg *config.VPNConfig) { cfg.DualStack = true })
+	user := &models.User{ID: "1", TunnelHost: 2, Status: "active", ServerPrivateKey: "server-private", PublicKey: "client-public"}
+	conf := vm.serverConfig(user)
+
+	for _, want := range []string{
+		"Address = 10.0.0.1/24, fd76:706e:6161::1/64\n",
+		"PostUp = iptables -A FORWARD -i %i -j ACCEPT; iptables -t nat -A POSTROUTING -o eth0 -j MASQUERADE\n",
+		"PostUp = ip6tables -A FORWARD -i %i -j ACCEPT; ip6tables -t nat -A POSTROUTING -o eth0 -j MASQUERADE\n",
+		"PostDown = ip6tables -D FORWARD -i %i -j ACCEPT; ip6tables -t nat -D POSTROUTING -o eth0 -j MASQUERADE\n",
+		"AllowedIPs = 10.0.0.2/32, fd76:706e:6161::2/128\n",
+	} {
+		if !strings.Contains(conf, want) {
+			t.Errorf("server config lacks %q:\n%s", want, conf)
+		}
+	}
+}
+
+func TestClientAddressesUniquePerUser(t *testing.T) {
+	userStore := store.NewMemoryStore()
+	alice := models.NewUser("alice", "alice@example.com")
+	bob := models.NewUser("bob", "bob@example.com")
+	for _, user := range []*models.User{alice, bob} {
+		if err := userStore.CreateUser(user); err != nil {
+			t.Fatalf("create %s: %v", user.Username, err)
+		}
+	}
+
+	// UUIDs all have the same length, which once gave every user one host
+	aliceAddrs, bobAddrs := clientAddresses(alice, true), clientAddresses(bob, true)
+	if len(aliceAddrs) != 2 || len(bobAddrs) != 2 {
+		t.Fatalf("want an address in each pool, got %v and %v", aliceAddrs, bobAddrs)
+	}
+	for i, pool := range tunnelPools(true) {
+		for _, addr := range []string{aliceAddrs[i], bobAddrs[i]} {
+			if prefix := netip.MustParsePrefix(addr); !pool.Contains(prefix.Addr()) || prefix.Addr() == hostAddress(pool, 1) {
+				t.Errorf("address %s is not a device address in pool %s", addr, pool)
+			}
+		}
+		if aliceAddrs[i] == bobAddrs[i] {
+			t.Errorf("both users got %s in pool %s", aliceAddrs[i], pool)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+
+	"vpnaas-backend/internal/models"
+)
+
+// podExecFunc runs a command in a container and returns its standard output
+type podExecFunc func(ctx context.Context, pod, container string, command []string) (string, error)
+
+// EnablePodExec lets the manager run commands in VPN pods. Exec needs the
+// REST config the clientset was built from, which the clientset does not
+// expose.
+func (vm *VPNManager) EnablePodExec(restConfig *rest.Config) {
+	vm.exec = func(ctx context.Context, pod, container string, command []string) (string, error) {
+		return vm.execInPod(ctx, restConfig, pod, container, command)
+	}
+}
+
+// ReadWireGuardDump returns the name of the user's current pod and the output
+// of `wg show <if> dump` in its WireGuard container
+func (vm *VPNManager) ReadWireGuardDump(ctx context.Context, user *models.User) (string, string, error) {
+	pod, err := vm.currentPod(ctx, user.ID)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to find VPN pod: %v", err)
+	}
+	if pod == nil {
+		return "", "", fmt.Errorf("no VPN pod for user %s", user.ID)
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		return "", "", fmt.Errorf("VPN pod %s is %s", pod.Name, pod.Status.Phase)
+	}
+
+	output, err := vm.exec(ctx, pod.Name, vm.containerName, []string{"wg", "show", vm.wgInterface, "dump"})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read WireGuard dump from pod %s: %v", pod.Name, err)
+	}
+
+	return pod.Name, output, nil
+}
+
+// execInPod runs a command in a container through the pods/exec subresource
+func (vm *VPNManager) execInPod(ctx context.Context, restConfig *rest.Config, pod, container string, command []string) (string, error) {
+	req := vm.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(pod).
+		Namespace(vm.namespace).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(restConfig, "POST", req.URL())
+	if err != nil {
+		return "", err
+	}
+
+	var stdout, stderr bytes.Buffer
+	err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%v: %s", err, msg)
+		}
+		return "", err
+	}
+
+	return stdout.String(), nil
+}
+
+// execUnavailable is used until EnablePodExec is called
+func (vm *VPNManager) execUnavailable(ctx context.Context, pod, container string, command []string) (string, error) {
+	return "", fmt.Errorf("pod exec is not enabled")
+}
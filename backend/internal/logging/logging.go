@@ -0,0 +1,81 @@
+// Package logging configures the backend's logs and carries a logger scoped
+// to a request, with its request ID, trace and the user it acts on, through
+// the request context
+package logging
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"vpnaas-backend/internal/config"
+)
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+)
+
+// Init configures the standard logger from cfg, with debug forcing the debug
+// level, and installs the redaction of secrets
+func Init(cfg config.LogConfig, debug bool) error {
+	if err := Configure(cfg, debug); err != nil {
+		return err
+	}
+	logrus.AddHook(redactHook{})
+	return nil
+}
+
+// Configure sets the format and level of the standard logger from cfg, with
+// debug forcing the debug level. It is called again when the configuration
+// is reloaded.
+func Configure(cfg config.LogConfig, debug bool) error {
+	switch format := strings.ToLower(cfg.Format); format {
+	case "", "text":
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{
+			FieldMap: logrus.FieldMap{logrus.FieldKeyMsg: "message"},
+		})
+	default:
+		return fmt.Errorf("unknown log format %q, want text or json", format)
+	}
+
+	level := logrus.InfoLevel
+	if name := cfg.Level; name != "" {
+		parsed, err := logrus.ParseLevel(name)
+		if err != nil {
+			return fmt.Errorf("invalid log level: %v", err)
+		}
+		level = parsed
+	}
+	if debug {
+		level = logrus.DebugLevel
+	}
+	logrus.SetLevel(level)
+	return nil
+}
+
+// FromContext returns the logger of the request ctx belongs to, or the
+// standard logger outside of a request
+func FromContext(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(loggerKey).(*logrus.Entry); ok {
+		return entry
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// WithFields returns a context whose logger adds fields to every line
+func WithFields(ctx context.Context, fields logrus.Fields) context.Context {
+	return context.WithValue(ctx, loggerKey, FromContext(ctx).WithFields(fields))
+}
+
+// RequestID returns the ID of the request ctx belongs to, or an empty string
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
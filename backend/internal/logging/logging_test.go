@@ -0,0 +1,143 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "wireguard config",
+			input: "rendered config: [Interface]\nPrivateKey = abc=\nAddress = 10.0.0.2/32\n",
+			want:  "rendered config: [REDACTED WireGuard config]",
+		},
+		{
+			name:  "key assignment",
+			input: "peer PrivateKey = aGVsbG8= PublicKey = d29ybGQ=",
+			want:  "peer PrivateKey = [REDACTED] PublicKey = d29ybGQ=",
+		},
+		{
+			name:  "json fields",
+			input: `{"private_key": "aGVsbG8=", "username": "alice"}`,
+			want:  `{"private_key": "[REDACTED]", "username": "alice"}`,
+		},
+		{
+			name:  "nothing to redact",
+			input: "Created VPN deployment vpn-1 for user alice",
+			want:  "Created VPN deployment vpn-1 for user alice",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Redact(tt.input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactHook(t *testing.T) {
+	logger, _ := logtest.NewNullLogger()
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.AddHook(redactHook{})
+
+	shared := logger.WithField("config_data", "[Interface]\nPrivateKey = abc=")
+	shared.WithFields(logrus.Fields{
+		"preshared_key": "c2VjcmV0",
+		"error":         errors.New("exec failed: PrivateKey = abc="),
+		"user_id":       "u1",
+	}).Error("Failed to apply [Interface]\nPrivateKey = abc=")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("decode log line: %v", err)
+	}
+	if strings.Contains(buf.String(), "abc=") || strings.Contains(buf.String(), "c2VjcmV0") {
+		t.Errorf("secret logged: %s", buf.String())
+	}
+	if line["user_id"] != "u1" || line["config_data"] != redacted || line["preshared_key"] != redacted {
+		t.Errorf("got fields %v", line)
+	}
+	if shared.Data["config_data"] == redacted {
+		t.Error("redaction modified the fields of the parent logger")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	var handlerID string
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/users/:id", func(c *gin.Context) {
+		handlerID = RequestID(c.Request.Context())
+		FromContext(c.Request.Context()).Info("handling")
+		c.Status(http.StatusNotFound)
+	})
+
+	tests := []struct {
+		name     string
+		header   string
+		generate bool
+	}{
+		{name: "from the gateway", header: "req-1"},
+		{name: "generated", generate: true},
+		{name: "unusable header replaced", header: "forged\nlevel=error", generate: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.Reset()
+			req := httptest.NewRequest(http.MethodGet, "/users/1?token=secret", nil)
+			if tt.header != "" {
+				req.Header.Set(RequestIDHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			id := w.Header().Get(RequestIDHeader)
+			if tt.generate && (id == "" || id == tt.header) || !tt.generate && id != tt.header {
+				t.Fatalf("got request ID %q for header %q", id, tt.header)
+			}
+			if handlerID != id {
+				t.Errorf("handler saw request ID %q, response carries %q", handlerID, id)
+			}
+
+			entries := hook.AllEntries()
+			if len(entries) != 2 {
+				t.Fatalf("got %d log entries, want the handler's and the access log", len(entries))
+			}
+			for _, entry := range entries {
+				if entry.Data["request_id"] != id {
+					t.Errorf("entry %q has request ID %v, want %q", entry.Message, entry.Data["request_id"], id)
+				}
+			}
+			access := entries[1]
+			if access.Level != logrus.WarnLevel || access.Data["status"] != http.StatusNotFound || access.Data["route"] != "/users/:id" {
+				t.Errorf("got access log %v %v", access.Level, access.Data)
+			}
+			if access.Data["path"] != "/users/1" {
+				t.Errorf("got path %v, want it without the query", access.Data["path"])
+			}
+		})
+	}
+}
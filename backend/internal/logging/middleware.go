@@ -0,0 +1,93 @@
+package logging
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader carries the ID of a request, set by the gateway or
+// generated here
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the request IDs taken from clients
+const maxRequestIDLength = 128
+
+// quietPaths are polled by probes and scrapers. Their successful requests are
+// only logged at debug level.
+var quietPaths = map[string]bool{
+	"/livez":   true,
+	"/readyz":  true,
+	"/health":  true,
+	"/metrics": true,
+}
+
+// Middleware gives every request an ID, taken from the X-Request-ID header
+// when the gateway set a usable one, returns it in the response and scopes
+// a logger carrying it and the request's trace to the request context. Once
+// the request has been handled it is logged with its route, status and
+// duration. Query strings are left out as they may carry secrets.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		requestID := c.GetHeader(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = uuid.New().String()
+		}
+		c.Header(RequestIDHeader, requestID)
+
+		ctx := context.WithValue(c.Request.Context(), requestIDKey, requestID)
+		fields := logrus.Fields{"request_id": requestID}
+		if span := trace.SpanContextFromContext(ctx); span.HasTraceID() {
+			fields["trace_id"] = span.TraceID().String()
+		}
+		ctx = WithFields(ctx, fields)
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		entry := FromContext(ctx).WithFields(logrus.Fields{
+			"method":      c.Request.Method,
+			"path":        c.Request.URL.Path,
+			"route":       c.FullPath(),
+			"status":      status,
+			"duration_ms": time.Since(start).Milliseconds(),
+			"client_ip":   c.ClientIP(),
+		})
+		if len(c.Errors) > 0 {
+			entry = entry.WithField("errors", c.Errors.String())
+		}
+
+		switch {
+		case status >= http.StatusInternalServerError:
+			entry.Error("Request failed")
+		case status >= http.StatusBadRequest:
+			entry.Warn("Request rejected")
+		case quietPaths[c.Request.URL.Path]:
+			entry.Debug("Request handled")
+		default:
+			entry.Info("Request handled")
+		}
+	}
+}
+
+// validRequestID reports whether a client-supplied request ID is short and
+// printable, so that it cannot forge log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// redacted replaces secrets in log lines
+const redacted = "[REDACTED]"
+
+// sensitiveFields are field names whose values are never logged
+var sensitiveFields = []string{"private_key", "privatekey", "preshared_key", "presharedkey", "config", "config_data", "password", "secret", "token", "authorization"}
+
+var (
+	// wireGuardConfig matches a WireGuard config from its [Interface]
+	// section to the end of the text
+	wireGuardConfig = regexp.MustCompile(`(?s)\[Interface\].*`)
+	// secretAssignment matches key-value pairs naming a secret, such as
+	// "PrivateKey = ..." or "private_key": "..."
+	secretAssignment = regexp.MustCompile(`(?i)("?(?:private_?key|preshared_?key|password|token|config_data)"?\s*[:=]\s*)("[^"]*"|\S+)`)
+)
+
+// Redact removes WireGuard configs and key, password and token values from s
+func Redact(s string) string {
+	s = wireGuardConfig.ReplaceAllString(s, "[REDACTED WireGuard config]")
+	return secretAssignment.ReplaceAllStringFunc(s, func(match string) string {
+		parts := secretAssignment.FindStringSubmatch(match)
+		if strings.HasPrefix(parts[2], `"`) {
+			return parts[1] + `"` + redacted + `"`
+		}
+		return parts[1] + redacted
+	})
+}
+
+// redactHook scrubs secrets from the message and fields of every entry
+// before it is formatted
+type redactHook struct{}
+
+// Levels applies the hook to every level
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire redacts the entry in place
+func (redactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = Redact(entry.Message)
+
+	// Fields are copied so that loggers sharing them are left untouched
+	fields := make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch {
+		case sensitiveField(key):
+			fields[key] = redacted
+		case isText(value):
+			fields[key] = Redact(fmt.Sprint(value))
+		default:
+			fields[key] = value
+		}
+	}
+	entry.Data = fields
+	return nil
+}
+
+// sensitiveField reports whether a field name denotes a secret
+func sensitiveField(key string) bool {
+	key = strings.ToLower(key)
+	for _, name := range sensitiveFields {
+		if key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isText reports whether a field value is logged as text that may embed a
+// secret
+func isText(value interface{}) bool {
+	switch value.(type) {
+	case string, error, fmt.Stringer:
+		return true
+	}
+	return false
+}
@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -60,11 +62,31 @@ var (
 		Help: "Total data usage in bytes",
 	})
 
+	// Per-user series are only exported when metrics.per_user.mode asks for
+	// them, see UpdateUsageMetrics
 	DataUsagePerUser = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "vpnaas_user_data_usage_bytes",
 		Help: "Data usage per user in bytes",
 	}, []string{"user_id", "username"})
 
+	// Provisioning metrics
+	ProvisioningDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vpnaas_provisioning_duration_seconds",
+		Help:    "Time from a provisioning request to a ready VPN, or to its failure, in seconds",
+		Buckets: []float64{1, 2.5, 5, 10, 20, 30, 60, 90, 120, 180, 300},
+	}, []string{"outcome"})
+
+	ProvisioningStepDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vpnaas_provisioning_step_duration_seconds",
+		Help:    "Duration of each provisioning step in seconds",
+		Buckets: []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"step"})
+
+	ProvisioningFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vpnaas_provisioning_failures_total",
+		Help: "Total number of failed VPN provisionings by reason",
+	}, []string{"reason"})
+
 	// API metrics
 	APIRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "vpnaas_api_requests_total",
@@ -77,6 +99,17 @@ var (
 		Buckets: prometheus.DefBuckets,
 	}, []string{"method", "endpoint"})
 
+	APIRequestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "vpnaas_api_requests_in_flight",
+		Help: "Number of API requests being served",
+	})
+
+	APIResponseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vpnaas_api_response_size_bytes",
+		Help:    "API response body size in bytes",
+		Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+	}, []string{"method", "endpoint"})
+
 	// Error metrics
 	ErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "vpnaas_errors_total",
@@ -84,6 +117,38 @@ var (
 	}, []string{"type", "component"})
 )
 
+// Provisioning steps reported by vpnaas_provisioning_step_duration_seconds
+const (
+	StepDeploymentCreate   = "deployment_create"
+	StepSecretCreate       = "secret_create"
+	StepServiceCreate      = "service_create"
+	StepNetworkPolicyApply = "network_policy_apply"
+	StepReadinessWait      = "readiness_wait"
+)
+
+// Reasons reported by vpnaas_provisioning_failures_total
+const (
+	FailureImagePull     = "image_pull"
+	FailureUnschedulable = "unschedulable"
+	FailureCrashLoop     = "crash_loop"
+	FailureQuota         = "quota"
+	FailureAPIError      = "api_error"
+	FailureTimeout       = "timeout"
+	FailureInternal      = "internal"
+)
+
+// ProvisioningFailureReasons lists every failure reason so each series
+// exists before the first failure
+var ProvisioningFailureReasons = []string{
+	FailureImagePull,
+	FailureUnschedulable,
+	FailureCrashLoop,
+	FailureQuota,
+	FailureAPIError,
+	FailureTimeout,
+	FailureInternal,
+}
+
 // Init initializes the metrics
 func Init() {
 	// Initialize all metrics to 0
@@ -96,6 +161,9 @@ func Init() {
 	VPNPodsPending.Set(0)
 	ActiveConnections.Set(0)
 	TotalDataUsage.Add(0)
+	for _, reason := range ProvisioningFailureReasons {
+		ProvisioningFailures.WithLabelValues(reason).Add(0)
+	}
 }
 
 // UpdateUserMetrics updates user-related metrics
@@ -128,19 +196,20 @@ func AddDataUsage(bytes int64) {
 	TotalDataUsage.Add(float64(bytes))
 }
 
-// SetUserDataUsage sets data usage for a specific user
-func SetUserDataUsage(userID, username string, bytes int64) {
-	DataUsagePerUser.WithLabelValues(userID, username).Set(float64(bytes))
-}
-
-// RecordAPIRequest records an API request
-func RecordAPIRequest(method, endpoint, status string) {
-	APIRequestsTotal.WithLabelValues(method, endpoint, status).Inc()
+// RecordProvisioning records how long provisioning a VPN took and, when it
+// failed, why. An empty reason means it succeeded.
+func RecordProvisioning(duration time.Duration, reason string) {
+	outcome := "success"
+	if reason != "" {
+		outcome = "failure"
+		ProvisioningFailures.WithLabelValues(reason).Inc()
+	}
+	ProvisioningDuration.WithLabelValues(outcome).Observe(duration.Seconds())
 }
 
-// RecordAPIRequestDuration records API request duration
-func RecordAPIRequestDuration(method, endpoint string, duration float64) {
-	APIRequestDuration.WithLabelValues(method, endpoint).Observe(duration)
+// RecordProvisioningStep records the duration of a provisioning step
+func RecordProvisioningStep(step string, duration time.Duration) {
+	ProvisioningStepDuration.WithLabelValues(step).Observe(duration.Seconds())
 }
 
 // RecordError records an error
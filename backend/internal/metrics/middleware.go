@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// unmatchedEndpoint labels requests that matched no route, so that arbitrary
+// paths cannot create new series
+const unmatchedEndpoint = "unmatched"
+
+// Middleware records the count, duration and response size of every request
+// under its method, route template and status, and the number of requests in
+// flight
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		APIRequestsInFlight.Inc()
+		defer APIRequestsInFlight.Dec()
+
+		c.Next()
+
+		endpoint := c.FullPath()
+		if endpoint == "" {
+			endpoint = unmatchedEndpoint
+		}
+		method := c.Request.Method
+		size := c.Writer.Size()
+		if size < 0 {
+			size = 0
+		}
+
+		APIRequestsTotal.WithLabelValues(method, endpoint, strconv.Itoa(c.Writer.Status())).Inc()
+		APIRequestDuration.WithLabelValues(method, endpoint).Observe(time.Since(start).Seconds())
+		APIResponseSize.WithLabelValues(method, endpoint).Observe(float64(size))
+	}
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/api/v1/users/:id", func(c *gin.Context) {
+		if got := testutil.ToFloat64(APIRequestsInFlight); got != 1 {
+			t.Errorf("got %v requests in flight while serving, want 1", got)
+		}
+		c.String(http.StatusInternalServerError, "failed")
+	})
+
+	before := testutil.ToFloat64(APIRequestsTotal.WithLabelValues("GET", "/api/v1/users/:id", "500"))
+	unmatchedBefore := testutil.ToFloat64(APIRequestsTotal.WithLabelValues("GET", unmatchedEndpoint, "404"))
+
+	for _, path := range []string{"/api/v1/users/1", "/api/v1/users/2", "/no/such/route"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	// Requests are labelled with their route template, not their path
+	if got := testutil.ToFloat64(APIRequestsTotal.WithLabelValues("GET", "/api/v1/users/:id", "500")) - before; got != 2 {
+		t.Errorf("got %v requests recorded for the route, want 2", got)
+	}
+	if got := testutil.ToFloat64(APIRequestsTotal.WithLabelValues("GET", unmatchedEndpoint, "404")) - unmatchedBefore; got != 1 {
+		t.Errorf("got %v unmatched requests recorded, want 1", got)
+	}
+	if got := testutil.ToFloat64(APIRequestsInFlight); got != 0 {
+		t.Errorf("got %v requests in flight after serving, want 0", got)
+	}
+	if got := testutil.CollectAndCount(APIResponseSize, "vpnaas_api_response_size_bytes"); got < 2 {
+		t.Errorf("got %d response size series, want one per route", got)
+	}
+}
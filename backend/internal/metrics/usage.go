@@ -0,0 +1,190 @@
+package metrics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/models"
+)
+
+// Per-user series modes for metrics.per_user.mode
+const (
+	PerUserOff  = "off"   // aggregates only
+	PerUserAll  = "all"   // a series for every provisioned user
+	PerUserTopN = "top_n" // a series for the metrics.per_user.top_n heaviest users
+)
+
+// Username label modes for metrics.per_user.username
+const (
+	UsernamePlain  = "plain"
+	UsernameHashed = "hashed"
+	UsernameOmit   = "omit"
+)
+
+// defaultTopN is how many users are exported in top_n mode when
+// metrics.per_user.top_n is not set
+const defaultTopN = 20
+
+// noPlan labels the users without a plan in the per-plan metrics
+const noPlan = "none"
+
+var (
+	// Aggregate usage metrics
+	DataUsagePerPlan = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vpnaas_plan_data_usage_bytes",
+		Help: "Data usage of the users on each plan in bytes",
+	}, []string{"plan"})
+
+	UsersPerPlan = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vpnaas_plan_users",
+		Help: "Number of users on each plan",
+	}, []string{"plan"})
+
+	DataUsagePerTenant = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vpnaas_tenant_data_usage_bytes",
+		Help: "Data usage of the users of each tenant in bytes",
+	}, []string{"tenant"})
+
+	UsersPerTenant = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vpnaas_tenant_users",
+		Help: "Number of users of each tenant",
+	}, []string{"tenant"})
+
+	userUsageSeries   = newSeriesSet(DataUsagePerUser)
+	planUsageSeries   = newSeriesSet(DataUsagePerPlan)
+	planUserSeries    = newSeriesSet(UsersPerPlan)
+	tenantUsageSeries = newSeriesSet(DataUsagePerTenant)
+	tenantUserSeries  = newSeriesSet(UsersPerTenant)
+)
+
+// seriesSet tracks the series of a gauge vec so that a new set of values can
+// replace the previous one, dropping the series that are no longer part of it
+type seriesSet struct {
+	mu     sync.Mutex
+	vec    *prometheus.GaugeVec
+	series map[string][]string
+}
+
+func newSeriesSet(vec *prometheus.GaugeVec) *seriesSet {
+	return &seriesSet{vec: vec, series: make(map[string][]string)}
+}
+
+// replace sets every series in values and deletes the ones set previously
+// that values no longer contains
+func (s *seriesSet) replace(values map[string]float64, labels map[string][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, value := range values {
+		s.vec.WithLabelValues(labels[key]...).Set(value)
+	}
+	for key, previous := range s.series {
+		if _, exists := values[key]; !exists {
+			s.vec.DeleteLabelValues(previous...)
+		}
+	}
+	s.series = labels
+}
+
+// accumulator sums values per label set for a seriesSet
+type accumulator struct {
+	values map[string]float64
+	labels map[string][]string
+}
+
+func newAccumulator() *accumulator {
+	return &accumulator{values: make(map[string]float64), labels: make(map[string][]string)}
+}
+
+func (a *accumulator) add(value float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+	a.values[key] += value
+	a.labels[key] = labels
+}
+
+// UpdateUsageMetrics recomputes the per-plan and per-tenant aggregates from
+// every user and, when perUser asks for them, the per-user series. Series of
+// users, plans and tenants that are gone are removed.
+func UpdateUsageMetrics(users []*models.User, perUser config.PerUserMetrics) {
+	planUsage, planUsers := newAccumulator(), newAccumulator()
+	tenantUsage, tenantUsers := newAccumulator(), newAccumulator()
+	for _, user := range users {
+		plan := user.Plan
+		if plan == "" {
+			plan = noPlan
+		}
+		planUsage.add(float64(user.DataUsage), plan)
+		planUsers.add(1, plan)
+
+		// Users outside any tenant are left out rather than pooled under an
+		// empty label
+		if user.Tenant != "" {
+			tenantUsage.add(float64(user.DataUsage), user.Tenant)
+			tenantUsers.add(1, user.Tenant)
+		}
+	}
+	planUsageSeries.replace(planUsage.values, planUsage.labels)
+	planUserSeries.replace(planUsers.values, planUsers.labels)
+	tenantUsageSeries.replace(tenantUsage.values, tenantUsage.labels)
+	tenantUserSeries.replace(tenantUsers.values, tenantUsers.labels)
+
+	userUsage := newAccumulator()
+	for _, user := range perUserSelection(users, perUser) {
+		userUsage.add(float64(user.DataUsage), user.ID, usernameLabel(user.Username, perUser.Username))
+	}
+	userUsageSeries.replace(userUsage.values, userUsage.labels)
+}
+
+// perUserSelection returns the users that get their own series under the
+// mode of perUser
+func perUserSelection(users []*models.User, perUser config.PerUserMetrics) []*models.User {
+	switch perUser.Mode {
+	case PerUserAll:
+		return users
+	case PerUserTopN:
+		limit := perUser.TopN
+		if limit <= 0 {
+			limit = defaultTopN
+		}
+		sorted := append([]*models.User(nil), users...)
+		sort.Slice(sorted, func(i, j int) bool {
+			if sorted[i].DataUsage != sorted[j].DataUsage {
+				return sorted[i].DataUsage > sorted[j].DataUsage
+			}
+			return sorted[i].ID < sorted[j].ID
+		})
+		if len(sorted) > limit {
+			sorted = sorted[:limit]
+		}
+		return sorted
+	default:
+		return nil
+	}
+}
+
+// usernameLabel renders the username label. An omitted username is an empty
+// value, which Prometheus treats as an absent label.
+func usernameLabel(username, mode string) string {
+	switch mode {
+	case UsernamePlain:
+		return username
+	case UsernameOmit:
+		return ""
+	default:
+		sum := sha256.Sum256([]byte(username))
+		return hex.EncodeToString(sum[:8])
+	}
+}
+
+// DeleteUserDataUsage removes the per-user series of a deleted user. The
+// aggregates catch up on the next usage collection.
+func DeleteUserDataUsage(userID string) {
+	DataUsagePerUser.DeletePartialMatch(prometheus.Labels{"user_id": userID})
+}
@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/models"
+)
+
+func usageUser(id, username, plan, tenant string, usage int64) *models.User {
+	return &models.User{ID: id, Username: username, Plan: plan, Tenant: tenant, DataUsage: usage}
+}
+
+func TestUpdateUsageMetricsAggregates(t *testing.T) {
+	perUser := config.PerUserMetrics{Mode: PerUserOff}
+
+	UpdateUsageMetrics([]*models.User{
+		usageUser("1", "alice", "pro", "acme", 100),
+		usageUser("2", "bob", "pro", "", 50),
+		usageUser("3", "carol", "", "acme", 25),
+	}, perUser)
+
+	if got := testutil.ToFloat64(DataUsagePerPlan.WithLabelValues("pro")); got != 150 {
+		t.Errorf("got pro usage %v, want 150", got)
+	}
+	if got := testutil.ToFloat64(UsersPerPlan.WithLabelValues(noPlan)); got != 1 {
+		t.Errorf("got %v users without a plan, want 1", got)
+	}
+	if got := testutil.ToFloat64(DataUsagePerTenant.WithLabelValues("acme")); got != 125 {
+		t.Errorf("got acme usage %v, want 125", got)
+	}
+	if got := testutil.CollectAndCount(DataUsagePerTenant); got != 1 {
+		t.Errorf("got %d tenant series, want 1", got)
+	}
+	if got := testutil.CollectAndCount(DataUsagePerUser); got != 0 {
+		t.Errorf("got %d per-user series with per-user metrics off, want 0", got)
+	}
+
+	// Plans and tenants without users anymore lose their series
+	UpdateUsageMetrics([]*models.User{usageUser("2", "bob", "basic", "", 75)}, perUser)
+	if got := testutil.CollectAndCount(DataUsagePerPlan); got != 1 {
+		t.Errorf("got %d plan series, want 1", got)
+	}
+	if got := testutil.CollectAndCount(DataUsagePerTenant); got != 0 {
+		t.Errorf("got %d tenant series, want 0", got)
+	}
+}
+
+func TestUpdateUsageMetricsPerUser(t *testing.T) {
+	users := []*models.User{
+		usageUser("1", "alice", "", "", 100),
+		usageUser("2", "bob", "", "", 300),
+		usageUser("3", "carol", "", "", 200),
+	}
+
+	tests := []struct {
+		name     string
+		mode     string
+		username string
+		want     map[string]string // user ID to username label
+	}{
+		{
+			name:     "all with plain usernames",
+			mode:     PerUserAll,
+			username: UsernamePlain,
+			want:     map[string]string{"1": "alice", "2": "bob", "3": "carol"},
+		},
+		{
+			name:     "top n without usernames",
+			mode:     PerUserTopN,
+			username: UsernameOmit,
+			want:     map[string]string{"2": "", "3": ""},
+		},
+		{
+			name:     "hashed usernames",
+			mode:     PerUserAll,
+			username: UsernameHashed,
+			want: map[string]string{
+				"1": usernameLabel("alice", UsernameHashed),
+				"2": usernameLabel("bob", UsernameHashed),
+				"3": usernameLabel("carol", UsernameHashed),
+			},
+		},
+		{
+			name: "off",
+			mode: PerUserOff,
+			want: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			UpdateUsageMetrics(users, config.PerUserMetrics{Mode: tt.mode, Username: tt.username, TopN: 2})
+
+			if got := testutil.CollectAndCount(DataUsagePerUser); got != len(tt.want) {
+				t.Errorf("got %d per-user series, want %d", got, len(tt.want))
+			}
+			for id, username := range tt.want {
+				if got := testutil.ToFloat64(DataUsagePerUser.WithLabelValues(id, username)); got == 0 {
+					t.Errorf("missing series for user %s with username %q", id, username)
+				}
+			}
+		})
+	}
+
+	if hashed := usernameLabel("alice", UsernameHashed); hashed == "alice" || len(hashed) != 16 {
+		t.Errorf("got hashed username %q", hashed)
+	}
+}
+
+func TestDeleteUserDataUsage(t *testing.T) {
+	perUser := config.PerUserMetrics{Mode: PerUserAll, Username: UsernamePlain}
+	UpdateUsageMetrics([]*models.User{usageUser("1", "alice", "", "", 100), usageUser("2", "bob", "", "", 50)}, perUser)
+	DeleteUserDataUsage("1")
+
+	if got := testutil.CollectAndCount(DataUsagePerUser); got != 1 {
+		t.Errorf("got %d per-user series after delete, want 1", got)
+	}
+}
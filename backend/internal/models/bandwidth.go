@@ -0,0 +1,31 @@
+package models
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// BandwidthLimits are the rate limits of a user's VPN in bits per second,
+// written as quantities such as 10M. An empty limit means unlimited.
+type BandwidthLimits struct {
+	Upload   string `json:"upload,omitempty"`
+	Download string `json:"download,omitempty"`
+}
+
+// Validate checks that the limits parse as positive quantities
+func (b BandwidthLimits) Validate() error {
+	for field, value := range map[string]string{"upload": b.Upload, "download": b.Download} {
+		if value == "" {
+			continue
+		}
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			return fmt.Errorf("bandwidth %s: %v", field, err)
+		}
+		if q.Sign() <= 0 {
+			return fmt.Errorf("bandwidth %s must be positive", field)
+		}
+	}
+	return nil
+}
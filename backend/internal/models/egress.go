@@ -0,0 +1,34 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// EgressProfile pins VPN pods to the nodes whose traffic leaves the cluster
+// from a known public IP, so partners can allowlist it
+type EgressProfile struct {
+	Name         string `json:"name" mapstructure:"-"`
+	NodePool     string `json:"node_pool,omitempty" mapstructure:"node_pool"`
+	NodeSelector string `json:"node_selector,omitempty" mapstructure:"node_selector"` // label selector, e.g. "zone in (a,b)"
+	PublicIP     string `json:"public_ip" mapstructure:"public_ip"`
+}
+
+// Validate checks that the profile selects nodes and has a valid public IP
+func (p *EgressProfile) Validate() error {
+	if p.NodePool == "" && p.NodeSelector == "" {
+		return errors.New("node_pool or node_selector is required")
+	}
+	if p.NodeSelector != "" {
+		if _, err := labels.Parse(p.NodeSelector); err != nil {
+			return fmt.Errorf("node_selector: %v", err)
+		}
+	}
+	if _, err := netip.ParseAddr(p.PublicIP); err != nil {
+		return fmt.Errorf("public_ip: %v", err)
+	}
+	return nil
+}
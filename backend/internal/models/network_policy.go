@@ -0,0 +1,95 @@
+package models
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// NetworkPolicy restricts where a user's VPN pod may send traffic. Traffic is
+// allowed if any rule matches. Traffic to other VPN pods is always blocked.
+type NetworkPolicy struct {
+	Egress []EgressRule `json:"egress" bson:"egress"`
+}
+
+// EgressRule allows traffic to the given networks and namespaces, or anywhere
+// if it names neither, on the given ports, or any port if it names none
+type EgressRule struct {
+	CIDRs      []string     `json:"cidrs,omitempty" bson:"cidrs,omitempty"`
+	Namespaces []string     `json:"namespaces,omitempty" bson:"namespaces,omitempty"`
+	Ports      []EgressPort `json:"ports,omitempty" bson:"ports,omitempty"`
+}
+
+// EgressPort is a destination port, or a range of ports up to EndPort
+type EgressPort struct {
+	Protocol string `json:"protocol,omitempty" bson:"protocol,omitempty"` // TCP, UDP or SCTP, TCP if empty
+	Port     int    `json:"port" bson:"port"`
+	EndPort  int    `json:"end_port,omitempty" bson:"end_port,omitempty"`
+}
+
+// IsZero reports whether the policy declares no rules
+func (p *NetworkPolicy) IsZero() bool {
+	return p == nil || len(p.Egress) == 0
+}
+
+// Validate checks the networks, namespaces and ports of every rule
+func (p *NetworkPolicy) Validate() error {
+	for i, rule := range p.Egress {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("egress rule %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Clone returns a copy of the policy that can be modified independently
+func (p *NetworkPolicy) Clone() *NetworkPolicy {
+	if p == nil {
+		return nil
+	}
+	clone := &NetworkPolicy{Egress: make([]EgressRule, len(p.Egress))}
+	for i, rule := range p.Egress {
+		clone.Egress[i] = EgressRule{
+			CIDRs:      append([]string(nil), rule.CIDRs...),
+			Namespaces: append([]string(nil), rule.Namespaces...),
+			Ports:      append([]EgressPort(nil), rule.Ports...),
+		}
+	}
+	return clone
+}
+
+func (r EgressRule) validate() error {
+	for _, value := range r.CIDRs {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return fmt.Errorf("cidr %q: %v", value, err)
+		}
+		if prefix != prefix.Masked() {
+			return fmt.Errorf("cidr %s has host bits set, use %s", value, prefix.Masked())
+		}
+	}
+
+	for _, namespace := range r.Namespaces {
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			return fmt.Errorf("namespace %q: %s", namespace, strings.Join(errs, ", "))
+		}
+	}
+
+	for _, port := range r.Ports {
+		switch port.Protocol {
+		case "", "TCP", "UDP", "SCTP":
+		default:
+			return fmt.Errorf("unknown protocol %q", port.Protocol)
+		}
+		if port.Port < 1 || port.Port > 65535 {
+			return fmt.Errorf("port %d out of range", port.Port)
+		}
+		if port.EndPort != 0 && (port.EndPort < port.Port || port.EndPort > 65535) {
+			return fmt.Errorf("end port %d out of range", port.EndPort)
+		}
+	}
+
+	return nil
+}
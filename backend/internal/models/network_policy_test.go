@@ -0,0 +1,39 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNetworkPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    EgressRule
+		wantErr string
+	}{
+		{"anywhere", EgressRule{}, ""},
+		{"full rule", EgressRule{CIDRs: []string{"10.20.0.0/16", "2001:db8::/32"}, Namespaces: []string{"intranet"}, Ports: []EgressPort{{Port: 443}, {Protocol: "UDP", Port: 5000, EndPort: 5100}}}, ""},
+		{"bad CIDR", EgressRule{CIDRs: []string{"10.20.0.0/33"}}, "cidr"},
+		{"host bits", EgressRule{CIDRs: []string{"10.20.0.1/16"}}, "use 10.20.0.0/16"},
+		{"bad namespace", EgressRule{Namespaces: []string{"Intranet"}}, "namespace"},
+		{"bad protocol", EgressRule{Ports: []EgressPort{{Protocol: "ICMP", Port: 1}}}, "unknown protocol"},
+		{"port zero", EgressRule{Ports: []EgressPort{{Port: 0}}}, "port 0 out of range"},
+		{"end port before port", EgressRule{Ports: []EgressPort{{Port: 100, EndPort: 99}}}, "end port 99"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &NetworkPolicy{Egress: []EgressRule{tt.rule}}
+			err := policy.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
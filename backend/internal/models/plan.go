@@ -0,0 +1,99 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Plan represents a service tier with its resource profile and limits
+type Plan struct {
+	Name             string          `json:"name" binding:"required"`
+	Description      string          `json:"description,omitempty"`
+	CPURequest       string          `json:"cpu_request,omitempty"`
+	CPULimit         string          `json:"cpu_limit,omitempty"`
+	MemoryRequest    string          `json:"memory_request,omitempty"`
+	MemoryLimit      string          `json:"memory_limit,omitempty"`
+	Bandwidth        BandwidthLimits `json:"bandwidth,omitempty"`
+	Routing          *RoutingPolicy  `json:"routing,omitempty"`
+	NetworkPolicy    *NetworkPolicy  `json:"network_policy,omitempty"`
+	MonthlyDataQuota int64           `json:"monthly_data_quota,omitempty"` // bytes, 0 means unlimited
+	MaxDevices       int             `json:"max_devices,omitempty"`        // 0 means unlimited
+	PodTemplate      string          `json:"pod_template,omitempty"`
+	HourlyRate       float64         `json:"hourly_rate,omitempty"` // price of a pod-hour in usage reports
+	CreatedAt        time.Time       `json:"created_at"`
+	UpdatedAt        time.Time       `json:"updated_at"`
+}
+
+// Validate checks that the plan's quantities parse and are consistent
+func (p *Plan) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	quantities := []struct{ field, value string }{
+		{"cpu_request", p.CPURequest},
+		{"cpu_limit", p.CPULimit},
+		{"memory_request", p.MemoryRequest},
+		{"memory_limit", p.MemoryLimit},
+	}
+	parsed := make(map[string]resource.Quantity, len(quantities))
+	for _, quantity := range quantities {
+		if quantity.value == "" {
+			continue
+		}
+		q, err := resource.ParseQuantity(quantity.value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", quantity.field, err)
+		}
+		if q.Sign() <= 0 {
+			return fmt.Errorf("%s must be positive", quantity.field)
+		}
+		parsed[quantity.field] = q
+	}
+
+	for _, pair := range [][2]string{{"cpu_request", "cpu_limit"}, {"memory_request", "memory_limit"}} {
+		request, hasRequest := parsed[pair[0]]
+		limit, hasLimit := parsed[pair[1]]
+		if hasRequest && hasLimit && request.Cmp(limit) > 0 {
+			return fmt.Errorf("%s exceeds %s", pair[0], pair[1])
+		}
+	}
+
+	if err := p.Bandwidth.Validate(); err != nil {
+		return err
+	}
+	if p.Routing != nil {
+		if err := p.Routing.Validate(); err != nil {
+			return err
+		}
+	}
+	if p.NetworkPolicy != nil {
+		if err := p.NetworkPolicy.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if p.MonthlyDataQuota < 0 {
+		return fmt.Errorf("monthly_data_quota must not be negative")
+	}
+	// Every user gets a single WireGuard peer, so a larger limit would
+	// promise devices the VPN cannot add
+	if p.MaxDevices < 0 || p.MaxDevices > 1 {
+		return fmt.Errorf("max_devices must be 0 (unlimited) or 1")
+	}
+	if p.HourlyRate < 0 {
+		return fmt.Errorf("hourly_rate must not be negative")
+	}
+
+	return nil
+}
+
+// Clone returns a copy of the plan that can be modified independently
+func (p *Plan) Clone() *Plan {
+	clone := *p
+	clone.Routing = p.Routing.Clone()
+	clone.NetworkPolicy = p.NetworkPolicy.Clone()
+	return &clone
+}
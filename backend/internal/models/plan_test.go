@@ -0,0 +1,44 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPlanValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		plan    Plan
+		wantErr string
+	}{
+		{"minimal", Plan{Name: "basic"}, ""},
+		{"full", Plan{Name: "pro", CPURequest: "100m", CPULimit: "1", MemoryRequest: "64Mi", MemoryLimit: "1Gi", Bandwidth: BandwidthLimits{Upload: "10M", Download: "50M"}, MonthlyDataQuota: 1 << 30, MaxDevices: 1}, ""},
+		{"missing name", Plan{}, "name is required"},
+		{"bad quantity", Plan{Name: "x", CPULimit: "lots"}, "cpu_limit"},
+		{"zero quantity", Plan{Name: "x", MemoryLimit: "0"}, "memory_limit must be positive"},
+		{"request above limit", Plan{Name: "x", MemoryRequest: "1Gi", MemoryLimit: "512Mi"}, "memory_request exceeds memory_limit"},
+		{"bad bandwidth", Plan{Name: "x", Bandwidth: BandwidthLimits{Download: "fast"}}, "bandwidth download"},
+		{"zero bandwidth", Plan{Name: "x", Bandwidth: BandwidthLimits{Upload: "0"}}, "bandwidth upload must be positive"},
+		{"bad routing", Plan{Name: "x", Routing: &RoutingPolicy{AllowedIPs: []string{"10.0.0.0/24"}}}, "lies within the tunnel pool"},
+		{"bad network policy", Plan{Name: "x", NetworkPolicy: &NetworkPolicy{Egress: []EgressRule{{Ports: []EgressPort{{Port: 70000}}}}}}, "egress rule 0: port 70000"},
+		{"negative quota", Plan{Name: "x", MonthlyDataQuota: -1}, "monthly_data_quota"},
+		{"negative devices", Plan{Name: "x", MaxDevices: -1}, "max_devices"},
+		{"more devices than peers", Plan{Name: "x", MaxDevices: 5}, "max_devices"},
+		{"first bad quantity reported", Plan{Name: "x", CPURequest: "lots", MemoryLimit: "lots"}, "cpu_request"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.plan.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// QuotaOverrideRequest represents an administrative change to a user's quota
+type QuotaOverrideRequest struct {
+	DataQuota  *int64 `json:"data_quota,omitempty" binding:"omitempty,min=0"` // bytes per period, 0 to follow the plan
+	GrantBytes int64  `json:"grant_bytes,omitempty" binding:"min=0"`
+	ResetUsage bool   `json:"reset_usage,omitempty"`
+}
+
+// QuotaStatus represents a user's usage against their quota
+type QuotaStatus struct {
+	Limit       int64     `json:"limit"` // bytes, 0 if unlimited
+	Used        int64     `json:"used"`
+	Remaining   int64     `json:"remaining"`
+	Bonus       int64     `json:"bonus"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	Suspended   bool      `json:"suspended"`
+}
@@ -0,0 +1,114 @@
+package models
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Networks of the tunnel between a user's device and their VPN pod. The IPv6
+// pool is a unique local range used when VPN pods run dual-stack.
+var (
+	TunnelPool  = netip.MustParsePrefix("10.0.0.0/24")
+	TunnelPool6 = netip.MustParsePrefix("fd76:706e:6161::/64")
+)
+
+// Host numbers of devices in the tunnel pools. Host 1 is the server in every
+// VPN pod, and a device has the same host number in each pool, so the IPv4
+// pool bounds them.
+const (
+	MinTunnelHost = 2
+	MaxTunnelHost = 254
+)
+
+const (
+	minMTU = 1280
+	maxMTU = 9000
+)
+
+// RoutingPolicy controls what a user's device sends through the tunnel and
+// how it resolves names while connected
+type RoutingPolicy struct {
+	// Destinations routed through the tunnel. Empty routes all traffic.
+	AllowedIPs    []string `json:"allowed_ips,omitempty" bson:"allowed_ips,omitempty"`
+	DNS           []string `json:"dns,omitempty" bson:"dns,omitempty"`
+	SearchDomains []string `json:"search_domains,omitempty" bson:"search_domains,omitempty"`
+	MTU           int      `json:"mtu,omitempty" bson:"mtu,omitempty"` // 0 leaves it to the client
+	// Routes all IPv6 traffic into the tunnel alongside AllowedIPs. Without
+	// dual-stack VPN pods it is dropped there, so that it cannot bypass the
+	// VPN.
+	IPv6DefaultRoute bool `json:"ipv6_default_route,omitempty" bson:"ipv6_default_route,omitempty"`
+}
+
+// IsZero reports whether the policy sets nothing
+func (r *RoutingPolicy) IsZero() bool {
+	return r == nil || (len(r.AllowedIPs) == 0 && len(r.DNS) == 0 && len(r.SearchDomains) == 0 &&
+		r.MTU == 0 && !r.IPv6DefaultRoute)
+}
+
+// Validate checks the policy's networks, addresses and names. Routes may
+// contain the tunnel pools, as the full tunnel 0.0.0.0/0 does, but must not
+// lie within them, and DNS servers must be reachable through the tunnel.
+func (r *RoutingPolicy) Validate() error {
+	routes := make([]netip.Prefix, 0, len(r.AllowedIPs))
+	for _, value := range r.AllowedIPs {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return fmt.Errorf("allowed IP %q: %v", value, err)
+		}
+		if prefix != prefix.Masked() {
+			return fmt.Errorf("allowed IP %s has host bits set, use %s", value, prefix.Masked())
+		}
+		for _, pool := range []netip.Prefix{TunnelPool, TunnelPool6} {
+			if pool.Contains(prefix.Addr()) && prefix.Bits() >= pool.Bits() {
+				return fmt.Errorf("allowed IP %s lies within the tunnel pool %s", value, pool)
+			}
+		}
+		routes = append(routes, prefix)
+	}
+
+	for _, value := range r.DNS {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return fmt.Errorf("DNS server %q: %v", value, err)
+		}
+		if len(routes) > 0 && !routed(addr, routes) && !(addr.Is6() && r.IPv6DefaultRoute) {
+			return fmt.Errorf("DNS server %s is not routed through the tunnel", value)
+		}
+	}
+
+	for _, domain := range r.SearchDomains {
+		if errs := validation.IsDNS1123Subdomain(domain); len(errs) > 0 {
+			return fmt.Errorf("search domain %q: %s", domain, strings.Join(errs, ", "))
+		}
+	}
+
+	if r.MTU != 0 && (r.MTU < minMTU || r.MTU > maxMTU) {
+		return fmt.Errorf("mtu must be between %d and %d", minMTU, maxMTU)
+	}
+
+	return nil
+}
+
+// Clone returns a copy of the policy that can be modified independently
+func (r *RoutingPolicy) Clone() *RoutingPolicy {
+	if r == nil {
+		return nil
+	}
+	clone := *r
+	clone.AllowedIPs = append([]string(nil), r.AllowedIPs...)
+	clone.DNS = append([]string(nil), r.DNS...)
+	clone.SearchDomains = append([]string(nil), r.SearchDomains...)
+	return &clone
+}
+
+func routed(addr netip.Addr, routes []netip.Prefix) bool {
+	for _, route := range routes {
+		if route.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoutingPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RoutingPolicy
+		wantErr string
+	}{
+		{"empty", RoutingPolicy{}, ""},
+		{"split tunnel", RoutingPolicy{AllowedIPs: []string{"10.20.0.0/16", "192.168.1.0/24"}, DNS: []string{"10.20.0.53"}, SearchDomains: []string{"corp.example.com"}, MTU: 1380}, ""},
+		{"full tunnel with public DNS", RoutingPolicy{DNS: []string{"1.1.1.1"}, IPv6DefaultRoute: true}, ""},
+		{"bad CIDR", RoutingPolicy{AllowedIPs: []string{"10.20.0.0"}}, "allowed IP \"10.20.0.0\""},
+		{"host bits", RoutingPolicy{AllowedIPs: []string{"10.20.0.1/16"}}, "use 10.20.0.0/16"},
+		{"dual-stack split tunnel", RoutingPolicy{AllowedIPs: []string{"10.20.0.0/16", "fd12:3456::/48"}, DNS: []string{"fd12:3456::53"}}, ""},
+		{"IPv6 DNS over IPv6 default route", RoutingPolicy{AllowedIPs: []string{"10.20.0.0/16"}, DNS: []string{"2606:4700:4700::1111"}, IPv6DefaultRoute: true}, ""},
+		{"within IPv6 tunnel pool", RoutingPolicy{AllowedIPs: []string{"fd76:706e:6161::/80"}}, "lies within the tunnel pool fd76:706e:6161::/64"},
+		{"IPv6 range containing the tunnel pool", RoutingPolicy{AllowedIPs: []string{"fd76:706e:6161::/48"}}, ""},
+		{"IPv6 default route", RoutingPolicy{AllowedIPs: []string{"::/0"}}, ""},
+		{"tunnel pool", RoutingPolicy{AllowedIPs: []string{"10.0.0.0/24"}}, "lies within the tunnel pool 10.0.0.0/24"},
+		{"within tunnel pool", RoutingPolicy{AllowedIPs: []string{"10.0.0.128/25"}}, "lies within the tunnel pool"},
+		{"private range containing the tunnel pool", RoutingPolicy{AllowedIPs: []string{"10.0.0.0/8"}}, ""},
+		{"default route", RoutingPolicy{AllowedIPs: []string{"0.0.0.0/0"}}, ""},
+		{"bad DNS", RoutingPolicy{DNS: []string{"dns.example.com"}}, "DNS server"},
+		{"DNS outside split tunnel", RoutingPolicy{AllowedIPs: []string{"10.20.0.0/16"}, DNS: []string{"8.8.8.8"}}, "not routed through the tunnel"},
+		{"bad search domain", RoutingPolicy{SearchDomains: []string{"Corp_Example"}}, "search domain"},
+		{"MTU too small", RoutingPolicy{MTU: 576}, "mtu"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// maxWindowDuration keeps windows from overlapping the next week's
+const maxWindowDuration = 7 * 24 * time.Hour
+
+// AccessSchedule restricts when a user may connect to recurring windows.
+// Outside every window the user's peer is removed from their VPN.
+type AccessSchedule struct {
+	Timezone string         `json:"timezone,omitempty" bson:"timezone,omitempty"` // IANA name, UTC if empty
+	Windows  []AccessWindow `json:"windows" bson:"windows"`
+}
+
+// AccessWindow opens at the times matched by a standard five field cron
+// expression, e.g. "0 9 * * 1-5", and stays open for Duration, e.g. "8h"
+type AccessWindow struct {
+	Start    string `json:"start" bson:"start"`
+	Duration string `json:"duration" bson:"duration"`
+}
+
+// Validate checks the timezone and every window of the schedule
+func (s *AccessSchedule) Validate() error {
+	if _, err := s.location(); err != nil {
+		return err
+	}
+	if len(s.Windows) == 0 {
+		return errors.New("access schedule needs at least one window")
+	}
+	for i, window := range s.Windows {
+		if _, _, err := window.parse(); err != nil {
+			return fmt.Errorf("access window %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Open reports whether any window of the schedule is open at t
+func (s *AccessSchedule) Open(t time.Time) (bool, error) {
+	loc, err := s.location()
+	if err != nil {
+		return false, err
+	}
+	t = t.In(loc)
+
+	for i, window := range s.Windows {
+		schedule, duration, err := window.parse()
+		if err != nil {
+			return false, fmt.Errorf("access window %d: %v", i, err)
+		}
+		// The window is open if it started within the last duration
+		if !schedule.Next(t.Add(-duration)).After(t) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Clone returns a copy of the schedule that can be modified independently
+func (s *AccessSchedule) Clone() *AccessSchedule {
+	if s == nil {
+		return nil
+	}
+	clone := *s
+	clone.Windows = append([]AccessWindow(nil), s.Windows...)
+	return &clone
+}
+
+func (s *AccessSchedule) location() (*time.Location, error) {
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %v", s.Timezone, err)
+	}
+	return loc, nil
+}
+
+func (w AccessWindow) parse() (cron.Schedule, time.Duration, error) {
+	schedule, err := cron.ParseStandard(w.Start)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid start %q: %v", w.Start, err)
+	}
+	duration, err := time.ParseDuration(w.Duration)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid duration %q: %v", w.Duration, err)
+	}
+	if duration <= 0 || duration > maxWindowDuration {
+		return nil, 0, fmt.Errorf("duration must be positive and at most %v", maxWindowDuration)
+	}
+	return schedule, duration, nil
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccessScheduleValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule AccessSchedule
+		wantErr  bool
+	}{
+		{"valid", AccessSchedule{Timezone: "America/New_York", Windows: []AccessWindow{{Start: "0 9 * * 1-5", Duration: "8h"}}}, false},
+		{"utc by default", AccessSchedule{Windows: []AccessWindow{{Start: "@daily", Duration: "1h"}}}, false},
+		{"no windows", AccessSchedule{}, true},
+		{"unknown timezone", AccessSchedule{Timezone: "Mars/Olympus", Windows: []AccessWindow{{Start: "0 9 * * *", Duration: "1h"}}}, true},
+		{"bad cron", AccessSchedule{Windows: []AccessWindow{{Start: "every morning", Duration: "1h"}}}, true},
+		{"bad duration", AccessSchedule{Windows: []AccessWindow{{Start: "0 9 * * *", Duration: "soon"}}}, true},
+		{"zero duration", AccessSchedule{Windows: []AccessWindow{{Start: "0 9 * * *", Duration: "0s"}}}, true},
+		{"duration over a week", AccessSchedule{Windows: []AccessWindow{{Start: "0 9 * * 1", Duration: "169h"}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.schedule.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAccessScheduleOpen(t *testing.T) {
+	schedule := &AccessSchedule{
+		Timezone: "Europe/Berlin",
+		Windows: []AccessWindow{
+			{Start: "0 9 * * 1-5", Duration: "8h"},
+			// Saturday night until Sunday morning
+			{Start: "0 22 * * 6", Duration: "10h"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want bool
+	}{
+		{"before opening", time.Date(2026, time.October, 14, 6, 59, 0, 0, time.UTC), false},
+		{"at opening", time.Date(2026, time.October, 14, 7, 0, 0, 0, time.UTC), true},
+		{"during window", time.Date(2026, time.October, 14, 12, 0, 0, 0, time.UTC), true},
+		{"at closing", time.Date(2026, time.October, 14, 15, 0, 0, 0, time.UTC), false},
+		{"weekend", time.Date(2026, time.October, 17, 12, 0, 0, 0, time.UTC), false},
+		{"across midnight", time.Date(2026, time.October, 18, 2, 0, 0, 0, time.UTC), true},
+		{"after standard time starts", time.Date(2026, time.October, 26, 8, 30, 0, 0, time.UTC), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := schedule.Open(tt.at)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got open %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
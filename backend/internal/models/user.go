@@ -11,30 +11,101 @@ type User struct {
 	ID          string    `json:"id" bson:"id"`
 	Username    string    `json:"username" bson:"username"`
 	Email       string    `json:"email" bson:"email"`
+	Tenant      string    `json:"tenant,omitempty" bson:"tenant,omitempty"`
+	Plan        string    `json:"plan,omitempty" bson:"plan,omitempty"`
 	Status      string    `json:"status" bson:"status"` // active, inactive, suspended
 	CreatedAt   time.Time `json:"created_at" bson:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at" bson:"updated_at"`
 	LastLogin   time.Time `json:"last_login,omitempty" bson:"last_login,omitempty"`
+	WorkloadName string   `json:"workload_name,omitempty" bson:"workload_name,omitempty"`
+	PodTemplate string    `json:"pod_template,omitempty" bson:"pod_template,omitempty"`
+	Bandwidth   BandwidthLimits `json:"bandwidth,omitempty" bson:"bandwidth,omitempty"` // overrides the plan's limits
+	AppliedBandwidth BandwidthLimits `json:"applied_bandwidth" bson:"applied_bandwidth"`
+	Routing     *RoutingPolicy `json:"routing,omitempty" bson:"routing,omitempty"` // replaces the plan's policy
+	NetworkPolicy *NetworkPolicy `json:"network_policy,omitempty" bson:"network_policy,omitempty"` // replaces the plan's policy
+	EgressProfile string `json:"egress_profile,omitempty" bson:"egress_profile,omitempty"` // empty uses the default profile
+	EgressIP    string    `json:"egress_ip,omitempty" bson:"egress_ip,omitempty"` // public IP of the applied profile
 	PodName     string    `json:"pod_name,omitempty" bson:"pod_name,omitempty"`
 	PodIP       string    `json:"pod_ip,omitempty" bson:"pod_ip,omitempty"`
+	TunnelHost  int       `json:"tunnel_host,omitempty" bson:"tunnel_host,omitempty"` // host number of the device in every tunnel pool
 	PublicKey   string    `json:"public_key,omitempty" bson:"public_key,omitempty"`
-	PrivateKey  string    `json:"private_key,omitempty" bson:"private_key,omitempty"`
-	ConfigData  string    `json:"config_data,omitempty" bson:"config_data,omitempty"`
+	PrivateKey  string    `json:"-" bson:"private_key,omitempty"`
+	ServerPublicKey  string `json:"server_public_key,omitempty" bson:"server_public_key,omitempty"`
+	ServerPrivateKey string `json:"-" bson:"server_private_key,omitempty"`
+	ConfigData  string    `json:"-" bson:"config_data,omitempty"` // served only by the audited config download
 	DataUsage   int64     `json:"data_usage" bson:"data_usage"` // bytes
 	ConnectionCount int   `json:"connection_count" bson:"connection_count"`
+
+	// Data quota of the current period. DataQuota overrides the plan's quota
+	// and QuotaBonus is extra allowance granted until the period resets.
+	DataQuota       int64     `json:"data_quota,omitempty" bson:"data_quota,omitempty"`
+	QuotaBonus      int64     `json:"quota_bonus,omitempty" bson:"quota_bonus,omitempty"`
+	PeriodStart     time.Time `json:"period_start" bson:"period_start"`
+	PeriodUsage     int64     `json:"period_usage" bson:"period_usage"` // bytes
+	QuotaWarning    int       `json:"-" bson:"quota_warning,omitempty"` // highest threshold reported this period
+	SuspendedReason string    `json:"suspended_reason,omitempty" bson:"suspended_reason,omitempty"`
+	PeerRemoved     bool      `json:"-" bson:"peer_removed,omitempty"` // the VPN has dropped the user's peer
+
+	// The user is suspended once ExpiresAt passes and deleted after a grace
+	// period, and may only connect within the windows of AccessSchedule
+	ExpiresAt      *time.Time      `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	AccessSchedule *AccessSchedule `json:"access_schedule,omitempty" bson:"access_schedule,omitempty"`
+
+	// Last WireGuard transfer counters seen in the user's pod, used to turn
+	// counters that restart with the pod into cumulative usage
+	CounterPod   string                  `json:"-" bson:"counter_pod,omitempty"`
+	PeerCounters map[string]PeerCounters `json:"-" bson:"peer_counters,omitempty"`
+}
+
+// Reasons a user is suspended. Only administrators lift an administrative
+// suspension, the others end when their cause does.
+const (
+	SuspendedByAdmin    = "admin"
+	SuspendedByExpiry   = "expired"
+	SuspendedByQuota    = "quota"
+	SuspendedBySchedule = "schedule"
+)
+
+// PeerCounters are the transfer counters last seen for a peer and whether it
+// was connected at the time
+type PeerCounters struct {
+	RxBytes   int64 `bson:"rx_bytes"`
+	TxBytes   int64 `bson:"tx_bytes"`
+	Connected bool  `bson:"connected"`
 }
 
 // CreateUserRequest represents a request to create a new user
 type CreateUserRequest struct {
 	Username string `json:"username" binding:"required"`
 	Email    string `json:"email" binding:"required,email"`
+	Tenant   string `json:"tenant,omitempty"`
+	Plan     string `json:"plan,omitempty"`
+
+	Routing        *RoutingPolicy  `json:"routing,omitempty"`
+	NetworkPolicy  *NetworkPolicy  `json:"network_policy,omitempty"`
+	EgressProfile  string          `json:"egress_profile,omitempty"`
+	ExpiresAt      *time.Time      `json:"expires_at,omitempty"`
+	AccessSchedule *AccessSchedule `json:"access_schedule,omitempty"`
+}
+
+// UpdateAccessRequest replaces when a user may connect. Omitted fields remove
+// the expiry or schedule.
+type UpdateAccessRequest struct {
+	ExpiresAt      *time.Time      `json:"expires_at"`
+	AccessSchedule *AccessSchedule `json:"access_schedule"`
 }
 
 // UpdateUserRequest represents a request to update a user
 type UpdateUserRequest struct {
-	Username string `json:"username,omitempty"`
-	Email    string `json:"email,omitempty"`
-	Status   string `json:"status,omitempty"`
+	Username  string           `json:"username,omitempty"`
+	Email     string           `json:"email,omitempty" binding:"omitempty,email"`
+	Status    string           `json:"status,omitempty" binding:"omitempty,oneof=active inactive suspended"`
+	Plan      string           `json:"plan,omitempty"`
+	Bandwidth *BandwidthLimits `json:"bandwidth,omitempty"` // replaces the user's limits, empty ones follow the plan
+	Routing   *RoutingPolicy   `json:"routing,omitempty"`   // replaces the user's policy, an empty one follows the plan
+
+	NetworkPolicy *NetworkPolicy `json:"network_policy,omitempty"` // replaces the user's policy, an empty one follows the plan
+	EgressProfile *string        `json:"egress_profile,omitempty"` // an empty name uses the default profile
 }
 
 // UserStats represents user statistics
@@ -82,5 +153,25 @@ func (u *User) IncrementConnectionCount() {
 // AddDataUsage adds data usage in bytes
 func (u *User) AddDataUsage(bytes int64) {
 	u.DataUsage += bytes
+	u.PeriodUsage += bytes
 	u.UpdatedAt = time.Now()
 }
+
+// Clone returns a copy of the user that can be modified independently
+func (u *User) Clone() *User {
+	clone := *u
+	if u.ExpiresAt != nil {
+		expiresAt := *u.ExpiresAt
+		clone.ExpiresAt = &expiresAt
+	}
+	clone.AccessSchedule = u.AccessSchedule.Clone()
+	clone.Routing = u.Routing.Clone()
+	clone.NetworkPolicy = u.NetworkPolicy.Clone()
+	if u.PeerCounters != nil {
+		clone.PeerCounters = make(map[string]PeerCounters, len(u.PeerCounters))
+		for key, counters := range u.PeerCounters {
+			clone.PeerCounters[key] = counters
+		}
+	}
+	return &clone
+}
@@ -0,0 +1,67 @@
+package models
+
+import "time"
+
+// RolloutRequest represents a request to roll a new image out to all VPN workloads
+type RolloutRequest struct {
+	Image string `json:"image,omitempty"`
+}
+
+// RolloutResult reports the outcome of a rollout. Workloads already running
+// what the rollout applies are unchanged; those whose user was deleted or
+// deprovisioned while the rollout ran are skipped; those a rollout stopped
+// before reaching are pending.
+type RolloutResult struct {
+	Image     string   `json:"image,omitempty"`
+	Updated   []string `json:"updated"`
+	Unchanged []string `json:"unchanged,omitempty"`
+	Skipped   []string `json:"skipped,omitempty"`
+	Pending   []string `json:"pending,omitempty"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+// States of a configuration rollout
+const (
+	RolloutRunning   = "running"
+	RolloutCompleted = "completed"
+	RolloutFailed    = "failed"
+	RolloutCanceled  = "canceled"
+)
+
+// ConfigRollout is the progress of a rollout of the configuration to the VPN
+// workloads, which runs in the background. While it runs, the workloads it
+// has yet to reach are pending.
+type ConfigRollout struct {
+	RolloutResult
+	State      string     `json:"state"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Clone returns a copy of the rollout that can be modified independently
+func (r *ConfigRollout) Clone() *ConfigRollout {
+	clone := *r
+	clone.Updated = append([]string{}, r.Updated...)
+	clone.Unchanged = append([]string(nil), r.Unchanged...)
+	clone.Skipped = append([]string(nil), r.Skipped...)
+	clone.Pending = append([]string(nil), r.Pending...)
+	clone.Errors = append([]string(nil), r.Errors...)
+	if r.FinishedAt != nil {
+		finishedAt := *r.FinishedAt
+		clone.FinishedAt = &finishedAt
+	}
+	return &clone
+}
+
+// ResourceRef identifies a Kubernetes object belonging to a user's VPN
+type ResourceRef struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// PodStats counts the VPN pods by phase
+type PodStats struct {
+	Running int `json:"running"`
+	Failed  int `json:"failed"`
+	Pending int `json:"pending"`
+}
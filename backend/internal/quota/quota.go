@@ -0,0 +1,122 @@
+package quota
+
+import (
+	"fmt"
+	"time"
+
+	"vpnaas-backend/internal/models"
+)
+
+// thresholds are the percentages of a quota that are reported once per period
+var thresholds = []int{80, 100}
+
+// Period is how often quotas reset
+type Period string
+
+const (
+	Daily   Period = "daily"
+	Weekly  Period = "weekly"
+	Monthly Period = "monthly"
+)
+
+// ParsePeriod parses a reset period name
+func ParsePeriod(name string) (Period, error) {
+	switch period := Period(name); period {
+	case Daily, Weekly, Monthly:
+		return period, nil
+	case "":
+		return Monthly, nil
+	default:
+		return "", fmt.Errorf("invalid quota reset period %q", name)
+	}
+}
+
+// Start returns the start of the period containing t. Periods follow the UTC
+// calendar, weeks start on Monday.
+func (p Period) Start(t time.Time) time.Time {
+	t = t.UTC()
+	switch p {
+	case Daily:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case Weekly:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// End returns the start of the period following the one containing t
+func (p Period) End(t time.Time) time.Time {
+	start := p.Start(t)
+	switch p {
+	case Daily:
+		return start.AddDate(0, 0, 1)
+	case Weekly:
+		return start.AddDate(0, 0, 7)
+	default:
+		return start.AddDate(0, 1, 0)
+	}
+}
+
+// Roll moves the user into the period containing now, clearing the usage,
+// bonus and warnings of an earlier period. It reports whether a new period
+// began.
+func (p Period) Roll(user *models.User, now time.Time) bool {
+	start := p.Start(now)
+	if !user.PeriodStart.Before(start) {
+		return false
+	}
+
+	user.PeriodStart = start
+	user.PeriodUsage = 0
+	user.QuotaBonus = 0
+	user.QuotaWarning = 0
+	return true
+}
+
+// Limit returns the user's quota for the current period in bytes, 0 meaning
+// unlimited. A quota set on the user takes precedence over the plan's.
+func Limit(user *models.User, plan *models.Plan) int64 {
+	base := user.DataQuota
+	if base == 0 && plan != nil {
+		base = plan.MonthlyDataQuota
+	}
+	if base == 0 {
+		return 0
+	}
+	return base + user.QuotaBonus
+}
+
+// Status summarizes a user's usage against their quota
+func Status(user *models.User, plan *models.Plan, period Period, now time.Time) models.QuotaStatus {
+	status := models.QuotaStatus{
+		Limit:       Limit(user, plan),
+		Used:        user.PeriodUsage,
+		Bonus:       user.QuotaBonus,
+		PeriodStart: period.Start(now),
+		PeriodEnd:   period.End(now),
+		Suspended:   user.Status == "suspended" && user.SuspendedReason == models.SuspendedByQuota,
+	}
+	if status.Limit > 0 && status.Limit > status.Used {
+		status.Remaining = status.Limit - status.Used
+	}
+	return status
+}
+
+// Level returns the highest threshold, as a percentage, the user's usage in
+// the current period has reached, 0 if none or the quota is unlimited
+func Level(user *models.User, plan *models.Plan) int {
+	limit := Limit(user, plan)
+	if limit == 0 {
+		return 0
+	}
+
+	level := 0
+	for _, threshold := range thresholds {
+		if user.PeriodUsage*100 >= limit*int64(threshold) {
+			level = threshold
+		}
+	}
+	return level
+}
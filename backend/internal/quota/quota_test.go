@@ -0,0 +1,89 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"vpnaas-backend/internal/models"
+)
+
+func TestPeriod(t *testing.T) {
+	// A Wednesday
+	now := time.Date(2026, time.October, 14, 15, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		period    Period
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{Daily, time.Date(2026, time.October, 14, 0, 0, 0, 0, time.UTC), time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC)},
+		{Weekly, time.Date(2026, time.October, 12, 0, 0, 0, 0, time.UTC), time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)},
+		{Monthly, time.Date(2026, time.October, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.period), func(t *testing.T) {
+			if got := tt.period.Start(now); !got.Equal(tt.wantStart) {
+				t.Errorf("got start %v, want %v", got, tt.wantStart)
+			}
+			if got := tt.period.End(now); !got.Equal(tt.wantEnd) {
+				t.Errorf("got end %v, want %v", got, tt.wantEnd)
+			}
+		})
+	}
+
+	if got := Weekly.Start(time.Date(2026, time.October, 18, 23, 0, 0, 0, time.UTC)); got.Day() != 12 {
+		t.Errorf("Sunday belongs to the week starting %v", got)
+	}
+	if _, err := ParsePeriod("hourly"); err == nil {
+		t.Errorf("expected error for unknown period")
+	}
+}
+
+func TestRoll(t *testing.T) {
+	now := time.Date(2026, time.October, 14, 0, 0, 0, 0, time.UTC)
+	user := &models.User{
+		PeriodStart:  time.Date(2026, time.September, 1, 0, 0, 0, 0, time.UTC),
+		PeriodUsage:  500,
+		QuotaBonus:   100,
+		QuotaWarning: 80,
+		DataUsage:    900,
+	}
+
+	if !Monthly.Roll(user, now) {
+		t.Fatalf("expected a new period")
+	}
+	if user.PeriodUsage != 0 || user.QuotaBonus != 0 || user.QuotaWarning != 0 || user.DataUsage != 900 {
+		t.Errorf("unexpected state after roll: %+v", user)
+	}
+	if Monthly.Roll(user, now.Add(time.Hour)) {
+		t.Errorf("rolled twice within a period")
+	}
+}
+
+func TestLevel(t *testing.T) {
+	plan := &models.Plan{Name: "basic", MonthlyDataQuota: 1000}
+
+	tests := []struct {
+		name string
+		user models.User
+		plan *models.Plan
+		want int
+	}{
+		{"below thresholds", models.User{PeriodUsage: 500}, plan, 0},
+		{"warning", models.User{PeriodUsage: 800}, plan, 80},
+		{"exhausted", models.User{PeriodUsage: 1200}, plan, 100},
+		{"bonus", models.User{PeriodUsage: 1200, QuotaBonus: 1000}, plan, 0},
+		{"user quota overrides plan", models.User{PeriodUsage: 1000, DataQuota: 5000}, plan, 0},
+		{"no quota is unlimited", models.User{PeriodUsage: 1 << 40}, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := tt.user
+			if got := Level(&user, tt.plan); got != tt.want {
+				t.Errorf("got level %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
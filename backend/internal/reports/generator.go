@@ -0,0 +1,129 @@
+package reports
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/history"
+	"vpnaas-backend/internal/metrics"
+	"vpnaas-backend/internal/store"
+)
+
+// ErrPeriodNotEnded is returned when generating the report of a period that
+// is not over yet
+var ErrPeriodNotEnded = errors.New("period has not ended yet")
+
+// baselineLookback is how far before a period the history is searched for
+// the samples its counters start from
+const baselineLookback = 24 * time.Hour
+
+// checkInterval is how often the generator checks whether the report of the
+// previous period is due
+const checkInterval = time.Hour
+
+// Generator builds period reports from the usage history and the plans'
+// rates, and saves each one once
+type Generator struct {
+	reports        Store
+	history        history.Store
+	plans          store.Store
+	sampleInterval time.Duration
+	maxGap         time.Duration
+	now            func() time.Time
+}
+
+// NewGenerator creates a generator saving reports to reports, reading the
+// history sampled as cfg sets
+func NewGenerator(reports Store, usageHistory history.Store, plans store.Store, cfg config.HistoryConfig) *Generator {
+	sampleInterval := cfg.SampleInterval
+	if sampleInterval <= 0 {
+		sampleInterval = 5 * time.Minute
+	}
+	// Downsampled history has a sample per resolution
+	maxGap := cfg.Resolution
+	if maxGap <= 0 {
+		maxGap = time.Hour
+	}
+
+	return &Generator{
+		reports:        reports,
+		history:        usageHistory,
+		plans:          plans,
+		sampleInterval: sampleInterval,
+		maxGap:         maxGap,
+		now:            time.Now,
+	}
+}
+
+// Store returns the store the generator saves reports to
+func (g *Generator) Store() Store {
+	return g.reports
+}
+
+// Generate builds and saves the report of a period that has ended, failing
+// with ErrExists if it was generated before
+func (g *Generator) Generate(period string) (*Report, error) {
+	from, to, err := ParsePeriod(period)
+	if err != nil {
+		return nil, err
+	}
+
+	// The last samples of the period are taken up to an interval after it
+	// ends
+	now := g.now()
+	if now.Before(to.Add(g.sampleInterval)) {
+		return nil, ErrPeriodNotEnded
+	}
+	if _, err := g.reports.Get(period); err == nil {
+		return nil, ErrExists
+	}
+
+	samples, err := g.history.Range(from.Add(-baselineLookback), to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage history: %v", err)
+	}
+	rates := make(map[string]float64)
+	for _, plan := range g.plans.ListPlans() {
+		rates[plan.Name] = plan.HourlyRate
+	}
+
+	report, err := Build(period, samples, rates, g.maxGap)
+	if err != nil {
+		return nil, err
+	}
+	report.GeneratedAt = now
+
+	if err := g.reports.Save(report); err != nil {
+		return nil, err
+	}
+	logrus.Infof("Generated usage report for %s", period)
+	return report, nil
+}
+
+// Run generates the report of the previous period once it has ended,
+// checking every hour until ctx is done. Replicas may race to generate the
+// same report; only one of them saves it.
+func (g *Generator) Run(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		now := g.now().UTC()
+		previous := PeriodOf(now.AddDate(0, 0, -now.Day()))
+		if _, err := g.Generate(previous); err != nil && !errors.Is(err, ErrExists) && !errors.Is(err, ErrPeriodNotEnded) {
+			metrics.RecordError("report_generation", "reports")
+			logrus.Warnf("Failed to generate usage report for %s: %v", previous, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package reports
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"vpnaas-backend/internal/history"
+)
+
+// periodLayout is the format of a report period, a calendar month in UTC
+const periodLayout = "2006-01"
+
+// noPlan groups the usage of users without a plan
+const noPlan = "none"
+
+// ErrInvalidPeriod is returned for a period that is not a month such as
+// 2024-03
+var ErrInvalidPeriod = errors.New("period must be a month such as 2024-03")
+
+// Report accounts for the usage of every user in a period and sums it per
+// tenant and per plan. Usage is attributed to the tenant and plan the user
+// had at the time, and pod-hours are priced at the plans' hourly rates when
+// the report was generated, which are recorded with it.
+type Report struct {
+	Period      string             `json:"period"`
+	From        time.Time          `json:"from"`
+	To          time.Time          `json:"to"`
+	GeneratedAt time.Time          `json:"generated_at"`
+	Rates       map[string]float64 `json:"rates"`
+	Users       []Line             `json:"users"`
+	Tenants     []Line             `json:"tenants"`
+	Plans       []Line             `json:"plans"`
+	Total       Line               `json:"total"`
+}
+
+// Line is the usage of a user, a tenant, a plan or of everyone
+type Line struct {
+	UserID         string  `json:"user_id,omitempty"`
+	Username       string  `json:"username,omitempty"`
+	Tenant         string  `json:"tenant,omitempty"`
+	Plan           string  `json:"plan,omitempty"`
+	DataBytes      int64   `json:"data_bytes"`
+	ConnectedHours float64 `json:"connected_hours"`
+	PodHours       float64 `json:"pod_hours"`
+	Cost           float64 `json:"cost"`
+}
+
+// add accumulates usage into the line
+func (l *Line) add(bytes int64, connected, provisioned time.Duration, rate float64) {
+	l.DataBytes += bytes
+	l.ConnectedHours += connected.Hours()
+	l.PodHours += provisioned.Hours()
+	l.Cost += provisioned.Hours() * rate
+}
+
+// round rounds hours and cost to hundredths
+func (l *Line) round() {
+	l.ConnectedHours = math.Round(l.ConnectedHours*100) / 100
+	l.PodHours = math.Round(l.PodHours*100) / 100
+	l.Cost = math.Round(l.Cost*100) / 100
+}
+
+// ParsePeriod returns the bounds [from, to) of a period
+func ParsePeriod(period string) (time.Time, time.Time, error) {
+	from, err := time.Parse(periodLayout, period)
+	if err != nil {
+		return time.Time{}, time.Time{}, ErrInvalidPeriod
+	}
+	return from, from.AddDate(0, 1, 0), nil
+}
+
+// PeriodOf returns the period containing t
+func PeriodOf(t time.Time) string {
+	return t.UTC().Format(periodLayout)
+}
+
+// Build computes the report of a period from the user samples taken in it
+// and the last sample of each user before it. A user's state at a sample
+// lasts until the next sample, but never longer than maxGap, so that time
+// the sampler was not running is not billed.
+func Build(period string, samples []history.Sample, rates map[string]float64, maxGap time.Duration) (*Report, error) {
+	from, to, err := ParsePeriod(period)
+	if err != nil {
+		return nil, err
+	}
+
+	// The latest sample before the period is the baseline of the cumulative
+	// counters
+	baselines := make(map[string]history.Sample)
+	series := make(map[string][]history.Sample)
+	for _, sample := range samples {
+		switch {
+		case sample.UserID == "" || !sample.Time.Before(to):
+		case sample.Time.Before(from):
+			if baseline, exists := baselines[sample.UserID]; !exists || baseline.Time.Before(sample.Time) {
+				baselines[sample.UserID] = sample
+			}
+		default:
+			series[sample.UserID] = append(series[sample.UserID], sample)
+		}
+	}
+	for userID, baseline := range baselines {
+		series[userID] = append([]history.Sample{baseline}, series[userID]...)
+	}
+
+	users := make(map[string]*Line)
+	tenants := make(map[string]*Line)
+	plans := make(map[string]*Line)
+	report := &Report{Period: period, From: from, To: to, Rates: rates}
+
+	for userID, userSamples := range series {
+		sort.SliceStable(userSamples, func(i, j int) bool { return userSamples[i].Time.Before(userSamples[j].Time) })
+		for i, current := range userSamples {
+			var bytes int64
+			var end time.Time
+			if i+1 < len(userSamples) {
+				next := userSamples[i+1]
+				if !next.Time.Before(from) {
+					bytes = next.DataUsage - current.DataUsage
+				}
+				end = next.Time
+			} else {
+				// The last sample lasts as long as the interval before it
+				spacing := maxGap
+				if i > 0 {
+					spacing = current.Time.Sub(userSamples[i-1].Time)
+				}
+				end = current.Time.Add(spacing)
+			}
+			if bytes < 0 {
+				// The counter went backwards, such as after a restore
+				bytes = 0
+			}
+			if limit := current.Time.Add(maxGap); end.After(limit) {
+				end = limit
+			}
+
+			start := current.Time
+			if start.Before(from) {
+				start = from
+			}
+			if end.After(to) {
+				end = to
+			}
+			var duration time.Duration
+			if end.After(start) {
+				duration = end.Sub(start)
+			}
+
+			var connected, provisioned time.Duration
+			if current.ActiveConnections > 0 {
+				connected = duration
+			}
+			if current.Provisioned {
+				provisioned = duration
+			}
+			plan := current.Plan
+			if plan == "" {
+				plan = noPlan
+			}
+			rate := rates[current.Plan]
+
+			// Users are listed as they were last seen in the period
+			line := lineFor(users, userID)
+			line.Username, line.Tenant, line.Plan = current.Username, current.Tenant, current.Plan
+			line.add(bytes, connected, provisioned, rate)
+			if current.Tenant != "" {
+				tenantLine := lineFor(tenants, current.Tenant)
+				tenantLine.Tenant = current.Tenant
+				tenantLine.add(bytes, connected, provisioned, rate)
+			}
+			planLine := lineFor(plans, plan)
+			planLine.Plan = plan
+			planLine.add(bytes, connected, provisioned, rate)
+			report.Total.add(bytes, connected, provisioned, rate)
+		}
+	}
+
+	for userID, line := range users {
+		line.UserID = userID
+	}
+	report.Users = sortedLines(users, func(a, b Line) bool {
+		if a.Username != b.Username {
+			return a.Username < b.Username
+		}
+		return a.UserID < b.UserID
+	})
+	report.Tenants = sortedLines(tenants, func(a, b Line) bool { return a.Tenant < b.Tenant })
+	report.Plans = sortedLines(plans, func(a, b Line) bool { return a.Plan < b.Plan })
+	report.Total.round()
+	return report, nil
+}
+
+// lineFor returns the line of key, creating it if needed
+func lineFor(lines map[string]*Line, key string) *Line {
+	line, exists := lines[key]
+	if !exists {
+		line = &Line{}
+		lines[key] = line
+	}
+	return line
+}
+
+// sortedLines rounds lines and orders them with less
+func sortedLines(lines map[string]*Line, less func(a, b Line) bool) []Line {
+	result := make([]Line, 0, len(lines))
+	for _, line := range lines {
+		line.round()
+		result = append(result, *line)
+	}
+	sort.Slice(result, func(i, j int) bool { return less(result[i], result[j]) })
+	return result
+}
+
+// csvHeader names the columns of a CSV report
+var csvHeader = []string{"scope", "user_id", "username", "tenant", "plan", "data_bytes", "connected_hours", "pod_hours", "cost"}
+
+// WriteCSV writes a report as CSV, one row per user, tenant and plan
+// followed by the total
+func WriteCSV(w io.Writer, report *Report) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+
+	rows := []struct {
+		scope string
+		lines []Line
+	}{
+		{"user", report.Users},
+		{"tenant", report.Tenants},
+		{"plan", report.Plans},
+		{"total", []Line{report.Total}},
+	}
+	for _, row := range rows {
+		for _, line := range row.lines {
+			record := []string{
+				row.scope,
+				line.UserID,
+				line.Username,
+				line.Tenant,
+				line.Plan,
+				strconv.FormatInt(line.DataBytes, 10),
+				strconv.FormatFloat(line.ConnectedHours, 'f', 2, 64),
+				strconv.FormatFloat(line.PodHours, 'f', 2, 64),
+				strconv.FormatFloat(line.Cost, 'f', 2, 64),
+			}
+			if err := writer.Write(record); err != nil {
+				return fmt.Errorf("failed to write report: %v", err)
+			}
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,190 @@
+package reports
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/history"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+)
+
+var march = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+func sample(at time.Time, userID, username, tenant, plan string, usage int64, active int) history.Sample {
+	return history.Sample{
+		Time:              at,
+		UserID:            userID,
+		Username:          username,
+		Tenant:            tenant,
+		Plan:              plan,
+		Provisioned:       true,
+		DataUsage:         usage,
+		ActiveConnections: active,
+	}
+}
+
+func testSamples() []history.Sample {
+	alice := func(hours int, usage int64, active int) history.Sample {
+		return sample(march.Add(time.Duration(hours)*time.Hour), "u1", "alice", "acme", "pro", usage, active)
+	}
+	return []history.Sample{
+		// alice is connected for the first two hours of the period; the
+		// sample before the period is the baseline of her usage
+		alice(-1, 1000, 0),
+		alice(0, 1500, 1),
+		alice(1, 2500, 1),
+		alice(2, 2500, 0),
+		// bob was not sampled for five hours, of which only one is counted
+		sample(march.Add(9*24*time.Hour), "u2", "bob", "", "", 100, 0),
+		sample(march.Add(9*24*time.Hour+5*time.Hour), "u2", "bob", "", "", 400, 0),
+		// carol's pod only exists for the last hour of the period
+		sample(march.AddDate(0, 1, 0).Add(-time.Hour), "u3", "carol", "", "pro", 0, 0),
+		sample(march.AddDate(0, 1, 0).Add(-30*time.Minute), "u3", "carol", "", "pro", 0, 0),
+		// Samples after the period and of the global series are ignored
+		sample(march.AddDate(0, 1, 0), "u3", "carol", "", "pro", 9999, 1),
+		{Time: march, DataUsage: 12345, Users: 3},
+	}
+}
+
+func TestBuild(t *testing.T) {
+	report, err := Build("2024-03", testSamples(), map[string]float64{"pro": 0.5}, time.Hour)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+
+	if !report.From.Equal(march) || !report.To.Equal(march.AddDate(0, 1, 0)) {
+		t.Errorf("got range %v to %v", report.From, report.To)
+	}
+
+	wantUsers := []Line{
+		{UserID: "u1", Username: "alice", Tenant: "acme", Plan: "pro", DataBytes: 1500, ConnectedHours: 2, PodHours: 3, Cost: 1.5},
+		{UserID: "u2", Username: "bob", DataBytes: 300, PodHours: 2},
+		{UserID: "u3", Username: "carol", Plan: "pro", PodHours: 1, Cost: 0.5},
+	}
+	assertLines(t, "users", report.Users, wantUsers)
+	assertLines(t, "tenants", report.Tenants, []Line{
+		{Tenant: "acme", DataBytes: 1500, ConnectedHours: 2, PodHours: 3, Cost: 1.5},
+	})
+	assertLines(t, "plans", report.Plans, []Line{
+		{Plan: noPlan, DataBytes: 300, PodHours: 2},
+		{Plan: "pro", DataBytes: 1500, ConnectedHours: 2, PodHours: 4, Cost: 2},
+	})
+	assertLines(t, "total", []Line{report.Total}, []Line{
+		{DataBytes: 1800, ConnectedHours: 2, PodHours: 6, Cost: 2},
+	})
+
+	if _, err := Build("March", nil, nil, time.Hour); !errors.Is(err, ErrInvalidPeriod) {
+		t.Errorf("got error %v for an invalid period, want ErrInvalidPeriod", err)
+	}
+}
+
+func assertLines(t *testing.T, name string, got, want []Line) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d lines, want %d: %+v", name, len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%s line %d: got %+v, want %+v", name, i, got[i], want[i])
+		}
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	report, _ := Build("2024-03", testSamples(), map[string]float64{"pro": 0.5}, time.Hour)
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, report); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1+3+1+2+1 {
+		t.Fatalf("got %d lines, want 8:\n%s", len(lines), buf.String())
+	}
+	if lines[0] != strings.Join(csvHeader, ",") {
+		t.Errorf("got header %q", lines[0])
+	}
+	if lines[1] != "user,u1,alice,acme,pro,1500,2.00,3.00,1.50" {
+		t.Errorf("got first user row %q", lines[1])
+	}
+	if want := "total,,,,,1800,2.00,6.00,2.00"; lines[7] != want {
+		t.Errorf("got total row %q, want %q", lines[7], want)
+	}
+}
+
+func TestStores(t *testing.T) {
+	fileStore, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+
+	for name, reports := range map[string]Store{"memory": NewMemoryStore(), "file": fileStore} {
+		t.Run(name, func(t *testing.T) {
+			for _, period := range []string{"2024-02", "2024-03"} {
+				report, _ := Build(period, testSamples(), nil, time.Hour)
+				if err := reports.Save(report); err != nil {
+					t.Fatalf("save %s: %v", period, err)
+				}
+			}
+
+			// A period's report is never replaced
+			again, _ := Build("2024-03", nil, nil, time.Hour)
+			if err := reports.Save(again); !errors.Is(err, ErrExists) {
+				t.Errorf("got error %v saving a report twice, want ErrExists", err)
+			}
+			got, err := reports.Get("2024-03")
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			if got.Total.DataBytes != 1800 {
+				t.Errorf("got total %d, want the first report's 1800", got.Total.DataBytes)
+			}
+
+			if _, err := reports.Get("2024-04"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got error %v for a missing report, want ErrNotFound", err)
+			}
+
+			summaries, err := reports.List()
+			if err != nil {
+				t.Fatalf("list: %v", err)
+			}
+			if len(summaries) != 2 || summaries[0].Period != "2024-03" || summaries[1].Period != "2024-02" {
+				t.Errorf("got summaries %+v, want newest first", summaries)
+			}
+		})
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	usageHistory := history.NewMemoryStore()
+	usageHistory.Append(testSamples())
+	users := store.NewMemoryStore()
+	users.CreatePlan(&models.Plan{Name: "pro", HourlyRate: 0.25})
+
+	generator := NewGenerator(NewMemoryStore(), usageHistory, users, config.HistoryConfig{})
+	generator.now = func() time.Time { return march.AddDate(0, 1, 0) }
+	if _, err := generator.Generate("2024-03"); !errors.Is(err, ErrPeriodNotEnded) {
+		t.Errorf("got error %v before the period's last samples, want ErrPeriodNotEnded", err)
+	}
+
+	generator.now = func() time.Time { return march.AddDate(0, 1, 1) }
+	report, err := generator.Generate("2024-03")
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if report.Rates["pro"] != 0.25 || report.Total.Cost != 1 {
+		t.Errorf("got rates %v and cost %v, want pod-hours priced at the plan's rate", report.Rates, report.Total.Cost)
+	}
+	if !report.GeneratedAt.Equal(generator.now()) {
+		t.Errorf("got generation time %v", report.GeneratedAt)
+	}
+
+	if _, err := generator.Generate("2024-03"); !errors.Is(err, ErrExists) {
+		t.Errorf("got error %v generating twice, want ErrExists", err)
+	}
+}
@@ -0,0 +1,201 @@
+package reports
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when no report was generated for a period
+	ErrNotFound = errors.New("report not found")
+	// ErrExists is returned when saving a report for a period that already
+	// has one
+	ErrExists = errors.New("report already exists")
+)
+
+// Summary describes a stored report without its lines
+type Summary struct {
+	Period      string    `json:"period"`
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"`
+	GeneratedAt time.Time `json:"generated_at"`
+	Total       Line      `json:"total"`
+}
+
+// Store keeps generated reports. A report is saved once and never replaced,
+// so that what was handed to finance can always be produced again.
+type Store interface {
+	// Save stores the report of a period, failing with ErrExists if the
+	// period already has one
+	Save(report *Report) error
+	// Get returns the report of a period
+	Get(period string) (*Report, error)
+	// List summarizes the stored reports, newest period first
+	List() ([]Summary, error)
+}
+
+// summarize returns the summary of a report
+func summarize(report *Report) Summary {
+	return Summary{
+		Period:      report.Period,
+		From:        report.From,
+		To:          report.To,
+		GeneratedAt: report.GeneratedAt,
+		Total:       report.Total,
+	}
+}
+
+// sortSummaries orders summaries newest period first
+func sortSummaries(summaries []Summary) {
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Period > summaries[j].Period })
+}
+
+// MemoryStore is a Store held in memory
+type MemoryStore struct {
+	mu      sync.RWMutex
+	reports map[string]*Report
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{reports: make(map[string]*Report)}
+}
+
+// Save stores the report of a period once
+func (s *MemoryStore) Save(report *Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.reports[report.Period]; exists {
+		return ErrExists
+	}
+	s.reports[report.Period] = report
+	return nil
+}
+
+// Get returns the report of a period
+func (s *MemoryStore) Get(period string) (*Report, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	report, exists := s.reports[period]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return report, nil
+}
+
+// List summarizes the stored reports, newest period first
+func (s *MemoryStore) List() ([]Summary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	summaries := make([]Summary, 0, len(s.reports))
+	for _, report := range s.reports {
+		summaries = append(summaries, summarize(report))
+	}
+	sortSummaries(summaries)
+	return summaries, nil
+}
+
+// FileStore is a Store keeping every report as a JSON file named after its
+// period in a directory that replicas may share
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore creates a store in dir, creating it if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create report directory: %v", err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// path returns the file of a period's report
+func (s *FileStore) path(period string) string {
+	return filepath.Join(s.dir, period+".json")
+}
+
+// Save writes the report to a temporary file and links it into place, which
+// fails if the period already has a report. Readers never see a partial
+// report and concurrent replicas cannot replace each other's.
+func (s *FileStore) Save(report *Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(s.dir, ".report-*")
+	if err != nil {
+		return fmt.Errorf("failed to save report: %v", err)
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to save report: %v", err)
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to save report: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to save report: %v", err)
+	}
+	if err := os.Link(temp.Name(), s.path(report.Period)); err != nil {
+		if os.IsExist(err) {
+			return ErrExists
+		}
+		return fmt.Errorf("failed to save report: %v", err)
+	}
+	return nil
+}
+
+// Get reads the report of a period
+func (s *FileStore) Get(period string) (*Report, error) {
+	if _, _, err := ParsePeriod(period); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(s.path(period))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report: %v", err)
+	}
+
+	var report Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("failed to decode report %s: %v", period, err)
+	}
+	return &report, nil
+}
+
+// List reads and summarizes every report in the directory, newest period
+// first
+func (s *FileStore) List() ([]Summary, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]Summary, 0, len(paths))
+	for _, path := range paths {
+		period := strings.TrimSuffix(filepath.Base(path), ".json")
+		if _, _, err := ParsePeriod(period); err != nil {
+			continue
+		}
+		report, err := s.Get(period)
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, summarize(report))
+	}
+	sortSummaries(summaries)
+	return summaries, nil
+}
@@ -0,0 +1,293 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"vpnaas-backend/internal/models"
+)
+
+var (
+	// ErrNotFound is returned when the requested user does not exist
+	ErrNotFound = errors.New("user not found")
+	// ErrConflict is returned when a user with the same username or email exists
+	ErrConflict = errors.New("user already exists")
+	// ErrPlanNotFound is returned when the requested plan does not exist
+	ErrPlanNotFound = errors.New("plan not found")
+	// ErrPlanExists is returned when a plan with the same name exists
+	ErrPlanExists = errors.New("plan already exists")
+	// ErrPlanInUse is returned when deleting a plan that users are assigned to
+	ErrPlanInUse = errors.New("plan is assigned to users")
+	// ErrTunnelPoolExhausted is returned when every tunnel host is taken
+	ErrTunnelPoolExhausted = errors.New("tunnel address pool exhausted")
+)
+
+// Store provides concurrency-safe access to users and plans. Implementations
+// hand out copies, so callers never share a model with another goroutine.
+type Store interface {
+	// CreateUser stores a new user and assigns it the lowest free tunnel
+	// host, failing with ErrConflict if the username or email is already
+	// taken, ErrPlanNotFound if its plan does not exist and
+	// ErrTunnelPoolExhausted if no tunnel host is free. Deleting a user
+	// frees its host.
+	CreateUser(user *models.User) error
+	// GetUser returns a copy of the user with the given ID
+	GetUser(id string) (*models.User, error)
+	// ListUsers returns copies of all users ordered by creation time
+	ListUsers() []*models.User
+	// UpdateUser applies fn to the stored user atomically. If fn returns an
+	// error the user is left unchanged.
+	UpdateUser(id string, fn func(user *models.User) error) (*models.User, error)
+	// DeleteUser removes the user and returns its last stored state
+	DeleteUser(id string) (*models.User, error)
+
+	// CreatePlan stores a new plan, failing with ErrPlanExists if the name is
+	// taken
+	CreatePlan(plan *models.Plan) error
+	// GetPlan returns a copy of the plan with the given name
+	GetPlan(name string) (*models.Plan, error)
+	// ListPlans returns copies of all plans ordered by name
+	ListPlans() []*models.Plan
+	// UpdatePlan applies fn to the stored plan atomically
+	UpdatePlan(name string, fn func(plan *models.Plan) error) (*models.Plan, error)
+	// DeletePlan removes a plan, failing with ErrPlanInUse while users are
+	// assigned to it
+	DeletePlan(name string) error
+
+	// Ping verifies that the store can serve requests
+	Ping(ctx context.Context) error
+}
+
+// UpdateApplied stores the template, egress IP, rate limits, peer state and
+// client configuration the VPN manager applied to a user's workload, taken
+// from the copy of the user it was given
+func UpdateApplied(s Store, applied *models.User) (*models.User, error) {
+	return s.UpdateUser(applied.ID, func(u *models.User) error {
+		u.PodTemplate = applied.PodTemplate
+		u.EgressIP = applied.EgressIP
+		u.AppliedBandwidth = applied.AppliedBandwidth
+		u.PeerRemoved = applied.PeerRemoved
+		u.ConfigData = applied.ConfigData
+		return nil
+	})
+}
+
+// MemoryStore is an in-memory Store guarded by a read-write mutex
+type MemoryStore struct {
+	mu    sync.RWMutex
+	users map[string]*models.User
+	plans map[string]*models.Plan
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users: make(map[string]*models.User),
+		plans: make(map[string]*models.Plan),
+	}
+}
+
+// CreateUser stores a new user
+func (s *MemoryStore) CreateUser(user *models.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.users[user.ID]; exists {
+		return ErrConflict
+	}
+	for _, existing := range s.users {
+		if existing.Username == user.Username || existing.Email == user.Email {
+			return ErrConflict
+		}
+	}
+	if _, exists := s.plans[user.Plan]; user.Plan != "" && !exists {
+		return ErrPlanNotFound
+	}
+	host, err := s.freeTunnelHost()
+	if err != nil {
+		return err
+	}
+
+	user.TunnelHost = host
+	s.users[user.ID] = user.Clone()
+	return nil
+}
+
+// freeTunnelHost returns the lowest tunnel host no user holds. The caller
+// holds the lock.
+func (s *MemoryStore) freeTunnelHost() (int, error) {
+	taken := make(map[int]bool, len(s.users))
+	for _, user := range s.users {
+		taken[user.TunnelHost] = true
+	}
+	for host := models.MinTunnelHost; host <= models.MaxTunnelHost; host++ {
+		if !taken[host] {
+			return host, nil
+		}
+	}
+	return 0, ErrTunnelPoolExhausted
+}
+
+// GetUser returns a copy of a user
+func (s *MemoryStore) GetUser(id string) (*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, exists := s.users[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	return user.Clone(), nil
+}
+
+// ListUsers returns copies of all users
+func (s *MemoryStore) ListUsers() []*models.User {
+	s.mu.RLock()
+	users := make([]*models.User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user.Clone())
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].CreatedAt.Equal(users[j].CreatedAt) {
+			return users[i].ID < users[j].ID
+		}
+		return users[i].CreatedAt.Before(users[j].CreatedAt)
+	})
+
+	return users
+}
+
+// UpdateUser atomically modifies a user
+func (s *MemoryStore) UpdateUser(id string, fn func(user *models.User) error) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.users[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	// Work on a copy so a failing fn leaves the stored user untouched
+	updated := user.Clone()
+	if err := fn(updated); err != nil {
+		return nil, err
+	}
+	updated.ID = id
+	updated.TunnelHost = user.TunnelHost
+
+	for otherID, other := range s.users {
+		if otherID != id && (other.Username == updated.Username || other.Email == updated.Email) {
+			return nil, ErrConflict
+		}
+	}
+	if _, exists := s.plans[updated.Plan]; updated.Plan != "" && updated.Plan != user.Plan && !exists {
+		return nil, ErrPlanNotFound
+	}
+
+	s.users[id] = updated
+	return updated.Clone(), nil
+}
+
+// DeleteUser removes a user
+func (s *MemoryStore) DeleteUser(id string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.users[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	delete(s.users, id)
+	return user, nil
+}
+
+// CreatePlan stores a new plan
+func (s *MemoryStore) CreatePlan(plan *models.Plan) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.plans[plan.Name]; exists {
+		return ErrPlanExists
+	}
+
+	s.plans[plan.Name] = plan.Clone()
+	return nil
+}
+
+// GetPlan returns a copy of a plan
+func (s *MemoryStore) GetPlan(name string) (*models.Plan, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	plan, exists := s.plans[name]
+	if !exists {
+		return nil, ErrPlanNotFound
+	}
+
+	return plan.Clone(), nil
+}
+
+// ListPlans returns copies of all plans
+func (s *MemoryStore) ListPlans() []*models.Plan {
+	s.mu.RLock()
+	plans := make([]*models.Plan, 0, len(s.plans))
+	for _, plan := range s.plans {
+		plans = append(plans, plan.Clone())
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(plans, func(i, j int) bool {
+		return plans[i].Name < plans[j].Name
+	})
+
+	return plans
+}
+
+// UpdatePlan atomically modifies a plan
+func (s *MemoryStore) UpdatePlan(name string, fn func(plan *models.Plan) error) (*models.Plan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	plan, exists := s.plans[name]
+	if !exists {
+		return nil, ErrPlanNotFound
+	}
+
+	updated := plan.Clone()
+	if err := fn(updated); err != nil {
+		return nil, err
+	}
+	updated.Name = name
+
+	s.plans[name] = updated
+	return updated.Clone(), nil
+}
+
+// DeletePlan removes a plan
+func (s *MemoryStore) DeletePlan(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.plans[name]; !exists {
+		return ErrPlanNotFound
+	}
+	for _, user := range s.users {
+		if user.Plan == name {
+			return ErrPlanInUse
+		}
+	}
+
+	delete(s.plans, name)
+	return nil
+}
+
+// Ping always succeeds, the store being in memory
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
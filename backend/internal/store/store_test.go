@@ -0,0 +1,209 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"vpnaas-backend/internal/models"
+)
+
+func TestMemoryStoreConflicts(t *testing.T) {
+	s := NewMemoryStore()
+
+	if err := s.CreateUser(models.NewUser("alice", "alice@example.com")); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		email    string
+	}{
+		{"same username", "alice", "other@example.com"},
+		{"same email", "other", "alice@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.CreateUser(models.NewUser(tt.username, tt.email))
+			if !errors.Is(err, ErrConflict) {
+				t.Fatalf("got %v, want ErrConflict", err)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreReturnsCopies(t *testing.T) {
+	s := NewMemoryStore()
+	user := models.NewUser("bob", "bob@example.com")
+	if err := s.CreateUser(user); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	// Mutating the original or a fetched copy must not leak into the store
+	user.Status = "suspended"
+	got, _ := s.GetUser(user.ID)
+	got.Status = "inactive"
+	for _, listed := range s.ListUsers() {
+		listed.Status = "inactive"
+	}
+
+	stored, err := s.GetUser(user.ID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if stored.Status != "active" {
+		t.Fatalf("stored status changed to %q", stored.Status)
+	}
+}
+
+func TestMemoryStoreTunnelHosts(t *testing.T) {
+	s := NewMemoryStore()
+	var users []*models.User
+	for i := models.MinTunnelHost; i <= models.MaxTunnelHost; i++ {
+		user := models.NewUser(fmt.Sprintf("user%d", i), fmt.Sprintf("user%d@example.com", i))
+		if err := s.CreateUser(user); err != nil {
+			t.Fatalf("create %s: %v", user.Username, err)
+		}
+		if user.TunnelHost != i {
+			t.Fatalf("%s got tunnel host %d, want %d", user.Username, user.TunnelHost, i)
+		}
+		users = append(users, user)
+	}
+
+	if err := s.CreateUser(models.NewUser("extra", "extra@example.com")); !errors.Is(err, ErrTunnelPoolExhausted) {
+		t.Fatalf("create with every host taken: got %v, want ErrTunnelPoolExhausted", err)
+	}
+
+	// Updates cannot move a user to another host
+	updated, err := s.UpdateUser(users[0].ID, func(u *models.User) error {
+		u.TunnelHost = users[1].TunnelHost
+		return nil
+	})
+	if err != nil || updated.TunnelHost != users[0].TunnelHost {
+		t.Fatalf("update changed tunnel host to %v (err %v)", updated, err)
+	}
+
+	// Deleting a user frees its host for the next one
+	if _, err := s.DeleteUser(users[3].ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	user := models.NewUser("next", "next@example.com")
+	if err := s.CreateUser(user); err != nil {
+		t.Fatalf("create after delete: %v", err)
+	}
+	if user.TunnelHost != users[3].TunnelHost {
+		t.Fatalf("got tunnel host %d, want released host %d", user.TunnelHost, users[3].TunnelHost)
+	}
+}
+
+func TestMemoryStoreUpdateUser(t *testing.T) {
+	s := NewMemoryStore()
+	alice := models.NewUser("alice", "alice@example.com")
+	bob := models.NewUser("bob", "bob@example.com")
+	s.CreateUser(alice)
+	s.CreateUser(bob)
+
+	if _, err := s.UpdateUser(bob.ID, func(u *models.User) error {
+		u.Username = "alice"
+		return nil
+	}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("rename to taken username: got %v, want ErrConflict", err)
+	}
+
+	failure := errors.New("boom")
+	if _, err := s.UpdateUser(bob.ID, func(u *models.User) error {
+		u.Status = "suspended"
+		return failure
+	}); !errors.Is(err, failure) {
+		t.Fatalf("failing update: got %v, want %v", err, failure)
+	}
+
+	stored, _ := s.GetUser(bob.ID)
+	if stored.Username != "bob" || stored.Status != "active" {
+		t.Fatalf("failed updates leaked into store: %+v", stored)
+	}
+
+	if _, err := s.UpdateUser("missing", func(u *models.User) error { return nil }); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("update missing: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryStoreConcurrentAccess(t *testing.T) {
+	s := NewMemoryStore()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				name := fmt.Sprintf("user-%d-%d", worker, i)
+				user := models.NewUser(name, name+"@example.com")
+				if err := s.CreateUser(user); err != nil {
+					t.Errorf("create: %v", err)
+					continue
+				}
+				s.UpdateUser(user.ID, func(u *models.User) error {
+					u.AddDataUsage(1024)
+					return nil
+				})
+				s.ListUsers()
+				if i%2 == 0 {
+					if _, err := s.DeleteUser(user.ID); err != nil {
+						t.Errorf("delete: %v", err)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if got := len(s.ListUsers()); got != 8*25 {
+		t.Fatalf("got %d users, want %d", got, 8*25)
+	}
+}
+
+func TestMemoryStorePlans(t *testing.T) {
+	s := NewMemoryStore()
+
+	if err := s.CreatePlan(&models.Plan{Name: "basic"}); err != nil {
+		t.Fatalf("create plan: %v", err)
+	}
+	if err := s.CreatePlan(&models.Plan{Name: "basic"}); !errors.Is(err, ErrPlanExists) {
+		t.Fatalf("duplicate plan: got %v, want ErrPlanExists", err)
+	}
+
+	user := models.NewUser("alice", "alice@example.com")
+	user.Plan = "missing"
+	if err := s.CreateUser(user); !errors.Is(err, ErrPlanNotFound) {
+		t.Fatalf("user with unknown plan: got %v, want ErrPlanNotFound", err)
+	}
+
+	user.Plan = "basic"
+	if err := s.CreateUser(user); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	if err := s.DeletePlan("basic"); !errors.Is(err, ErrPlanInUse) {
+		t.Fatalf("delete plan in use: got %v, want ErrPlanInUse", err)
+	}
+
+	if _, err := s.UpdateUser(user.ID, func(u *models.User) error {
+		u.Plan = "missing"
+		return nil
+	}); !errors.Is(err, ErrPlanNotFound) {
+		t.Fatalf("move to unknown plan: got %v, want ErrPlanNotFound", err)
+	}
+
+	s.UpdateUser(user.ID, func(u *models.User) error {
+		u.Plan = ""
+		return nil
+	})
+	if err := s.DeletePlan("basic"); err != nil {
+		t.Fatalf("delete unused plan: %v", err)
+	}
+	if _, err := s.GetPlan("basic"); !errors.Is(err, ErrPlanNotFound) {
+		t.Fatalf("get deleted plan: got %v, want ErrPlanNotFound", err)
+	}
+}
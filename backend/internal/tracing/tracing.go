@@ -0,0 +1,136 @@
+// Package tracing sets up OpenTelemetry tracing and provides the spans for
+// API requests, VPNManager steps and Kubernetes API calls
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"vpnaas-backend/internal/config"
+)
+
+// instrumentationName identifies the spans created by the backend
+const instrumentationName = "vpnaas-backend"
+
+// Init installs the W3C trace context propagator and, when cfg is enabled, a
+// tracer provider exporting spans over OTLP/HTTP to cfg.Endpoint. The
+// returned function flushes and stops the exporter.
+func Init(ctx context.Context, cfg config.TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	if !cfg.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+
+	provider, err := Setup(cfg.ServiceName, sdktrace.NewBatchSpanProcessor(exporter), sdktrace.TraceIDRatioBased(cfg.SampleRatio))
+	if err != nil {
+		return nil, err
+	}
+	return provider.Shutdown, nil
+}
+
+// Setup installs a tracer provider sending spans of serviceName to
+// processor. Root spans are sampled by sampler, other spans follow their
+// parent, so a request sampled by the gateway is traced here as well.
+func Setup(serviceName string, processor sdktrace.SpanProcessor, sampler sdktrace.Sampler) (*sdktrace.TracerProvider, error) {
+	if serviceName == "" {
+		serviceName = instrumentationName
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider, nil
+}
+
+// Start starts a span as a child of the span in ctx
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End records err on the span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// WrapTransport traces the requests sent through rt, such as the calls of a
+// Kubernetes client, naming each span after its method and resource. Only
+// requests made within a trace are traced, which leaves out background
+// polling.
+func WrapTransport(rt http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(rt,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return "k8s " + r.Method + " " + kubernetesResource(r.URL.Path)
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return trace.SpanContextFromContext(r.Context()).IsValid()
+		}),
+	)
+}
+
+// kubernetesResource returns the resource type, and subresource if any, a
+// Kubernetes API path refers to, leaving out namespaces and object names to
+// keep span names few
+func kubernetesResource(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	// Skip the group and version: /api/v1 or /apis/<group>/<version>
+	switch {
+	case len(parts) >= 2 && parts[0] == "api":
+		parts = parts[2:]
+	case len(parts) >= 3 && parts[0] == "apis":
+		parts = parts[3:]
+	default:
+		return path
+	}
+	if len(parts) >= 3 && parts[0] == "namespaces" {
+		parts = parts[2:]
+	}
+
+	switch len(parts) {
+	case 0:
+		return path
+	case 1, 2:
+		return parts[0]
+	default:
+		return parts[0] + "/" + parts[2]
+	}
+}
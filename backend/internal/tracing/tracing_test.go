@@ -0,0 +1,129 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"vpnaas-backend/internal/config"
+)
+
+// newRecorder installs a tracer provider recording every span in memory
+func newRecorder(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	if _, err := Setup("vpnaas-backend", sdktrace.NewSimpleSpanProcessor(exporter), sdktrace.AlwaysSample()); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	Init(context.Background(), config.TracingConfig{})
+	return exporter
+}
+
+func TestKubernetesResource(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/api/v1/namespaces/vpnaas/pods", "pods"},
+		{"/api/v1/namespaces/vpnaas/pods/vpn-1-abc", "pods"},
+		{"/api/v1/namespaces/vpnaas/pods/vpn-1-abc/exec", "pods/exec"},
+		{"/apis/apps/v1/namespaces/vpnaas/deployments/vpn-1", "deployments"},
+		{"/apis/networking.k8s.io/v1/namespaces/vpnaas/networkpolicies", "networkpolicies"},
+		{"/api/v1/nodes/node-a", "nodes"},
+		{"/api/v1/namespaces/vpnaas", "namespaces"},
+		{"/version", "/version"},
+	}
+
+	for _, tt := range tests {
+		if got := kubernetesResource(tt.path); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	exporter := newRecorder(t)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware())
+	router.POST("/api/v1/users/:id", func(c *gin.Context) {
+		_, span := Start(c.Request.Context(), "step")
+		span.End()
+		c.Status(http.StatusInternalServerError)
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/users/1", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	step, server := spans[0], spans[1]
+
+	// The request continues the caller's trace
+	if server.Name != "POST /api/v1/users/:id" || server.SpanKind != trace.SpanKindServer {
+		t.Errorf("got server span %q of kind %v", server.Name, server.SpanKind)
+	}
+	if got := server.SpanContext.TraceID().String(); got != traceID {
+		t.Errorf("got trace ID %s, want %s", got, traceID)
+	}
+	if got := server.Parent.SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("got parent span %s", got)
+	}
+	if server.Status.Code != codes.Error {
+		t.Errorf("got status %v for a 500 response", server.Status.Code)
+	}
+	if step.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Errorf("handler span is not a child of the request span")
+	}
+}
+
+func TestWrapTransport(t *testing.T) {
+	exporter := newRecorder(t)
+
+	apiserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if traced := r.Header.Get("traceparent") != ""; traced != strings.HasSuffix(r.URL.Path, "vpn-1") {
+			t.Errorf("got traceparent %v for %s", traced, r.URL.Path)
+		}
+	}))
+	defer apiserver.Close()
+	client := &http.Client{Transport: WrapTransport(http.DefaultTransport)}
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "parent")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, apiserver.URL+"/api/v1/namespaces/vpnaas/pods/vpn-1", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("traced request: %v", err)
+	}
+	resp.Body.Close()
+	parent.End()
+
+	// Calls outside a trace are left alone
+	req, _ = http.NewRequest(http.MethodGet, apiserver.URL+"/api/v1/namespaces/vpnaas/pods", nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("untraced request: %v", err)
+	}
+	resp.Body.Close()
+
+	var names []string
+	for _, span := range exporter.GetSpans() {
+		names = append(names, span.Name)
+	}
+	if len(names) != 2 || names[0] != "k8s GET pods" || names[1] != "parent" {
+		t.Fatalf("got spans %v", names)
+	}
+}
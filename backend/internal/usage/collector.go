@@ -0,0 +1,212 @@
+package usage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"vpnaas-backend/internal/access"
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/metrics"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+	"vpnaas-backend/internal/wireguard"
+)
+
+// activeWindow is how long after its latest handshake a peer counts as
+// connected. WireGuard renews the handshake every two minutes while a session
+// is in use.
+const activeWindow = 3 * time.Minute
+
+// DumpReader reads the WireGuard state of a user's VPN
+type DumpReader interface {
+	// ReadWireGuardDump returns the name of the pod serving the user and the
+	// output of `wg show <if> dump` in it
+	ReadWireGuardDump(ctx context.Context, user *models.User) (string, string, error)
+}
+
+// Collector periodically gathers transfer counters and handshakes from the
+// VPN pods and folds them into the stored users and the Prometheus metrics.
+// With an access enforcer, every sample is checked against the user's quota.
+type Collector struct {
+	reader   DumpReader
+	store    store.Store
+	access   *access.Enforcer
+	interval time.Duration
+	perUser  config.PerUserMetrics
+	now      func() time.Time
+}
+
+// NewCollector creates a collector that runs at the interval of cfg and
+// exports the per-user series perUser asks for. The enforcer may be nil to
+// collect usage without enforcing quotas.
+func NewCollector(reader DumpReader, userStore store.Store, enforcer *access.Enforcer, cfg config.UsageConfig, perUser config.PerUserMetrics) *Collector {
+	interval := cfg.CollectInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	return &Collector{
+		reader:   reader,
+		store:    userStore,
+		access:   enforcer,
+		interval: interval,
+		perUser:  perUser,
+		now:      time.Now,
+	}
+}
+
+// Run collects immediately and then at every interval until ctx is done
+func (c *Collector) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Collect(ctx); err != nil {
+			logrus.Warnf("Usage collection incomplete: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Collect takes one sample from the VPN of every provisioned user. Users whose
+// pods cannot be read are skipped and reported in the returned error.
+func (c *Collector) Collect(ctx context.Context) error {
+	var errs []error
+	connected := 0
+
+	for _, user := range c.store.ListUsers() {
+		if user.WorkloadName == "" {
+			continue
+		}
+
+		result, err := c.collectUser(ctx, user)
+		if err != nil {
+			metrics.RecordError("usage_collection", "collector")
+			errs = append(errs, fmt.Errorf("user %s: %v", user.ID, err))
+			continue
+		}
+		connected += result.connected
+	}
+
+	metrics.SetActiveConnections(connected)
+	metrics.UpdateUsageMetrics(c.store.ListUsers(), c.perUser)
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// collectUser samples a single user's VPN and stores the result
+func (c *Collector) collectUser(ctx context.Context, user *models.User) (sampleResult, error) {
+	pod, output, err := c.reader.ReadWireGuardDump(ctx, user)
+	if err != nil {
+		return sampleResult{}, err
+	}
+
+	dump, err := wireguard.ParseDump(output)
+	if err != nil {
+		return sampleResult{}, fmt.Errorf("failed to parse WireGuard dump: %v", err)
+	}
+
+	var result sampleResult
+	now := c.now()
+	updated, err := c.update(ctx, user.ID, func(u *models.User) {
+		result = applySample(u, pod, dump.Peers, now)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		// Deleted since the list was taken
+		return sampleResult{}, nil
+	}
+	if updated == nil {
+		return sampleResult{}, fmt.Errorf("failed to store usage: %v", err)
+	}
+
+	metrics.AddDataUsage(result.bytes)
+	for i := 0; i < result.newConnections; i++ {
+		metrics.IncrementConnections()
+	}
+
+	return result, err
+}
+
+// update stores a sample, enforcing the user's quota if an enforcer is set.
+// The stored user is returned even if enforcing the quota failed.
+func (c *Collector) update(ctx context.Context, userID string, fn func(user *models.User)) (*models.User, error) {
+	if c.access != nil {
+		return c.access.Apply(ctx, userID, fn)
+	}
+	return c.store.UpdateUser(userID, func(u *models.User) error {
+		fn(u)
+		return nil
+	})
+}
+
+// sampleResult is what a single sample added to a user
+type sampleResult struct {
+	bytes          int64
+	newConnections int
+	connected      int
+}
+
+// applySample folds the peers of a dump taken from pod into the user's usage.
+// The counters of a new pod start from zero, as do those of an interface
+// recreated inside the same pod, which shows up as a counter going backwards.
+// A peer that is connected now but was not at the previous sample counts as a
+// new connection.
+func applySample(user *models.User, pod string, peers []wireguard.Peer, now time.Time) sampleResult {
+	previous := user.PeerCounters
+	if user.CounterPod != pod {
+		previous = nil
+	}
+
+	var result sampleResult
+	counters := make(map[string]models.PeerCounters, len(peers))
+	for _, peer := range peers {
+		last := previous[peer.PublicKey]
+		result.bytes += counterDelta(last.RxBytes, peer.RxBytes) + counterDelta(last.TxBytes, peer.TxBytes)
+
+		connected := !peer.LatestHandshake.IsZero() && now.Sub(peer.LatestHandshake) <= activeWindow
+		if connected {
+			result.connected++
+			if !last.Connected {
+				result.newConnections++
+			}
+		}
+		if peer.LatestHandshake.After(user.LastLogin) {
+			user.LastLogin = peer.LatestHandshake
+		}
+
+		counters[peer.PublicKey] = models.PeerCounters{
+			RxBytes:   peer.RxBytes,
+			TxBytes:   peer.TxBytes,
+			Connected: connected,
+		}
+	}
+
+	if result.bytes > 0 {
+		user.AddDataUsage(result.bytes)
+	}
+	for i := 0; i < result.newConnections; i++ {
+		user.IncrementConnectionCount()
+	}
+	user.CounterPod = pod
+	user.PeerCounters = counters
+
+	return result
+}
+
+// counterDelta returns the bytes transferred since a counter was last read
+func counterDelta(last, current int64) int64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
@@ -0,0 +1,228 @@
+package usage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/metrics"
+	"vpnaas-backend/internal/models"
+	"vpnaas-backend/internal/store"
+	"vpnaas-backend/internal/wireguard"
+)
+
+const (
+	peerA = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	peerB = "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0="
+)
+
+var sampleTime = time.Unix(1760781600, 0)
+
+func peer(key string, rx, tx int64, handshakeAgo time.Duration) wireguard.Peer {
+	p := wireguard.Peer{PublicKey: key, RxBytes: rx, TxBytes: tx}
+	if handshakeAgo >= 0 {
+		p.LatestHandshake = sampleTime.Add(-handshakeAgo)
+	}
+	return p
+}
+
+func TestApplySample(t *testing.T) {
+	tests := []struct {
+		name            string
+		user            models.User
+		pod             string
+		peers           []wireguard.Peer
+		wantUsage       int64
+		wantConnections int
+		wantConnected   int
+	}{
+		{
+			name:            "first sample counts from zero",
+			user:            models.User{},
+			pod:             "vpn-1-a",
+			peers:           []wireguard.Peer{peer(peerA, 100, 200, time.Minute)},
+			wantUsage:       300,
+			wantConnections: 1,
+			wantConnected:   1,
+		},
+		{
+			name: "counters accumulate within a pod",
+			user: models.User{
+				DataUsage:       300,
+				ConnectionCount: 1,
+				CounterPod:      "vpn-1-a",
+				PeerCounters:    map[string]models.PeerCounters{peerA: {RxBytes: 100, TxBytes: 200, Connected: true}},
+			},
+			pod:             "vpn-1-a",
+			peers:           []wireguard.Peer{peer(peerA, 150, 1200, 30*time.Second)},
+			wantUsage:       1350,
+			wantConnections: 1,
+			wantConnected:   1,
+		},
+		{
+			name: "counter reset within a pod",
+			user: models.User{
+				DataUsage:    5000,
+				CounterPod:   "vpn-1-a",
+				PeerCounters: map[string]models.PeerCounters{peerA: {RxBytes: 2000, TxBytes: 3000}},
+			},
+			pod:       "vpn-1-a",
+			peers:     []wireguard.Peer{peer(peerA, 10, 20, -1)},
+			wantUsage: 5030,
+		},
+		{
+			name: "new pod starts from zero",
+			user: models.User{
+				DataUsage:       5000,
+				ConnectionCount: 2,
+				CounterPod:      "vpn-1-a",
+				PeerCounters:    map[string]models.PeerCounters{peerA: {RxBytes: 10, TxBytes: 20, Connected: true}},
+			},
+			pod:             "vpn-1-b",
+			peers:           []wireguard.Peer{peer(peerA, 40, 60, time.Second)},
+			wantUsage:       5100,
+			wantConnections: 3,
+			wantConnected:   1,
+		},
+		{
+			name: "stale handshake is not connected",
+			user: models.User{
+				CounterPod:   "vpn-1-a",
+				PeerCounters: map[string]models.PeerCounters{peerA: {Connected: true}},
+			},
+			pod:   "vpn-1-a",
+			peers: []wireguard.Peer{peer(peerA, 0, 0, 10*time.Minute), peer(peerB, 0, 0, -1)},
+		},
+		{
+			name: "reconnect after idle counts again",
+			user: models.User{
+				ConnectionCount: 4,
+				CounterPod:      "vpn-1-a",
+				PeerCounters:    map[string]models.PeerCounters{peerA: {Connected: false}},
+			},
+			pod:             "vpn-1-a",
+			peers:           []wireguard.Peer{peer(peerA, 0, 0, time.Second), peer(peerB, 0, 0, 2*time.Minute)},
+			wantConnections: 6,
+			wantConnected:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := tt.user.Clone()
+			before := user.DataUsage
+			result := applySample(user, tt.pod, tt.peers, sampleTime)
+
+			if user.DataUsage != tt.wantUsage {
+				t.Errorf("got usage %d, want %d", user.DataUsage, tt.wantUsage)
+			}
+			if result.bytes != tt.wantUsage-before {
+				t.Errorf("got delta %d, want %d", result.bytes, tt.wantUsage-before)
+			}
+			if user.ConnectionCount != tt.wantConnections {
+				t.Errorf("got %d connections, want %d", user.ConnectionCount, tt.wantConnections)
+			}
+			if result.connected != tt.wantConnected {
+				t.Errorf("got %d connected peers, want %d", result.connected, tt.wantConnected)
+			}
+			if user.CounterPod != tt.pod || len(user.PeerCounters) != len(tt.peers) {
+				t.Errorf("counters not recorded: pod %q, %v", user.CounterPod, user.PeerCounters)
+			}
+			for _, p := range tt.peers {
+				if !p.LatestHandshake.IsZero() && user.LastLogin.Before(p.LatestHandshake) {
+					t.Errorf("last login %v is before handshake %v", user.LastLogin, p.LatestHandshake)
+				}
+			}
+		})
+	}
+}
+
+// fakeReader serves recorded dumps per user
+type fakeReader struct {
+	pods  map[string]string
+	dumps map[string]string
+}
+
+func (f *fakeReader) ReadWireGuardDump(ctx context.Context, user *models.User) (string, string, error) {
+	dump, ok := f.dumps[user.ID]
+	if !ok {
+		return "", "", fmt.Errorf("pod not running")
+	}
+	return f.pods[user.ID], dump, nil
+}
+
+func dumpOf(rx, tx int64, handshake time.Time) string {
+	return fmt.Sprintf("priv\tpub\t51820\toff\n%s\t(none)\t203.0.113.7:41523\t10.0.0.2/32\t%d\t%d\t%d\t25\n",
+		peerA, handshake.Unix(), rx, tx)
+}
+
+func TestCollect(t *testing.T) {
+	userStore := store.NewMemoryStore()
+	provisioned := models.NewUser("alice", "alice@example.com")
+	provisioned.WorkloadName = "vpn-alice"
+	broken := models.NewUser("bob", "bob@example.com")
+	broken.WorkloadName = "vpn-bob"
+	pending := models.NewUser("carol", "carol@example.com")
+	for _, user := range []*models.User{provisioned, broken, pending} {
+		if err := userStore.CreateUser(user); err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+
+	reader := &fakeReader{
+		pods:  map[string]string{provisioned.ID: "vpn-alice-1"},
+		dumps: map[string]string{provisioned.ID: dumpOf(1000, 2000, sampleTime.Add(-time.Minute))},
+	}
+	collector := NewCollector(reader, userStore, nil, config.UsageConfig{}, config.PerUserMetrics{})
+	collector.now = func() time.Time { return sampleTime }
+
+	totalBefore := testutil.ToFloat64(metrics.TotalDataUsage)
+	connectionsBefore := testutil.ToFloat64(metrics.TotalConnections)
+
+	err := collector.Collect(context.Background())
+	if err == nil || !strings.Contains(err.Error(), broken.ID) {
+		t.Fatalf("got error %v, want failure for %s", err, broken.ID)
+	}
+
+	// A second sample only adds the difference
+	reader.dumps[provisioned.ID] = dumpOf(1500, 2500, sampleTime.Add(-time.Second))
+	collector.Collect(context.Background())
+
+	stored, _ := userStore.GetUser(provisioned.ID)
+	if stored.DataUsage != 4000 {
+		t.Errorf("got usage %d, want 4000", stored.DataUsage)
+	}
+	if stored.ConnectionCount != 1 {
+		t.Errorf("got %d connections, want 1", stored.ConnectionCount)
+	}
+	if !stored.LastLogin.Equal(sampleTime.Add(-time.Second)) {
+		t.Errorf("got last login %v", stored.LastLogin)
+	}
+
+	if got := testutil.ToFloat64(metrics.DataUsagePerPlan.WithLabelValues("none")); got != 4000 {
+		t.Errorf("got plan data usage metric %v, want 4000", got)
+	}
+	if got := testutil.ToFloat64(metrics.TotalDataUsage) - totalBefore; got != 4000 {
+		t.Errorf("total data usage grew by %v, want 4000", got)
+	}
+	if got := testutil.ToFloat64(metrics.TotalConnections) - connectionsBefore; got != 1 {
+		t.Errorf("total connections grew by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.ActiveConnections); got != 1 {
+		t.Errorf("got %v active connections, want 1", got)
+	}
+
+	// Malformed dumps are reported and leave the user untouched
+	reader.dumps[provisioned.ID] = "garbage"
+	if err := collector.Collect(context.Background()); err == nil || !strings.Contains(err.Error(), "failed to parse") {
+		t.Fatalf("got error %v, want parse failure", err)
+	}
+	if after, _ := userStore.GetUser(provisioned.ID); after.DataUsage != 4000 {
+		t.Errorf("malformed dump changed usage to %d", after.DataUsage)
+	}
+}
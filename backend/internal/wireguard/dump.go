@@ -0,0 +1,131 @@
+package wireguard
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interface is the interface line of a `wg show <if> dump`
+type Interface struct {
+	PublicKey  string
+	ListenPort int
+}
+
+// Peer is a peer line of a `wg show <if> dump`
+type Peer struct {
+	PublicKey           string
+	Endpoint            string
+	AllowedIPs          []string
+	LatestHandshake     time.Time // zero if the peer never completed a handshake
+	RxBytes             int64
+	TxBytes             int64
+	PersistentKeepalive int // seconds, zero if off
+}
+
+// Dump is the parsed output of `wg show <if> dump`
+type Dump struct {
+	Interface Interface
+	Peers     []Peer
+}
+
+// ParseDump parses the output of `wg show <if> dump`. The first line describes
+// the interface and every following line a peer, with tab separated fields.
+// Private and preshared keys are discarded.
+func ParseDump(data string) (*Dump, error) {
+	dump := &Dump{}
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	line := 0
+
+	for scanner.Scan() {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		line++
+		fields := strings.Split(text, "\t")
+
+		if line == 1 {
+			iface, err := parseInterface(fields)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			dump.Interface = iface
+			continue
+		}
+
+		peer, err := parsePeer(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		dump.Peers = append(dump.Peers, peer)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if line == 0 {
+		return nil, fmt.Errorf("empty dump")
+	}
+
+	return dump, nil
+}
+
+func parseInterface(fields []string) (Interface, error) {
+	if len(fields) != 4 {
+		return Interface{}, fmt.Errorf("interface line has %d fields, want 4", len(fields))
+	}
+
+	port, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return Interface{}, fmt.Errorf("invalid listen port %q", fields[2])
+	}
+
+	return Interface{PublicKey: fields[1], ListenPort: port}, nil
+}
+
+func parsePeer(fields []string) (Peer, error) {
+	if len(fields) != 8 {
+		return Peer{}, fmt.Errorf("peer line has %d fields, want 8", len(fields))
+	}
+
+	peer := Peer{
+		PublicKey: fields[0],
+		Endpoint:  none(fields[2]),
+	}
+	if allowed := none(fields[3]); allowed != "" {
+		peer.AllowedIPs = strings.Split(allowed, ",")
+	}
+
+	handshake, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil || handshake < 0 {
+		return Peer{}, fmt.Errorf("invalid latest handshake %q", fields[4])
+	}
+	if handshake > 0 {
+		peer.LatestHandshake = time.Unix(handshake, 0)
+	}
+
+	if peer.RxBytes, err = strconv.ParseInt(fields[5], 10, 64); err != nil || peer.RxBytes < 0 {
+		return Peer{}, fmt.Errorf("invalid rx bytes %q", fields[5])
+	}
+	if peer.TxBytes, err = strconv.ParseInt(fields[6], 10, 64); err != nil || peer.TxBytes < 0 {
+		return Peer{}, fmt.Errorf("invalid tx bytes %q", fields[6])
+	}
+
+	if fields[7] != "off" {
+		if peer.PersistentKeepalive, err = strconv.Atoi(fields[7]); err != nil {
+			return Peer{}, fmt.Errorf("invalid persistent keepalive %q", fields[7])
+		}
+	}
+
+	return peer, nil
+}
+
+// none maps the "(none)" placeholder wg prints for unset fields to ""
+func none(field string) string {
+	if field == "(none)" {
+		return ""
+	}
+	return field
+}
@@ -0,0 +1,115 @@
+package wireguard
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	return string(data)
+}
+
+func TestParseDump(t *testing.T) {
+	handshake := time.Unix(1760781600, 0)
+
+	tests := []struct {
+		name      string
+		fixture   string
+		wantPeers []Peer
+		wantErr   string
+	}{
+		{
+			name:    "single peer",
+			fixture: "single_peer.dump",
+			wantPeers: []Peer{{
+				PublicKey:           "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+				Endpoint:            "203.0.113.7:41523",
+				AllowedIPs:          []string{"10.0.0.2/32"},
+				LatestHandshake:     handshake,
+				RxBytes:             1536204,
+				TxBytes:             20481024,
+				PersistentKeepalive: 25,
+			}},
+		},
+		{
+			name:    "multiple peers with unset fields",
+			fixture: "multi_peer.dump",
+			wantPeers: []Peer{
+				{
+					PublicKey:       "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+					Endpoint:        "[2001:db8::7]:41523",
+					AllowedIPs:      []string{"10.0.0.2/32", "fd00::2/128"},
+					LatestHandshake: handshake,
+					RxBytes:         1536204,
+					TxBytes:         20481024,
+				},
+				{
+					PublicKey:  "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=",
+					AllowedIPs: []string{"10.0.0.3/32"},
+				},
+			},
+		},
+		{
+			name:    "no peers",
+			fixture: "no_peers.dump",
+		},
+		{
+			name:    "invalid counter",
+			fixture: "bad_counter.dump",
+			wantErr: `line 2: invalid rx bytes "lots"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dump, err := ParseDump(readFixture(t, tt.fixture))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+
+			if dump.Interface.PublicKey != "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=" || dump.Interface.ListenPort != 51820 {
+				t.Errorf("unexpected interface %+v", dump.Interface)
+			}
+			if !reflect.DeepEqual(dump.Peers, tt.wantPeers) {
+				t.Errorf("got peers %+v, want %+v", dump.Peers, tt.wantPeers)
+			}
+		})
+	}
+}
+
+func TestParseDumpMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"short interface line", "key\tkey\t51820\n"},
+		{"bad listen port", "key\tkey\tport\toff\n"},
+		{"short peer line", "key\tkey\t51820\toff\npeer\t(none)\t(none)\n"},
+		{"negative handshake", "key\tkey\t51820\toff\npeer\t(none)\t(none)\t(none)\t-1\t0\t0\toff\n"},
+		{"bad keepalive", "key\tkey\t51820\toff\npeer\t(none)\t(none)\t(none)\t0\t0\t0\tsometimes\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseDump(tt.data); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
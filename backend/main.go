@@ -3,40 +3,58 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
+	_ "time/tzdata" // access schedule timezones on images without zoneinfo
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
+	"vpnaas-backend/internal/access"
 	"vpnaas-backend/internal/api"
+	"vpnaas-backend/internal/audit"
 	"vpnaas-backend/internal/config"
+	"vpnaas-backend/internal/health"
+	"vpnaas-backend/internal/history"
 	"vpnaas-backend/internal/k8s"
+	"vpnaas-backend/internal/logging"
 	"vpnaas-backend/internal/metrics"
+	"vpnaas-backend/internal/reports"
+	"vpnaas-backend/internal/store"
+	"vpnaas-backend/internal/tracing"
+	"vpnaas-backend/internal/usage"
 )
 
 func main() {
-	// Initialize configuration
-	if err := config.Load(); err != nil {
+	// Load and validate the configuration, reporting every invalid setting
+	// at once
+	cfg, err := config.Load()
+	if err != nil {
 		logrus.Fatalf("Failed to load configuration: %v", err)
 	}
 
 	// Initialize logger
-	logrus.SetLevel(logrus.InfoLevel)
-	if viper.GetBool("debug") {
-		logrus.SetLevel(logrus.DebugLevel)
+	if err := logging.Init(cfg.Log, cfg.Debug); err != nil {
+		logrus.Fatalf("Invalid logging configuration: %v", err)
+	}
+
+	// Initialize tracing
+	shutdownTracing, err := tracing.Init(context.Background(), cfg.Tracing)
+	if err != nil {
+		logrus.Fatalf("Failed to initialize tracing: %v", err)
 	}
 
 	// Initialize Kubernetes client
-	k8sClient, err := initK8sClient()
+	k8sClient, restConfig, err := initK8sClient(cfg.K8s.Kubeconfig)
 	if err != nil {
 		logrus.Fatalf("Failed to initialize Kubernetes client: %v", err)
 	}
@@ -45,13 +63,103 @@ func main() {
 	metrics.Init()
 
 	// Initialize VPN manager
-	vpnManager := k8s.NewVPNManager(k8sClient)
+	vpnManager := k8s.NewVPNManager(k8sClient, cfg.K8s.Namespace, cfg.VPN)
+	if err := vpnManager.LoadPodTemplates(context.Background()); err != nil {
+		logrus.Fatalf("Invalid VPN pod templates: %v", err)
+	}
+	if err := vpnManager.LoadEgressProfiles(); err != nil {
+		logrus.Fatalf("Invalid egress profiles: %v", err)
+	}
+	vpnManager.EnablePodExec(restConfig)
+	vpnManager.EnableEvents()
+
+	userStore := store.NewMemoryStore()
+
+	accessEnforcer, err := access.NewEnforcer(userStore, vpnManager, vpnManager, cfg.Quota)
+	if err != nil {
+		logrus.Fatalf("Invalid quota configuration: %v", err)
+	}
+
+	// Every replica appends to a file named after its pod in the shared
+	// audit directory
+	hostname, err := os.Hostname()
+	if err != nil {
+		logrus.Fatalf("Failed to determine hostname: %v", err)
+	}
+	auditLog, err := audit.NewFileLog(cfg.Audit.Dir, hostname)
+	if err != nil {
+		logrus.Fatalf("Failed to open audit log in %s: %v", cfg.Audit.Dir, err)
+	}
+	defer auditLog.Close()
+
+	usageHistory, err := history.NewFileStore(cfg.History.Dir, hostname)
+	if err != nil {
+		logrus.Fatalf("Failed to open usage history in %s: %v", cfg.History.Dir, err)
+	}
+	defer usageHistory.Close()
+
+	reportStore, err := reports.NewFileStore(cfg.Reports.Dir)
+	if err != nil {
+		logrus.Fatalf("Failed to open usage reports in %s: %v", cfg.Reports.Dir, err)
+	}
+	reportGenerator := reports.NewGenerator(reportStore, usageHistory, userStore, cfg.History)
 
 	// Initialize API server
-	apiServer := api.NewServer(vpnManager)
+	apiServer := api.NewServer(vpnManager, userStore, accessEnforcer, auditLog, usageHistory, reportGenerator, cfg)
+
+	// Collect data usage and connections from the VPN pods, enforce quotas,
+	// expiry and access schedules, record the usage history and generate the
+	// monthly usage reports
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	go usage.NewCollector(vpnManager, userStore, accessEnforcer, cfg.Usage, cfg.Metrics.PerUser).Run(backgroundCtx)
+	go access.NewScheduler(accessEnforcer, userStore, vpnManager, vpnManager, cfg.Access).Run(backgroundCtx)
+	go history.NewSampler(userStore, usageHistory, hostname, cfg.History).Run(backgroundCtx)
+	go reportGenerator.Run(backgroundCtx)
+
+	// Count VPN pods from a watch and refresh the user and pod gauges in the
+	// background rather than when /api/v1/metrics is read
+	vpnManager.StartPodInformer(backgroundCtx)
+	go apiServer.RunMetricsRefresh(backgroundCtx)
+
+	// Apply changes to the mounted config.yaml without a restart. Invalid
+	// changes are ignored: the backend keeps running on what it has.
+	if cfg.Reload.Enabled {
+		watched, err := config.Watch(func(newCfg *config.Config, err error) {
+			if err != nil {
+				logrus.Errorf("Ignoring invalid configuration change: %v", err)
+				metrics.RecordError("config_reload", "config")
+				return
+			}
+			if err := apiServer.ApplyConfig(backgroundCtx, newCfg); err != nil {
+				logrus.Errorf("Ignoring configuration change: %v", err)
+				metrics.RecordError("config_reload", "config")
+			}
+		})
+		if err != nil {
+			logrus.Warnf("Configuration changes require a restart: %v", err)
+		} else {
+			logrus.Infof("Watching %s for configuration changes", watched)
+		}
+	}
+
+	// Readiness requires the Kubernetes API, the permissions to manage VPN
+	// workloads, the user store and a synced pod informer
+	readiness := health.NewChecker(cfg.Health.CheckTimeout,
+		health.Check{Name: "kubernetes_api", Run: vpnManager.CheckAPI},
+		health.Check{Name: "kubernetes_permissions", Run: vpnManager.CheckPermissions},
+		health.Check{Name: "store", Run: userStore.Ping},
+		health.Check{Name: "informers", Run: vpnManager.CheckInformers},
+	)
 
 	// Setup Gin router
-	router := gin.Default()
+	// Requests are logged by the logging middleware, which runs inside the
+	// request's span so that its lines carry the trace ID
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.Use(tracing.Middleware())
+	router.Use(logging.Middleware())
+	router.Use(metrics.Middleware())
 
 	// Add CORS middleware
 	router.Use(func(c *gin.Context) {
@@ -69,35 +177,59 @@ func main() {
 
 	// API routes
 	apiGroup := router.Group("/api/v1")
+	apiGroup.Use(audit.Middleware(auditLog, cfg.Audit))
 	{
 		// User management
 		apiGroup.GET("/users", apiServer.ListUsers)
 		apiGroup.POST("/users", apiServer.CreateUser)
 		apiGroup.GET("/users/:id", apiServer.GetUser)
+		apiGroup.PUT("/users/:id", apiServer.UpdateUser)
 		apiGroup.DELETE("/users/:id", apiServer.DeleteUser)
 		apiGroup.GET("/users/:id/config", apiServer.GetUserConfig)
+		apiGroup.GET("/users/:id/quota", apiServer.GetUserQuota)
+		apiGroup.POST("/users/:id/quota", apiServer.OverrideUserQuota)
+		apiGroup.PUT("/users/:id/access", apiServer.UpdateUserAccess)
+		apiGroup.GET("/egress-profiles", apiServer.ListEgressProfiles)
+
+		// Plans
+		apiGroup.GET("/plans", apiServer.ListPlans)
+		apiGroup.POST("/plans", apiServer.CreatePlan)
+		apiGroup.GET("/plans/:name", apiServer.GetPlan)
+		apiGroup.PUT("/plans/:name", apiServer.UpdatePlan)
+		apiGroup.DELETE("/plans/:name", apiServer.DeletePlan)
+
+		// VPN workloads
+		apiGroup.POST("/vpn/rollout", apiServer.RolloutVPNs)
+		apiGroup.POST("/config/rollout", apiServer.RolloutVPNConfig)
+		apiGroup.GET("/config/rollout", apiServer.GetVPNConfigRollout)
 
 		// Metrics
 		apiGroup.GET("/metrics", apiServer.GetMetrics)
 		apiGroup.GET("/stats", apiServer.GetStats)
+		apiGroup.GET("/stats/history", apiServer.GetStatsHistory)
+
+		// Usage reports
+		apiGroup.GET("/reports", apiServer.ListReports)
+		apiGroup.POST("/reports", apiServer.CreateReport)
+		apiGroup.GET("/reports/:period", apiServer.GetReport)
+
+		// Audit log
+		apiGroup.GET("/audit", apiServer.ListAudit)
+		apiGroup.GET("/audit/export", apiServer.ExportAudit)
 	}
 
 	// Prometheus metrics endpoint
 	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
-	// Health check
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "healthy"})
-	})
+	// Liveness only requires the process to serve HTTP; readiness checks the
+	// backend's dependencies. /health is kept for existing clients.
+	router.GET("/livez", health.Livez)
+	router.GET("/health", health.Livez)
+	router.GET("/readyz", readiness.Readyz)
 
 	// Start server
-	port := viper.GetString("server.port")
-	if port == "" {
-		port = "8080"
-	}
-
 	srv := &http.Server{
-		Addr:    ":" + port,
+		Addr:    net.JoinHostPort(cfg.Server.Host, strconv.Itoa(cfg.Server.Port)),
 		Handler: router,
 	}
 
@@ -108,7 +240,7 @@ func main() {
 		}
 	}()
 
-	logrus.Infof("Server started on port %s", port)
+	logrus.Infof("Server started on %s", srv.Addr)
 
 	// Wait for interrupt signal
 	quit := make(chan os.Signal, 1)
@@ -116,6 +248,7 @@ func main() {
 	<-quit
 
 	logrus.Info("Shutting down server...")
+	stopBackground()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -123,11 +256,14 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		logrus.Fatalf("Server forced to shutdown: %v", err)
 	}
+	if err := shutdownTracing(ctx); err != nil {
+		logrus.Errorf("Failed to flush traces: %v", err)
+	}
 
 	logrus.Info("Server exited")
 }
 
-func initK8sClient() (*kubernetes.Clientset, error) {
+func initK8sClient(kubeconfig string) (*kubernetes.Clientset, *rest.Config, error) {
 	var config *rest.Config
 	var err error
 
@@ -135,7 +271,6 @@ func initK8sClient() (*kubernetes.Clientset, error) {
 	config, err = rest.InClusterConfig()
 	if err != nil {
 		// Fall back to kubeconfig file
-		kubeconfig := viper.GetString("k8s.kubeconfig")
 		if kubeconfig == "" {
 			kubeconfig = os.Getenv("KUBECONFIG")
 		}
@@ -145,14 +280,17 @@ func initK8sClient() (*kubernetes.Clientset, error) {
 
 		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load kubeconfig: %v", err)
+			return nil, nil, fmt.Errorf("failed to load kubeconfig: %v", err)
 		}
 	}
 
+	// Trace the calls made while serving a traced request
+	config.Wrap(tracing.WrapTransport)
+
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create kubernetes client: %v", err)
+		return nil, nil, fmt.Errorf("failed to create kubernetes client: %v", err)
 	}
 
-	return clientset, nil
+	return clientset, config, nil
 }
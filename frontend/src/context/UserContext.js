@@ -104,6 +104,18 @@ export const UserProvider = ({ children }) => {
     }
   };
 
+  const fetchStatsHistory = async ({ userId, from, to, step } = {}) => {
+    try {
+      const response = await api.get('/stats/history', {
+        params: { user: userId, from, to, step },
+      });
+      return response.data.series;
+    } catch (error) {
+      console.error('Failed to fetch stats history:', error);
+      return [];
+    }
+  };
+
   useEffect(() => {
     fetchUsers();
     fetchStats();
@@ -116,6 +128,7 @@ export const UserProvider = ({ children }) => {
     deleteUser,
     downloadConfig,
     fetchStats,
+    fetchStatsHistory,
   };
 
   return (
@@ -23,8 +23,9 @@ import {
 } from '@heroicons/react/24/outline';
 
 const Metrics = () => {
-  const { users, stats, fetchStats } = useUsers();
+  const { users, stats, fetchStats, fetchStatsHistory } = useUsers();
   const [timeRange, setTimeRange] = useState('7d');
+  const [history, setHistory] = useState([]);
 
   useEffect(() => {
     const interval = setInterval(() => {
@@ -34,6 +35,20 @@ const Metrics = () => {
     return () => clearInterval(interval);
   }, [fetchStats]);
 
+  useEffect(() => {
+    const ranges = {
+      '1d': { hours: 24, step: '15m' },
+      '7d': { hours: 24 * 7, step: '1h' },
+      '30d': { hours: 24 * 30, step: '6h' },
+    };
+    const { hours, step } = ranges[timeRange];
+    const to = new Date();
+    const from = new Date(to.getTime() - hours * 60 * 60 * 1000);
+
+    fetchStatsHistory({ from: from.toISOString(), to: to.toISOString(), step })
+      .then(setHistory);
+  }, [timeRange]);
+
   const formatBytes = (bytes) => {
     if (bytes === 0) return '0 B';
     const k = 1024;
@@ -67,16 +82,14 @@ const Metrics = () => {
       dataUsage: user.data_usage,
     }));
 
-  // Mock time series data for demonstration
-  const timeSeriesData = [
-    { time: '00:00', users: 12, connections: 8, dataUsage: 1024 },
-    { time: '04:00', users: 15, connections: 12, dataUsage: 2048 },
-    { time: '08:00', users: 25, connections: 20, dataUsage: 4096 },
-    { time: '12:00', users: 30, connections: 28, dataUsage: 8192 },
-    { time: '16:00', users: 28, connections: 25, dataUsage: 6144 },
-    { time: '20:00', users: 22, connections: 18, dataUsage: 3072 },
-    { time: '24:00', users: 18, connections: 15, dataUsage: 2048 },
-  ];
+  const timeSeriesData = history.map(sample => ({
+    time: new Date(sample.time).toLocaleString([], timeRange === '1d'
+      ? { hour: '2-digit', minute: '2-digit' }
+      : { month: 'short', day: 'numeric', hour: '2-digit' }),
+    users: sample.active_users || 0,
+    connections: sample.active_connections,
+    dataUsage: sample.data_usage,
+  }));
 
   const StatCard = ({ title, value, icon: Icon, change, changeType }) => (
     <div className="card">